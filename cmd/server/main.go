@@ -2,26 +2,54 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/volcengine/veadk-go/apps"
 	"github.com/volcengine/veadk-go/apps/a2a_app"
+	"github.com/volcengine/veadk-go/observability"
 	"google.golang.org/adk/agent"
+	"google.golang.org/adk/cmd/launcher/web"
+	"google.golang.org/adk/session"
 
 	"github.com/zhengjr9/dify-agent/internal/a2a"
 	"github.com/zhengjr9/dify-agent/internal/config"
 	"github.com/zhengjr9/dify-agent/internal/dify"
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/jwtauth"
+	"github.com/zhengjr9/dify-agent/internal/mcp"
 	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/internal/shadow"
+	"github.com/zhengjr9/dify-agent/internal/tlsutil"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
 )
 
 func main() {
+	// "config print" shows the effective configuration and "shadow report"
+	// summarises the shadow log; both exit afterwards.
+	if len(os.Args) > 2 {
+		switch os.Args[1] + " " + os.Args[2] {
+		case "config print":
+			printConfig(os.Args[3:])
+			return
+		case "shadow report":
+			shadowReport(os.Args[3:])
+			return
+		}
+	}
+
 	cfg := config.Load()
 
 	slog.Info("starting dify-agent",
@@ -33,8 +61,21 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// In MCP stdio mode stdout carries the protocol, so no server is started.
+	if cfg.MCPStdio {
+		if err := serveMCPStdio(ctx, cfg); err != nil {
+			slog.Error("MCP stdio error", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Always start the proxy server.
-	srv := proxy.New(cfg)
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		slog.Error("failed to create proxy server", "error", err)
+		os.Exit(1)
+	}
 	proxyErr := make(chan error, 1)
 	go func() {
 		if err := srv.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -42,10 +83,32 @@ func main() {
 		}
 	}()
 
+	// Reload on SIGHUP or when the config file changes.
+	go config.Watch(ctx, os.Args[1:], cfg.ConfigFile, 2*time.Second, func(c *config.Config) {
+		if err := srv.Reload(c); err != nil {
+			slog.Error("failed to apply reloaded config", "error", err)
+		}
+	})
+
 	// Optionally start the A2A server.
 	a2aErr := make(chan error, 1)
 	if cfg.A2AEnabled {
-		difyClient := dify.NewClient(cfg.DifyBaseURL, cfg.RequestTimeout, cfg.DifyProxyURL)
+		users, err := identity.New(cfg.Identity())
+		if err != nil {
+			slog.Error("invalid identity configuration", "error", err)
+			os.Exit(1)
+		}
+		auth, err := jwtauth.New(cfg.JWT())
+		if err != nil {
+			slog.Error("invalid JWT configuration", "error", err)
+			os.Exit(1)
+		}
+		difyTLS, err := tlsutil.NewClient(cfg.DifyTLS())
+		if err != nil {
+			slog.Error("invalid Dify TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		difyClient := dify.NewClient(cfg.DifyBaseURL, cfg.RequestTimeout, cfg.DifyProxyURL, difyTLS)
 		difyAgent, err := a2a.New(a2a.AgentConfig{
 			Name:        cfg.AgentName,
 			Description: cfg.AgentDesc,
@@ -61,12 +124,20 @@ func main() {
 		slog.Info("starting A2A server", "port", cfg.A2APort, "agent_name", cfg.AgentName)
 
 		// Wrap the standard A2A app to inject an HTTP middleware that extracts
-		// the caller's Bearer token and stores it in the request context before
-		// the JSON-RPC handler sees the request.
+		// the caller's key, resolving virtual keys issued by the proxy, and
+		// stores it in the request context before the JSON-RPC handler sees
+		// the request.
 		inner := a2a_app.NewAgentkitA2AServerApp(
 			apps.DefaultApiConfig().SetPort(cfg.A2APort),
 		)
-		wrapped := &authMiddlewareApp{BasicApp: inner}
+		wrapped := &authMiddlewareApp{
+			BasicApp: inner,
+			users:    users,
+			keys:     srv.KeyMiddleware,
+			auth:     auth,
+			tls:      srv.TLSConfig(),
+			identity: cfg.TLSClientIdentity,
+		}
 
 		go func() {
 			if err := wrapped.Run(ctx, &apps.RunConfig{
@@ -96,41 +167,178 @@ func main() {
 	slog.Info("server stopped")
 }
 
+// printConfig writes the configuration described by args to stdout, with
+// secrets redacted.
+func printConfig(args []string) {
+	cfg, err := config.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(2)
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(1)
+	}
+}
+
+// shadowReport writes a summary of the shadow log configured by args to
+// stdout.
+func shadowReport(args []string) {
+	cfg, err := config.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err == nil && cfg.ShadowLog == "" {
+		err = errors.New("shadow_log is not set")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(2)
+	}
+	summaries, err := shadow.Summarize(cfg.ShadowLog)
+	if err == nil {
+		err = shadow.WriteReport(os.Stdout, summaries)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shadow report:", err)
+		os.Exit(1)
+	}
+}
+
+// serveMCPStdio serves the configured Dify apps as MCP tools on stdin and
+// stdout until stdin is closed.
+func serveMCPStdio(ctx context.Context, cfg *config.Config) error {
+	users, err := identity.New(cfg.Identity())
+	if err != nil {
+		return err
+	}
+	registry, err := cfg.LoadApps()
+	if err != nil {
+		return err
+	}
+	difyTLS, err := tlsutil.NewClient(cfg.DifyTLS())
+	if err != nil {
+		return err
+	}
+	client := dify.NewClient(cfg.DifyBaseURL, cfg.RequestTimeout, cfg.DifyProxyURL, difyTLS)
+	tokens, err := tokenizer.Load(cfg.TokenizerDir, cfg.TokenizerEncoding)
+	if err != nil {
+		return err
+	}
+	// The stdio server has a single local client, which is not rate limited.
+	server := mcp.NewServer(client, users, inputs.NewBuilder(client, registry), registry, cfg.DifyAPIKey, cfg.RequestTimeout, tokens, nil)
+	slog.Info("serving MCP over stdio")
+	return server.ServeStdio(ctx, os.Stdin, os.Stdout)
+}
+
 // authMiddlewareApp wraps a BasicApp and installs an HTTP middleware on the
-// Gorilla mux router that extracts "Authorization: Bearer <token>" from every
-// incoming request and injects the token into the request context via
-// a2a.ContextWithAPIKey. This makes the token available to the agent's Run
-// function regardless of how deep the framework buries the context.
+// Gorilla mux router that extracts the caller's Dify key from every incoming
+// request and injects it into the request context via a2a.ContextWithAPIKey,
+// together with the Dify user resolved by users. This makes both available to
+// the agent's Run function regardless of how deep the framework buries the
+// context. Virtual keys are resolved by keys first, then JWTs are verified by
+// auth and client certificates name the callers no token did. The app is
+// served over TLS when tls is set.
 type authMiddlewareApp struct {
 	apps.BasicApp
+	users    *identity.Resolver
+	keys     func(http.Handler) http.Handler
+	auth     *jwtauth.Authenticator
+	tls      *tls.Config
+	identity string
 }
 
 // Run overrides the embedded Run so that apps.Run receives `w` as the app
 // argument. Without this, the embedded Run calls apps.Run with the inner app,
 // meaning apps.Run would invoke SetupRouters on the inner app and our
-// middleware override would never be registered.
+// middleware override would never be registered. apps.Run only serves plain
+// HTTP, so runTLS takes its place when TLS is configured.
 func (w *authMiddlewareApp) Run(ctx context.Context, config *apps.RunConfig) error {
+	if w.tls != nil {
+		return w.runTLS(ctx, config)
+	}
 	return apps.Run(ctx, config, w)
 }
 
+// runTLS does what apps.Run does, serving over TLS until ctx is done.
+func (w *authMiddlewareApp) runTLS(ctx context.Context, config *apps.RunConfig) error {
+	router := web.BuildBaseRouter()
+	if config.SessionService == nil {
+		config.SessionService = session.InMemoryService()
+	}
+	config.AppendObservability()
+	defer func() {
+		if err := observability.Shutdown(ctx); err != nil {
+			slog.Error("observability shutdown error", "error", err)
+		}
+	}()
+	if err := w.SetupRouters(router, config); err != nil {
+		return fmt.Errorf("setup %s routers failed: %w", w.GetServerName(), err)
+	}
+
+	api := w.GetApiConfig()
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", api.Port),
+		Handler:      router,
+		TLSConfig:    w.tls,
+		ReadTimeout:  api.ReadTimeout,
+		WriteTimeout: api.WriteTimeout,
+		IdleTimeout:  api.IdleTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutCtx); err != nil {
+			slog.Error("A2A shutdown error", "error", err)
+		}
+	}()
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s failed: %w", w.GetServerName(), err)
+	}
+	return nil
+}
+
 func (w *authMiddlewareApp) SetupRouters(router *mux.Router, config *apps.RunConfig) error {
 	if err := w.BasicApp.SetupRouters(router, config); err != nil {
 		return err
 	}
-	// Add the Bearer-token middleware after all routes are registered.
-	router.Use(bearerTokenMiddleware)
+	// Add the key middlewares after all routes are registered. The agent card
+	// stays public.
+	router.Use(
+		w.keys,
+		mux.MiddlewareFunc(w.auth.Middleware("/.well-known/")),
+		mux.MiddlewareFunc(tlsutil.Middleware(w.identity)),
+		bearerTokenMiddleware(w.users),
+	)
 	return nil
 }
 
-// bearerTokenMiddleware is a Gorilla mux middleware that reads
-// "Authorization: Bearer <token>" and stores the token in the request context.
-func bearerTokenMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if auth := r.Header.Get("Authorization"); auth != "" {
-			if token, ok := strings.CutPrefix(auth, "Bearer "); ok && token != "" {
-				r = r.WithContext(a2a.ContextWithAPIKey(r.Context(), token))
+// bearerTokenMiddleware returns a Gorilla mux middleware that reads the
+// caller's Dify key with httputil.ExtractCredentials and stores it in the
+// request context, along with the Dify user resolved from the request
+// headers. A virtual key standing for no Dify key is rejected, as the agent
+// would otherwise fall back to its own key; callers authenticated by a JWT
+// present no Dify key and use the agent's.
+func bearerTokenMiddleware(users *identity.Resolver) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			creds := httputil.ExtractCredentials(r)
+			if creds.KeyID != "" && creds.APIKey == "" {
+				apierrors.WriteJSONError(w, http.StatusForbidden, "API key is not bound to a Dify app")
+				return
 			}
-		}
-		next.ServeHTTP(w, r)
-	})
+			if creds.APIKey != "" {
+				ctx = a2a.ContextWithAPIKey(ctx, creds.APIKey)
+			}
+			if user := users.Resolve(r, ""); user != "" {
+				ctx = a2a.ContextWithUser(ctx, user)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
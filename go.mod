@@ -3,10 +3,13 @@ module github.com/zhengjr9/dify-agent
 go 1.25.4
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/gorilla/mux v1.8.1
 	github.com/volcengine/veadk-go v0.0.5
+	go.etcd.io/bbolt v1.4.3
 	google.golang.org/adk v0.4.0
 	google.golang.org/genai v1.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -58,7 +61,6 @@ require (
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251202230838-ff82c1b0f217 // indirect
 	google.golang.org/grpc v1.77.0 // indirect
 	google.golang.org/protobuf v1.36.10 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	gorm.io/gorm v1.31.0 // indirect
 	rsc.io/omap v1.2.0 // indirect
 	rsc.io/ordered v1.1.1 // indirect
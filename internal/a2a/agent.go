@@ -31,6 +31,21 @@ func apiKeyFromContext(ctx context.Context) (string, bool) {
 	return v, ok && v != ""
 }
 
+// userContextKey is the context key used to propagate the resolved Dify user
+// from the HTTP layer into the agent's Run function.
+type userContextKey struct{}
+
+// ContextWithUser returns a new context carrying the resolved Dify user.
+func ContextWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// userFromContext retrieves the user injected by the HTTP middleware.
+func userFromContext(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(userContextKey{}).(string)
+	return v, ok && v != ""
+}
+
 // AgentConfig holds the configuration for the Dify-backed A2A agent.
 type AgentConfig struct {
 	// Name is the agent name exposed via A2A AgentCard.
@@ -43,7 +58,8 @@ type AgentConfig struct {
 	// When empty the per-request key extracted from the caller's
 	// Authorization header is used instead.
 	APIKey string
-	// DefaultUser is the fallback user field for Dify requests.
+	// DefaultUser is the fallback user field for Dify requests when the
+	// HTTP middleware did not resolve one.
 	DefaultUser string
 }
 
@@ -94,10 +110,14 @@ func runFunc(cfg AgentConfig) func(agent.InvocationContext) iter.Seq2[*session.E
 				return
 			}
 
+			user, ok := userFromContext(ctx)
+			if !ok {
+				user = cfg.DefaultUser
+			}
 			difyReq := &dify.ChatRequest{
 				Inputs:      map[string]any{},
 				Query:       query,
-				User:        cfg.DefaultUser,
+				User:        user,
 			}
 
 			streamCh, err := cfg.DifyClient.SendStreaming(ctx, apiKey, difyReq)
@@ -0,0 +1,407 @@
+// Package accounting records the token usage and cost of requests and
+// enforces monthly budgets.
+//
+// Every request's usage, as reported by Dify on message_end or else
+// estimated, is priced from a table of per-model prices and added to daily
+// aggregates by virtual key, user and model in the state store. Budgets cap
+// the tokens or cost of the requests they match in a calendar month (UTC);
+// once one is exhausted the requests it matches are rejected until the next
+// month. A webhook is posted as a budget's spend crosses each of its
+// thresholds.
+package accounting
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/store"
+)
+
+const (
+	dailyBucket = "usage_daily"
+	spendBucket = "budget_spend"
+	// sep joins the fields of store keys; it does not occur in key IDs,
+	// users or model names in practice.
+	sep = "\x1f"
+)
+
+// Price is the price of a model in currency units per million tokens.
+type Price struct {
+	Prompt     float64 `json:"prompt" yaml:"prompt" toml:"prompt"`
+	Completion float64 `json:"completion" yaml:"completion" toml:"completion"`
+}
+
+// Prices maps model names to their prices. The entry "*", if any, prices
+// models without an entry of their own; other models cost nothing.
+type Prices map[string]Price
+
+// Cost returns the cost of a request to model.
+func (p Prices) Cost(model string, promptTokens, completionTokens int) float64 {
+	price, ok := p[model]
+	if !ok {
+		price = p["*"]
+	}
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1e6
+}
+
+// Budget caps the monthly usage of the requests it matches. Its selectors
+// match requests by the owner or ID of their virtual key, their user and
+// their model; empty selectors match anything.
+type Budget struct {
+	Name  string `json:"name" yaml:"name" toml:"name"`
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty" toml:"owner,omitempty"`
+	Key   string `json:"key,omitempty" yaml:"key,omitempty" toml:"key,omitempty"`
+	User  string `json:"user,omitempty" yaml:"user,omitempty" toml:"user,omitempty"`
+	Model string `json:"model,omitempty" yaml:"model,omitempty" toml:"model,omitempty"`
+	// Tokens and Cost are the monthly limits; zero is unlimited.
+	Tokens int64   `json:"tokens,omitempty" yaml:"tokens,omitempty" toml:"tokens,omitempty"`
+	Cost   float64 `json:"cost,omitempty" yaml:"cost,omitempty" toml:"cost,omitempty"`
+	// Thresholds are the percentages of the budget whose crossing fires
+	// the webhook; nil means DefaultThresholds.
+	Thresholds []float64 `json:"thresholds,omitempty" yaml:"thresholds,omitempty" toml:"thresholds,omitempty"`
+	// Webhook overrides Config.Webhook for this budget.
+	Webhook string `json:"webhook,omitempty" yaml:"webhook,omitempty" toml:"webhook,omitempty"`
+}
+
+// DefaultThresholds are the thresholds of budgets that list none.
+var DefaultThresholds = []float64{80, 100}
+
+// Matches reports whether b applies to requests of s.
+func (b *Budget) Matches(s Subject) bool {
+	match := func(sel, v string) bool { return sel == "" || sel == v }
+	return match(b.Owner, s.Owner) && match(b.Key, s.Key) && match(b.User, s.User) && match(b.Model, s.Model)
+}
+
+// Validate reports an invalid budget.
+func (b *Budget) Validate() error {
+	switch {
+	case b.Name == "":
+		return errors.New("name is required")
+	case b.Tokens < 0 || b.Cost < 0:
+		return fmt.Errorf("budget %q: limits must not be negative", b.Name)
+	case b.Tokens == 0 && b.Cost == 0:
+		return fmt.Errorf("budget %q: tokens or cost is required", b.Name)
+	}
+	for _, t := range b.Thresholds {
+		if t <= 0 || t > 100 {
+			return fmt.Errorf("budget %q: thresholds must be above 0 and at most 100, got %g", b.Name, t)
+		}
+	}
+	return nil
+}
+
+// Config is the price table and budgets a Ledger applies.
+type Config struct {
+	Prices  Prices
+	Budgets []Budget
+	// Webhook receives threshold notifications of budgets without a
+	// webhook of their own; empty sends none.
+	Webhook string
+}
+
+// Subject identifies who a request is accounted to.
+type Subject struct {
+	// Key is the ID of the virtual key, Owner its owner; both are empty for
+	// requests made with Dify keys.
+	Key   string
+	Owner string
+	User  string
+	// Model is the model the caller requested.
+	Model string
+}
+
+// Usage is the usage of one request.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	// Estimated is set when the tokens were counted locally.
+	Estimated bool
+}
+
+// Aggregate is the usage of the requests of a key, user and model on a day.
+// Reports merge aggregates, leaving the fields they do not group by empty.
+type Aggregate struct {
+	Day              string  `json:"day,omitempty"`
+	Key              string  `json:"key,omitempty"`
+	Owner            string  `json:"owner,omitempty"`
+	User             string  `json:"user,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Requests         int64   `json:"requests"`
+	Estimated        int64   `json:"estimated_requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// spend is the usage charged to a budget in one period.
+type spend struct {
+	Tokens int64   `json:"tokens"`
+	Cost   float64 `json:"cost"`
+	// Notified lists the thresholds already reported.
+	Notified []float64 `json:"notified,omitempty"`
+}
+
+// Exhausted is the error returned for requests matching an exhausted budget.
+type Exhausted struct {
+	Budget string
+	Period string
+}
+
+func (e *Exhausted) Error() string {
+	return fmt.Sprintf("budget %q is exhausted for %s", e.Budget, e.Period)
+}
+
+// Ledger records usage and enforces budgets. It is safe for concurrent use.
+// A nil *Ledger records nothing and admits every request.
+type Ledger struct {
+	cfg Config
+	*books
+}
+
+// books is the state shared by a Ledger and those WithConfig derives.
+type books struct {
+	store  store.Store
+	client *http.Client
+	now    func() time.Time
+
+	mu     sync.Mutex
+	spends map[string]*spend
+	hooks  sync.WaitGroup
+}
+
+// NewLedger returns a Ledger keeping usage in st.
+func NewLedger(st store.Store, cfg Config) *Ledger {
+	return &Ledger{cfg: cfg, books: &books{
+		store:  st,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+		spends: map[string]*spend{},
+	}}
+}
+
+// WithConfig returns a Ledger sharing l's usage and spend that applies the
+// prices and budgets of cfg, e.g. for the configuration a reload builds.
+// Spend recorded for budgets of the same name carries over.
+func (l *Ledger) WithConfig(cfg Config) *Ledger {
+	if l == nil {
+		return nil
+	}
+	return &Ledger{cfg: cfg, books: l.books}
+}
+
+// Check returns an *Exhausted error when a budget matching s is exhausted
+// for the current month.
+func (l *Ledger) Check(s Subject) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	period := l.now().UTC().Format("2006-01")
+	for i := range l.cfg.Budgets {
+		b := &l.cfg.Budgets[i]
+		if !b.Matches(s) {
+			continue
+		}
+		sp, err := l.spend(b.Name, period)
+		if err != nil {
+			return err
+		}
+		if exhausted(b, sp) {
+			return &Exhausted{Budget: b.Name, Period: period}
+		}
+	}
+	return nil
+}
+
+// Record adds the usage of a request of s to the day's aggregate and to the
+// budgets matching s, posting the webhooks of thresholds crossed.
+func (l *Ledger) Record(s Subject, u Usage) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now().UTC()
+	cost := l.cfg.Prices.Cost(s.Model, u.PromptTokens, u.CompletionTokens)
+	tokens := int64(u.PromptTokens + u.CompletionTokens)
+
+	day := now.Format(time.DateOnly)
+	key := strings.Join([]string{day, s.Key, s.User, s.Model}, sep)
+	agg := Aggregate{Day: day, Key: s.Key, User: s.User, Model: s.Model}
+	if _, err := l.store.Get(dailyBucket, key, &agg); err != nil {
+		return err
+	}
+	agg.Owner = s.Owner
+	agg.Requests++
+	if u.Estimated {
+		agg.Estimated++
+	}
+	agg.PromptTokens += int64(u.PromptTokens)
+	agg.CompletionTokens += int64(u.CompletionTokens)
+	agg.TotalTokens += tokens
+	agg.Cost += cost
+	if err := l.store.Put(dailyBucket, key, agg); err != nil {
+		return err
+	}
+
+	period := now.Format("2006-01")
+	for i := range l.cfg.Budgets {
+		b := &l.cfg.Budgets[i]
+		if !b.Matches(s) {
+			continue
+		}
+		sp, err := l.spend(b.Name, period)
+		if err != nil {
+			return err
+		}
+		sp.Tokens += tokens
+		sp.Cost += cost
+		used := percentUsed(b, sp)
+		thresholds := b.Thresholds
+		if thresholds == nil {
+			thresholds = DefaultThresholds
+		}
+		var crossed []float64
+		for _, t := range thresholds {
+			if used >= t && !slices.Contains(sp.Notified, t) {
+				crossed = append(crossed, t)
+				sp.Notified = append(sp.Notified, t)
+			}
+		}
+		if err := l.store.Put(spendBucket, b.Name+sep+period, sp); err != nil {
+			return err
+		}
+		for _, t := range crossed {
+			l.notify(b, Notification{
+				Budget:     b.Name,
+				Period:     period,
+				Threshold:  t,
+				Tokens:     sp.Tokens,
+				Cost:       sp.Cost,
+				TokenLimit: b.Tokens,
+				CostLimit:  b.Cost,
+				Exhausted:  exhausted(b, sp),
+				At:         now,
+			})
+		}
+	}
+	return nil
+}
+
+// spend returns the spend of a budget in period, loading it from the store
+// on first use. l.mu must be held.
+func (l *Ledger) spend(budget, period string) (*spend, error) {
+	key := budget + sep + period
+	if sp, ok := l.spends[key]; ok {
+		return sp, nil
+	}
+	sp := &spend{}
+	if _, err := l.store.Get(spendBucket, key, sp); err != nil {
+		return nil, err
+	}
+	l.spends[key] = sp
+	return sp, nil
+}
+
+// percentUsed returns the share of b spent, by tokens or cost, whichever is
+// higher.
+func percentUsed(b *Budget, sp *spend) float64 {
+	used := 0.0
+	if b.Tokens > 0 {
+		used = float64(sp.Tokens) / float64(b.Tokens) * 100
+	}
+	if b.Cost > 0 {
+		used = max(used, sp.Cost/b.Cost*100)
+	}
+	return used
+}
+
+func exhausted(b *Budget, sp *spend) bool {
+	return (b.Tokens > 0 && sp.Tokens >= b.Tokens) || (b.Cost > 0 && sp.Cost >= b.Cost)
+}
+
+// Notification is the JSON body posted to a webhook when a budget crosses a
+// threshold.
+type Notification struct {
+	Budget     string    `json:"budget"`
+	Period     string    `json:"period"`
+	Threshold  float64   `json:"threshold"`
+	Tokens     int64     `json:"tokens"`
+	Cost       float64   `json:"cost"`
+	TokenLimit int64     `json:"token_limit,omitempty"`
+	CostLimit  float64   `json:"cost_limit,omitempty"`
+	Exhausted  bool      `json:"exhausted"`
+	At         time.Time `json:"at"`
+}
+
+// notify posts n to the webhook of b in the background. l.mu must be held.
+func (l *Ledger) notify(b *Budget, n Notification) {
+	slog.Warn("budget threshold crossed", "budget", n.Budget, "period", n.Period, "threshold", n.Threshold, "tokens", n.Tokens, "cost", n.Cost)
+	url := b.Webhook
+	if url == "" {
+		url = l.cfg.Webhook
+	}
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(n)
+	l.hooks.Add(1)
+	go func() {
+		defer l.hooks.Done()
+		resp, err := l.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("budget webhook failed", "budget", n.Budget, "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("budget webhook failed", "budget", n.Budget, "status", resp.StatusCode)
+		}
+	}()
+}
+
+// Wait waits for the webhooks in flight.
+func (l *Ledger) Wait() {
+	if l != nil {
+		l.hooks.Wait()
+	}
+}
+
+// LoadPrices reads a JSON price table, an object mapping model names to
+// prices. An empty path returns an empty table.
+func LoadPrices(path string) (Prices, error) {
+	if path == "" {
+		return Prices{}, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read prices file: %w", err)
+	}
+	var p Prices
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("parse prices file %s: %w", path, err)
+	}
+	return p, p.Validate()
+}
+
+// Validate reports negative prices.
+func (p Prices) Validate() error {
+	for _, model := range slices.Sorted(maps.Keys(p)) {
+		if price := p[model]; price.Prompt < 0 || price.Completion < 0 {
+			return fmt.Errorf("price of %q must not be negative", model)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package accounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+)
+
+// Dimensions aggregates can be grouped by.
+var Dimensions = []string{"day", "key", "owner", "user", "model"}
+
+// Query selects and groups the aggregates of a report.
+type Query struct {
+	// From and To bound the days reported, inclusive, as YYYY-MM-DD.
+	From, To string
+	// GroupBy lists the Dimensions kept; aggregates differing only in
+	// the others are merged.
+	GroupBy []string
+	// Key, Owner, User and Model, when set, keep only matching aggregates.
+	Key, Owner, User, Model string
+}
+
+// Report returns the aggregates selected by q, ordered by their dimensions.
+func (l *Ledger) Report(q Query) ([]Aggregate, error) {
+	merged := map[string]*Aggregate{}
+	err := l.store.List(dailyBucket, "", func(_ string, raw []byte) error {
+		var a Aggregate
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return err
+		}
+		if (q.From != "" && a.Day < q.From) || (q.To != "" && a.Day > q.To) {
+			return nil
+		}
+		for _, f := range []struct{ want, got string }{{q.Key, a.Key}, {q.Owner, a.Owner}, {q.User, a.User}, {q.Model, a.Model}} {
+			if f.want != "" && f.want != f.got {
+				return nil
+			}
+		}
+		group := Aggregate{}
+		for _, d := range q.GroupBy {
+			switch d {
+			case "day":
+				group.Day = a.Day
+			case "key":
+				group.Key, group.Owner = a.Key, a.Owner
+			case "owner":
+				group.Owner = a.Owner
+			case "user":
+				group.User = a.User
+			case "model":
+				group.Model = a.Model
+			}
+		}
+		id := strings.Join([]string{group.Day, group.Key, group.Owner, group.User, group.Model}, sep)
+		m, ok := merged[id]
+		if !ok {
+			m = &group
+			merged[id] = m
+		}
+		m.Requests += a.Requests
+		m.Estimated += a.Estimated
+		m.PromptTokens += a.PromptTokens
+		m.CompletionTokens += a.CompletionTokens
+		m.TotalTokens += a.TotalTokens
+		m.Cost += a.Cost
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Aggregate, 0, len(merged))
+	for _, a := range merged {
+		out = append(out, *a)
+	}
+	slices.SortFunc(out, func(a, b Aggregate) int {
+		return strings.Compare(
+			strings.Join([]string{a.Day, a.Owner, a.Key, a.User, a.Model}, sep),
+			strings.Join([]string{b.Day, b.Owner, b.Key, b.User, b.Model}, sep))
+	})
+	return out, nil
+}
+
+// BudgetStatus is the spend of a budget in the current month.
+type BudgetStatus struct {
+	Budget
+	Period    string  `json:"period"`
+	Spent     int64   `json:"spent_tokens"`
+	SpentCost float64 `json:"spent_cost"`
+	Used      float64 `json:"used_percent"`
+	Exhausted bool    `json:"exhausted"`
+}
+
+// Budgets returns the status of every budget in the current month.
+func (l *Ledger) Budgets() ([]BudgetStatus, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	period := l.now().UTC().Format("2006-01")
+	out := []BudgetStatus{}
+	for _, b := range l.cfg.Budgets {
+		sp, err := l.spend(b.Name, period)
+		if err != nil {
+			return nil, err
+		}
+		b.Webhook = ""
+		out = append(out, BudgetStatus{
+			Budget:    b,
+			Period:    period,
+			Spent:     sp.Tokens,
+			SpentCost: sp.Cost,
+			Used:      percentUsed(&b, sp),
+			Exhausted: exhausted(&b, sp),
+		})
+	}
+	return out, nil
+}
+
+// Handler serves GET /admin/usage: the aggregates selected by the query
+// parameters from, to, group_by, key, owner, user and model, and the status
+// of the budgets. from defaults to the first day of the month and group_by
+// to every dimension.
+func Handler(l *Ledger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		now := l.now().UTC()
+		q := Query{
+			From:    v.Get("from"),
+			To:      v.Get("to"),
+			GroupBy: Dimensions,
+			Key:     v.Get("key"),
+			Owner:   v.Get("owner"),
+			User:    v.Get("user"),
+			Model:   v.Get("model"),
+		}
+		if q.From == "" {
+			q.From = now.Format("2006-01") + "-01"
+		}
+		for _, d := range []string{q.From, q.To} {
+			if _, err := time.Parse(time.DateOnly, d); d != "" && err != nil {
+				apierrors.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid date %q: want YYYY-MM-DD", d))
+				return
+			}
+		}
+		if g := v.Get("group_by"); g != "" {
+			q.GroupBy = strings.Split(g, ",")
+			for _, d := range q.GroupBy {
+				if !slices.Contains(Dimensions, d) {
+					apierrors.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid group_by %q: want a list of %s", d, strings.Join(Dimensions, ", ")))
+					return
+				}
+			}
+		}
+		data, err := l.Report(q)
+		if err != nil {
+			apierrors.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		budgets, err := l.Budgets()
+		if err != nil {
+			apierrors.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"object":  "list",
+			"from":    q.From,
+			"to":      q.To,
+			"data":    data,
+			"budgets": budgets,
+		})
+	})
+}
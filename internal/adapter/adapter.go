@@ -1,25 +1,216 @@
+// Package adapter defines the canonical chat request shared by the wire
+// protocols and the pipeline that runs it against Dify.
+//
+// A protocol plugs in by implementing Adapter: it decodes its request body
+// into a Request and encodes Dify answers in its own format. Everything in
+// between — model routing, credentials, rate limits, timeouts, identity, inputs, image uploads, fan-out,
+// stop sequences, output limits, usage and upstream errors — is handled once
+// by the Pipeline.
 package adapter
 
 import (
-	"context"
+	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+	"github.com/zhengjr9/dify-agent/internal/toolcall"
 )
 
-// Adapter translates between a caller's API format and Dify's API.
+// Adapter translates between a caller's API format and the canonical form.
 type Adapter interface {
-	// ExtractAPIKey pulls the caller's API key from the request.
-	// Returns an error if the key is absent or malformed.
-	ExtractAPIKey(r *http.Request) (string, error)
+	// ExtractAPIKey returns the Dify API key for a decoded request whose
+	// model has no route. Returns an error if the key is absent.
+	ExtractAPIKey(r *http.Request, req *Request) (string, error)
 
-	// ToDifyRequest parses the incoming request body and returns a Dify ChatRequest.
-	ToDifyRequest(ctx context.Context, r *http.Request) (*dify.ChatRequest, error)
+	// Decode parses the incoming request into a canonical Request.
+	Decode(r *http.Request) (*Request, error)
 
-	// WriteBlockingResponse encodes the Dify blocking response into the caller's format.
-	WriteBlockingResponse(w http.ResponseWriter, resp *dify.BlockingResponse) error
+	// WriteBlocking encodes the answers of a blocking call.
+	WriteBlocking(w http.ResponseWriter, req *Request, res *Result) error
 
-	// WriteStreamingResponse consumes the StreamEvent channel and encodes each chunk
-	// into the caller's streaming format, flushing after each write.
-	WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent) error
+	// WriteStream consumes s.Events and encodes each chunk into the
+	// caller's streaming format, flushing after each write. It sets the
+	// response headers itself.
+	WriteStream(w http.ResponseWriter, req *Request, s *Stream) error
+
+	// WriteError writes an error in the caller's format. status is the HTTP
+	// status the pipeline chose; adapters may map it to their own codes.
+	WriteError(w http.ResponseWriter, status int, msg string)
+}
+
+// RateLimitReporter is implemented by adapters whose protocol has
+// conventional rate limit response headers. The pipeline calls it before
+// writing the response, including a 429 for a request over a limit.
+type RateLimitReporter interface {
+	// SetRateLimitHeaders describes s in h. Windows with a zero Limit are
+	// unlimited and should be left out.
+	SetRateLimitHeaders(h http.Header, s ratelimit.Status)
+}
+
+// Error is a request error with its own HTTP status, such as 404 for an
+// unknown model. Decode and ExtractAPIKey may return one; other errors are
+// reported as 400 and 401 respectively.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// statusOf returns the status of an *Error, or def.
+func statusOf(err error, def int) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Status
+	}
+	return def
+}
+
+// Request is a chat request in canonical form.
+type Request struct {
+	// Model is the model the caller named. It selects the route and the
+	// tokenizer.
+	Model string
+	// System holds system prompts, sent ahead of the conversation.
+	System []string
+	// Messages is the conversation; the last message is the one answered.
+	Messages []Message
+	// Tools is the function-calling spec, or nil when tools are not in use.
+	Tools *toolcall.Spec
+	// Params are the generation parameters.
+	Params Params
+	// BodyUser is the end-user named in the body, if the protocol has one;
+	// the identity resolver weighs it against the request headers.
+	BodyUser string
+	// Identity is filled by the pipeline before the response is encoded.
+	Identity Identity
+	// Native is the decoded protocol request, for the adapter's encoders.
+	Native any
+}
+
+// Message is one turn of the conversation. Role is "user", "assistant",
+// "system" or "tool".
+type Message struct {
+	Role  string
+	Parts []Part
+}
+
+// Part is a piece of a message: text, or an image to upload to Dify.
+type Part struct {
+	Text  string
+	Image []byte
+}
+
+// Params are the generation parameters of a request.
+type Params struct {
+	Stream bool
+	// N is the number of candidates; 0 means 1.
+	N int
+	// Stop and MaxTokens are enforced by the pipeline.
+	Stop      []string
+	MaxTokens int
+	// Inputs are the protocol parameters that may be mapped onto Dify
+	// inputs; see inputs.Builder.
+	Inputs inputs.Params
+	// DetectModeration runs blocking calls in streaming mode, so that
+	// BlockingResponse.Moderated is known.
+	DetectModeration bool
+}
+
+// Identity is what a request runs as upstream.
+type Identity struct {
+	APIKey string
+	// User is the resolved Dify user.
+	User string
+}
+
+// Text joins the text parts of m.
+func (m Message) Text() string {
+	var sb strings.Builder
+	for _, p := range m.Parts {
+		sb.WriteString(p.Text)
+	}
+	return sb.String()
+}
+
+// Text returns a message with a single text part.
+func Text(role, text string) Message {
+	return Message{Role: role, Parts: []Part{{Text: text}}}
+}
+
+// Query flattens the request into the Dify query: the function-calling
+// instructions, the system prompts, then the conversation. The last message
+// becomes the query; prior messages are prepended as context.
+func (r *Request) Query() string {
+	var sb strings.Builder
+	sb.WriteString(r.Tools.Prompt())
+	for _, s := range r.System {
+		sb.WriteString("system: ")
+		sb.WriteString(s)
+		sb.WriteString("\n")
+	}
+	if len(r.Messages) == 0 {
+		return sb.String()
+	}
+	last := len(r.Messages) - 1
+	for _, m := range r.Messages[:last] {
+		sb.WriteString(m.Role)
+		sb.WriteString(": ")
+		sb.WriteString(m.Text())
+		sb.WriteString("\n")
+	}
+	sb.WriteString(r.Messages[last].Text())
+	return sb.String()
+}
+
+// EchoModel returns the model named in responses: the requested one, or
+// "dify" when the caller named none.
+func (r *Request) EchoModel() string {
+	if r.Model == "" {
+		return "dify"
+	}
+	return r.Model
+}
+
+// Images returns the image parts of all messages in order.
+func (r *Request) Images() [][]byte {
+	var out [][]byte
+	for _, m := range r.Messages {
+		for _, p := range m.Parts {
+			if p.Image != nil {
+				out = append(out, p.Image)
+			}
+		}
+	}
+	return out
+}
+
+// Result is the outcome of a blocking call, one entry per candidate.
+type Result struct {
+	// Responses hold the answers, already cut by Limiters.
+	Responses []*dify.BlockingResponse
+	Limiters  []*enforce.Limiter
+	// Usage is the merged usage of all candidates.
+	Usage tokenizer.Usage
+	// Start is when the upstream call started.
+	Start time.Time
+}
+
+// Stream is a streaming call. Events carries StreamEvent.Index as the
+// candidate index; there is one candidate per entry of Limiters, whose
+// outcome is final once Events is closed.
+type Stream struct {
+	Events   <-chan dify.StreamEvent
+	Limiters []*enforce.Limiter
+	// UsageFor resolves the usage of one candidate from its message_end
+	// metadata and answer.
+	UsageFor func(metadata map[string]any, answer string) tokenizer.Usage
+	// Start is when the upstream call started.
+	Start time.Time
 }
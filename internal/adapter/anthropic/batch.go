@@ -0,0 +1,414 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/admission"
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/batch"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+)
+
+// BatchIDPrefix is the prefix of Message Batch IDs.
+const BatchIDPrefix = "msgbatch_"
+
+// BatchHandler implements the Anthropic Message Batches endpoints on top of a
+// batch.Manager whose Executor is Handler.ExecuteBatchRequest.
+type BatchHandler struct {
+	batches *batch.Manager
+	users   *identity.Resolver
+	inputs  *inputs.Builder
+	routes  *routes.Table
+	apps    *apps.Registry
+	control *admission.Controller
+}
+
+// NewBatchHandler constructs a BatchHandler. Batches are owned by the caller
+// (see owner) even when their requests name routed models. A Dify key
+// presented by the caller is stored as the name of its app in apps, if any.
+// A batch is refused when a budget enforced by control is exhausted for one
+// of its requests.
+func NewBatchHandler(batches *batch.Manager, users *identity.Resolver, inputs *inputs.Builder, routes *routes.Table, apps *apps.Registry, control *admission.Controller) *BatchHandler {
+	return &BatchHandler{batches: batches, users: users, inputs: inputs, routes: routes, apps: apps, control: control}
+}
+
+// Create handles POST /v1/messages/batches.
+func (h *BatchHandler) Create(w http.ResponseWriter, r *http.Request) {
+	creds, ok := h.credentials(w, r)
+	if !ok {
+		return
+	}
+
+	var req BatchCreateRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	// Users and inputs are resolved now, while the request headers are
+	// available; each entry's metadata.user_id is honoured like on
+	// /v1/messages.
+	reqs := make([]batch.Request, len(req.Requests))
+	for i, br := range req.Requests {
+		var params MessagesRequest
+		if err := json.Unmarshal(br.Params, &params); err != nil {
+			apierrors.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("requests[%d] (custom_id %q): decode params: %v", i, br.CustomID, err))
+			return
+		}
+		if !creds.Allows(params.Model) {
+			apierrors.WriteJSONError(w, http.StatusForbidden, fmt.Sprintf("requests[%d]: API key may not use model %q", i, params.Model))
+			return
+		}
+		user := h.users.Resolve(r, params.UserID())
+		if err := h.control.Check(admission.Request{Creds: creds, User: user, Model: params.Model}); err != nil {
+			apierrors.WriteJSONError(w, http.StatusTooManyRequests, fmt.Sprintf("requests[%d]: %v", i, err))
+			return
+		}
+		app := inputs.App{APIKey: creds.APIKey}
+		target, routed := h.routes.Lookup(params.Model)
+		switch {
+		case routed:
+			if !target.Public && !creds.Authenticated() {
+				apierrors.WriteJSONError(w, http.StatusUnauthorized, fmt.Sprintf("requests[%d]: model %q requires a virtual key or access token", i, params.Model))
+				return
+			}
+			app = target.Pick(user).App()
+		case h.routes.Strict():
+			apierrors.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("requests[%d]: model %q not found", i, params.Model))
+			return
+		case creds.APIKey == "":
+			apierrors.WriteJSONError(w, http.StatusUnauthorized, fmt.Sprintf("requests[%d]: model %q has no route and the caller has no Dify key", i, params.Model))
+			return
+		}
+		in, err := h.inputs.Build(r.Context(), r, app, user, params.InputParams())
+		if err != nil {
+			apierrors.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("requests[%d]: %v", i, err))
+			return
+		}
+		reqs[i] = batch.Request{CustomID: br.CustomID, Params: br.Params, User: user, Inputs: in}
+	}
+
+	up := batch.Upstream{KeyID: creds.KeyID}
+	if up.KeyID == "" {
+		if app, ok := h.apps.ByKey(creds.APIKey); ok {
+			up.App = app.Name
+		} else {
+			up.APIKey = creds.APIKey
+		}
+	}
+	b, err := h.batches.Create(owner(creds), up, h.users.Resolve(r, ""), creds.Tier, reqs)
+	if err != nil {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, toMessageBatch(r, b))
+}
+
+// Get handles GET /v1/messages/batches/{id}.
+func (h *BatchHandler) Get(w http.ResponseWriter, r *http.Request) {
+	creds, ok := h.credentials(w, r)
+	if !ok {
+		return
+	}
+	b, err := h.batches.Get(owner(creds), r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, err)
+		return
+	}
+	writeJSON(w, toMessageBatch(r, b))
+}
+
+// List handles GET /v1/messages/batches with limit, before_id and after_id.
+func (h *BatchHandler) List(w http.ResponseWriter, r *http.Request) {
+	creds, ok := h.credentials(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 20
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			apierrors.WriteJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	all, err := h.batches.List(owner(creds))
+	if err != nil {
+		apierrors.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// all is ordered newest first. after_id pages towards older batches,
+	// before_id towards newer ones.
+	var page []*batch.Batch
+	hasMore := false
+	if id := q.Get("before_id"); id != "" {
+		end := max(indexOfBatch(all, id), 0)
+		start := max(end-limit, 0)
+		page, hasMore = all[start:end], start > 0
+	} else {
+		start := 0
+		if id := q.Get("after_id"); id != "" {
+			start = indexOfBatch(all, id) + 1
+		}
+		end := min(start+limit, len(all))
+		page, hasMore = all[start:end], end < len(all)
+	}
+
+	out := BatchList{Data: make([]MessageBatch, len(page)), HasMore: hasMore}
+	for i, b := range page {
+		out.Data[i] = toMessageBatch(r, b)
+	}
+	if len(page) > 0 {
+		out.FirstID, out.LastID = &page[0].ID, &page[len(page)-1].ID
+	}
+	writeJSON(w, out)
+}
+
+// Cancel handles POST /v1/messages/batches/{id}/cancel.
+func (h *BatchHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	creds, ok := h.credentials(w, r)
+	if !ok {
+		return
+	}
+	b, err := h.batches.Cancel(owner(creds), r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, err)
+		return
+	}
+	writeJSON(w, toMessageBatch(r, b))
+}
+
+// Results handles GET /v1/messages/batches/{id}/results, streaming one JSONL
+// line per request once the batch has ended.
+func (h *BatchHandler) Results(w http.ResponseWriter, r *http.Request) {
+	creds, ok := h.credentials(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	b, err := h.batches.Get(owner(creds), id)
+	if err != nil {
+		writeBatchError(w, err)
+		return
+	}
+	if b.Status != batch.StatusEnded {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("batch %s has not ended; results are not available yet", id))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-jsonl")
+	enc := json.NewEncoder(w)
+	_ = h.batches.Results(owner(creds), id, func(res batch.Result) error {
+		body := res.Body
+		if len(body) == 0 {
+			body, _ = json.Marshal(BatchResult{Type: res.Type})
+		}
+		return enc.Encode(BatchResultLine{CustomID: res.CustomID, Result: body})
+	})
+}
+
+func (h *BatchHandler) credentials(w http.ResponseWriter, r *http.Request) (httputil.Credentials, bool) {
+	creds := httputil.ExtractCredentials(r)
+	if owner(creds) == "" {
+		apierrors.WriteJSONError(w, http.StatusUnauthorized, "missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
+		return creds, false
+	}
+	return creds, true
+}
+
+// owner names the caller batches belong to: its virtual key, which keeps its
+// batches across rotations, else the user of its access token or client
+// certificate, else the Dify key it presented.
+func owner(creds httputil.Credentials) string {
+	switch {
+	case creds.KeyID != "":
+		return "key:" + creds.KeyID
+	case creds.User != "":
+		return "user:" + creds.User
+	}
+	return creds.APIKey
+}
+
+// ExecuteBatchRequest is the batch.Executor for Messages requests. It runs the
+// request in blocking mode and encodes the outcome as an Anthropic batch result.
+func (h *Handler) ExecuteBatchRequest(ctx context.Context, b *batch.Batch, req batch.Request) batch.Result {
+	var params MessagesRequest
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return erroredResult("invalid_request_error", "decode params: "+err.Error())
+	}
+	if params.Stream {
+		return erroredResult("invalid_request_error", "stream is not supported for batch requests")
+	}
+	user := req.User
+	if user == "" {
+		user = b.User
+	}
+	canon, err := decode(&params)
+	if err != nil {
+		return erroredResult("invalid_request_error", err.Error())
+	}
+	difyReq := &dify.ChatRequest{Inputs: req.Inputs, Query: canon.Query(), User: user}
+	if difyReq.Inputs == nil {
+		difyReq.Inputs = map[string]any{}
+	}
+
+	creds, err := h.upstream(b, params.Model)
+	if err != nil {
+		return erroredResult("authentication_error", err.Error())
+	}
+	client, apiKey := h.client, creds.APIKey
+	target, routed := h.routes.Lookup(params.Model)
+	if routed {
+		picked := target.Pick(user)
+		client, apiKey = picked.Client, picked.APIKey
+	} else if apiKey == "" {
+		return erroredResult("authentication_error", "the Dify key of this batch is not stored and was lost on restart; submit the batch again")
+	}
+
+	ticket, err := h.admit(ctx, admission.Request{
+		Creds:  creds,
+		User:   user,
+		Model:  params.Model,
+		Route:  target,
+		Prompt: func() int { return h.tokens.For(params.Model).Count(difyReq.Query) },
+	})
+	if err != nil {
+		return erroredResult("rate_limit_error", err.Error())
+	}
+	defer ticket.Settle()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	resp, err := client.SendBlocking(ctx, apiKey, difyReq)
+	if err != nil {
+		return erroredResult("api_error", "upstream error: "+err.Error())
+	}
+
+	var lim *enforce.Limiter
+	resp.Answer, lim = enforce.Apply(resp.Answer, params.StopSequences, params.MaxTokens, h.tokens.For(params.Model))
+	usage := h.tokens.Resolve(params.Model, resp.Metadata, difyReq.Query, resp.Answer)
+	ticket.Use(usage)
+	msg := toMessagesResponse(resp, canon.EchoModel(), usage, lim)
+	body, _ := json.Marshal(BatchResult{Type: batch.ResultSucceeded, Message: &msg})
+	return batch.Result{Type: batch.ResultSucceeded, Body: body}
+}
+
+// admit admits a batch request, waiting while it is over a rate limit: the
+// requests of a batch are throttled rather than failed. They fail once a
+// budget is exhausted.
+func (h *Handler) admit(ctx context.Context, req admission.Request) (*admission.Ticket, error) {
+	for {
+		ticket, _, err := h.control.Admit(req)
+		var exceeded *ratelimit.Exceeded
+		if !errors.As(err, &exceeded) {
+			return ticket, err
+		}
+		select {
+		case <-time.After(exceeded.RetryAfter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// upstream resolves the credentials of b for a request for model when it
+// runs: those of its virtual key, which must still be valid and allow model,
+// or the Dify key of its registered app or held in memory. They carry the
+// rate limit tier of the batch's creator.
+func (h *Handler) upstream(b *batch.Batch, model string) (httputil.Credentials, error) {
+	var creds httputil.Credentials
+	switch up := b.Upstream; {
+	case up.KeyID != "":
+		var err error
+		if creds, err = h.keys.ResolveID(up.KeyID); err != nil {
+			return creds, err
+		}
+		if !creds.Allows(model) {
+			return creds, fmt.Errorf("API key may not use model %q", model)
+		}
+	case up.App != "":
+		app, ok := h.apps.ByName(up.App)
+		if !ok {
+			return creds, fmt.Errorf("app %q is no longer registered", up.App)
+		}
+		creds.APIKey = app.APIKey
+	default:
+		creds.APIKey = up.APIKey
+	}
+	creds.Tier = b.Tier
+	return creds, nil
+}
+
+func erroredResult(errType, message string) batch.Result {
+	body, _ := json.Marshal(BatchResult{
+		Type: batch.ResultErrored,
+		Error: &ErrorResponse{
+			Type:  "error",
+			Error: ErrorDetail{Type: errType, Message: message},
+		},
+	})
+	return batch.Result{Type: batch.ResultErrored, Body: body}
+}
+
+func toMessageBatch(r *http.Request, b *batch.Batch) MessageBatch {
+	out := MessageBatch{
+		ID:               b.ID,
+		Type:             "message_batch",
+		ProcessingStatus: b.Status,
+		RequestCounts: RequestCounts{
+			Processing: b.Counts.Processing,
+			Succeeded:  b.Counts.Succeeded,
+			Errored:    b.Counts.Errored,
+			Canceled:   b.Counts.Canceled,
+			Expired:    b.Counts.Expired,
+		},
+		EndedAt:           b.EndedAt,
+		CreatedAt:         b.CreatedAt,
+		ExpiresAt:         b.ExpiresAt,
+		CancelInitiatedAt: b.CancelInitiatedAt,
+	}
+	if b.Status == batch.StatusEnded {
+		url := httputil.BaseURL(r) + "/v1/messages/batches/" + b.ID + "/results"
+		out.ResultsURL = &url
+	}
+	return out
+}
+
+func indexOfBatch(all []*batch.Batch, id string) int {
+	for i, b := range all {
+		if b.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func writeBatchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, batch.ErrNotFound) {
+		apierrors.WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	apierrors.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
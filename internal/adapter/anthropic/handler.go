@@ -1,75 +1,139 @@
 package anthropic
 
 import (
-	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
-	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	"github.com/zhengjr9/dify-agent/internal/admission"
+	"github.com/zhengjr9/dify-agent/internal/apps"
 	"github.com/zhengjr9/dify-agent/internal/dify"
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
 	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/keys"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
 )
 
-// Handler implements the Anthropic Messages endpoint.
-type Handler struct {
-	client      *dify.Client
-	defaultUser string
-	timeout     time.Duration
+// Protocol is the name Adapter is registered under in the pipeline.
+const Protocol = "anthropic"
+
+// Adapter implements the Anthropic Messages endpoint, POST /v1/messages.
+type Adapter struct{}
+
+// NewAdapter constructs an Adapter.
+func NewAdapter() *Adapter {
+	return &Adapter{}
 }
 
-// NewHandler constructs a Handler.
-func NewHandler(client *dify.Client, defaultUser string, timeout time.Duration) *Handler {
-	return &Handler{client: client, defaultUser: defaultUser, timeout: timeout}
+// ExtractAPIKey implements adapter.Adapter.
+func (a *Adapter) ExtractAPIKey(r *http.Request, _ *adapter.Request) (string, error) {
+	if key := httputil.ExtractCredentials(r).APIKey; key != "" {
+		return key, nil
+	}
+	return "", errors.New("missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
 }
 
-// ServeHTTP handles POST /v1/messages.
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	creds := httputil.ExtractCredentials(r, h.defaultUser)
-	if creds.APIKey == "" {
-		apierrors.WriteJSONError(w, http.StatusUnauthorized, "missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
-		return
+// Decode implements adapter.Adapter.
+func (a *Adapter) Decode(r *http.Request) (*adapter.Request, error) {
+	var req MessagesRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
 	}
+	return decode(&req)
+}
 
-	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
-	defer cancel()
+// WriteBlocking implements adapter.Adapter.
+func (a *Adapter) WriteBlocking(w http.ResponseWriter, req *adapter.Request, res *adapter.Result) error {
+	return WriteBlockingResponse(w, res.Responses[0], req.EchoModel(), res.Usage, res.Limiters[0])
+}
 
-	difyReq, streaming, err := ToDifyRequest(ctx, r, creds.User)
-	if err != nil {
-		apierrors.WriteJSONError(w, http.StatusBadRequest, err.Error())
-		return
-	}
+// WriteStream implements adapter.Adapter.
+func (a *Adapter) WriteStream(w http.ResponseWriter, req *adapter.Request, s *adapter.Stream) error {
+	httputil.SetSSEHeaders(w)
+	return WriteStreamingResponse(w, s.Events, req.EchoModel(), s.UsageFor, s.Limiters[0])
+}
 
-	model := "dify"
+// WriteError implements adapter.Adapter.
+func (a *Adapter) WriteError(w http.ResponseWriter, status int, msg string) {
+	apierrors.WriteJSONError(w, status, msg)
+}
 
-	if streaming {
-		stream, err := h.client.SendStreaming(ctx, creds.APIKey, difyReq)
-		if err != nil {
-			writeUpstreamError(w, err)
-			return
-		}
-		httputil.SetSSEHeaders(w)
-		if err := WriteStreamingResponse(w, stream, model); err != nil {
-			return
+// SetRateLimitHeaders implements adapter.RateLimitReporter with the
+// anthropic-ratelimit-* headers, whose resets are RFC 3339 times.
+func (a *Adapter) SetRateLimitHeaders(h http.Header, s ratelimit.Status) {
+	now := time.Now().UTC()
+	for _, l := range []struct {
+		name string
+		w    ratelimit.Window
+	}{{"requests", s.Requests}, {"tokens", s.Tokens}} {
+		if l.w.Limit == 0 {
+			continue
 		}
+		h.Set("Anthropic-Ratelimit-"+l.name+"-Limit", strconv.Itoa(l.w.Limit))
+		h.Set("Anthropic-Ratelimit-"+l.name+"-Remaining", strconv.Itoa(l.w.Remaining))
+		h.Set("Anthropic-Ratelimit-"+l.name+"-Reset", now.Add(l.w.Reset).Format(time.RFC3339))
+	}
+}
+
+// Handler implements the Anthropic endpoints that do not run through the
+// pipeline: token counting and the execution of batch requests.
+type Handler struct {
+	client  *dify.Client
+	users   *identity.Resolver
+	timeout time.Duration
+	tokens  *tokenizer.Set
+	routes  *routes.Table
+	apps    *apps.Registry
+	keys    *keys.Manager
+	control *admission.Controller
+}
+
+// NewHandler constructs a Handler. Batch requests for a routed model run
+// against the route's app; others run with the Dify key of the batch's
+// virtual key in keys or of its app in apps. Batch requests and token
+// counting count against the rate limits and budgets enforced by control.
+func NewHandler(client *dify.Client, users *identity.Resolver, timeout time.Duration, tokens *tokenizer.Set, routes *routes.Table, apps *apps.Registry, keys *keys.Manager, control *admission.Controller) *Handler {
+	return &Handler{client: client, users: users, timeout: timeout, tokens: tokens, routes: routes, apps: apps, keys: keys, control: control}
+}
+
+// CountTokens handles POST /v1/messages/count_tokens. The count is computed
+// locally from the same flattened query that would be sent to Dify; the
+// request still counts against the caller's requests per minute.
+func (h *Handler) CountTokens(w http.ResponseWriter, r *http.Request) {
+	creds := httputil.ExtractCredentials(r)
+	if creds.APIKey == "" && !creds.Authenticated() {
+		apierrors.WriteJSONError(w, http.StatusUnauthorized, "missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
 		return
 	}
 
-	resp, err := h.client.SendBlocking(ctx, creds.APIKey, difyReq)
-	if err != nil {
-		writeUpstreamError(w, err)
+	var req MessagesRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, "decode body: "+err.Error())
 		return
 	}
-	if err := WriteBlockingResponse(w, resp, model); err != nil {
-		apierrors.WriteJSONError(w, http.StatusInternalServerError, "failed to write response")
+	canon, err := decode(&req)
+	if err != nil {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-}
-
-func writeUpstreamError(w http.ResponseWriter, err error) {
-	msg := err.Error()
-	if strings.Contains(msg, "context deadline exceeded") || strings.Contains(msg, "timeout") {
-		apierrors.WriteJSONError(w, http.StatusGatewayTimeout, "upstream timeout")
+	target, _ := h.routes.Lookup(req.Model)
+	ticket, status, err := h.control.Admit(admission.Request{Creds: creds, User: h.users.Resolve(r, req.UserID()), Model: req.Model, Route: target})
+	(&Adapter{}).SetRateLimitHeaders(w.Header(), status)
+	if err != nil {
+		admission.SetRetryAfter(w.Header(), err)
+		apierrors.WriteJSONError(w, http.StatusTooManyRequests, err.Error())
 		return
 	}
-	apierrors.WriteJSONError(w, http.StatusBadGateway, "upstream error: "+msg)
+	defer ticket.Settle()
+
+	out := CountTokensResponse{InputTokens: h.tokens.For(req.Model).Count(canon.Query())}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
 }
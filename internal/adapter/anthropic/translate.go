@@ -1,81 +1,81 @@
 package anthropic
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/zhengjr9/dify-agent/internal/adapter"
 	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
 )
 
-// ToDifyRequest converts an Anthropic Messages request to a Dify ChatRequest.
-func ToDifyRequest(ctx context.Context, r *http.Request, defaultUser string) (*dify.ChatRequest, bool, error) {
-	var req MessagesRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, false, fmt.Errorf("decode body: %w", err)
-	}
+// decode converts a decoded Messages request to a canonical request, kept
+// as Native for response shaping.
+func decode(req *MessagesRequest) (*adapter.Request, error) {
 	if len(req.Messages) == 0 {
-		return nil, false, fmt.Errorf("messages must not be empty")
+		return nil, fmt.Errorf("messages must not be empty")
+	}
+	out := &adapter.Request{
+		Model:    req.Model,
+		Messages: make([]adapter.Message, len(req.Messages)),
+		Params: adapter.Params{
+			Stream:    req.Stream,
+			Stop:      req.StopSequences,
+			MaxTokens: req.MaxTokens,
+			Inputs:    req.InputParams(),
+		},
+		BodyUser: req.UserID(),
+		Native:   req,
 	}
-
-	query := flattenMessages(req.Messages, req.System)
-
-	difyReq := &dify.ChatRequest{
-		Inputs: map[string]any{},
-		Query:  query,
-		User:   defaultUser,
+	if req.System != "" {
+		out.System = []string{req.System}
 	}
-
-	return difyReq, req.Stream, nil
+	for i, m := range req.Messages {
+		out.Messages[i] = adapter.Text(m.Role, m.Content)
+	}
+	return out, nil
 }
 
-// flattenMessages converts Anthropic messages into a single query string.
-func flattenMessages(msgs []Message, system string) string {
-	var sb strings.Builder
-	if system != "" {
-		sb.WriteString("system: ")
-		sb.WriteString(system)
-		sb.WriteString("\n")
-	}
+// WriteBlockingResponse encodes a Dify blocking response as an Anthropic MessagesResponse.
+// The stop reason is derived from the limiter that was applied to the answer.
+func WriteBlockingResponse(w http.ResponseWriter, resp *dify.BlockingResponse, model string, usage tokenizer.Usage, lim *enforce.Limiter) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(toMessagesResponse(resp, model, usage, lim))
+}
 
-	if len(msgs) == 1 {
-		if sb.Len() > 0 {
-			sb.WriteString(msgs[0].Content)
-			return sb.String()
-		}
-		return msgs[0].Content
+func toMessagesResponse(resp *dify.BlockingResponse, model string, usage tokenizer.Usage, lim *enforce.Limiter) MessagesResponse {
+	stopReason, stopSequence := toStopReason(lim)
+	return MessagesResponse{
+		ID:           resp.MessageID,
+		Type:         "message",
+		Role:         "assistant",
+		Content:      []Content{{Type: "text", Text: resp.Answer}},
+		Model:        model,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        toUsage(usage),
 	}
-
-	last := msgs[len(msgs)-1]
-	prior := msgs[:len(msgs)-1]
-	for _, m := range prior {
-		sb.WriteString(m.Role)
-		sb.WriteString(": ")
-		sb.WriteString(m.Content)
-		sb.WriteString("\n")
-	}
-	sb.WriteString(last.Content)
-	return sb.String()
 }
 
-// WriteBlockingResponse encodes a Dify blocking response as an Anthropic MessagesResponse.
-func WriteBlockingResponse(w http.ResponseWriter, resp *dify.BlockingResponse, model string) error {
-	out := MessagesResponse{
-		ID:         resp.MessageID,
-		Type:       "message",
-		Role:       "assistant",
-		Content:    []Content{{Type: "text", Text: resp.Answer}},
-		Model:      model,
-		StopReason: "end_turn",
+// toStopReason maps the limiter outcome to stop_reason and stop_sequence.
+func toStopReason(lim *enforce.Limiter) (string, *string) {
+	switch lim.Reason() {
+	case enforce.ReasonStopSequence:
+		seq := lim.StopSequence()
+		return "stop_sequence", &seq
+	case enforce.ReasonMaxTokens:
+		return "max_tokens", nil
 	}
-	w.Header().Set("Content-Type", "application/json")
-	return json.NewEncoder(w).Encode(out)
+	return "end_turn", nil
 }
 
 // WriteStreamingResponse encodes Dify stream events as Anthropic SSE events.
-func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent, model string) error {
+// usageFor is called once the stream ends to fill the message_delta usage, and
+// lim supplies its stop_reason.
+func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent, model string, usageFor func(metadata map[string]any, answer string) tokenizer.Usage, lim *enforce.Limiter) error {
 	// Send message_start
 	startEvt := map[string]any{
 		"type": "message_start",
@@ -84,6 +84,7 @@ func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEven
 			"type":  "message",
 			"role":  "assistant",
 			"model": model,
+			"usage": Usage{},
 		},
 	}
 	if err := writeSSEEvent(w, "message_start", startEvt); err != nil {
@@ -96,13 +97,22 @@ func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEven
 		return err
 	}
 
+	var (
+		answer   strings.Builder
+		metadata map[string]any
+	)
 	for ev := range stream {
 		if ev.Err != nil {
 			return ev.Err
 		}
+		if ev.Event == "message_end" {
+			metadata = ev.Metadata
+			continue
+		}
 		if ev.Event != "message" && ev.Event != "agent_message" {
 			continue
 		}
+		answer.WriteString(ev.Answer)
 
 		delta := StreamEvent{
 			Type:  "content_block_delta",
@@ -114,10 +124,19 @@ func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEven
 		}
 	}
 
-	// Send content_block_stop and message_stop
+	// Send content_block_stop, message_delta and message_stop
 	if err := writeSSEEvent(w, "content_block_stop", map[string]any{"type": "content_block_stop", "index": 0}); err != nil {
 		return err
 	}
+	stopReason, stopSequence := toStopReason(lim)
+	msgDelta := map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": stopSequence},
+		"usage": toUsage(usageFor(metadata, answer.String())),
+	}
+	if err := writeSSEEvent(w, "message_delta", msgDelta); err != nil {
+		return err
+	}
 	if err := writeSSEEvent(w, "message_stop", map[string]any{"type": "message_stop"}); err != nil {
 		return err
 	}
@@ -137,3 +156,11 @@ func writeSSEEvent(w http.ResponseWriter, event string, payload any) error {
 	}
 	return nil
 }
+
+func toUsage(u tokenizer.Usage) Usage {
+	return Usage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		Estimated:    u.Estimated,
+	}
+}
@@ -1,5 +1,11 @@
 package anthropic
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+)
 
 // MessagesRequest mirrors the Anthropic Messages API request body.
 type MessagesRequest struct {
@@ -8,6 +14,43 @@ type MessagesRequest struct {
 	Messages  []Message `json:"messages"`
 	System    string    `json:"system,omitempty"`
 	Stream    bool      `json:"stream"`
+	// StopSequences and MaxTokens are enforced by the proxy.
+	StopSequences []string  `json:"stop_sequences,omitempty"`
+	Metadata      *Metadata `json:"metadata,omitempty"`
+	// Sampling parameters reach Dify only as inputs, through the apps
+	// mapping; see InputParams.
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+}
+
+// InputParams returns the request parameters that may be mapped onto Dify
+// inputs.
+func (r *MessagesRequest) InputParams() inputs.Params {
+	p := inputs.Params{}
+	inputs.Set(p, "temperature", r.Temperature)
+	inputs.Set(p, "top_p", r.TopP)
+	inputs.Set(p, "top_k", r.TopK)
+	if r.MaxTokens > 0 {
+		p["max_tokens"] = r.MaxTokens
+	}
+	if id := r.UserID(); id != "" {
+		p["metadata.user_id"] = id
+	}
+	return p
+}
+
+// Metadata carries request metadata; UserID identifies the end-user.
+type Metadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// UserID returns metadata.user_id, or "" when absent.
+func (r *MessagesRequest) UserID() string {
+	if r.Metadata == nil {
+		return ""
+	}
+	return r.Metadata.UserID
 }
 
 // Message is a single Anthropic chat message.
@@ -34,10 +77,17 @@ type Content struct {
 	Text string `json:"text"`
 }
 
-// Usage carries token counts.
+// Usage carries token counts. Estimated is set when the counts were computed
+// locally because Dify did not report usage.
 type Usage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens  int  `json:"input_tokens"`
+	OutputTokens int  `json:"output_tokens"`
+	Estimated    bool `json:"estimated,omitempty"`
+}
+
+// CountTokensResponse is the body returned by POST /v1/messages/count_tokens.
+type CountTokensResponse struct {
+	InputTokens int `json:"input_tokens"`
 }
 
 // StreamEvent represents one Anthropic SSE event.
@@ -53,3 +103,70 @@ type Delta struct {
 	Text string `json:"text"`
 }
 
+// BatchCreateRequest is the body of POST /v1/messages/batches.
+type BatchCreateRequest struct {
+	Requests []BatchRequest `json:"requests"`
+}
+
+// BatchRequest is one Messages request inside a batch.
+type BatchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// MessageBatch mirrors the Anthropic Message Batch object.
+type MessageBatch struct {
+	ID                string        `json:"id"`
+	Type              string        `json:"type"`
+	ProcessingStatus  string        `json:"processing_status"`
+	RequestCounts     RequestCounts `json:"request_counts"`
+	EndedAt           *time.Time    `json:"ended_at"`
+	CreatedAt         time.Time     `json:"created_at"`
+	ExpiresAt         time.Time     `json:"expires_at"`
+	ArchivedAt        *time.Time    `json:"archived_at"`
+	CancelInitiatedAt *time.Time    `json:"cancel_initiated_at"`
+	ResultsURL        *string       `json:"results_url"`
+}
+
+// RequestCounts tallies batch requests by state.
+type RequestCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// BatchList is the response of GET /v1/messages/batches.
+type BatchList struct {
+	Data    []MessageBatch `json:"data"`
+	HasMore bool           `json:"has_more"`
+	FirstID *string        `json:"first_id"`
+	LastID  *string        `json:"last_id"`
+}
+
+// BatchResultLine is one line of the JSONL results stream.
+type BatchResultLine struct {
+	CustomID string          `json:"custom_id"`
+	Result   json.RawMessage `json:"result"`
+}
+
+// BatchResult is the result object of a single batch request. Message is set
+// for "succeeded" results and Error for "errored" ones.
+type BatchResult struct {
+	Type    string            `json:"type"`
+	Message *MessagesResponse `json:"message,omitempty"`
+	Error   *ErrorResponse    `json:"error,omitempty"`
+}
+
+// ErrorResponse is the Anthropic error envelope.
+type ErrorResponse struct {
+	Type  string      `json:"type"`
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes an Anthropic API error.
+type ErrorDetail struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,107 @@
+package bedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/eventstream"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+)
+
+// Protocol is the name Adapter is registered under in the pipeline.
+const Protocol = "bedrock"
+
+// Adapter implements the Bedrock Converse and ConverseStream endpoints;
+// streaming is selected by the URL path.
+//
+// Besides the usual headers, the Dify key may come from the app whose name
+// matches the model ID, which is lent only to callers the gateway
+// authenticated whose credentials allow the model. SigV4 signatures are not
+// verified, so a SigV4 Authorization header is neither a key nor a
+// credential.
+type Adapter struct {
+	apps *apps.Registry
+}
+
+// NewAdapter constructs an Adapter.
+func NewAdapter(apps *apps.Registry) *Adapter {
+	return &Adapter{apps: apps}
+}
+
+// ExtractAPIKey implements adapter.Adapter: the caller's credentials, else,
+// for an authenticated caller allowed the model, the key of the app named by
+// the model ID.
+func (a *Adapter) ExtractAPIKey(r *http.Request, req *adapter.Request) (string, error) {
+	creds := httputil.ExtractCredentials(r)
+	if creds.APIKey != "" {
+		return creds.APIKey, nil
+	}
+	if creds.Authenticated() && creds.Allows(req.Model) {
+		if app, ok := a.apps.ByName(req.Model); ok {
+			return app.APIKey, nil
+		}
+	}
+	return "", &adapter.Error{
+		Status:  http.StatusForbidden,
+		Message: "missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>",
+	}
+}
+
+// Decode implements adapter.Adapter.
+func (a *Adapter) Decode(r *http.Request) (*adapter.Request, error) {
+	var req ConverseRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+	out, err := decode(&req, r.PathValue("modelId"))
+	if err != nil {
+		return nil, err
+	}
+	out.Params.Stream = strings.HasSuffix(r.URL.Path, "/converse-stream")
+	return out, nil
+}
+
+// WriteBlocking implements adapter.Adapter.
+func (a *Adapter) WriteBlocking(w http.ResponseWriter, req *adapter.Request, res *adapter.Result) error {
+	return WriteBlockingResponse(w, res.Responses[0], res.Usage, res.Limiters[0], res.Start)
+}
+
+// WriteStream implements adapter.Adapter.
+func (a *Adapter) WriteStream(w http.ResponseWriter, req *adapter.Request, s *adapter.Stream) error {
+	w.Header().Set("Content-Type", eventstream.ContentType)
+	return WriteStreamingResponse(w, s.Events, s.Start, s.UsageFor, s.Limiters[0])
+}
+
+// WriteError implements adapter.Adapter. The status is mapped to the
+// exception the AWS SDKs expect.
+func (a *Adapter) WriteError(w http.ResponseWriter, status int, msg string) {
+	switch status {
+	case http.StatusBadRequest:
+		writeError(w, status, "ValidationException", msg)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		writeError(w, http.StatusForbidden, "AccessDeniedException", msg)
+	case http.StatusNotFound:
+		writeError(w, status, "ResourceNotFoundException", msg)
+	case http.StatusTooManyRequests:
+		writeError(w, status, "ThrottlingException", msg)
+	case http.StatusGatewayTimeout:
+		writeError(w, http.StatusRequestTimeout, "ModelTimeoutException", msg)
+	case http.StatusBadGateway:
+		writeError(w, http.StatusFailedDependency, "ModelErrorException", msg)
+	default:
+		writeError(w, status, "InternalServerException", msg)
+	}
+}
+
+// writeError writes a Bedrock error: the type in X-Amzn-ErrorType, which the
+// AWS SDKs use to pick the exception, and the message in the body.
+func writeError(w http.ResponseWriter, status int, errType, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-ErrorType", errType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Message: msg})
+}
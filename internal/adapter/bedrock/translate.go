@@ -0,0 +1,177 @@
+package bedrock
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	"github.com/zhengjr9/dify-agent/internal/eventstream"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// decode converts a Converse request for model to a canonical request. The
+// text blocks of a message are joined by newlines; image blocks become
+// image parts.
+func decode(req *ConverseRequest, model string) (*adapter.Request, error) {
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("messages must not be empty")
+	}
+	out := &adapter.Request{
+		Model:    model,
+		Messages: make([]adapter.Message, len(req.Messages)),
+		Params: adapter.Params{
+			Stop:      req.InferenceConfig.Stops(),
+			MaxTokens: req.InferenceConfig.OutputLimit(),
+			Inputs:    req.InputParams(),
+		},
+		Native: req,
+	}
+	for _, s := range req.System {
+		out.System = append(out.System, s.Text)
+	}
+	for i, m := range req.Messages {
+		var texts []string
+		var images []adapter.Part
+		for j, b := range m.Content {
+			switch {
+			case b.Text != nil:
+				texts = append(texts, *b.Text)
+			case b.Image != nil:
+				raw, err := base64.StdEncoding.DecodeString(b.Image.Source.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("messages[%d].content[%d].image: invalid base64 bytes: %v", i, j, err)
+				}
+				images = append(images, adapter.Part{Image: raw})
+			}
+		}
+		parts := append([]adapter.Part{{Text: strings.Join(texts, "\n")}}, images...)
+		out.Messages[i] = adapter.Message{Role: m.Role, Parts: parts}
+	}
+	return out, nil
+}
+
+// stopReason maps the limiter outcome to a Bedrock stopReason.
+func stopReason(lim *enforce.Limiter) string {
+	switch lim.Reason() {
+	case enforce.ReasonStopSequence:
+		return "stop_sequence"
+	case enforce.ReasonMaxTokens:
+		return "max_tokens"
+	}
+	return "end_turn"
+}
+
+func toUsage(u tokenizer.Usage) Usage {
+	return Usage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens, TotalTokens: u.PromptTokens + u.CompletionTokens}
+}
+
+// WriteBlockingResponse encodes a Dify blocking response as a Converse
+// response.
+func WriteBlockingResponse(w http.ResponseWriter, resp *dify.BlockingResponse, usage tokenizer.Usage, lim *enforce.Limiter, start time.Time) error {
+	text := resp.Answer
+	out := ConverseResponse{
+		Output: Output{Message: Message{
+			Role:    "assistant",
+			Content: []ContentBlock{{Text: &text}},
+		}},
+		StopReason: stopReason(lim),
+		Usage:      toUsage(usage),
+		Metrics:    Metrics{LatencyMs: time.Since(start).Milliseconds()},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(out)
+}
+
+// WriteStreamingResponse encodes Dify stream events as a ConverseStream event
+// stream: messageStart, a contentBlockDelta per chunk, contentBlockStop,
+// messageStop with the stop reason from lim, and a metadata event with the
+// usage from usageFor.
+//
+// A Dify message_replace event means output moderation replaced the answer;
+// nothing further is streamed and the stop reason is content_filtered. An
+// upstream error after the stream started is sent as an exception message.
+func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent, start time.Time, usageFor func(metadata map[string]any, answer string) tokenizer.Usage, lim *enforce.Limiter) error {
+	var (
+		answer   strings.Builder
+		metadata map[string]any
+		replaced bool
+	)
+	ew := &eventWriter{w: w}
+	if err := ew.event("messageStart", MessageStartEvent{Role: "assistant"}); err != nil {
+		return err
+	}
+	for ev := range stream {
+		if ev.Err != nil {
+			_ = ew.exception("internalServerException", ErrorResponse{Message: "upstream error: " + ev.Err.Error()})
+			return ev.Err
+		}
+		switch ev.Event {
+		case "message_end":
+			metadata = ev.Metadata
+			continue
+		case "message_replace":
+			replaced = true
+			continue
+		case "message", "agent_message":
+		default:
+			continue
+		}
+		if replaced || ev.Answer == "" {
+			continue
+		}
+		answer.WriteString(ev.Answer)
+		var delta ContentBlockDeltaEvent
+		delta.Delta.Text = ev.Answer
+		if err := ew.event("contentBlockDelta", delta); err != nil {
+			return err
+		}
+	}
+
+	reason := stopReason(lim)
+	if replaced {
+		reason = "content_filtered"
+	}
+	if err := ew.event("contentBlockStop", ContentBlockStopEvent{}); err != nil {
+		return err
+	}
+	if err := ew.event("messageStop", MessageStopEvent{StopReason: reason}); err != nil {
+		return err
+	}
+	return ew.event("metadata", MetadataEvent{
+		Usage:   toUsage(usageFor(metadata, answer.String())),
+		Metrics: Metrics{LatencyMs: time.Since(start).Milliseconds()},
+	})
+}
+
+// eventWriter writes JSON payloads as flushed event stream messages.
+type eventWriter struct {
+	w http.ResponseWriter
+}
+
+func (e *eventWriter) event(eventType string, v any) error {
+	return e.write(eventType, v, eventstream.Event)
+}
+
+func (e *eventWriter) exception(exceptionType string, v any) error {
+	return e.write(exceptionType, v, eventstream.Exception)
+}
+
+func (e *eventWriter) write(typ string, v any, msg func(string, []byte) eventstream.Message) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := eventstream.WriteMessage(e.w, msg(typ, payload)); err != nil {
+		return err
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
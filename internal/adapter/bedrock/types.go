@@ -0,0 +1,144 @@
+package bedrock
+
+import (
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+)
+
+// ConverseRequest mirrors the Bedrock Converse and ConverseStream request
+// body. The model ID comes from the URL path.
+type ConverseRequest struct {
+	Messages        []Message         `json:"messages"`
+	System          []SystemBlock     `json:"system,omitempty"`
+	InferenceConfig *InferenceConfig  `json:"inferenceConfig,omitempty"`
+	RequestMetadata map[string]string `json:"requestMetadata,omitempty"`
+}
+
+// Message is a single conversation turn.
+type Message struct {
+	Role    string         `json:"role"`
+	Content []ContentBlock `json:"content"`
+}
+
+// ContentBlock is one block of a message. Only text and image blocks reach
+// Dify; tool and document blocks are ignored.
+type ContentBlock struct {
+	Text  *string     `json:"text,omitempty"`
+	Image *ImageBlock `json:"image,omitempty"`
+}
+
+// ImageBlock is an inline image. Bytes are base64-encoded, as the AWS SDKs
+// serialise blobs in JSON.
+type ImageBlock struct {
+	Format string `json:"format"`
+	Source struct {
+		Bytes string `json:"bytes"`
+	} `json:"source"`
+}
+
+// SystemBlock is one system prompt block.
+type SystemBlock struct {
+	Text string `json:"text"`
+}
+
+// InferenceConfig carries the inference parameters. StopSequences and
+// MaxTokens are enforced by the proxy; the sampling parameters reach Dify
+// only as inputs, through the apps mapping.
+type InferenceConfig struct {
+	MaxTokens     *int     `json:"maxTokens,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+}
+
+// OutputLimit returns maxTokens, or 0 when unset.
+func (c *InferenceConfig) OutputLimit() int {
+	if c == nil || c.MaxTokens == nil || *c.MaxTokens < 0 {
+		return 0
+	}
+	return *c.MaxTokens
+}
+
+// Stops returns the stop sequences.
+func (c *InferenceConfig) Stops() []string {
+	if c == nil {
+		return nil
+	}
+	return c.StopSequences
+}
+
+// InputParams returns the request parameters that may be mapped onto Dify
+// inputs. requestMetadata entries are exposed as metadata.<key>.
+func (r *ConverseRequest) InputParams() inputs.Params {
+	p := inputs.Params{}
+	if c := r.InferenceConfig; c != nil {
+		inputs.Set(p, "temperature", c.Temperature)
+		inputs.Set(p, "top_p", c.TopP)
+		if n := c.OutputLimit(); n > 0 {
+			p["max_tokens"] = n
+		}
+	}
+	for k, v := range r.RequestMetadata {
+		p["metadata."+k] = v
+	}
+	return p
+}
+
+// ConverseResponse is the Converse response body.
+type ConverseResponse struct {
+	Output     Output  `json:"output"`
+	StopReason string  `json:"stopReason"`
+	Usage      Usage   `json:"usage"`
+	Metrics    Metrics `json:"metrics"`
+}
+
+// Output wraps the assistant message.
+type Output struct {
+	Message Message `json:"message"`
+}
+
+// Usage reports token counts.
+type Usage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+	TotalTokens  int `json:"totalTokens"`
+}
+
+// Metrics reports the request latency.
+type Metrics struct {
+	LatencyMs int64 `json:"latencyMs"`
+}
+
+// MessageStartEvent is the payload of a messageStart event.
+type MessageStartEvent struct {
+	Role string `json:"role"`
+}
+
+// ContentBlockDeltaEvent is the payload of a contentBlockDelta event.
+type ContentBlockDeltaEvent struct {
+	ContentBlockIndex int `json:"contentBlockIndex"`
+	Delta             struct {
+		Text string `json:"text"`
+	} `json:"delta"`
+}
+
+// ContentBlockStopEvent is the payload of a contentBlockStop event.
+type ContentBlockStopEvent struct {
+	ContentBlockIndex int `json:"contentBlockIndex"`
+}
+
+// MessageStopEvent is the payload of a messageStop event.
+type MessageStopEvent struct {
+	StopReason string `json:"stopReason"`
+}
+
+// MetadataEvent is the payload of the final metadata event.
+type MetadataEvent struct {
+	Usage   Usage   `json:"usage"`
+	Metrics Metrics `json:"metrics"`
+}
+
+// ErrorResponse is the body of a Bedrock error; its type is carried in the
+// X-Amzn-ErrorType header.
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,173 @@
+package adapter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+)
+
+// attempt is one try of a request at a target of its route's fallback chain.
+// While it may still fall back, a watchdog cancels it when it exceeds the
+// route's timeouts; once output is about to be sent it is committed and the
+// watchdog stopped.
+type attempt struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	parent context.Context
+	// target is the route tried, nil for unrouted requests.
+	target *routes.Target
+	// triggers are the failures that move the request on; nil when this is
+	// the last target.
+	triggers *routes.Triggers
+	start    time.Time
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired string
+}
+
+func newAttempt(parent context.Context, target *routes.Target, triggers *routes.Triggers) *attempt {
+	ctx, cancel := context.WithCancel(parent)
+	return &attempt{ctx: ctx, cancel: cancel, parent: parent, target: target, triggers: triggers, start: time.Now()}
+}
+
+// begin starts the watchdog. Timeout bounds a blocking attempt, or a
+// streaming one until its stream opens; FirstToken bounds a streaming
+// attempt until its first answer, and so its opening too.
+func (t *attempt) begin(stream bool) {
+	if t.triggers == nil {
+		return
+	}
+	timeout, firstToken := time.Duration(t.triggers.Timeout), time.Duration(t.triggers.FirstToken)
+	if stream && firstToken > 0 && (timeout <= 0 || firstToken < timeout) {
+		t.watch(firstToken, "first token timeout")
+		return
+	}
+	t.watch(timeout, "timeout")
+}
+
+// watch replaces the watchdog with one cancelling the attempt, for reason,
+// once d has passed since it started. d <= 0 only stops the watchdog.
+func (t *attempt) watch(d time.Duration, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if d <= 0 || t.expired != "" {
+		return
+	}
+	t.timer = time.AfterFunc(d-time.Since(t.start), func() {
+		t.mu.Lock()
+		t.expired = reason
+		t.mu.Unlock()
+		t.cancel()
+	})
+}
+
+// commit stops the watchdog before output is sent. It returns false if the
+// attempt has already timed out.
+func (t *attempt) commit() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t.expired == ""
+}
+
+// fallback reports whether err, which ended the attempt, moves the request to
+// the next target, and why. Nothing falls back once the request itself is
+// cancelled or out of time.
+func (t *attempt) fallback(err error) (string, bool) {
+	if t.triggers == nil || t.parent.Err() != nil {
+		return "", false
+	}
+	t.mu.Lock()
+	expired := t.expired
+	t.mu.Unlock()
+	if expired != "" {
+		return expired, true
+	}
+	return t.triggers.Match(err)
+}
+
+// name returns the model of the target tried, "" for unrouted requests.
+func (t *attempt) name() string {
+	if t.target == nil {
+		return ""
+	}
+	return t.target.Model
+}
+
+// served names the target serving the request in the response headers.
+func (t *attempt) served(w http.ResponseWriter) {
+	if name := t.name(); name != "" {
+		w.Header().Set(routes.Header, name)
+	}
+}
+
+// awaitAnswer holds stream back until its first answer event, so that a
+// failure before it can still fall back, and returns a stream replaying
+// every event read. An error before the answer is returned instead. Streams
+// that cannot fall back are returned as they are.
+func (t *attempt) awaitAnswer(stream <-chan dify.StreamEvent) (<-chan dify.StreamEvent, error) {
+	if t.triggers == nil {
+		return stream, nil
+	}
+	t.watch(time.Duration(t.triggers.FirstToken), "first token timeout")
+	var held []dify.StreamEvent
+	for ev := range stream {
+		if ev.Err != nil {
+			go drainEvents(stream)
+			return nil, ev.Err
+		}
+		if ev.Event == "error" {
+			go drainEvents(stream)
+			return nil, dify.EventError(ev)
+		}
+		held = append(held, ev)
+		if isAnswer(ev) {
+			break
+		}
+	}
+	if !t.commit() {
+		go drainEvents(stream)
+		return nil, t.ctx.Err()
+	}
+	out := make(chan dify.StreamEvent, len(held))
+	for _, ev := range held {
+		out <- ev
+	}
+	go func() {
+		defer close(out)
+		for ev := range stream {
+			select {
+			case out <- ev:
+			case <-t.ctx.Done():
+				drainEvents(stream)
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// isAnswer reports whether ev is output the caller would see.
+func isAnswer(ev dify.StreamEvent) bool {
+	switch ev.Event {
+	case "message", "agent_message", "message_replace", "message_end":
+		return true
+	}
+	return false
+}
+
+func drainEvents(stream <-chan dify.StreamEvent) {
+	for range stream {
+	}
+}
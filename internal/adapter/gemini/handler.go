@@ -1,96 +1,154 @@
 package gemini
 
 import (
-	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
-	"time"
 
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	"github.com/zhengjr9/dify-agent/internal/admission"
 	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
-	"github.com/zhengjr9/dify-agent/internal/dify"
 	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
 )
 
-// Handler implements the Gemini generateContent / streamGenerateContent endpoints.
-type Handler struct {
-	client      *dify.Client
-	defaultUser string
-	timeout     time.Duration
-}
+// Protocol is the name Adapter is registered under in the pipeline.
+const Protocol = "gemini"
+
+// Adapter implements the Gemini generateContent and streamGenerateContent
+// endpoints. Streaming is selected by the method in the URL path.
+type Adapter struct{}
 
-// NewHandler constructs a Handler.
-func NewHandler(client *dify.Client, defaultUser string, timeout time.Duration) *Handler {
-	return &Handler{client: client, defaultUser: defaultUser, timeout: timeout}
+// NewAdapter constructs an Adapter.
+func NewAdapter() *Adapter {
+	return &Adapter{}
 }
 
-// serveHTTP handles both generateContent and streamGenerateContent.
-func (h *Handler) serveHTTP(w http.ResponseWriter, r *http.Request, streaming bool) {
-	creds := httputil.ExtractCredentials(r, h.defaultUser)
-	if creds.APIKey == "" {
-		apierrors.WriteJSONError(w, http.StatusUnauthorized, "missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
-		return
+// ExtractAPIKey implements adapter.Adapter.
+func (a *Adapter) ExtractAPIKey(r *http.Request, _ *adapter.Request) (string, error) {
+	if key := httputil.ExtractCredentials(r).APIKey; key != "" {
+		return key, nil
 	}
+	return "", errMissingKey
+}
 
-	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
-	defer cancel()
-
-	difyReq, isStream, err := ToDifyRequest(ctx, r, creds.User, streaming)
+// Decode implements adapter.Adapter. Native is the StreamFormat requested by
+// the alt query parameter; blocking calls detect moderation.
+func (a *Adapter) Decode(r *http.Request) (*adapter.Request, error) {
+	var req GenerateContentRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+	out, err := decode(&req, modelFromPath(r.URL.Path))
 	if err != nil {
-		apierrors.WriteJSONError(w, http.StatusBadRequest, err.Error())
-		return
+		return nil, err
 	}
+	out.Params.Stream = strings.HasSuffix(r.URL.Path, ":streamGenerateContent")
+	out.Native = StreamFormatFor(r)
+	out.Params.DetectModeration = true
+	return out, nil
+}
+
+// WriteBlocking implements adapter.Adapter.
+func (a *Adapter) WriteBlocking(w http.ResponseWriter, req *adapter.Request, res *adapter.Result) error {
+	return WriteBlockingResponse(w, res.Responses, req.Model, res.Usage, res.Limiters, req.Tools)
+}
 
-	if isStream {
-		stream, err := h.client.SendStreaming(ctx, creds.APIKey, difyReq)
-		if err != nil {
-			writeUpstreamError(w, err)
-			return
-		}
+// WriteStream implements adapter.Adapter.
+func (a *Adapter) WriteStream(w http.ResponseWriter, req *adapter.Request, s *adapter.Stream) error {
+	format := req.Native.(StreamFormat)
+	if format == StreamSSE {
 		httputil.SetSSEHeaders(w)
-		if err := WriteStreamingResponse(w, stream); err != nil {
-			return
-		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return WriteStreamingResponse(w, s.Events, format, req.Model, s.UsageFor, s.Limiters, req.Tools)
+}
+
+// WriteError implements adapter.Adapter.
+func (a *Adapter) WriteError(w http.ResponseWriter, status int, msg string) {
+	apierrors.WriteJSONError(w, status, msg)
+}
+
+// Handler routes the Gemini model methods: generation to the pipeline and
+// token counting locally.
+type Handler struct {
+	generate http.Handler
+	users    *identity.Resolver
+	tokens   *tokenizer.Set
+	routes   *routes.Table
+	control  *admission.Controller
+}
+
+// NewHandler constructs a Handler. generate serves generateContent and
+// streamGenerateContent, usually the pipeline's handler for Adapter. Token
+// counting counts against the budgets and rate limits enforced by control.
+func NewHandler(generate http.Handler, users *identity.Resolver, tokens *tokenizer.Set, routes *routes.Table, control *admission.Controller) *Handler {
+	return &Handler{generate: generate, users: users, tokens: tokens, routes: routes, control: control}
+}
+
+// countTokens handles POST /v1beta/models/{model}:countTokens locally. The
+// request still counts against the caller's requests per minute.
+func (h *Handler) countTokens(w http.ResponseWriter, r *http.Request) {
+	creds := httputil.ExtractCredentials(r)
+	if creds.APIKey == "" && !creds.Authenticated() {
+		apierrors.WriteJSONError(w, http.StatusUnauthorized, errMissingKey.Error())
 		return
 	}
 
-	resp, err := h.client.SendBlocking(ctx, creds.APIKey, difyReq)
+	var req CountTokensRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	g := req.GenerateContentRequest
+	if g == nil {
+		g = &GenerateContentRequest{Contents: req.Contents}
+	}
+	model := modelFromPath(r.URL.Path)
+	canon, err := decode(g, model)
 	if err != nil {
-		writeUpstreamError(w, err)
+		apierrors.WriteJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if err := WriteBlockingResponse(w, resp); err != nil {
-		apierrors.WriteJSONError(w, http.StatusInternalServerError, "failed to write response")
+	target, _ := h.routes.Lookup(model)
+	ticket, _, err := h.control.Admit(admission.Request{Creds: creds, User: h.users.Resolve(r, ""), Model: model, Route: target})
+	if err != nil {
+		admission.SetRetryAfter(w.Header(), err)
+		apierrors.WriteJSONError(w, http.StatusTooManyRequests, err.Error())
+		return
 	}
+	defer ticket.Settle()
+
+	out := CountTokensResponse{TotalTokens: h.tokens.For(model).Count(canon.Query())}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
 }
 
-// Dispatch routes to blocking or streaming based on the URL path suffix.
+// Dispatch routes to generation or token counting based on the URL path suffix.
 func (h *Handler) Dispatch(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	switch {
-	case strings.HasSuffix(path, ":streamGenerateContent"):
-		h.serveHTTP(w, r, true)
-	case strings.HasSuffix(path, ":generateContent"):
-		h.serveHTTP(w, r, false)
+	case strings.HasSuffix(path, ":streamGenerateContent"), strings.HasSuffix(path, ":generateContent"):
+		h.generate.ServeHTTP(w, r)
+	case strings.HasSuffix(path, ":countTokens"):
+		h.countTokens(w, r)
 	default:
 		http.NotFound(w, r)
 	}
 }
 
-// HandleBlocking serves POST /v1beta/models/{model}:generateContent.
-func (h *Handler) HandleBlocking(w http.ResponseWriter, r *http.Request) {
-	h.serveHTTP(w, r, false)
-}
-
-// HandleStreaming serves POST /v1beta/models/{model}:streamGenerateContent.
-func (h *Handler) HandleStreaming(w http.ResponseWriter, r *http.Request) {
-	h.serveHTTP(w, r, true)
-}
+var errMissingKey = errors.New("missing API key: provide x-goog-api-key header, key query parameter or Authorization: Bearer <key>")
 
-func writeUpstreamError(w http.ResponseWriter, err error) {
-	msg := err.Error()
-	if strings.Contains(msg, "context deadline exceeded") || strings.Contains(msg, "timeout") {
-		apierrors.WriteJSONError(w, http.StatusGatewayTimeout, "upstream timeout")
-		return
+// modelFromPath extracts {model} from /v1beta/models/{model}:{method}.
+func modelFromPath(path string) string {
+	name := path[strings.LastIndex(path, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[:i]
 	}
-	apierrors.WriteJSONError(w, http.StatusBadGateway, "upstream error: "+msg)
+	return name
 }
@@ -1,130 +1,391 @@
 package gemini
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/zhengjr9/dify-agent/internal/adapter"
 	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+	"github.com/zhengjr9/dify-agent/internal/toolcall"
 )
 
-// ToDifyRequest converts a Gemini generateContent request to a Dify ChatRequest.
-// streaming indicates whether the request was to the streamGenerateContent endpoint.
-func ToDifyRequest(ctx context.Context, r *http.Request, defaultUser string, streaming bool) (*dify.ChatRequest, bool, error) {
-	var req GenerateContentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, false, fmt.Errorf("decode body: %w", err)
-	}
+// decode converts a decoded generateContent request for model to a canonical
+// request.
+func decode(req *GenerateContentRequest, model string) (*adapter.Request, error) {
 	if len(req.Contents) == 0 {
-		return nil, false, fmt.Errorf("contents must not be empty")
+		return nil, fmt.Errorf("contents must not be empty")
 	}
-
-	query := flattenContents(req.Contents, req.SystemInstruction)
-
-	difyReq := &dify.ChatRequest{
-		Inputs: map[string]any{},
-		Query:  query,
-		User:   defaultUser,
+	out := &adapter.Request{
+		Model:    model,
+		Messages: make([]adapter.Message, len(req.Contents)),
+		Tools:    toolSpec(req),
+		Params:   adapter.Params{Inputs: req.InputParams()},
 	}
-
-	return difyReq, streaming, nil
-}
-
-// flattenContents converts Gemini contents into a single query string.
-func flattenContents(contents []Content, sys *SystemInstruction) string {
-	var sb strings.Builder
-
-	if sys != nil && len(sys.Parts) > 0 {
-		sb.WriteString("system: ")
-		sb.WriteString(joinParts(sys.Parts))
-		sb.WriteString("\n")
+	if gc := req.GenerationConfig; gc != nil {
+		out.Params.Stop, out.Params.MaxTokens, out.Params.N = gc.StopSequences, gc.MaxOutputTokens, gc.CandidateCount
 	}
-
-	if len(contents) == 1 {
-		text := joinParts(contents[0].Parts)
-		if sb.Len() > 0 {
-			sb.WriteString(text)
-			return sb.String()
-		}
-		return text
+	if sys := req.SystemInstruction; sys != nil && len(sys.Parts) > 0 {
+		out.System = []string{joinParts(sys.Parts)}
 	}
-
-	last := contents[len(contents)-1]
-	prior := contents[:len(contents)-1]
-	for _, c := range prior {
+	for i, c := range req.Contents {
 		role := c.Role
 		if role == "model" {
 			role = "assistant"
 		}
-		sb.WriteString(role)
-		sb.WriteString(": ")
-		sb.WriteString(joinParts(c.Parts))
-		sb.WriteString("\n")
+		out.Messages[i] = adapter.Text(role, joinParts(c.Parts))
 	}
-	sb.WriteString(joinParts(last.Parts))
-	return sb.String()
+	return out, nil
 }
 
 func joinParts(parts []Part) string {
 	texts := make([]string, 0, len(parts))
 	for _, p := range parts {
-		texts = append(texts, p.Text)
+		switch {
+		case p.FunctionCall != nil:
+			texts = append(texts, toolcall.FormatCall(p.FunctionCall.Name, p.FunctionCall.Args))
+		case p.FunctionResponse != nil:
+			texts = append(texts, toolcall.FormatResult(p.FunctionResponse.Name, p.FunctionResponse.Response))
+		default:
+			texts = append(texts, p.Text)
+		}
 	}
 	return strings.Join(texts, "")
 }
 
-// WriteBlockingResponse encodes a Dify blocking response as a Gemini GenerateContentResponse.
-func WriteBlockingResponse(w http.ResponseWriter, resp *dify.BlockingResponse) error {
+// toolSpec returns the functions offered by req under its toolConfig, or nil
+// when function calling is not in use.
+func toolSpec(req *GenerateContentRequest) *toolcall.Spec {
+	var funcs []toolcall.Function
+	for _, t := range req.Tools {
+		for _, d := range t.FunctionDeclarations {
+			params := d.Parameters
+			if len(params) == 0 {
+				params = d.ParametersJSONSchema
+			}
+			funcs = append(funcs, toolcall.Function{Name: d.Name, Description: d.Description, Parameters: params})
+		}
+	}
+	mode, allowed := toolcall.ModeAuto, []string(nil)
+	if tc := req.ToolConfig; tc != nil && tc.FunctionCallingConfig != nil {
+		switch strings.ToUpper(tc.FunctionCallingConfig.Mode) {
+		case "ANY":
+			mode = toolcall.ModeAny
+		case "NONE":
+			mode = toolcall.ModeNone
+		}
+		allowed = tc.FunctionCallingConfig.AllowedFunctionNames
+	}
+	return toolcall.NewSpec(funcs, mode, allowed)
+}
+
+// responseParts builds candidate parts from answer text and parsed calls.
+func responseParts(text string, calls []toolcall.Call) []Part {
+	var parts []Part
+	if text != "" || len(calls) == 0 {
+		parts = append(parts, Part{Text: text})
+	}
+	for _, c := range calls {
+		parts = append(parts, Part{FunctionCall: &FunctionCall{Name: c.Name, Args: c.Args}})
+	}
+	return parts
+}
+
+// WriteBlockingResponse encodes Dify blocking responses, one per candidate, as
+// a Gemini GenerateContentResponse. Each finish reason is derived from the
+// limiter applied to that answer; tool call blocks offered by tools are
+// returned as functionCall parts.
+//
+// An answer replaced by output moderation is reported as WriteStreamingResponse
+// does: its candidate has no content and finishReason SAFETY, and when every
+// candidate was replaced before producing any text the prompt is reported as
+// blocked via promptFeedback instead.
+func WriteBlockingResponse(w http.ResponseWriter, resps []*dify.BlockingResponse, model string, usage tokenizer.Usage, lims []*enforce.Limiter, tools *toolcall.Spec) error {
 	out := GenerateContentResponse{
-		Candidates: []Candidate{
-			{
-				Content: Content{
-					Role:  "model",
-					Parts: []Part{{Text: resp.Answer}},
-				},
-				FinishReason: "STOP",
-				Index:        0,
-			},
-		},
+		UsageMetadata: toUsageMetadata(usage),
+		ModelVersion:  model,
+		ResponseID:    resps[0].MessageID,
+	}
+	blocked := true
+	for _, resp := range resps {
+		if !resp.Blocked {
+			blocked = false
+		}
+	}
+	if blocked {
+		out.PromptFeedback = &PromptFeedback{BlockReason: "SAFETY"}
+		resps = nil
+	}
+	for i, resp := range resps {
+		cand := Candidate{
+			Content:      Content{Role: "model", Parts: []Part{}},
+			FinishReason: "SAFETY",
+			Index:        i,
+		}
+		if !resp.Moderated {
+			text, calls := tools.Parse(resp.Answer)
+			cand.Content.Parts, cand.FinishReason = responseParts(text, calls), toFinishReason(lims[i])
+		}
+		out.Candidates = append(out.Candidates, cand)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	return json.NewEncoder(w).Encode(out)
 }
 
-// WriteStreamingResponse encodes Dify stream events as Gemini SSE JSON payloads.
-func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent) error {
+// StreamFormat selects how streamGenerateContent frames its chunks.
+type StreamFormat int
+
+const (
+	// StreamJSONArray writes the chunks as elements of one streamed JSON
+	// array. It is the default when the request has no alt parameter.
+	StreamJSONArray StreamFormat = iota
+	// StreamSSE writes each chunk as an SSE data line (alt=sse).
+	StreamSSE
+)
+
+// StreamFormatFor returns the format requested by r's alt query parameter.
+func StreamFormatFor(r *http.Request) StreamFormat {
+	if r.URL.Query().Get("alt") == "sse" {
+		return StreamSSE
+	}
+	return StreamJSONArray
+}
+
+// WriteStreamingResponse encodes Dify stream events as Gemini stream chunks in
+// the given format, with StreamEvent.Index as the candidate index; there is
+// one candidate per entry of lims. usageFor is called per candidate once the
+// stream ends; the merged usage is sent as the usageMetadata of a final chunk
+// carrying each candidate's finishReason from its limiter.
+//
+// A Dify message_replace event means output moderation replaced the answer.
+// If text was already streamed the candidate's finishReason is SAFETY; if no
+// candidate streamed anything the prompt itself is reported as blocked via
+// promptFeedback. The preset replacement text is not forwarded, matching
+// Gemini's own safety stops.
+//
+// With tools, text is streamed until a tool call block starts; the calls are
+// sent as functionCall parts once the answer is complete.
+//
+// An upstream error ends the stream and is returned. A JSON array is then
+// closed with an element carrying the error, as Google does, so that it
+// still parses.
+func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent, format StreamFormat, model string, usageFor func(metadata map[string]any, answer string) tokenizer.Usage, lims []*enforce.Limiter, tools *toolcall.Spec) error {
+	cw := &chunkWriter{w: w, format: format}
+	cands := make([]candidateStream, len(lims))
+	for i := range cands {
+		cands[i].scanner = tools.NewScanner()
+	}
+	var responseID string
 	for ev := range stream {
 		if ev.Err != nil {
-			return ev.Err
+			return cw.fail(ev.Err)
+		}
+		if responseID == "" {
+			responseID = ev.MessageID
 		}
-		if ev.Event != "message" && ev.Event != "agent_message" {
+		c := &cands[ev.Index]
+		switch ev.Event {
+		case "message_end":
+			c.metadata = ev.Metadata
+			continue
+		case "message_replace":
+			c.replaced = true
+			continue
+		case "error":
+			return cw.fail(dify.EventError(ev))
+		case "message", "agent_message":
+		default:
 			continue
 		}
-
-		chunk := StreamResponse{
-			Candidates: []Candidate{
-				{
-					Content: Content{
-						Role:  "model",
-						Parts: []Part{{Text: ev.Answer}},
-					},
-					FinishReason: "",
-					Index:        0,
-				},
-			},
+		if c.replaced {
+			continue
 		}
-		data, err := json.Marshal(chunk)
-		if err != nil {
-			return fmt.Errorf("marshal chunk: %w", err)
+		c.answer.WriteString(ev.Answer)
+
+		text := c.scanner.Push(ev.Answer)
+		if text == "" {
+			continue
 		}
-		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		if err := cw.write(contentChunk(ev.Index, []Part{{Text: text}}, model, responseID)); err != nil {
 			return err
 		}
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+	}
+
+	var usage tokenizer.Usage
+	blocked := true
+	for i := range cands {
+		c := &cands[i]
+		usage = usage.Merge(usageFor(c.metadata, c.answer.String()))
+		if !c.replaced || c.answer.Len() > 0 {
+			blocked = false
 		}
+		if c.replaced {
+			continue
+		}
+		text, calls := c.scanner.Finish()
+		if text != "" || len(calls) > 0 {
+			if err := cw.write(contentChunk(i, responseParts(text, calls), model, responseID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	meta := toUsageMetadata(usage)
+	final := StreamResponse{
+		UsageMetadata: &meta,
+		ModelVersion:  model,
+		ResponseID:    responseID,
+	}
+	if blocked {
+		final.PromptFeedback = &PromptFeedback{BlockReason: "SAFETY"}
+	} else {
+		for i, c := range cands {
+			reason := toFinishReason(lims[i])
+			if c.replaced {
+				reason = "SAFETY"
+			}
+			final.Candidates = append(final.Candidates, Candidate{
+				Content:      Content{Role: "model", Parts: []Part{}},
+				FinishReason: reason,
+				Index:        i,
+			})
+		}
+	}
+	if err := cw.write(final); err != nil {
+		return err
+	}
+	return cw.close()
+}
+
+// candidateStream is the per-candidate state of WriteStreamingResponse.
+type candidateStream struct {
+	answer   strings.Builder
+	metadata map[string]any
+	scanner  *toolcall.Scanner
+	replaced bool
+}
+
+func contentChunk(index int, parts []Part, model, responseID string) StreamResponse {
+	return StreamResponse{
+		Candidates: []Candidate{
+			{
+				Content:      Content{Role: "model", Parts: parts},
+				FinishReason: "",
+				Index:        index,
+			},
+		},
+		ModelVersion: model,
+		ResponseID:   responseID,
+	}
+}
+
+// chunkWriter frames stream chunks as SSE events or JSON array elements,
+// flushing after each one.
+type chunkWriter struct {
+	w      http.ResponseWriter
+	format StreamFormat
+	n      int
+}
+
+func (c *chunkWriter) write(chunk any) error {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return fmt.Errorf("marshal chunk: %w", err)
+	}
+	switch {
+	case c.format == StreamSSE:
+		_, err = fmt.Fprintf(c.w, "data: %s\n\n", data)
+	case c.n == 0:
+		_, err = fmt.Fprintf(c.w, "[%s", data)
+	default:
+		_, err = fmt.Fprintf(c.w, ",\r\n%s", data)
+	}
+	if err != nil {
+		return err
 	}
+	c.n++
+	c.flush()
 	return nil
 }
+
+// fail ends a JSON array with an element describing err and returns err. For
+// SSE it only returns err.
+func (c *chunkWriter) fail(err error) error {
+	if c.format == StreamSSE {
+		return err
+	}
+	e := ErrorStatus{Code: http.StatusBadGateway, Message: "upstream error: " + err.Error()}
+	var apiErr *dify.APIError
+	if errors.As(err, &apiErr) && apiErr.Status >= 400 {
+		e.Code = apiErr.Status
+	}
+	e.Status = statusName(e.Code)
+	if c.write(StreamError{Error: e}) == nil {
+		_ = c.close()
+	}
+	return err
+}
+
+// close terminates the JSON array; it is a no-op for SSE.
+func (c *chunkWriter) close() error {
+	if c.format == StreamSSE {
+		return nil
+	}
+	tail := "]"
+	if c.n == 0 {
+		tail = "[]"
+	}
+	if _, err := fmt.Fprint(c.w, tail); err != nil {
+		return err
+	}
+	c.flush()
+	return nil
+}
+
+func (c *chunkWriter) flush() {
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// statusName returns the canonical status name Google reports with an HTTP
+// status code.
+func statusName(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	return "INTERNAL"
+}
+
+func toUsageMetadata(u tokenizer.Usage) UsageMetadata {
+	return UsageMetadata{
+		PromptTokenCount:     u.PromptTokens,
+		CandidatesTokenCount: u.CompletionTokens,
+		TotalTokenCount:      u.Total(),
+		Estimated:            u.Estimated,
+	}
+}
+
+func toFinishReason(lim *enforce.Limiter) string {
+	if lim.Reason() == enforce.ReasonMaxTokens {
+		return "MAX_TOKENS"
+	}
+	return "STOP"
+}
@@ -1,9 +1,73 @@
 package gemini
 
+import (
+	"encoding/json"
+
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+)
+
 // GenerateContentRequest mirrors the Gemini generateContent request body.
 type GenerateContentRequest struct {
-	Contents         []Content         `json:"contents"`
+	Contents          []Content          `json:"contents"`
 	SystemInstruction *SystemInstruction `json:"system_instruction,omitempty"`
+	GenerationConfig  *GenerationConfig  `json:"generationConfig,omitempty"`
+	Tools             []Tool             `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig        `json:"toolConfig,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The REST docs use
+// system_instruction while the google-genai SDKs send systemInstruction;
+// both are accepted.
+func (r *GenerateContentRequest) UnmarshalJSON(data []byte) error {
+	type plain GenerateContentRequest
+	var aux struct {
+		plain
+		SystemInstructionCamel *SystemInstruction `json:"systemInstruction"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*r = GenerateContentRequest(aux.plain)
+	if r.SystemInstruction == nil {
+		r.SystemInstruction = aux.SystemInstructionCamel
+	}
+	return nil
+}
+
+// GenerationConfig carries generation parameters. StopSequences and
+// MaxOutputTokens are enforced by the proxy; each of CandidateCount
+// candidates is a separate Dify request. The sampling parameters reach Dify
+// only as inputs, through the apps mapping; see InputParams.
+type GenerationConfig struct {
+	StopSequences    []string `json:"stopSequences,omitempty"`
+	MaxOutputTokens  int      `json:"maxOutputTokens,omitempty"`
+	CandidateCount   int      `json:"candidateCount,omitempty"`
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"topP,omitempty"`
+	TopK             *int     `json:"topK,omitempty"`
+	PresencePenalty  *float64 `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+}
+
+// InputParams returns the generation parameters that may be mapped onto Dify
+// inputs.
+func (r *GenerateContentRequest) InputParams() inputs.Params {
+	p := inputs.Params{}
+	gc := r.GenerationConfig
+	if gc == nil {
+		return p
+	}
+	inputs.Set(p, "temperature", gc.Temperature)
+	inputs.Set(p, "top_p", gc.TopP)
+	inputs.Set(p, "top_k", gc.TopK)
+	inputs.Set(p, "presence_penalty", gc.PresencePenalty)
+	inputs.Set(p, "frequency_penalty", gc.FrequencyPenalty)
+	inputs.Set(p, "seed", gc.Seed)
+	if gc.MaxOutputTokens > 0 {
+		p["max_tokens"] = gc.MaxOutputTokens
+	}
+	return p
 }
 
 // Content is a single turn in a Gemini conversation.
@@ -12,9 +76,64 @@ type Content struct {
 	Parts []Part `json:"parts"`
 }
 
-// Part carries text content.
+// Part carries text content, a function call made by the model, or the
+// caller's response to one.
 type Part struct {
-	Text string `json:"text"`
+	Text             string            `json:"text,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. A text part always carries text,
+// even an empty answer, as clients tell parts apart by their fields.
+func (p Part) MarshalJSON() ([]byte, error) {
+	type plain Part
+	if p.FunctionCall == nil && p.FunctionResponse == nil {
+		return json.Marshal(struct {
+			Text string `json:"text"`
+		}{p.Text})
+	}
+	return json.Marshal(plain(p))
+}
+
+// FunctionCall is a function call predicted by the model.
+type FunctionCall struct {
+	ID   string         `json:"id,omitempty"`
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// FunctionResponse is the result of a FunctionCall sent back by the caller.
+type FunctionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+// Tool declares functions the model may call.
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+// FunctionDeclaration describes one callable function. Parameters is an
+// OpenAPI schema object; ParametersJSONSchema a JSON Schema alternative.
+type FunctionDeclaration struct {
+	Name                 string          `json:"name"`
+	Description          string          `json:"description,omitempty"`
+	Parameters           json.RawMessage `json:"parameters,omitempty"`
+	ParametersJSONSchema json.RawMessage `json:"parametersJsonSchema,omitempty"`
+}
+
+// ToolConfig configures how declared tools are used.
+type ToolConfig struct {
+	FunctionCallingConfig *FunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
+// FunctionCallingConfig selects the calling mode (AUTO, ANY or NONE) and
+// optionally restricts the functions that may be called.
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
 }
 
 // SystemInstruction carries the system prompt.
@@ -24,8 +143,16 @@ type SystemInstruction struct {
 
 // GenerateContentResponse is the Gemini blocking response format.
 type GenerateContentResponse struct {
-	Candidates    []Candidate   `json:"candidates"`
-	UsageMetadata UsageMetadata `json:"usageMetadata"`
+	Candidates     []Candidate     `json:"candidates"`
+	PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  UsageMetadata   `json:"usageMetadata"`
+	ModelVersion   string          `json:"modelVersion,omitempty"`
+	ResponseID     string          `json:"responseId,omitempty"`
+}
+
+// PromptFeedback reports why a prompt was blocked.
+type PromptFeedback struct {
+	BlockReason string `json:"blockReason,omitempty"`
 }
 
 // Candidate is one response candidate.
@@ -35,15 +162,47 @@ type Candidate struct {
 	Index        int     `json:"index"`
 }
 
-// UsageMetadata carries token counts.
+// UsageMetadata carries token counts. Estimated is set when the counts were
+// computed locally because Dify did not report usage.
 type UsageMetadata struct {
-	PromptTokenCount     int `json:"promptTokenCount"`
-	CandidatesTokenCount int `json:"candidatesTokenCount"`
-	TotalTokenCount      int `json:"totalTokenCount"`
+	PromptTokenCount     int  `json:"promptTokenCount"`
+	CandidatesTokenCount int  `json:"candidatesTokenCount"`
+	TotalTokenCount      int  `json:"totalTokenCount"`
+	Estimated            bool `json:"estimated,omitempty"`
 }
 
-// StreamResponse wraps a single SSE payload for Gemini streaming.
+// CountTokensRequest is the body of POST /v1beta/models/{model}:countTokens.
+// Either Contents or GenerateContentRequest is set.
+type CountTokensRequest struct {
+	Contents               []Content               `json:"contents,omitempty"`
+	GenerateContentRequest *GenerateContentRequest `json:"generateContentRequest,omitempty"`
+}
+
+// CountTokensResponse is the countTokens response body.
+type CountTokensResponse struct {
+	TotalTokens int `json:"totalTokens"`
+}
+
+// StreamResponse wraps a single SSE payload for Gemini streaming. Candidates
+// is empty when the prompt was blocked.
 type StreamResponse struct {
-	Candidates    []Candidate   `json:"candidates"`
-	UsageMetadata *UsageMetadata `json:"usageMetadata,omitempty"`
+	Candidates     []Candidate     `json:"candidates,omitempty"`
+	PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  *UsageMetadata  `json:"usageMetadata,omitempty"`
+	ModelVersion   string          `json:"modelVersion,omitempty"`
+	ResponseID     string          `json:"responseId,omitempty"`
+}
+
+// StreamError is the last element of a JSON array stream that failed
+// upstream, in Google's error format.
+type StreamError struct {
+	Error ErrorStatus `json:"error"`
+}
+
+// ErrorStatus describes an error: its HTTP status code, message and
+// canonical status name such as INTERNAL.
+type ErrorStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
 }
@@ -0,0 +1,240 @@
+package ollama
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+)
+
+// Protocol is the name Adapter is registered under in the pipeline.
+const Protocol = "ollama"
+
+// Adapter implements the Ollama /api/chat and /api/generate endpoints; the
+// endpoint is selected by the URL path.
+//
+// Besides the usual headers, the Dify key may come from the app whose name
+// matches the requested model, or from the configured default key. Those are
+// the gateway's keys, lent only to callers it authenticated whose
+// credentials allow the model.
+type Adapter struct {
+	apps       *apps.Registry
+	defaultKey string
+}
+
+// NewAdapter constructs an Adapter. defaultKey is used for authenticated
+// callers when neither the request nor the apps registry supplies a Dify key.
+func NewAdapter(apps *apps.Registry, defaultKey string) *Adapter {
+	return &Adapter{apps: apps, defaultKey: defaultKey}
+}
+
+// ExtractAPIKey implements adapter.Adapter: the caller's credentials, else,
+// for an authenticated caller allowed the model, the key of the app named by
+// the model or the default key.
+func (a *Adapter) ExtractAPIKey(r *http.Request, req *adapter.Request) (string, error) {
+	creds := httputil.ExtractCredentials(r)
+	if creds.APIKey != "" {
+		return creds.APIKey, nil
+	}
+	if !creds.Authenticated() || !creds.Allows(req.Model) {
+		return "", errors.New("missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
+	}
+	if app, ok := a.apps.ByName(baseName(req.Model)); ok {
+		return app.APIKey, nil
+	}
+	if a.defaultKey != "" {
+		return a.defaultKey, nil
+	}
+	return "", errors.New("missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
+}
+
+// Decode implements adapter.Adapter. Native is the Frame of the endpoint. A
+// request without messages, or a generate request without a prompt, decodes
+// to a request without messages, which Ollama answers by loading the model.
+func (a *Adapter) Decode(r *http.Request) (*adapter.Request, error) {
+	if r.URL.Path == "/api/generate" {
+		var req GenerateRequest
+		if err := httputil.DecodeJSON(r, &req); err != nil {
+			return nil, fmt.Errorf("decode body: %w", err)
+		}
+		return decodeGenerate(&req)
+	}
+	var req ChatRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
+	}
+	return decodeChat(&req)
+}
+
+// WriteBlocking implements adapter.Adapter.
+func (a *Adapter) WriteBlocking(w http.ResponseWriter, req *adapter.Request, res *adapter.Result) error {
+	m := metrics(res.Usage, res.Limiters[0], res.Start, time.Time{})
+	return WriteBlockingResponse(w, res.Responses[0], req.Native.(Frame), m)
+}
+
+// WriteStream implements adapter.Adapter.
+func (a *Adapter) WriteStream(w http.ResponseWriter, req *adapter.Request, s *adapter.Stream) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return WriteStreamingResponse(w, s.Events, req.Native.(Frame), s.Start, s.UsageFor, s.Limiters[0])
+}
+
+// WriteError implements adapter.Adapter.
+func (a *Adapter) WriteError(w http.ResponseWriter, status int, msg string) {
+	writeError(w, status, msg)
+}
+
+// Handler implements the Ollama /api endpoints, running chat and generate
+// requests through the pipeline.
+type Handler struct {
+	pipeline *adapter.Pipeline
+	apps     *apps.Registry
+	routes   *routes.Table
+	started  time.Time
+}
+
+// NewHandler constructs a Handler. p must have an Adapter registered as
+// Protocol; apps and routes supply the model names listed by /api/tags.
+func NewHandler(p *adapter.Pipeline, apps *apps.Registry, routes *routes.Table) *Handler {
+	return &Handler{pipeline: p, apps: apps, routes: routes, started: time.Now()}
+}
+
+// Chat handles POST /api/chat.
+func (h *Handler) Chat(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r)
+}
+
+// Generate handles POST /api/generate.
+func (h *Handler) Generate(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	a, _ := h.pipeline.Adapter(Protocol)
+	req, err := a.Decode(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeJSON(w, req.Native.(Frame)("", &Metrics{DoneReason: "load"}))
+		return
+	}
+	h.pipeline.Serve(w, r, Protocol, req)
+}
+
+// Tags handles GET /api/tags, listing the routed models and registered apps
+// as models.
+func (h *Handler) Tags(w http.ResponseWriter, r *http.Request) {
+	out := TagsResponse{Models: []ModelInfo{}}
+	for _, name := range h.modelNames() {
+		out.Models = append(out.Models, ModelInfo{
+			Name:       name + ":latest",
+			Model:      name + ":latest",
+			ModifiedAt: h.started.UTC().Format(time.RFC3339Nano),
+			Digest:     digest(name),
+			Details:    details(),
+		})
+	}
+	writeJSON(w, out)
+}
+
+// Show handles POST /api/show.
+func (h *Handler) Show(w http.ResponseWriter, r *http.Request) {
+	var req ShowRequest
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	name := req.Model
+	if name == "" {
+		name = req.Name
+	}
+	if !h.knownModel(name) {
+		writeError(w, http.StatusNotFound, "model '"+name+"' not found")
+		return
+	}
+	desc := "Dify app"
+	if app, ok := h.apps.ByName(baseName(name)); ok && app.Description != "" {
+		desc = app.Description
+	}
+	writeJSON(w, ShowResponse{
+		Modelfile:    "# " + desc + "\nFROM " + baseName(name) + "\n",
+		Template:     "{{ .Prompt }}",
+		Details:      details(),
+		ModelInfo:    map[string]any{"general.architecture": "dify", "general.basename": baseName(name)},
+		Capabilities: []string{"completion", "vision"},
+		ModifiedAt:   h.started.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// Version handles GET /api/version.
+func (h *Handler) Version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"version": Version})
+}
+
+// Root handles GET /, which Ollama clients probe to detect a server.
+func (h *Handler) Root(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("Ollama is running"))
+}
+
+// modelNames lists the routed models and their aliases, then the registered
+// app names, or "dify" when there are none.
+func (h *Handler) modelNames() []string {
+	names := h.routes.Models()
+	for _, app := range h.apps.Apps() {
+		names = append(names, app.Name)
+	}
+	if len(names) == 0 {
+		names = []string{"dify"}
+	}
+	return names
+}
+
+// knownModel reports whether name is listed by /api/tags. Without routes or
+// registered apps every name is accepted, as any name reaches the caller's
+// app.
+func (h *Handler) knownModel(name string) bool {
+	if _, ok := h.routes.Lookup(baseName(name)); ok {
+		return true
+	}
+	if len(h.apps.Apps()) == 0 && len(h.routes.Routes()) == 0 {
+		return name != ""
+	}
+	_, ok := h.apps.ByName(baseName(name))
+	return ok
+}
+
+// baseName strips the :latest tag Ollama clients add to model names.
+func baseName(model string) string {
+	return strings.TrimSuffix(model, ":latest")
+}
+
+func digest(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func details() ModelDetails {
+	return ModelDetails{Format: "dify", Family: "dify", Families: []string{"dify"}}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+}
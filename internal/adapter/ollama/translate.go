@@ -0,0 +1,205 @@
+package ollama
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// decodeChat converts an /api/chat request to a canonical request.
+func decodeChat(req *ChatRequest) (*adapter.Request, error) {
+	out := &adapter.Request{
+		Model:    baseName(req.Model),
+		Messages: make([]adapter.Message, len(req.Messages)),
+		Params:   params(req.Stream, req.Options),
+		Native:   chatFrame(req.Model),
+	}
+	for i, m := range req.Messages {
+		images, err := decodeImages(m.Images)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d].%v", i, err)
+		}
+		out.Messages[i] = adapter.Message{Role: m.Role, Parts: append([]adapter.Part{{Text: m.Content}}, images...)}
+	}
+	return out, nil
+}
+
+// decodeGenerate converts an /api/generate request to a canonical request.
+// The system message becomes the system prompt.
+func decodeGenerate(req *GenerateRequest) (*adapter.Request, error) {
+	out := &adapter.Request{
+		Model:  baseName(req.Model),
+		Params: params(req.Stream, req.Options),
+		Native: generateFrame(req.Model),
+	}
+	if req.System != "" {
+		out.System = []string{req.System}
+	}
+	images, err := decodeImages(req.Images)
+	if err != nil {
+		return nil, err
+	}
+	if req.Prompt != "" || len(images) > 0 {
+		out.Messages = []adapter.Message{{Role: "user", Parts: append([]adapter.Part{{Text: req.Prompt}}, images...)}}
+	}
+	return out, nil
+}
+
+// params maps the stream flag, which defaults to true, and the options.
+func params(stream *bool, o *Options) adapter.Params {
+	return adapter.Params{
+		Stream:    stream == nil || *stream,
+		Stop:      o.StopSequences(),
+		MaxTokens: o.OutputLimit(),
+		Inputs:    o.InputParams(),
+	}
+}
+
+// decodeImages decodes base64 images, tolerating data URLs, into image parts.
+func decodeImages(images []string) ([]adapter.Part, error) {
+	out := make([]adapter.Part, len(images))
+	for i, img := range images {
+		if _, data, ok := strings.Cut(img, ";base64,"); ok && strings.HasPrefix(img, "data:") {
+			img = data
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(img))
+		if err != nil {
+			return nil, fmt.Errorf("images[%d]: invalid base64: %v", i, err)
+		}
+		out[i] = adapter.Part{Image: raw}
+	}
+	return out, nil
+}
+
+// Frame builds one response object of an endpoint. text is the streamed
+// delta, or the whole answer for a blocking response; m is non-nil on the
+// final object.
+type Frame func(text string, m *Metrics) any
+
+func chatFrame(model string) Frame {
+	return func(text string, m *Metrics) any {
+		out := ChatResponse{
+			Model:     model,
+			CreatedAt: timestamp(),
+			Message:   Message{Role: "assistant", Content: text},
+		}
+		if m != nil {
+			out.Done, out.Metrics = true, *m
+		}
+		return out
+	}
+}
+
+func generateFrame(model string) Frame {
+	return func(text string, m *Metrics) any {
+		out := GenerateResponse{
+			Model:     model,
+			CreatedAt: timestamp(),
+			Response:  text,
+		}
+		if m != nil {
+			out.Done, out.Metrics = true, *m
+		}
+		return out
+	}
+}
+
+// metrics fills the completion fields. firstToken is when the first text
+// arrived, or zero when unknown; the time before it counts as prompt
+// evaluation and the time after as generation.
+func metrics(usage tokenizer.Usage, lim *enforce.Limiter, start, firstToken time.Time) Metrics {
+	now := time.Now()
+	m := Metrics{
+		DoneReason:      doneReason(lim),
+		TotalDuration:   now.Sub(start).Nanoseconds(),
+		PromptEvalCount: usage.PromptTokens,
+		EvalCount:       usage.CompletionTokens,
+		EvalDuration:    now.Sub(start).Nanoseconds(),
+	}
+	if !firstToken.IsZero() {
+		m.PromptEvalDuration = firstToken.Sub(start).Nanoseconds()
+		m.EvalDuration = now.Sub(firstToken).Nanoseconds()
+	}
+	return m
+}
+
+func doneReason(lim *enforce.Limiter) string {
+	if lim.Reason() == enforce.ReasonMaxTokens {
+		return "length"
+	}
+	return "stop"
+}
+
+// WriteBlockingResponse encodes a Dify blocking response as a single Ollama
+// response object with done set.
+func WriteBlockingResponse(w http.ResponseWriter, resp *dify.BlockingResponse, frame Frame, m Metrics) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(frame(resp.Answer, &m))
+}
+
+// WriteStreamingResponse encodes Dify stream events as newline-delimited JSON
+// objects, Ollama's streaming format, ending with a done object that carries
+// the done reason from lim and the eval counts from usageFor. An upstream
+// error ends the stream with an error object instead, as Ollama does, and is
+// returned.
+func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent, frame Frame, start time.Time, usageFor func(metadata map[string]any, answer string) tokenizer.Usage, lim *enforce.Limiter) error {
+	var (
+		answer     strings.Builder
+		metadata   map[string]any
+		firstToken time.Time
+	)
+	enc := json.NewEncoder(w)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	fail := func(err error) error {
+		if enc.Encode(ErrorResponse{Error: "upstream error: " + err.Error()}) == nil {
+			flush()
+		}
+		return err
+	}
+	for ev := range stream {
+		if ev.Err != nil {
+			return fail(ev.Err)
+		}
+		switch ev.Event {
+		case "message_end":
+			metadata = ev.Metadata
+			continue
+		case "error":
+			return fail(dify.EventError(ev))
+		}
+		if ev.Event != "message" && ev.Event != "agent_message" {
+			continue
+		}
+		if firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+		answer.WriteString(ev.Answer)
+		if err := enc.Encode(frame(ev.Answer, nil)); err != nil {
+			return err
+		}
+		flush()
+	}
+
+	m := metrics(usageFor(metadata, answer.String()), lim, start, firstToken)
+	if err := enc.Encode(frame("", &m)); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,168 @@
+package ollama
+
+import (
+	"encoding/json"
+
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+)
+
+// Version is the Ollama version reported by /api/version. Clients gate
+// features on it, so it names a release whose chat API we implement.
+const Version = "0.9.0"
+
+// ChatRequest mirrors the Ollama /api/chat request body.
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	// Stream defaults to true when absent.
+	Stream    *bool           `json:"stream,omitempty"`
+	Options   *Options        `json:"options,omitempty"`
+	Format    json.RawMessage `json:"format,omitempty"`
+	KeepAlive json.RawMessage `json:"keep_alive,omitempty"`
+}
+
+// GenerateRequest mirrors the Ollama /api/generate request body.
+type GenerateRequest struct {
+	Model  string   `json:"model"`
+	Prompt string   `json:"prompt"`
+	System string   `json:"system,omitempty"`
+	Images []string `json:"images,omitempty"`
+	// Stream defaults to true when absent.
+	Stream    *bool           `json:"stream,omitempty"`
+	Options   *Options        `json:"options,omitempty"`
+	Format    json.RawMessage `json:"format,omitempty"`
+	KeepAlive json.RawMessage `json:"keep_alive,omitempty"`
+}
+
+// Message is a single Ollama chat message. Images are base64-encoded.
+type Message struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+// Options carries model parameters. Stop and NumPredict are enforced by the
+// proxy; the sampling parameters reach Dify only as inputs, through the apps
+// mapping.
+type Options struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	TopK             *int     `json:"top_k,omitempty"`
+	NumPredict       *int     `json:"num_predict,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+}
+
+// OutputLimit returns num_predict, where -1 (infinite) and -2 (fill the
+// context) mean no limit.
+func (o *Options) OutputLimit() int {
+	if o == nil || o.NumPredict == nil || *o.NumPredict < 0 {
+		return 0
+	}
+	return *o.NumPredict
+}
+
+// StopSequences returns the stop option.
+func (o *Options) StopSequences() []string {
+	if o == nil {
+		return nil
+	}
+	return o.Stop
+}
+
+// InputParams returns the options that may be mapped onto Dify inputs.
+func (o *Options) InputParams() inputs.Params {
+	p := inputs.Params{}
+	if o == nil {
+		return p
+	}
+	inputs.Set(p, "temperature", o.Temperature)
+	inputs.Set(p, "top_p", o.TopP)
+	inputs.Set(p, "top_k", o.TopK)
+	inputs.Set(p, "presence_penalty", o.PresencePenalty)
+	inputs.Set(p, "frequency_penalty", o.FrequencyPenalty)
+	inputs.Set(p, "seed", o.Seed)
+	if n := o.OutputLimit(); n > 0 {
+		p["max_tokens"] = n
+	}
+	return p
+}
+
+// Metrics are the completion fields of the final response object. Durations
+// are in nanoseconds.
+type Metrics struct {
+	DoneReason         string `json:"done_reason,omitempty"`
+	TotalDuration      int64  `json:"total_duration,omitempty"`
+	LoadDuration       int64  `json:"load_duration,omitempty"`
+	PromptEvalCount    int    `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64  `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int    `json:"eval_count,omitempty"`
+	EvalDuration       int64  `json:"eval_duration,omitempty"`
+}
+
+// ChatResponse is one /api/chat response object: a streamed chunk, or the
+// whole answer with stream set to false.
+type ChatResponse struct {
+	Model     string  `json:"model"`
+	CreatedAt string  `json:"created_at"`
+	Message   Message `json:"message"`
+	Done      bool    `json:"done"`
+	Metrics
+}
+
+// GenerateResponse is one /api/generate response object.
+type GenerateResponse struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Response  string `json:"response"`
+	Done      bool   `json:"done"`
+	Metrics
+}
+
+// ShowRequest is the /api/show request body. Older clients send name.
+type ShowRequest struct {
+	Model string `json:"model"`
+	Name  string `json:"name,omitempty"`
+}
+
+// ShowResponse is the /api/show response body.
+type ShowResponse struct {
+	Modelfile    string         `json:"modelfile"`
+	Parameters   string         `json:"parameters"`
+	Template     string         `json:"template"`
+	Details      ModelDetails   `json:"details"`
+	ModelInfo    map[string]any `json:"model_info"`
+	Capabilities []string       `json:"capabilities"`
+	ModifiedAt   string         `json:"modified_at"`
+}
+
+// TagsResponse is the /api/tags response body.
+type TagsResponse struct {
+	Models []ModelInfo `json:"models"`
+}
+
+// ModelInfo describes one model in /api/tags.
+type ModelInfo struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model"`
+	ModifiedAt string       `json:"modified_at"`
+	Size       int64        `json:"size"`
+	Digest     string       `json:"digest"`
+	Details    ModelDetails `json:"details"`
+}
+
+// ModelDetails describes a model's format and family.
+type ModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// ErrorResponse is Ollama's error body.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,98 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+)
+
+// Protocol is the name Adapter is registered under in the pipeline.
+const Protocol = "openai"
+
+// Adapter implements the OpenAI chat completions endpoint,
+// POST /v1/chat/completions.
+type Adapter struct{}
+
+// NewAdapter constructs an Adapter.
+func NewAdapter() *Adapter {
+	return &Adapter{}
+}
+
+// ExtractAPIKey implements adapter.Adapter.
+func (a *Adapter) ExtractAPIKey(r *http.Request, _ *adapter.Request) (string, error) {
+	if key := httputil.ExtractCredentials(r).APIKey; key != "" {
+		return key, nil
+	}
+	return "", errors.New("missing API key: provide X-Dify-Api-Key header or Authorization: Bearer <key>")
+}
+
+// Decode implements adapter.Adapter.
+func (a *Adapter) Decode(r *http.Request) (*adapter.Request, error) {
+	return decode(r)
+}
+
+// WriteBlocking implements adapter.Adapter.
+func (a *Adapter) WriteBlocking(w http.ResponseWriter, req *adapter.Request, res *adapter.Result) error {
+	return WriteBlockingResponse(w, res.Responses, req.EchoModel(), res.Usage, res.Limiters, false)
+}
+
+// WriteStream implements adapter.Adapter.
+func (a *Adapter) WriteStream(w http.ResponseWriter, req *adapter.Request, s *adapter.Stream) error {
+	return writeStream(w, req, s, req.EchoModel(), false)
+}
+
+// WriteError implements adapter.Adapter.
+func (a *Adapter) WriteError(w http.ResponseWriter, status int, msg string) {
+	apierrors.WriteJSONError(w, status, msg)
+}
+
+// SetRateLimitHeaders implements adapter.RateLimitReporter.
+func (a *Adapter) SetRateLimitHeaders(h http.Header, s ratelimit.Status) {
+	setRateLimitHeaders(h, s)
+}
+
+// setRateLimitHeaders sets OpenAI's x-ratelimit-* headers, whose resets are
+// durations such as "6m0s".
+func setRateLimitHeaders(h http.Header, s ratelimit.Status) {
+	for _, l := range []struct {
+		name string
+		w    ratelimit.Window
+	}{{"requests", s.Requests}, {"tokens", s.Tokens}} {
+		if l.w.Limit == 0 {
+			continue
+		}
+		h.Set("X-Ratelimit-Limit-"+l.name, strconv.Itoa(l.w.Limit))
+		h.Set("X-Ratelimit-Remaining-"+l.name, strconv.Itoa(l.w.Remaining))
+		h.Set("X-Ratelimit-Reset-"+l.name, l.w.Reset.Round(time.Millisecond).String())
+	}
+}
+
+// writeStream sends SSE headers and the stream. Usage is reported only when
+// the caller asked for it with stream_options.include_usage.
+func writeStream(w http.ResponseWriter, req *adapter.Request, s *adapter.Stream, model string, azure bool) error {
+	httputil.SetSSEHeaders(w)
+	o := req.Native.(*ChatCompletionRequest).StreamOptions
+	return WriteStreamingResponse(w, s.Events, model, s.UsageFor, o != nil && o.IncludeUsage, s.Limiters, azure)
+}
+
+// ModelsHandler returns a handler for GET /v1/models listing the routed
+// models and their aliases.
+func ModelsHandler(routes *routes.Table) http.HandlerFunc {
+	created := time.Now().Unix()
+	return func(w http.ResponseWriter, r *http.Request) {
+		out := ModelList{Object: "list", Data: []Model{}}
+		for _, name := range routes.Models() {
+			out.Data = append(out.Data, Model{ID: name, Object: "model", Created: created, OwnedBy: "dify"})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	}
+}
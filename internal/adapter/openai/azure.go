@@ -0,0 +1,113 @@
+package openai
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/zhengjr9/dify-agent/internal/adapter"
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+)
+
+// blocklistID names the Dify moderation verdict in custom_blocklists.
+const blocklistID = "dify_moderation"
+
+// AzureProtocol is the name AzureAdapter is registered under in the pipeline.
+const AzureProtocol = "azure"
+
+// AzureAdapter implements the Azure OpenAI deployment route,
+// POST /openai/deployments/{deployment}/chat/completions. The deployment is
+// the model: it selects a model route, or else the app of that name in the
+// apps registry, whose key is lent only to callers the gateway authenticated
+// and whose credentials allow the deployment. Other callers use their own key
+// (usually the api-key header) as for /v1/chat/completions. The api-version
+// query parameter is accepted and ignored.
+//
+// Responses carry Azure's prompt_filter_results and content_filter_results.
+// A choice is reported as filtered, with finish_reason content_filter, when
+// Dify output moderation replaced its answer. Dify does not report input
+// moderation separately, so the prompt is always reported as unfiltered.
+type AzureAdapter struct {
+	apps *apps.Registry
+}
+
+// NewAzureAdapter constructs an AzureAdapter; apps maps deployments to Dify
+// apps.
+func NewAzureAdapter(apps *apps.Registry) *AzureAdapter {
+	return &AzureAdapter{apps: apps}
+}
+
+// ExtractAPIKey implements adapter.Adapter.
+func (a *AzureAdapter) ExtractAPIKey(r *http.Request, req *adapter.Request) (string, error) {
+	creds := httputil.ExtractCredentials(r)
+	if len(a.apps.Apps()) > 0 {
+		app, ok := a.apps.ByName(req.Model)
+		if !ok {
+			return "", &adapter.Error{Status: http.StatusNotFound, Message: "deployment " + req.Model + " not found"}
+		}
+		if creds.Authenticated() && creds.Allows(req.Model) {
+			return app.APIKey, nil
+		}
+	}
+	if key := creds.APIKey; key != "" {
+		return key, nil
+	}
+	return "", errors.New("missing API key: provide api-key header or Authorization: Bearer <key>")
+}
+
+// Decode implements adapter.Adapter. The deployment becomes the model, and
+// blocking calls detect moderation.
+func (a *AzureAdapter) Decode(r *http.Request) (*adapter.Request, error) {
+	req, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+	req.Model = r.PathValue("deployment")
+	req.Params.DetectModeration = true
+	return req, nil
+}
+
+// WriteBlocking implements adapter.Adapter.
+func (a *AzureAdapter) WriteBlocking(w http.ResponseWriter, req *adapter.Request, res *adapter.Result) error {
+	return WriteBlockingResponse(w, res.Responses, req.Model, res.Usage, res.Limiters, true)
+}
+
+// WriteStream implements adapter.Adapter.
+func (a *AzureAdapter) WriteStream(w http.ResponseWriter, req *adapter.Request, s *adapter.Stream) error {
+	return writeStream(w, req, s, req.Model, true)
+}
+
+// SetRateLimitHeaders implements adapter.RateLimitReporter. Azure OpenAI
+// sends the same headers as OpenAI.
+func (a *AzureAdapter) SetRateLimitHeaders(h http.Header, s ratelimit.Status) {
+	setRateLimitHeaders(h, s)
+}
+
+// WriteError implements adapter.Adapter.
+func (a *AzureAdapter) WriteError(w http.ResponseWriter, status int, msg string) {
+	apierrors.WriteJSONError(w, status, msg)
+}
+
+// promptFilterResults reports the single flattened prompt as unfiltered.
+func promptFilterResults() []PromptFilterResult {
+	return []PromptFilterResult{{PromptIndex: 0, ContentFilterResults: *contentFilterResults(false)}}
+}
+
+// contentFilterResults reports every category as safe and the Dify verdict
+// as a custom blocklist match.
+func contentFilterResults(moderated bool) *ContentFilterResults {
+	safe := func() *FilterResult { return &FilterResult{Filtered: false, Severity: "safe"} }
+	out := &ContentFilterResults{
+		Hate:             safe(),
+		SelfHarm:         safe(),
+		Sexual:           safe(),
+		Violence:         safe(),
+		CustomBlocklists: &BlocklistResult{Filtered: moderated, Details: []BlocklistDetails{}},
+	}
+	if moderated {
+		out.CustomBlocklists.Details = append(out.CustomBlocklists.Details, BlocklistDetails{Filtered: true, ID: blocklistID})
+	}
+	return out
+}
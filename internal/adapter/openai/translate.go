@@ -1,110 +1,197 @@
 package openai
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/zhengjr9/dify-agent/internal/adapter"
 	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
 )
 
-// ToDifyRequest converts an OpenAI chat completions request to a Dify ChatRequest.
-func ToDifyRequest(ctx context.Context, r *http.Request, defaultUser string) (*dify.ChatRequest, bool, error) {
+// decode converts an OpenAI chat completions request to a canonical request.
+// The decoded OpenAI request is kept as Native for response shaping.
+func decode(r *http.Request) (*adapter.Request, error) {
 	var req ChatCompletionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, false, fmt.Errorf("decode body: %w", err)
+	if err := httputil.DecodeJSON(r, &req); err != nil {
+		return nil, fmt.Errorf("decode body: %w", err)
 	}
 	if len(req.Messages) == 0 {
-		return nil, false, fmt.Errorf("messages must not be empty")
+		return nil, fmt.Errorf("messages must not be empty")
 	}
 
-	query, history := flattenMessages(req.Messages)
-
-	difyReq := &dify.ChatRequest{
-		Inputs:  map[string]any{},
-		Query:   query,
-		User:    defaultUser,
+	out := &adapter.Request{
+		Model:    req.Model,
+		Messages: make([]adapter.Message, len(req.Messages)),
+		Params: adapter.Params{
+			Stream:    req.Stream,
+			N:         req.N,
+			Stop:      req.Stop,
+			MaxTokens: req.OutputLimit(),
+			Inputs:    req.InputParams(),
+		},
+		BodyUser: req.User,
+		Native:   &req,
 	}
-	_ = history // prepended into query already
-
-	return difyReq, req.Stream, nil
-}
-
-// flattenMessages converts OpenAI messages into a single query string.
-// The last user message becomes the query; prior messages are prepended as context.
-func flattenMessages(msgs []Message) (query string, _ []Message) {
-	if len(msgs) == 1 {
-		return msgs[0].Content, nil
+	for i, m := range req.Messages {
+		out.Messages[i] = adapter.Text(m.Role, m.Content)
 	}
-
-	last := msgs[len(msgs)-1]
-	prior := msgs[:len(msgs)-1]
-
-	var sb strings.Builder
-	for _, m := range prior {
-		sb.WriteString(m.Role)
-		sb.WriteString(": ")
-		sb.WriteString(m.Content)
-		sb.WriteString("\n")
-	}
-	sb.WriteString(last.Content)
-	return sb.String(), prior
+	return out, nil
 }
 
-// WriteBlockingResponse encodes a Dify blocking response as an OpenAI ChatCompletionResponse.
-func WriteBlockingResponse(w http.ResponseWriter, resp *dify.BlockingResponse, model string) error {
-	finishReason := "stop"
+// WriteBlockingResponse encodes Dify blocking responses, one per candidate, as
+// an OpenAI ChatCompletionResponse. Each choice's finish reason is derived
+// from the limiter that was applied to its answer. With azure set, the
+// response carries Azure's filter results, and a moderated choice finishes
+// with content_filter and no content.
+func WriteBlockingResponse(w http.ResponseWriter, resps []*dify.BlockingResponse, model string, usage tokenizer.Usage, lims []*enforce.Limiter, azure bool) error {
 	out := ChatCompletionResponse{
-		ID:      resp.MessageID,
+		ID:      resps[0].MessageID,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Model:   model,
-		Choices: []Choice{
-			{
-				Index:        0,
-				Message:      Message{Role: "assistant", Content: resp.Answer},
-				FinishReason: finishReason,
-			},
-		},
+		Choices: make([]Choice, len(resps)),
+		Usage:   toUsage(usage),
+	}
+	if azure {
+		out.PromptFilterResults = promptFilterResults()
+	}
+	for i, resp := range resps {
+		out.Choices[i] = Choice{
+			Index:        i,
+			Message:      Message{Role: "assistant", Content: resp.Answer},
+			FinishReason: toFinishReason(lims[i]),
+		}
+		if azure {
+			out.Choices[i].ContentFilterResults = contentFilterResults(resp.Moderated)
+			if resp.Moderated {
+				out.Choices[i].Message.Content = ""
+				out.Choices[i].FinishReason = "content_filter"
+			}
+		}
 	}
 	w.Header().Set("Content-Type", "application/json")
 	return json.NewEncoder(w).Encode(out)
 }
 
-// WriteStreamingResponse encodes Dify stream events as OpenAI SSE chunks.
-func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent, model string) error {
+// WriteStreamingResponse encodes Dify stream events as OpenAI SSE chunks, with
+// StreamEvent.Index as the choice index; there is one candidate per entry of
+// lims. After the stream, each choice gets a chunk carrying its finish reason
+// from its limiter. usageFor is called per candidate; with includeUsage the
+// merged usage is sent in a final chunk with an empty choices list before
+// [DONE], as with stream_options.include_usage.
+//
+// With azure set, a first chunk carries prompt_filter_results and every
+// choice carries content_filter_results. A Dify message_replace event ends
+// its choice with finish_reason content_filter; the replacement text is not
+// forwarded.
+func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEvent, model string, usageFor func(metadata map[string]any, answer string) tokenizer.Usage, includeUsage bool, lims []*enforce.Limiter, azure bool) error {
+	var (
+		id        string
+		answers   = make([]strings.Builder, len(lims))
+		metadata  = make([]map[string]any, len(lims))
+		moderated = make([]bool, len(lims))
+		started   bool
+	)
 	for ev := range stream {
 		if ev.Err != nil {
 			return ev.Err
 		}
-		if ev.Event != "message" && ev.Event != "agent_message" {
+		if id == "" {
+			id = ev.MessageID
+		}
+		if azure && !started {
+			started = true
+			chunk := StreamChunk{
+				ID:                  id,
+				Object:              "chat.completion.chunk",
+				Created:             time.Now().Unix(),
+				Model:               model,
+				Choices:             []StreamChoice{},
+				PromptFilterResults: promptFilterResults(),
+			}
+			data, err := json.Marshal(chunk)
+			if err := writeChunk(w, data, err); err != nil {
+				return err
+			}
+		}
+		switch ev.Event {
+		case "message_end":
+			metadata[ev.Index] = ev.Metadata
+			continue
+		case "message_replace":
+			moderated[ev.Index] = azure
+			continue
+		case "message", "agent_message":
+		default:
+			continue
+		}
+		if moderated[ev.Index] {
 			continue
 		}
+		answers[ev.Index].WriteString(ev.Answer)
 
 		chunk := StreamChunk{
-			ID:      ev.MessageID,
+			ID:      id,
 			Object:  "chat.completion.chunk",
 			Created: time.Now().Unix(),
 			Model:   model,
 			Choices: []StreamChoice{
 				{
-					Index: 0,
+					Index: ev.Index,
 					Delta: Delta{Content: ev.Answer},
 				},
 			},
 		}
+		if azure {
+			chunk.Choices[0].ContentFilterResults = contentFilterResults(false)
+		}
 		data, err := json.Marshal(chunk)
-		if err != nil {
-			return fmt.Errorf("marshal chunk: %w", err)
+		if err := writeChunk(w, data, err); err != nil {
+			return err
+		}
+	}
+	for i, lim := range lims {
+		finishReason := toFinishReason(lim)
+		if moderated[i] {
+			finishReason = "content_filter"
+		}
+		finish := StreamChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []StreamChoice{{Index: i, Delta: Delta{}, FinishReason: &finishReason}},
 		}
-		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		if azure {
+			finish.Choices[0].ContentFilterResults = contentFilterResults(moderated[i])
+		}
+		data, err := json.Marshal(finish)
+		if err := writeChunk(w, data, err); err != nil {
 			return err
 		}
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+	}
+	var usage tokenizer.Usage
+	for i := range lims {
+		usage = usage.Merge(usageFor(metadata[i], answers[i].String()))
+	}
+	if includeUsage {
+		chunk := StreamChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   model,
+			Choices: []StreamChoice{},
+			Usage:   toUsage(usage),
+		}
+		data, err := json.Marshal(chunk)
+		if err := writeChunk(w, data, err); err != nil {
+			return err
 		}
 	}
 	_, err := fmt.Fprintf(w, "data: [DONE]\n\n")
@@ -113,3 +200,32 @@ func WriteStreamingResponse(w http.ResponseWriter, stream <-chan dify.StreamEven
 	}
 	return err
 }
+
+func writeChunk(w http.ResponseWriter, data []byte, err error) error {
+	if err != nil {
+		return fmt.Errorf("marshal chunk: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func toUsage(u tokenizer.Usage) *Usage {
+	return &Usage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		TotalTokens:      u.Total(),
+		Estimated:        u.Estimated,
+	}
+}
+
+func toFinishReason(lim *enforce.Limiter) string {
+	if lim.Reason() == enforce.ReasonMaxTokens {
+		return "length"
+	}
+	return "stop"
+}
@@ -1,11 +1,84 @@
 package openai
 
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+)
 
 // ChatCompletionRequest mirrors the OpenAI chat completions request body.
 type ChatCompletionRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// Stop, MaxTokens and MaxCompletionTokens are enforced by the proxy.
+	Stop                StopList `json:"stop,omitempty"`
+	MaxTokens           int      `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int      `json:"max_completion_tokens,omitempty"`
+	// User identifies the end-user; see the identity package.
+	User string `json:"user,omitempty"`
+	// N is the number of choices; each is a separate Dify request.
+	N int `json:"n,omitempty"`
+	// Sampling parameters and metadata reach Dify only as inputs, through
+	// the apps mapping; see InputParams.
+	Temperature      *float64          `json:"temperature,omitempty"`
+	TopP             *float64          `json:"top_p,omitempty"`
+	PresencePenalty  *float64          `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64          `json:"frequency_penalty,omitempty"`
+	Seed             *int              `json:"seed,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+// InputParams returns the request parameters that may be mapped onto Dify
+// inputs.
+func (r *ChatCompletionRequest) InputParams() inputs.Params {
+	p := inputs.Params{}
+	inputs.Set(p, "temperature", r.Temperature)
+	inputs.Set(p, "top_p", r.TopP)
+	inputs.Set(p, "presence_penalty", r.PresencePenalty)
+	inputs.Set(p, "frequency_penalty", r.FrequencyPenalty)
+	inputs.Set(p, "seed", r.Seed)
+	if n := r.OutputLimit(); n > 0 {
+		p["max_tokens"] = n
+	}
+	for k, v := range r.Metadata {
+		p["metadata."+k] = v
+	}
+	return p
+}
+
+// StopList accepts the "stop" field as either a string or an array of strings.
+type StopList []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *StopList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = StopList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+// OutputLimit returns the effective output token limit, preferring
+// max_completion_tokens over the deprecated max_tokens.
+func (r *ChatCompletionRequest) OutputLimit() int {
+	if r.MaxCompletionTokens > 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// StreamOptions controls optional parts of a streamed response.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 // Message is a single chat message.
@@ -21,6 +94,18 @@ type ChatCompletionResponse struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+	// PromptFilterResults is set on Azure deployment routes.
+	PromptFilterResults []PromptFilterResult `json:"prompt_filter_results,omitempty"`
+}
+
+// Usage carries token counts. Estimated is set when the counts were computed
+// locally because Dify did not report usage.
+type Usage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	TotalTokens      int  `json:"total_tokens"`
+	Estimated        bool `json:"estimated,omitempty"`
 }
 
 // Choice wraps a single completion result.
@@ -28,22 +113,29 @@ type Choice struct {
 	Index        int     `json:"index"`
 	Message      Message `json:"message"`
 	FinishReason string  `json:"finish_reason"`
+	// ContentFilterResults is set on Azure deployment routes.
+	ContentFilterResults *ContentFilterResults `json:"content_filter_results,omitempty"`
 }
 
 // StreamChunk is one SSE data object in OpenAI streaming format.
 type StreamChunk struct {
-	ID      string        `json:"id"`
-	Object  string        `json:"object"`
-	Created int64         `json:"created"`
-	Model   string        `json:"model"`
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   *Usage         `json:"usage,omitempty"`
+	// PromptFilterResults is set on the first chunk of Azure deployment routes.
+	PromptFilterResults []PromptFilterResult `json:"prompt_filter_results,omitempty"`
 }
 
 // StreamChoice is a single choice delta in a stream chunk.
 type StreamChoice struct {
-	Index        int         `json:"index"`
-	Delta        Delta       `json:"delta"`
-	FinishReason *string     `json:"finish_reason"`
+	Index        int     `json:"index"`
+	Delta        Delta   `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+	// ContentFilterResults is set on Azure deployment routes.
+	ContentFilterResults *ContentFilterResults `json:"content_filter_results,omitempty"`
 }
 
 // Delta carries incremental content in a stream chunk.
@@ -52,3 +144,51 @@ type Delta struct {
 	Content string `json:"content,omitempty"`
 }
 
+// PromptFilterResult is Azure's moderation outcome for one prompt.
+type PromptFilterResult struct {
+	PromptIndex          int                  `json:"prompt_index"`
+	ContentFilterResults ContentFilterResults `json:"content_filter_results"`
+}
+
+// ContentFilterResults is Azure's per-category moderation outcome. Dify
+// moderation has no categories, so its verdict is reported as a custom
+// blocklist match.
+type ContentFilterResults struct {
+	Hate             *FilterResult    `json:"hate,omitempty"`
+	SelfHarm         *FilterResult    `json:"self_harm,omitempty"`
+	Sexual           *FilterResult    `json:"sexual,omitempty"`
+	Violence         *FilterResult    `json:"violence,omitempty"`
+	CustomBlocklists *BlocklistResult `json:"custom_blocklists,omitempty"`
+}
+
+// FilterResult is the outcome for one severity-graded category.
+type FilterResult struct {
+	Filtered bool   `json:"filtered"`
+	Severity string `json:"severity"`
+}
+
+// BlocklistResult is the outcome of the custom blocklists.
+type BlocklistResult struct {
+	Filtered bool               `json:"filtered"`
+	Details  []BlocklistDetails `json:"details"`
+}
+
+// BlocklistDetails names one matched blocklist.
+type BlocklistDetails struct {
+	Filtered bool   `json:"filtered"`
+	ID       string `json:"id"`
+}
+
+// ModelList is the GET /v1/models response.
+type ModelList struct {
+	Object string  `json:"object"` // "list"
+	Data   []Model `json:"data"`
+}
+
+// Model is one entry of a ModelList.
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"` // "model"
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
@@ -0,0 +1,306 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/admission"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/enforce"
+	"github.com/zhengjr9/dify-agent/internal/fanout"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+	"github.com/zhengjr9/dify-agent/internal/shadow"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// Pipeline runs canonical requests against Dify on behalf of the adapters
+// registered with it.
+type Pipeline struct {
+	client   *dify.Client
+	users    *identity.Resolver
+	inputs   *inputs.Builder
+	timeout  time.Duration
+	tokens   *tokenizer.Set
+	limits   fanout.Limits
+	routes   *routes.Table
+	mirror   *shadow.Mirror
+	control  *admission.Controller
+	adapters map[string]Adapter
+}
+
+// NewPipeline constructs a Pipeline. limits bounds the fan-out for requests
+// asking for several candidates; routes maps model names to the apps they run
+// and mirror runs the shadow requests of routes that have one. control
+// enforces the budgets and rate limits of keys, users and routes, and
+// records usage.
+func NewPipeline(client *dify.Client, users *identity.Resolver, inputs *inputs.Builder, timeout time.Duration, tokens *tokenizer.Set, limits fanout.Limits, routes *routes.Table, mirror *shadow.Mirror, control *admission.Controller) *Pipeline {
+	return &Pipeline{
+		client:   client,
+		users:    users,
+		inputs:   inputs,
+		timeout:  timeout,
+		tokens:   tokens,
+		limits:   limits,
+		routes:   routes,
+		mirror:   mirror,
+		control:  control,
+		adapters: map[string]Adapter{},
+	}
+}
+
+// Register adds a under the protocol name name, replacing any adapter
+// registered under that name before.
+func (p *Pipeline) Register(name string, a Adapter) {
+	p.adapters[name] = a
+}
+
+// Adapter returns the adapter registered under name.
+func (p *Pipeline) Adapter(name string) (Adapter, bool) {
+	a, ok := p.adapters[name]
+	return a, ok
+}
+
+// Handler returns a handler that decodes requests with the adapter
+// registered under name and serves them. It panics if there is none, as
+// routes are wired at startup.
+func (p *Pipeline) Handler(name string) http.Handler {
+	a, ok := p.adapters[name]
+	if !ok {
+		panic(fmt.Sprintf("adapter: no adapter registered as %q", name))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := a.Decode(r)
+		if err != nil {
+			a.WriteError(w, statusOf(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		p.Serve(w, r, name, req)
+	})
+}
+
+// Serve runs a decoded request with the adapter registered under name. It is
+// used directly by handlers that need to look at the request before it runs.
+func (p *Pipeline) Serve(w http.ResponseWriter, r *http.Request, name string, req *Request) {
+	a := p.adapters[name]
+	if len(req.Messages) == 0 {
+		a.WriteError(w, http.StatusBadRequest, "messages must not be empty")
+		return
+	}
+	app, target, err := p.resolve(r, a, req)
+	if err != nil {
+		a.WriteError(w, statusOf(err, http.StatusUnauthorized), err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+	defer cancel()
+
+	user := p.users.Resolve(r, req.BodyUser)
+	n, err := p.limits.Count(req.Params.N)
+	if err != nil {
+		a.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ticket, ok := p.admit(w, r, a, req, target, user, n)
+	if !ok {
+		return
+	}
+	defer ticket.Settle()
+
+	// A split route assigns the request to one of its variants, which then
+	// serves it like any route. The shadow of the requested route, or else of
+	// the variant, is sent a sample of the requests without images.
+	mirrored := target
+	if target != nil && target.IsSplit() {
+		variant := target.Pick(stickyKey(r, req, target.Sticky, user))
+		w.Header().Set(routes.VariantHeader, variant.Model)
+		variantRequests.Inc(target.Model, variant.Model)
+		target = variant
+		if s, _ := mirrored.ShadowTarget(); s == nil {
+			mirrored = variant
+		}
+	}
+	var run *shadow.Run
+	if len(req.Images()) == 0 {
+		run = p.mirror.Start(r, mirrored, shadow.Request{Model: req.Model, Query: req.Query(), User: user, Params: req.Params.Inputs})
+		defer run.Finish()
+	}
+
+	// A routed request tries the route's fallbacks in turn. Every target but
+	// the last is abandoned on a trigger of the route before output is sent.
+	chain := []*routes.Target{target}
+	if target != nil {
+		chain = target.Chain()
+	}
+	start := time.Now()
+	for i, t := range chain {
+		var triggers *routes.Triggers
+		if i < len(chain)-1 {
+			triggers = target.Triggers()
+		}
+		if t != nil {
+			app = t.App()
+		}
+		try := newAttempt(ctx, t, triggers)
+		err := p.serveApp(w, r, a, req, try, app, user, n, start, run, ticket)
+		if err == nil {
+			return
+		}
+		reason, ok := try.fallback(err)
+		if !ok {
+			run.Failed(err)
+			writeUpstreamError(w, a, err)
+			return
+		}
+		slog.Warn("route fallback", "model", req.Model, "from", t.Model, "to", chain[i+1].Model, "reason", reason, "error", err)
+	}
+}
+
+// serveApp runs req against app and writes the response, reporting the
+// first candidate's answer to run and the usage to ticket, also for a stream
+// cut short. When try may fall back, an upstream failure before any output is
+// returned instead, leaving w untouched; every other outcome is written to w
+// and nil returned.
+func (p *Pipeline) serveApp(w http.ResponseWriter, r *http.Request, a Adapter, req *Request, try *attempt, app inputs.App, user string, n int, start time.Time, run *shadow.Run, ticket *admission.Ticket) error {
+	defer try.cancel()
+	try.begin(req.Params.Stream)
+	ctx := try.ctx
+	client, apiKey := app.Client, app.APIKey
+
+	req.Identity = Identity{APIKey: apiKey, User: user}
+	difyReq := &dify.ChatRequest{Query: req.Query(), User: user}
+	var err error
+	difyReq.Inputs, err = p.inputs.Build(ctx, r, app, user, req.Params.Inputs)
+	if err != nil {
+		a.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	if images := req.Images(); len(images) > 0 {
+		difyReq.Files, err = client.UploadImages(ctx, apiKey, user, images)
+		if err != nil {
+			return err
+		}
+	}
+
+	tok := p.tokens.For(req.Model)
+	stops, maxTokens := req.Params.Stop, req.Params.MaxTokens
+	lims := make([]*enforce.Limiter, n)
+
+	if req.Params.Stream {
+		open := func(ctx context.Context, i int) (<-chan dify.StreamEvent, error) {
+			ctx, stopOne := context.WithCancel(ctx)
+			one := *difyReq
+			stream, err := client.SendStreaming(ctx, apiKey, &one)
+			if err != nil {
+				stopOne()
+				return nil, err
+			}
+			lims[i] = enforce.New(stops, maxTokens, tok)
+			return lims[i].Stream(stream, enforce.UpstreamStopper(client, apiKey, user, stopOne)), nil
+		}
+		stream, err := fanout.Stream(ctx, p.limits, n, open, enforce.UpstreamStopper(client, apiKey, user, nil))
+		if err != nil {
+			return err
+		}
+		if stream, err = try.awaitAnswer(stream); err != nil {
+			return err
+		}
+		try.served(w)
+		stream, sent := meter(ctx, stream, n)
+		_ = a.WriteStream(w, req, &Stream{
+			Events:   stream,
+			Limiters: lims,
+			UsageFor: func(metadata map[string]any, answer string) tokenizer.Usage {
+				usage := p.tokens.Resolve(req.Model, metadata, difyReq.Query, answer)
+				run.Answered(try.name(), answer, usage.CompletionTokens)
+				return usage
+			},
+			Start: start,
+		})
+		sent.charge(ticket, p.tokens, req.Model, difyReq.Query)
+		return nil
+	}
+
+	send := client.SendBlocking
+	if req.Params.DetectModeration {
+		send = func(ctx context.Context, apiKey string, req *dify.ChatRequest) (*dify.BlockingResponse, error) {
+			return collect(ctx, client, apiKey, req)
+		}
+	}
+	resps, err := fanout.Blocking(ctx, p.limits, n, func(ctx context.Context, i int) (*dify.BlockingResponse, error) {
+		one := *difyReq
+		return send(ctx, apiKey, &one)
+	})
+	if err == nil && !try.commit() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	var usage tokenizer.Usage
+	for i, resp := range resps {
+		resp.Answer, lims[i] = enforce.Apply(resp.Answer, stops, maxTokens, tok)
+		one := p.tokens.Resolve(req.Model, resp.Metadata, difyReq.Query, resp.Answer)
+		run.Answered(try.name(), resp.Answer, one.CompletionTokens)
+		ticket.Use(one)
+		usage = usage.Merge(one)
+	}
+	try.served(w)
+	if err := a.WriteBlocking(w, req, &Result{Responses: resps, Limiters: lims, Usage: usage, Start: start}); err != nil {
+		a.WriteError(w, http.StatusInternalServerError, "failed to write response")
+	}
+	return nil
+}
+
+// resolve picks the app a request runs against: the route of the requested
+// model, returned with its target, or else the app of the key the adapter
+// extracts from the caller's credentials. With a strict routing table
+// unrouted models are not found. Virtual keys may only use the models they
+// are scoped to, and routes other than public ones require the caller to be
+// authenticated by the gateway, as they run with the gateway's Dify keys.
+func (p *Pipeline) resolve(r *http.Request, a Adapter, req *Request) (inputs.App, *routes.Target, error) {
+	creds := httputil.ExtractCredentials(r)
+	if !creds.Allows(req.Model) {
+		return inputs.App{}, nil, &Error{Status: http.StatusForbidden, Message: fmt.Sprintf("API key may not use model %q", req.Model)}
+	}
+	if target, ok := p.routes.Lookup(req.Model); ok {
+		if !target.Public && !creds.Authenticated() {
+			return inputs.App{}, nil, &Error{Status: http.StatusUnauthorized, Message: fmt.Sprintf("model %q requires a virtual key or access token", req.Model)}
+		}
+		return target.App(), target, nil
+	}
+	if p.routes.Strict() {
+		return inputs.App{}, nil, &Error{Status: http.StatusNotFound, Message: fmt.Sprintf("model %q not found", req.Model)}
+	}
+	apiKey, err := a.ExtractAPIKey(r, req)
+	if err != nil {
+		return inputs.App{}, nil, err
+	}
+	return inputs.App{APIKey: apiKey, Client: p.client}, nil, nil
+}
+
+// collect sends req in streaming mode and collects the answer, so that the
+// response tells whether output moderation fired.
+func collect(ctx context.Context, client *dify.Client, apiKey string, req *dify.ChatRequest) (*dify.BlockingResponse, error) {
+	stream, err := client.SendStreaming(ctx, apiKey, req)
+	if err != nil {
+		return nil, err
+	}
+	return dify.Collect(stream)
+}
+
+func writeUpstreamError(w http.ResponseWriter, a Adapter, err error) {
+	msg := err.Error()
+	if strings.Contains(msg, "context deadline exceeded") || strings.Contains(msg, "timeout") {
+		a.WriteError(w, http.StatusGatewayTimeout, "upstream timeout")
+		return
+	}
+	a.WriteError(w, http.StatusBadGateway, "upstream error: "+msg)
+}
@@ -0,0 +1,96 @@
+package adapter
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/zhengjr9/dify-agent/internal/admission"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// admit checks the budgets of req and takes its n candidates from the rate
+// limits of the caller's virtual key, the resolved user, in the tier named
+// by the caller's access token, and the requested route, and sets the
+// protocol's rate limit headers. When a budget is exhausted or a limit
+// exceeded it writes 429, with Retry-After for a limit, and returns false.
+func (p *Pipeline) admit(w http.ResponseWriter, r *http.Request, a Adapter, req *Request, target *routes.Target, user string, n int) (*admission.Ticket, bool) {
+	ticket, status, err := p.control.Admit(admission.Request{
+		Creds:  httputil.ExtractCredentials(r),
+		User:   user,
+		Model:  req.Model,
+		Route:  target,
+		Prompt: func() int { return p.tokens.For(req.Model).Count(req.Query()) },
+		N:      n,
+		Stream: req.Params.Stream,
+	})
+	if rep, ok := a.(RateLimitReporter); ok {
+		rep.SetRateLimitHeaders(w.Header(), status)
+	}
+	if err != nil {
+		admission.SetRetryAfter(w.Header(), err)
+		a.WriteError(w, http.StatusTooManyRequests, err.Error())
+		return nil, false
+	}
+	return ticket, true
+}
+
+// streamed is what the candidates of a stream received from Dify, kept so
+// that their usage is charged however the stream ends: stream writers stop
+// at an upstream error or a client disconnect without reporting usage.
+type streamed struct {
+	mu       sync.Mutex
+	answers  []strings.Builder
+	metadata []map[string]any
+}
+
+// meter relays the n candidates of stream, recording each event before it is
+// handed on. Once ctx is done it stops relaying and drains stream.
+func meter(ctx context.Context, stream <-chan dify.StreamEvent, n int) (<-chan dify.StreamEvent, *streamed) {
+	s := &streamed{answers: make([]strings.Builder, n), metadata: make([]map[string]any, n)}
+	out := make(chan dify.StreamEvent)
+	go func() {
+		defer close(out)
+		for ev := range stream {
+			s.record(ev)
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+				drainEvents(stream)
+				return
+			}
+		}
+	}()
+	return out, s
+}
+
+func (s *streamed) record(ev dify.StreamEvent) {
+	if ev.Index < 0 || ev.Index >= len(s.answers) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch ev.Event {
+	case "message", "agent_message":
+		s.answers[ev.Index].WriteString(ev.Answer)
+	case "message_replace":
+		s.answers[ev.Index].Reset()
+		s.answers[ev.Index].WriteString(ev.Answer)
+	case "message_end":
+		s.metadata[ev.Index] = ev.Metadata
+	}
+}
+
+// charge reports the usage of every candidate to ticket: the usage Dify
+// reported, or else an estimate from prompt and the answer streamed so far.
+func (s *streamed) charge(ticket *admission.Ticket, tokens *tokenizer.Set, model, prompt string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.answers {
+		ticket.Use(tokens.Resolve(model, s.metadata[i], prompt, s.answers[i].String()))
+	}
+}
@@ -0,0 +1,38 @@
+package adapter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/zhengjr9/dify-agent/internal/metrics"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+)
+
+var variantRequests = metrics.NewCounter("dify_agent_variant_requests_total",
+	"Requests assigned to each variant of a split route.", "route", "variant")
+
+// stickyKey returns the key a split route assigns req by. For conversation
+// stickiness it is the routes.ConversationHeader, or else a digest of the
+// user, the system prompts and the first message, which every turn of a
+// conversation resends unchanged.
+func stickyKey(r *http.Request, req *Request, sticky, user string) string {
+	if sticky != routes.StickyConversation {
+		return user
+	}
+	if id := strings.TrimSpace(r.Header.Get(routes.ConversationHeader)); id != "" {
+		return id
+	}
+	h := sha256.New()
+	h.Write([]byte(user))
+	for _, s := range req.System {
+		h.Write([]byte{0})
+		h.Write([]byte(s))
+	}
+	if len(req.Messages) > 0 {
+		h.Write([]byte{0})
+		h.Write([]byte(req.Messages[0].Text()))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
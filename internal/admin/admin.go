@@ -0,0 +1,185 @@
+// Package admin serves the gateway's management API under /admin. Every
+// endpoint requires the admin token as "Authorization: Bearer <token>",
+// which is separate from the keys callers use for the proxy.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/keys"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+)
+
+// Handler serves the admin API.
+type Handler struct {
+	token string
+	keys  *keys.Manager
+	mux   *http.ServeMux
+}
+
+// NewHandler returns a Handler guarded by token. The token must not be empty.
+func NewHandler(token string, keys *keys.Manager) *Handler {
+	h := &Handler{token: token, keys: keys, mux: http.NewServeMux()}
+	h.mux.HandleFunc("POST /admin/keys", h.createKey)
+	h.mux.HandleFunc("GET /admin/keys", h.listKeys)
+	h.mux.HandleFunc("GET /admin/keys/{id}", h.getKey)
+	h.mux.HandleFunc("PATCH /admin/keys/{id}", h.updateKey)
+	h.mux.HandleFunc("POST /admin/keys/{id}/rotate", h.rotateKey)
+	h.mux.HandleFunc("DELETE /admin/keys/{id}", h.revokeKey)
+	return h
+}
+
+// Handle registers handler for pattern, a ServeMux pattern under /admin/,
+// behind the admin token.
+func (h *Handler) Handle(pattern string, handler http.Handler) {
+	h.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(h.token)) != 1 {
+		apierrors.WriteJSONError(w, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// KeyView is a key as shown by the admin API. The upstream Dify key and the
+// key digest are never shown; Key carries the secret once, when it is issued.
+type KeyView struct {
+	ID         string            `json:"id"`
+	Object     string            `json:"object"` // "api_key"
+	Key        string            `json:"key,omitempty"`
+	Hint       string            `json:"hint"`
+	Owner      string            `json:"owner,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Models     []string          `json:"models,omitempty"`
+	App        string            `json:"app,omitempty"`
+	HasDifyKey bool              `json:"has_dify_key"`
+	Limits     ratelimit.Limits  `json:"limits,omitzero"`
+	Enabled    bool              `json:"enabled"`
+	ExpiresAt  *time.Time        `json:"expires_at,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	RotatedAt  *time.Time        `json:"rotated_at,omitempty"`
+}
+
+func toKeyView(k *keys.Key, secret string) KeyView {
+	return KeyView{
+		ID:         k.ID,
+		Object:     "api_key",
+		Key:        secret,
+		Hint:       k.Hint,
+		Owner:      k.Owner,
+		Labels:     k.Labels,
+		Models:     k.Models,
+		App:        k.App,
+		HasDifyKey: k.DifyKey != "",
+		Limits:     k.Limits,
+		Enabled:    k.Enabled,
+		ExpiresAt:  k.ExpiresAt,
+		CreatedAt:  k.CreatedAt,
+		RotatedAt:  k.RotatedAt,
+	}
+}
+
+// createKey handles POST /admin/keys.
+func (h *Handler) createKey(w http.ResponseWriter, r *http.Request) {
+	var spec keys.Spec
+	if err := httputil.DecodeJSON(r, &spec); err != nil {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	k, secret, err := h.keys.Create(spec)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toKeyView(k, secret))
+}
+
+// listKeys handles GET /admin/keys.
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	list, err := h.keys.List()
+	if err != nil {
+		apierrors.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := struct {
+		Object string    `json:"object"`
+		Data   []KeyView `json:"data"`
+	}{Object: "list", Data: make([]KeyView, len(list))}
+	for i, k := range list {
+		out.Data[i] = toKeyView(k, "")
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// getKey handles GET /admin/keys/{id}.
+func (h *Handler) getKey(w http.ResponseWriter, r *http.Request) {
+	k, err := h.keys.Get(r.PathValue("id"))
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toKeyView(k, ""))
+}
+
+// updateKey handles PATCH /admin/keys/{id}.
+func (h *Handler) updateKey(w http.ResponseWriter, r *http.Request) {
+	var spec keys.Spec
+	if err := httputil.DecodeJSON(r, &spec); err != nil {
+		apierrors.WriteJSONError(w, http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	k, err := h.keys.Update(r.PathValue("id"), spec)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toKeyView(k, ""))
+}
+
+// rotateKey handles POST /admin/keys/{id}/rotate.
+func (h *Handler) rotateKey(w http.ResponseWriter, r *http.Request) {
+	k, secret, err := h.keys.Rotate(r.PathValue("id"))
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toKeyView(k, secret))
+}
+
+// revokeKey handles DELETE /admin/keys/{id}.
+func (h *Handler) revokeKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.keys.Revoke(id); err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "object": "api_key", "deleted": true})
+}
+
+func writeKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, keys.ErrNotFound):
+		apierrors.WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, keys.ErrInvalidSpec):
+		apierrors.WriteJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		apierrors.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
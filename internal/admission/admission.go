@@ -0,0 +1,170 @@
+// Package admission decides whether a request may run, against the budgets
+// and rate limits of its caller, and records what it used once it has.
+// Every entry point that sends work to Dify admits it through a Controller:
+// the generation pipeline, token counting, message batches, the Dify
+// passthrough and MCP.
+package admission
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/zhengjr9/dify-agent/internal/accounting"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/metrics"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+var (
+	rateLimited = metrics.NewCounter("dify_agent_rate_limited_total",
+		"Requests rejected by a rate limit, by scope kind and limit.", "scope", "limit")
+	budgetRejected = metrics.NewCounter("dify_agent_budget_rejected_total",
+		"Requests rejected because a budget was exhausted.", "budget")
+)
+
+// Controller admits requests. A nil *Controller admits every request.
+type Controller struct {
+	limiter *ratelimit.Limiter
+	ledger  *accounting.Ledger
+}
+
+// New returns a Controller enforcing the limits of limiter and the budgets
+// of ledger, where usage is recorded.
+func New(limiter *ratelimit.Limiter, ledger *accounting.Ledger) *Controller {
+	return &Controller{limiter: limiter, ledger: ledger}
+}
+
+// Request describes a request to admit.
+type Request struct {
+	// Creds are the caller's credentials; their virtual key, if any, is
+	// limited as a scope of its own.
+	Creds httputil.Credentials
+	// User is the resolved Dify user, limited in the tier of Creds.
+	User string
+	// Model is the model or app requested, and Route its route, if any.
+	Model string
+	Route *routes.Target
+	// Prompt estimates the prompt tokens of the request. It is only called
+	// when a scope limits tokens; nil counts none.
+	Prompt func() int
+	// N is the number of candidates, each sent with the prompt; zero is one.
+	N int
+	// Stream is set for requests holding a stream slot while they run.
+	Stream bool
+}
+
+// subject returns who req is accounted to.
+func (req Request) subject() accounting.Subject {
+	return accounting.Subject{Key: req.Creds.KeyID, Owner: req.Creds.Owner, User: req.User, Model: req.Model}
+}
+
+// Check returns an *accounting.Exhausted error when a budget matching req is
+// exhausted. A budget that cannot be read is logged and does not reject.
+func (c *Controller) Check(req Request) error {
+	if c == nil {
+		return nil
+	}
+	err := c.ledger.Check(req.subject())
+	var exhausted *accounting.Exhausted
+	if errors.As(err, &exhausted) {
+		budgetRejected.Inc(exhausted.Budget)
+		return err
+	}
+	if err != nil {
+		slog.Error("budget check failed", "error", err)
+	}
+	return nil
+}
+
+// Admit checks the budgets matching req, then takes it from the rate limits
+// of the caller's virtual key, the resolved user and the requested route.
+// It returns an *accounting.Exhausted error when a budget is exhausted and a
+// *ratelimit.Exceeded error over a limit. The Status describes the limits
+// for the response headers. The Ticket must be settled when the request
+// ends.
+func (c *Controller) Admit(req Request) (*Ticket, ratelimit.Status, error) {
+	if c == nil {
+		return nil, ratelimit.Status{}, nil
+	}
+	if err := c.Check(req); err != nil {
+		return nil, ratelimit.Status{}, err
+	}
+	scopes := []ratelimit.Scope{c.limiter.User(req.User, req.Creds.Tier)}
+	if req.Creds.KeyID != "" {
+		scopes = append(scopes, ratelimit.Scope{Kind: ratelimit.ScopeKey, Name: req.Creds.KeyID, Limits: req.Creds.Limits})
+	}
+	if req.Route != nil {
+		scopes = append(scopes, ratelimit.Scope{Kind: ratelimit.ScopeRoute, Name: req.Route.Model, Limits: req.Route.Limits})
+	}
+	prompt := 0
+	if req.Prompt != nil && slices.ContainsFunc(scopes, func(s ratelimit.Scope) bool { return s.Limits.TPM > 0 }) {
+		prompt = req.Prompt() * max(req.N, 1)
+	}
+
+	grant, status, err := c.limiter.Acquire(scopes, prompt, req.Stream)
+	if err != nil {
+		var exceeded *ratelimit.Exceeded
+		if errors.As(err, &exceeded) {
+			rateLimited.Inc(exceeded.Scope.Kind, exceeded.Limit)
+		}
+		return nil, status, err
+	}
+	return &Ticket{ledger: c.ledger, subject: req.subject(), grant: grant}, status, nil
+}
+
+// SetRetryAfter sets the Retry-After header, in whole seconds, for an error
+// returned by Admit.
+func SetRetryAfter(h http.Header, err error) {
+	var exceeded *ratelimit.Exceeded
+	if errors.As(err, &exceeded) {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(exceeded.RetryAfter.Seconds()))))
+	}
+}
+
+// Ticket is an admitted request. A nil *Ticket is valid and does nothing.
+type Ticket struct {
+	ledger  *accounting.Ledger
+	subject accounting.Subject
+	grant   *ratelimit.Grant
+
+	mu    sync.Mutex
+	used  bool
+	usage tokenizer.Usage // summed over candidates
+}
+
+// Use reports the usage of one candidate of the request.
+func (t *Ticket) Use(u tokenizer.Usage) {
+	if t == nil {
+		return
+	}
+	t.grant.Use(u.PromptTokens, u.CompletionTokens)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used = true
+	t.usage = t.usage.Add(u)
+}
+
+// Settle ends the request: the usage reported replaces the estimate taken
+// from the rate limits by Admit and is recorded in the ledger.
+func (t *Ticket) Settle() {
+	if t == nil {
+		return
+	}
+	t.grant.Release()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.used {
+		return
+	}
+	u := accounting.Usage{PromptTokens: t.usage.PromptTokens, CompletionTokens: t.usage.CompletionTokens, Estimated: t.usage.Estimated}
+	if err := t.ledger.Record(t.subject, u); err != nil {
+		slog.Error("record usage", "model", t.subject.Model, "error", err)
+	}
+}
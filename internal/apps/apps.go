@@ -0,0 +1,122 @@
+// Package apps holds the registry of Dify apps known to the gateway, loaded
+// from a JSON apps file. Apps are identified by their Dify API key, which is
+// what callers present; the registry adds per-app settings such as how
+// protocol parameters map onto the app's input variables.
+package apps
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// App is one Dify app.
+type App struct {
+	Name        string `json:"name" yaml:"name" toml:"name"`
+	APIKey      string `json:"api_key" yaml:"api_key" toml:"api_key"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty" toml:"description,omitempty"`
+	// Inputs maps protocol parameter names (see the inputs package) to the
+	// app's input variables. It extends and overrides File.Inputs.
+	Inputs map[string]string `json:"inputs,omitempty" yaml:"inputs,omitempty" toml:"inputs,omitempty"`
+}
+
+// File is the apps file format.
+type File struct {
+	// Inputs is the parameter mapping applied to every app, including apps
+	// that are not listed.
+	Inputs map[string]string `json:"inputs,omitempty" yaml:"inputs,omitempty" toml:"inputs,omitempty"`
+	Apps   []App             `json:"apps" yaml:"apps" toml:"apps"`
+}
+
+// Registry looks up apps by API key. A nil *Registry knows no apps.
+type Registry struct {
+	file  File
+	byKey map[string]*App
+}
+
+// Load reads the apps file at path. An empty path returns an empty registry.
+func Load(path string) (*Registry, error) {
+	if path == "" {
+		return New(File{})
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read apps file: %w", err)
+	}
+	var f File
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("parse apps file %s: %w", path, err)
+	}
+	return New(f)
+}
+
+// New validates f and returns a Registry.
+func New(f File) (*Registry, error) {
+	reg := &Registry{file: f, byKey: make(map[string]*App, len(f.Apps))}
+	names := make(map[string]bool, len(f.Apps))
+	for i := range f.Apps {
+		app := &f.Apps[i]
+		if app.Name == "" || app.APIKey == "" {
+			return nil, fmt.Errorf("apps[%d]: name and api_key are required", i)
+		}
+		if names[app.Name] {
+			return nil, fmt.Errorf("apps[%d]: duplicate name %q", i, app.Name)
+		}
+		if reg.byKey[app.APIKey] != nil {
+			return nil, fmt.Errorf("apps[%d]: api_key already used by %q", i, reg.byKey[app.APIKey].Name)
+		}
+		names[app.Name] = true
+		reg.byKey[app.APIKey] = app
+	}
+	return reg, nil
+}
+
+// ByKey returns the app with the given API key.
+func (r *Registry) ByKey(apiKey string) (*App, bool) {
+	if r == nil {
+		return nil, false
+	}
+	app, ok := r.byKey[apiKey]
+	return app, ok
+}
+
+// ByName returns the app with the given name.
+func (r *Registry) ByName(name string) (*App, bool) {
+	if r == nil {
+		return nil, false
+	}
+	for i := range r.file.Apps {
+		if r.file.Apps[i].Name == name {
+			return &r.file.Apps[i], true
+		}
+	}
+	return nil, false
+}
+
+// Apps returns every registered app in file order.
+func (r *Registry) Apps() []App {
+	if r == nil {
+		return nil
+	}
+	return r.file.Apps
+}
+
+// InputMapping returns the parameter mapping for the app with the given API
+// key: the file-wide mapping overlaid with the app's own.
+func (r *Registry) InputMapping(apiKey string) map[string]string {
+	if r == nil {
+		return nil
+	}
+	app, ok := r.byKey[apiKey]
+	if !ok || len(app.Inputs) == 0 {
+		return r.file.Inputs
+	}
+	out := make(map[string]string, len(r.file.Inputs)+len(app.Inputs))
+	for k, v := range r.file.Inputs {
+		out[k] = v
+	}
+	for k, v := range app.Inputs {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,473 @@
+// Package batch runs message batches against Dify in the background.
+//
+// A Manager persists each batch and its per-request results in a store.Store
+// and executes pending requests with bounded concurrency. A dispatcher picks
+// up every stored batch that has not ended, so batches that were still in
+// progress when the process stopped are resumed on Start; requests that
+// already have a result are not re-run.
+package batch
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/store"
+)
+
+const (
+	batchBucket  = "batches"
+	resultBucket = "batch_results"
+
+	// Expiry is how long a batch may take before unfinished requests expire.
+	Expiry = 24 * time.Hour
+)
+
+// Processing statuses.
+const (
+	StatusInProgress = "in_progress"
+	StatusCanceling  = "canceling"
+	StatusEnded      = "ended"
+)
+
+// Result types.
+const (
+	ResultSucceeded = "succeeded"
+	ResultErrored   = "errored"
+	ResultCanceled  = "canceled"
+	ResultExpired   = "expired"
+)
+
+// ErrNotFound is returned when a batch does not exist or belongs to a
+// different owner.
+var ErrNotFound = errors.New("batch not found")
+
+// Request is one entry of a batch. Params is the protocol request body and is
+// interpreted only by the Executor. User, when set, overrides Batch.User.
+type Request struct {
+	CustomID string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+	User     string          `json:"user,omitempty"`
+	// Inputs are the Dify inputs, built when the batch is created.
+	Inputs map[string]any `json:"inputs,omitempty"`
+}
+
+// Counts tallies requests by state.
+type Counts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// Batch is the persisted state of one batch.
+type Batch struct {
+	ID                string     `json:"id"`
+	Status            string     `json:"status"`
+	Counts            Counts     `json:"counts"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	EndedAt           *time.Time `json:"ended_at,omitempty"`
+	CancelInitiatedAt *time.Time `json:"cancel_initiated_at,omitempty"`
+	Requests          []Request  `json:"requests"`
+
+	// KeyHash, the hash of the owner, scopes access.
+	KeyHash  string   `json:"key_hash"`
+	User     string   `json:"user"`
+	Tier     string   `json:"tier,omitempty"` // rate limit tier of the creator
+	Upstream Upstream `json:"upstream"`
+}
+
+// Upstream names the Dify key a batch's requests run with without storing
+// it: the virtual key or the registered app it is resolved from when each
+// request runs. A Dify key belonging to neither is held in APIKey in memory
+// only, so its requests cannot run after a restart.
+type Upstream struct {
+	KeyID  string `json:"key_id,omitempty"`
+	App    string `json:"app,omitempty"`
+	APIKey string `json:"-"`
+}
+
+// Result is the outcome of one request. Body is the protocol-specific result
+// object and is written verbatim to the results stream.
+type Result struct {
+	CustomID string          `json:"custom_id"`
+	Type     string          `json:"type"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Executor runs a single batch request and returns its result. It must not
+// return ResultCanceled or ResultExpired; the Manager produces those itself.
+type Executor func(ctx context.Context, b *Batch, req Request) Result
+
+// Manager owns batch state and the background dispatcher.
+type Manager struct {
+	store    store.Store
+	exec     Executor
+	idPrefix string
+	sem      chan struct{}
+	// wake asks the dispatcher to look for batches to run.
+	wake chan struct{}
+	now  func() time.Time
+
+	mu      sync.Mutex
+	running map[string]bool
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+	// apiKeys holds Upstream.APIKey by batch ID.
+	apiKeys map[string]string
+}
+
+// NewManager constructs a Manager. concurrency bounds the number of requests
+// executing at once across all batches; idPrefix is prepended to batch IDs.
+func NewManager(st store.Store, exec Executor, concurrency int, idPrefix string) *Manager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Manager{
+		store:    st,
+		exec:     exec,
+		idPrefix: idPrefix,
+		sem:      make(chan struct{}, concurrency),
+		wake:     make(chan struct{}, 1),
+		now:      time.Now,
+		running:  make(map[string]bool),
+		cancels:  make(map[string]context.CancelFunc),
+		apiKeys:  make(map[string]string),
+	}
+}
+
+// Start launches the dispatcher, which resumes batches left unfinished by a
+// previous run and then runs the batches Create stores. It stops when ctx is
+// cancelled.
+func (m *Manager) Start(ctx context.Context) error {
+	if err := m.dispatch(ctx, true); err != nil {
+		return err
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+				if err := m.dispatch(ctx, false); err != nil {
+					slog.Error("dispatch batches", "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// dispatch starts processing every stored batch that has not ended and is
+// not running yet.
+func (m *Manager) dispatch(ctx context.Context, resume bool) error {
+	var pending []string
+	err := m.store.List(batchBucket, "", func(key string, raw []byte) error {
+		var b Batch
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return fmt.Errorf("decode batch %s: %w", key, err)
+		}
+		if b.Status != StatusEnded {
+			pending = append(pending, b.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range pending {
+		if m.running[id] {
+			continue
+		}
+		if resume {
+			slog.Info("resuming batch", "batch_id", id)
+		}
+		m.running[id] = true
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.process(ctx, id)
+			m.mu.Lock()
+			delete(m.running, id)
+			m.mu.Unlock()
+		}()
+	}
+	return nil
+}
+
+// Wait blocks until the dispatcher and all running batches have returned.
+func (m *Manager) Wait() { m.wg.Wait() }
+
+// Create persists a new batch owned by owner, an opaque name of the caller,
+// and wakes the dispatcher to run it with the Dify key named by up. user and
+// tier are the caller's Dify user and rate limit tier.
+func (m *Manager) Create(owner string, up Upstream, user, tier string, reqs []Request) (*Batch, error) {
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("requests must not be empty")
+	}
+	seen := make(map[string]bool, len(reqs))
+	for i, r := range reqs {
+		if r.CustomID == "" {
+			return nil, fmt.Errorf("requests[%d]: custom_id must not be empty", i)
+		}
+		if seen[r.CustomID] {
+			return nil, fmt.Errorf("requests[%d]: duplicate custom_id %q", i, r.CustomID)
+		}
+		seen[r.CustomID] = true
+	}
+
+	now := m.now().UTC()
+	b := &Batch{
+		ID:        m.newID(now),
+		Status:    StatusInProgress,
+		Counts:    Counts{Processing: len(reqs)},
+		CreatedAt: now,
+		ExpiresAt: now.Add(Expiry),
+		Requests:  reqs,
+		KeyHash:   hashKey(owner),
+		User:      user,
+		Tier:      tier,
+		Upstream:  up,
+	}
+	// The key is held before the batch is stored, where the dispatcher can
+	// find it.
+	if up.APIKey != "" {
+		m.mu.Lock()
+		m.apiKeys[b.ID] = up.APIKey
+		m.mu.Unlock()
+	}
+	if err := m.store.Put(batchBucket, b.ID, b); err != nil {
+		m.mu.Lock()
+		delete(m.apiKeys, b.ID)
+		m.mu.Unlock()
+		return nil, err
+	}
+	// A wake-up already pending covers this batch too, as it is stored.
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return b, nil
+}
+
+// Get returns the batch with the given ID if it belongs to owner.
+func (m *Manager) Get(owner, id string) (*Batch, error) {
+	var b Batch
+	found, err := m.store.Get(batchBucket, id, &b)
+	if err != nil {
+		return nil, err
+	}
+	if !found || subtle.ConstantTimeCompare([]byte(b.KeyHash), []byte(hashKey(owner))) != 1 {
+		return nil, ErrNotFound
+	}
+	return &b, nil
+}
+
+// List returns the batches owned by owner, most recently created first.
+func (m *Manager) List(owner string) ([]*Batch, error) {
+	keyHash := hashKey(owner)
+	var out []*Batch
+	err := m.store.List(batchBucket, "", func(key string, raw []byte) error {
+		var b Batch
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return fmt.Errorf("decode batch %s: %w", key, err)
+		}
+		if b.KeyHash == keyHash {
+			out = append(out, &b)
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, err
+}
+
+// Cancel marks a batch as canceling. Requests that have not started yet are
+// recorded as canceled; requests already executing run to completion.
+func (m *Manager) Cancel(owner, id string) (*Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := m.Get(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status != StatusInProgress {
+		return b, nil
+	}
+	now := m.now().UTC()
+	b.Status = StatusCanceling
+	b.CancelInitiatedAt = &now
+	if err := m.store.Put(batchBucket, b.ID, b); err != nil {
+		return nil, err
+	}
+	if cancel, ok := m.cancels[b.ID]; ok {
+		cancel()
+	}
+	return b, nil
+}
+
+// Results calls fn for each result of an ended batch in request order.
+func (m *Manager) Results(owner, id string, fn func(Result) error) error {
+	b, err := m.Get(owner, id)
+	if err != nil {
+		return err
+	}
+	return m.store.List(resultBucket, b.ID+"/", func(key string, raw []byte) error {
+		var r Result
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return fmt.Errorf("decode result %s: %w", key, err)
+		}
+		return fn(r)
+	})
+}
+
+// process executes every request of a batch that does not have a result yet.
+func (m *Manager) process(ctx context.Context, id string) {
+	var b Batch
+	if found, err := m.store.Get(batchBucket, id, &b); err != nil || !found {
+		slog.Error("load batch", "batch_id", id, "error", err)
+		return
+	}
+
+	done := make(map[string]bool)
+	_ = m.store.List(resultBucket, id+"/", func(_ string, raw []byte) error {
+		var r Result
+		if json.Unmarshal(raw, &r) == nil {
+			done[r.CustomID] = true
+		}
+		return nil
+	})
+
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	m.mu.Lock()
+	b.Upstream.APIKey = m.apiKeys[id]
+	m.cancels[id] = cancel
+	// Re-read under the lock so a Cancel that raced with loading is not lost.
+	var cur Batch
+	if found, _ := m.store.Get(batchBucket, id, &cur); found && cur.Status == StatusCanceling {
+		cancel()
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.cancels, id)
+		m.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i, req := range b.Requests {
+		if done[req.CustomID] {
+			continue
+		}
+		acquired := false
+		select {
+		case m.sem <- struct{}{}:
+			acquired = true
+		case <-batchCtx.Done():
+		}
+		if acquired && (batchCtx.Err() != nil || m.now().After(b.ExpiresAt)) {
+			<-m.sem
+		}
+		switch {
+		case ctx.Err() != nil:
+			// Shutting down: leave the remaining requests for the next run.
+			wg.Wait()
+			return
+		case batchCtx.Err() != nil:
+			m.record(id, i, Result{CustomID: req.CustomID, Type: ResultCanceled})
+			continue
+		case m.now().After(b.ExpiresAt):
+			m.record(id, i, Result{CustomID: req.CustomID, Type: ResultExpired})
+			continue
+		}
+
+		// Requests run with the server context rather than batchCtx so that a
+		// cancel lets requests that already started finish normally.
+		wg.Add(1)
+		go func(i int, req Request) {
+			defer wg.Done()
+			defer func() { <-m.sem }()
+			res := m.exec(ctx, &b, req)
+			if ctx.Err() != nil {
+				return
+			}
+			res.CustomID = req.CustomID
+			m.record(id, i, res)
+		}(i, req)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if found, err := m.store.Get(batchBucket, id, &cur); err != nil || !found {
+		return
+	}
+	now := m.now().UTC()
+	cur.Status = StatusEnded
+	cur.EndedAt = &now
+	if err := m.store.Put(batchBucket, id, &cur); err != nil {
+		slog.Error("persist batch", "batch_id", id, "error", err)
+	}
+	delete(m.apiKeys, id)
+}
+
+// record persists one result and updates the batch counts.
+func (m *Manager) record(id string, index int, r Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.store.Put(resultBucket, fmt.Sprintf("%s/%08d", id, index), r); err != nil {
+		slog.Error("persist batch result", "batch_id", id, "custom_id", r.CustomID, "error", err)
+		return
+	}
+	var b Batch
+	if found, err := m.store.Get(batchBucket, id, &b); err != nil || !found {
+		return
+	}
+	b.Counts.Processing--
+	switch r.Type {
+	case ResultSucceeded:
+		b.Counts.Succeeded++
+	case ResultErrored:
+		b.Counts.Errored++
+	case ResultCanceled:
+		b.Counts.Canceled++
+	case ResultExpired:
+		b.Counts.Expired++
+	}
+	if err := m.store.Put(batchBucket, id, &b); err != nil {
+		slog.Error("persist batch", "batch_id", id, "error", err)
+	}
+}
+
+// newID returns an ID whose lexical order follows creation time.
+func (m *Manager) newID(now time.Time) string {
+	var buf [6]byte
+	_, _ = rand.Read(buf[:])
+	return fmt.Sprintf("%s%013x%s", m.idPrefix, now.UnixMilli(), hex.EncodeToString(buf[:]))
+}
+
+func hashKey(owner string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(owner)))
+	return hex.EncodeToString(sum[:])
+}
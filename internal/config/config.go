@@ -1,77 +1,490 @@
+// Package config loads the gateway configuration.
+//
+// Settings come, in increasing priority, from built-in defaults, the config
+// file named by --config (YAML or TOML), environment variables and command
+// line flags. Every flag can be set in the file under its name with dashes
+// replaced by underscores, e.g. dify_base_url; the file may also hold the
+// apps registry and the routing table inline, under apps and routes, and
+// the rate limits of individual users under user_limits and of access token
+// tiers under rate_tiers, the price table under prices and the budgets under
+// budgets.
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"maps"
+	"net/url"
 	"os"
-	"strconv"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/accounting"
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/fanout"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/jwtauth"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+	"github.com/zhengjr9/dify-agent/internal/tlsutil"
 )
 
 type Config struct {
-	DifyBaseURL    string
-	DifyAPIKey     string
-	DifyProxyURL   string
-	ListenAddr     string
-	DefaultUser    string
-	RequestTimeout time.Duration
+	// ConfigFile is the file the configuration was read from, if any.
+	ConfigFile string `yaml:"-" toml:"-"`
+
+	DifyBaseURL    string        `yaml:"dify_base_url" toml:"dify_base_url"`
+	DifyAPIKey     string        `yaml:"dify_api_key" toml:"dify_api_key"`
+	DifyProxyURL   string        `yaml:"dify_proxy_url" toml:"dify_proxy_url"`
+	ListenAddr     string        `yaml:"listen_addr" toml:"listen_addr"`
+	DefaultUser    string        `yaml:"default_user" toml:"default_user"`
+	RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout"`
+	// Upstream TLS
+	DifyCAFile        string `yaml:"dify_ca_file" toml:"dify_ca_file"`
+	DifyClientCert    string `yaml:"dify_client_cert" toml:"dify_client_cert"`
+	DifyClientKey     string `yaml:"dify_client_key" toml:"dify_client_key"`
+	DifyTLSMinVersion string `yaml:"dify_tls_min_version" toml:"dify_tls_min_version"`
+	// Listener TLS
+	TLSCertFile       string `yaml:"tls_cert_file" toml:"tls_cert_file"`
+	TLSKeyFile        string `yaml:"tls_key_file" toml:"tls_key_file"`
+	TLSClientCA       string `yaml:"tls_client_ca" toml:"tls_client_ca"`
+	TLSClientAuth     string `yaml:"tls_client_auth" toml:"tls_client_auth"`
+	TLSClientIdentity string `yaml:"tls_client_identity" toml:"tls_client_identity"`
+	TLSMinVersion     string `yaml:"tls_min_version" toml:"tls_min_version"`
+	// AppsFile is the JSON apps registry; see the apps package. Apps holds
+	// the registry inline instead.
+	AppsFile string     `yaml:"apps_file" toml:"apps_file"`
+	Apps     *apps.File `yaml:"apps,omitempty" toml:"apps,omitempty"`
+	// RoutesFile is the JSON model routing table; see the routes package.
+	// Routes holds the table inline instead.
+	RoutesFile string       `yaml:"routes_file" toml:"routes_file"`
+	Routes     *routes.File `yaml:"routes,omitempty" toml:"routes,omitempty"`
+	// AdminToken guards the /admin API; empty disables it.
+	AdminToken string `yaml:"admin_token" toml:"admin_token"`
+	// ShadowLog is the JSONL file shadow requests are recorded in.
+	ShadowLog string `yaml:"shadow_log" toml:"shadow_log"`
+	// Identity
+	UserSources    string `yaml:"user_sources" toml:"user_sources"`
+	UserTokenClaim string `yaml:"user_token_claim" toml:"user_token_claim"`
+	UserHash       bool   `yaml:"user_hash" toml:"user_hash"`
+	UserHashSalt   string `yaml:"user_hash_salt" toml:"user_hash_salt"`
+	UserPrefix     string `yaml:"user_prefix" toml:"user_prefix"`
+	TenantHeader   string `yaml:"tenant_header" toml:"tenant_header"`
+	// JWT authentication
+	JWTJWKSFile      string        `yaml:"jwt_jwks_file" toml:"jwt_jwks_file"`
+	JWTJWKSURL       string        `yaml:"jwt_jwks_url" toml:"jwt_jwks_url"`
+	JWTJWKSCache     time.Duration `yaml:"jwt_jwks_cache" toml:"jwt_jwks_cache"`
+	JWTIssuer        string        `yaml:"jwt_issuer" toml:"jwt_issuer"`
+	JWTAudience      string        `yaml:"jwt_audience" toml:"jwt_audience"`
+	JWTUserClaim     string        `yaml:"jwt_user_claim" toml:"jwt_user_claim"`
+	JWTRoutesClaim   string        `yaml:"jwt_routes_claim" toml:"jwt_routes_claim"`
+	JWTTierClaim     string        `yaml:"jwt_tier_claim" toml:"jwt_tier_claim"`
+	JWTAllowDifyKeys bool          `yaml:"jwt_allow_dify_keys" toml:"jwt_allow_dify_keys"`
+	// Rate limits
+	UserRPM     int `yaml:"user_rpm" toml:"user_rpm"`
+	UserTPM     int `yaml:"user_tpm" toml:"user_tpm"`
+	UserStreams int `yaml:"user_streams" toml:"user_streams"`
+	// UserLimits overrides the user limits for the users it names.
+	UserLimits map[string]ratelimit.Limits `yaml:"user_limits,omitempty" toml:"user_limits,omitempty"`
+	// RateTiers holds the user limits of the tiers named by access tokens.
+	RateTiers map[string]ratelimit.Limits `yaml:"rate_tiers,omitempty" toml:"rate_tiers,omitempty"`
+	// Usage accounting: PricesFile is the JSON price table, Prices holds it
+	// inline instead. Budgets are set in the file only.
+	PricesFile    string              `yaml:"prices_file" toml:"prices_file"`
+	Prices        accounting.Prices   `yaml:"prices,omitempty" toml:"prices,omitempty"`
+	Budgets       []accounting.Budget `yaml:"budgets,omitempty" toml:"budgets,omitempty"`
+	BudgetWebhook string              `yaml:"budget_webhook" toml:"budget_webhook"`
+	// Tokenizer
+	TokenizerDir      string `yaml:"tokenizer_dir" toml:"tokenizer_dir"`
+	TokenizerEncoding string `yaml:"tokenizer_encoding" toml:"tokenizer_encoding"`
+	// Fan-out
+	MaxCandidates     int `yaml:"max_candidates" toml:"max_candidates"`
+	FanoutConcurrency int `yaml:"fanout_concurrency" toml:"fanout_concurrency"`
+	// State
+	StateFile        string `yaml:"state_file" toml:"state_file"`
+	BatchConcurrency int    `yaml:"batch_concurrency" toml:"batch_concurrency"`
+	// MCP
+	MCPStdio bool `yaml:"-" toml:"-"`
 	// A2A
-	A2AEnabled bool
-	A2APort    int
-	AgentName  string
-	AgentDesc  string
+	A2AEnabled bool   `yaml:"a2a" toml:"a2a"`
+	A2APort    int    `yaml:"a2a_port" toml:"a2a_port"`
+	AgentName  string `yaml:"agent_name" toml:"agent_name"`
+	AgentDesc  string `yaml:"agent_desc" toml:"agent_desc"`
 }
 
+// Load parses the command line and exits on error; see Parse.
 func Load() *Config {
+	cfg, err := Parse(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// Parse builds the configuration from defaults, the config file, the
+// environment and args, in increasing priority, and validates it.
+func Parse(args []string) (*Config, error) {
+	// The first pass finds the config file and the flags set explicitly.
+	first, fs, _ := newFlagSet()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	var explicit []*flag.Flag
+	fs.Visit(func(f *flag.Flag) { explicit = append(explicit, f) })
+
+	cfg, fs, env := newFlagSet()
+	cfg.ConfigFile = first.ConfigFile
+	if cfg.ConfigFile != "" {
+		if err := readFile(cfg.ConfigFile, cfg); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range env {
+		v := os.Getenv(e.env)
+		if v == "" || slices.ContainsFunc(explicit, func(f *flag.Flag) bool { return f.Name == e.flag }) {
+			continue
+		}
+		if b, ok := fs.Lookup(e.flag).Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			v = strings.NewReplacer("yes", "true", "no", "false").Replace(v)
+		}
+		if err := fs.Set(e.flag, v); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.env, err)
+		}
+	}
+	for _, f := range explicit {
+		if err := fs.Set(f.Name, f.Value.String()); err != nil {
+			return nil, fmt.Errorf("-%s: %v", f.Name, err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// envBinding ties a flag to the environment variable that overrides it.
+type envBinding struct {
+	flag, env string
+}
+
+// newFlagSet returns a Config holding the defaults and a FlagSet bound to
+// it, with the environment variable of each flag.
+func newFlagSet() (*Config, *flag.FlagSet, []envBinding) {
 	cfg := &Config{}
+	fs := flag.NewFlagSet("dify-agent", flag.ContinueOnError)
+	var env []envBinding
+	bind := func(name, key string) { env = append(env, envBinding{name, key}) }
+	str := func(p *string, name, key, def, usage string) {
+		fs.StringVar(p, name, def, usage)
+		bind(name, key)
+	}
+	boolean := func(p *bool, name, key string, def bool, usage string) {
+		fs.BoolVar(p, name, def, usage)
+		bind(name, key)
+	}
+	integer := func(p *int, name, key string, def int, usage string) {
+		fs.IntVar(p, name, def, usage)
+		bind(name, key)
+	}
+
+	fs.StringVar(&cfg.ConfigFile, "config", os.Getenv("CONFIG_FILE"), "YAML (.yaml, .yml) or TOML (.toml) config file; environment variables and flags override it")
+
+	str(&cfg.DifyBaseURL, "dify-base-url", "DIFY_BASE_URL", "http://localhost", "Dify instance base URL or full endpoint URL")
+	str(&cfg.DifyAPIKey, "dify-api-key", "DIFY_API_KEY", "", "Dify API key (required for A2A; used by Ollama clients that send none; otherwise the proxy passes the caller's key)")
+	str(&cfg.DifyProxyURL, "dify-proxy-url", "DIFY_PROXY_URL", "", "HTTP/HTTPS proxy URL for Dify requests (e.g. http://proxy:8080)")
+	str(&cfg.ListenAddr, "listen-addr", "LISTEN_ADDR", ":8080", "Proxy listen address")
+	str(&cfg.DefaultUser, "default-user", "DEFAULT_USER", "dify-agent", "Default user field for Dify requests")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", 120*time.Second, "Dify round-trip timeout")
+	bind("request-timeout", "REQUEST_TIMEOUT")
+
+	str(&cfg.DifyCAFile, "dify-ca-file", "DIFY_CA_FILE", "", "PEM CA bundle verifying Dify's certificate (empty: system roots)")
+	str(&cfg.DifyClientCert, "dify-client-cert", "DIFY_CLIENT_CERT", "", "PEM client certificate presented to Dify (requires --dify-client-key)")
+	str(&cfg.DifyClientKey, "dify-client-key", "DIFY_CLIENT_KEY", "", "PEM key of --dify-client-cert")
+	str(&cfg.DifyTLSMinVersion, "dify-tls-min-version", "DIFY_TLS_MIN_VERSION", "1.2", "Lowest TLS version used towards Dify (1.0 | 1.1 | 1.2 | 1.3)")
+
+	str(&cfg.TLSCertFile, "tls-cert-file", "TLS_CERT_FILE", "", "PEM certificate chain served by the proxy and A2A listeners (empty: plain HTTP)")
+	str(&cfg.TLSKeyFile, "tls-key-file", "TLS_KEY_FILE", "", "PEM key of --tls-cert-file")
+	str(&cfg.TLSClientCA, "tls-client-ca", "TLS_CLIENT_CA", "", "PEM CA bundle verifying client certificates (empty: no client certificates)")
+	str(&cfg.TLSClientAuth, "tls-client-auth", "TLS_CLIENT_AUTH", tlsutil.ClientAuthRequire, "Client certificates with --tls-client-ca: require, or optional to verify them only when presented")
+	str(&cfg.TLSClientIdentity, "tls-client-identity", "TLS_CLIENT_IDENTITY", tlsutil.IdentityCN, "Client certificate field naming the Dify user (cn | dn | email | uri | none)")
+	str(&cfg.TLSMinVersion, "tls-min-version", "TLS_MIN_VERSION", "1.2", "Lowest TLS version accepted by the listeners (1.0 | 1.1 | 1.2 | 1.3)")
+
+	str(&cfg.AppsFile, "apps-file", "APPS_FILE", "", "JSON file describing Dify apps and their input mappings (empty: none)")
+	str(&cfg.AdminToken, "admin-token", "ADMIN_TOKEN", "", "Bearer token for the /admin API, which manages virtual keys (empty: disabled)")
+	str(&cfg.RoutesFile, "routes-file", "ROUTES_FILE", "", "JSON file mapping model names to Dify apps (empty: the caller's key selects the app)")
+	str(&cfg.ShadowLog, "shadow-log", "SHADOW_LOG", "", "JSONL file recording shadow requests; required when routes have a shadow")
+
+	str(&cfg.UserSources, "user-sources", "USER_SOURCES", strings.Join(identity.DefaultSources, ","), "Comma-separated Dify user sources in priority order (header, body, token, default)")
+	str(&cfg.UserTokenClaim, "user-token-claim", "USER_TOKEN_CLAIM", "sub", "JWT claim used by the token user source")
+	boolean(&cfg.UserHash, "user-hash", "USER_HASH", false, "Replace caller-supplied users with an HMAC-SHA256 digest")
+	str(&cfg.UserHashSalt, "user-hash-salt", "USER_HASH_SALT", "", "HMAC key for --user-hash")
+	str(&cfg.UserPrefix, "user-prefix", "USER_PREFIX", "", "Prefix prepended to caller-supplied users")
+	str(&cfg.TenantHeader, "tenant-header", "TENANT_HEADER", "", "Header whose value namespaces users as <tenant>:<user> (empty: disabled)")
+
+	str(&cfg.JWTJWKSFile, "jwt-jwks-file", "JWT_JWKS_FILE", "", "JSON Web Key Set file verifying caller JWTs (empty: JWT authentication disabled unless --jwt-jwks-url is set)")
+	str(&cfg.JWTJWKSURL, "jwt-jwks-url", "JWT_JWKS_URL", "", "URL of the JSON Web Key Set verifying caller JWTs, e.g. the issuer's jwks_uri")
+	fs.DurationVar(&cfg.JWTJWKSCache, "jwt-jwks-cache", 10*time.Minute, "How long keys fetched from --jwt-jwks-url are cached")
+	bind("jwt-jwks-cache", "JWT_JWKS_CACHE")
+	str(&cfg.JWTIssuer, "jwt-issuer", "JWT_ISSUER", "", "Required iss claim of caller JWTs (empty: any)")
+	str(&cfg.JWTAudience, "jwt-audience", "JWT_AUDIENCE", "", "Comma-separated accepted aud claims of caller JWTs (empty: any)")
+	str(&cfg.JWTUserClaim, "jwt-user-claim", "JWT_USER_CLAIM", "sub", "JWT claim naming the Dify user")
+	str(&cfg.JWTRoutesClaim, "jwt-routes-claim", "JWT_ROUTES_CLAIM", "", "JWT claim listing the models and apps the caller may use (empty: any)")
+	str(&cfg.JWTTierClaim, "jwt-tier-claim", "JWT_TIER_CLAIM", "", "JWT claim naming the caller's rate limit tier in rate_tiers (empty: none)")
+	boolean(&cfg.JWTAllowDifyKeys, "jwt-allow-dify-keys", "JWT_ALLOW_DIFY_KEYS", false, "Also accept callers presenting a Dify key instead of a JWT")
+
+	integer(&cfg.UserRPM, "user-rpm", "USER_RPM", 0, "Requests per minute allowed to each resolved user (0: unlimited)")
+	integer(&cfg.UserTPM, "user-tpm", "USER_TPM", 0, "Prompt and completion tokens per minute allowed to each resolved user (0: unlimited)")
+	integer(&cfg.UserStreams, "user-streams", "USER_STREAMS", 0, "Concurrent streaming requests allowed to each resolved user (0: unlimited)")
+
+	str(&cfg.PricesFile, "prices-file", "PRICES_FILE", "", "JSON file with per-model prices per million prompt and completion tokens (empty: usage is recorded without cost)")
+	str(&cfg.BudgetWebhook, "budget-webhook", "BUDGET_WEBHOOK", "", "URL posted to when a budget crosses a threshold (empty: log only)")
 
-	flag.StringVar(&cfg.DifyBaseURL, "dify-base-url", getEnv("DIFY_BASE_URL", "http://localhost"), "Dify instance base URL or full endpoint URL")
-	flag.StringVar(&cfg.DifyAPIKey, "dify-api-key", getEnv("DIFY_API_KEY", ""), "Dify API key (required for A2A; proxy passes caller's key)")
-	flag.StringVar(&cfg.DifyProxyURL, "dify-proxy-url", getEnv("DIFY_PROXY_URL", ""), "HTTP/HTTPS proxy URL for Dify requests (e.g. http://proxy:8080)")
-	flag.StringVar(&cfg.ListenAddr, "listen-addr", getEnv("LISTEN_ADDR", ":8080"), "Proxy listen address")
-	flag.StringVar(&cfg.DefaultUser, "default-user", getEnv("DEFAULT_USER", "dify-agent"), "Default user field for Dify requests")
+	str(&cfg.TokenizerDir, "tokenizer-dir", "TOKENIZER_DIR", "", "Directory holding <encoding>.tiktoken rank files (empty: approximate counts)")
+	str(&cfg.TokenizerEncoding, "tokenizer-encoding", "TOKENIZER_ENCODING", "cl100k_base", "Default tokenizer encoding for unrecognised models (cl100k_base | o200k_base)")
 
-	timeoutStr := getEnv("REQUEST_TIMEOUT", "120s")
-	defaultTimeout, _ := time.ParseDuration(timeoutStr)
-	if defaultTimeout == 0 {
-		defaultTimeout = 120 * time.Second
+	integer(&cfg.MaxCandidates, "max-candidates", "MAX_CANDIDATES", 8, "Maximum OpenAI n / Gemini candidateCount per request")
+	integer(&cfg.FanoutConcurrency, "fanout-concurrency", "FANOUT_CONCURRENCY", 4, "Maximum concurrent Dify requests per multi-candidate request")
+
+	str(&cfg.StateFile, "state-file", "STATE_FILE", "", "BoltDB file for persistent gateway state such as message batches (empty: in-memory)")
+	integer(&cfg.BatchConcurrency, "batch-concurrency", "BATCH_CONCURRENCY", 4, "Maximum concurrent Dify requests executed for message batches")
+
+	boolean(&cfg.MCPStdio, "mcp-stdio", "MCP_STDIO", false, "Serve the Dify apps as MCP tools over stdin/stdout instead of starting the servers")
+
+	boolean(&cfg.A2AEnabled, "a2a", "A2A_ENABLED", false, "Enable A2A server alongside the proxy")
+	integer(&cfg.A2APort, "a2a-port", "A2A_PORT", 8000, "A2A server listen port")
+	str(&cfg.AgentName, "agent-name", "AGENT_NAME", "dify-agent", "A2A AgentCard name")
+	str(&cfg.AgentDesc, "agent-desc", "AGENT_DESC", "Dify-backed agent exposed via A2A protocol", "A2A AgentCard description")
+
+	return cfg, fs, env
+}
+
+// Validate reports every invalid setting, naming each by its file key.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+	}
+	if u, err := url.Parse(c.DifyBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("dify_base_url", "must be an http or https URL, got %q", c.DifyBaseURL)
+	}
+	if c.DifyProxyURL != "" {
+		if u, err := url.Parse(c.DifyProxyURL); err != nil || u.Host == "" {
+			fail("dify_proxy_url", "must be a URL, got %q", c.DifyProxyURL)
+		}
+	}
+	if c.ListenAddr == "" {
+		fail("listen_addr", "must not be empty")
 	}
-	flag.DurationVar(&cfg.RequestTimeout, "request-timeout", defaultTimeout, "Dify round-trip timeout")
+	if !tlsutil.ValidVersion(c.TLSMinVersion) {
+		fail("tls_min_version", "must be 1.0, 1.1, 1.2 or 1.3, got %q", c.TLSMinVersion)
+	} else if _, err := tlsutil.NewServer(c.ServerTLS()); err != nil {
+		errs = append(errs, err)
+	}
+	if !tlsutil.ValidVersion(c.DifyTLSMinVersion) {
+		fail("dify_tls_min_version", "must be 1.0, 1.1, 1.2 or 1.3, got %q", c.DifyTLSMinVersion)
+	} else if _, err := tlsutil.NewClient(c.DifyTLS()); err != nil {
+		errs = append(errs, fmt.Errorf("dify %w", err))
+	}
+	if !tlsutil.ValidIdentity(c.TLSClientIdentity) {
+		fail("tls_client_identity", "must be cn, dn, email, uri or none, got %q", c.TLSClientIdentity)
+	}
+	if c.RequestTimeout <= 0 {
+		fail("request_timeout", "must be positive, got %s", c.RequestTimeout)
+	}
+	if c.TokenizerEncoding != "cl100k_base" && c.TokenizerEncoding != "o200k_base" {
+		fail("tokenizer_encoding", "must be cl100k_base or o200k_base, got %q", c.TokenizerEncoding)
+	}
+	if c.MaxCandidates < 1 {
+		fail("max_candidates", "must be at least 1, got %d", c.MaxCandidates)
+	}
+	if c.FanoutConcurrency < 1 {
+		fail("fanout_concurrency", "must be at least 1, got %d", c.FanoutConcurrency)
+	}
+	if c.BatchConcurrency < 1 {
+		fail("batch_concurrency", "must be at least 1, got %d", c.BatchConcurrency)
+	}
+	if c.A2APort < 1 || c.A2APort > 65535 {
+		fail("a2a_port", "must be a port number, got %d", c.A2APort)
+	}
+	for _, l := range []struct {
+		key   string
+		value int
+	}{{"user_rpm", c.UserRPM}, {"user_tpm", c.UserTPM}, {"user_streams", c.UserStreams}} {
+		if l.value < 0 {
+			fail(l.key, "must not be negative, got %d", l.value)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.UserLimits)) {
+		if err := c.UserLimits[name].Validate(); err != nil {
+			fail("user_limits", "%s: %v", name, err)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.RateTiers)) {
+		if err := c.RateTiers[name].Validate(); err != nil {
+			fail("rate_tiers", "%s: %v", name, err)
+		}
+	}
+	if c.Prices != nil && c.PricesFile != "" {
+		fail("prices", "cannot be combined with prices_file")
+	} else if _, err := c.Usage(); err != nil {
+		fail("prices", "%v", err)
+	}
+	names := map[string]bool{}
+	for i, b := range c.Budgets {
+		if err := b.Validate(); err != nil {
+			fail("budgets", "[%d]: %v", i, err)
+		} else if names[b.Name] {
+			fail("budgets", "[%d]: duplicate name %q", i, b.Name)
+		}
+		names[b.Name] = true
+		if b.Webhook != "" {
+			if u, err := url.Parse(b.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				fail("budgets", "[%d]: webhook must be an http or https URL", i)
+			}
+		}
+	}
+	if c.BudgetWebhook != "" {
+		if u, err := url.Parse(c.BudgetWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fail("budget_webhook", "must be an http or https URL")
+		}
+	}
+	if _, err := identity.New(c.Identity()); err != nil {
+		errs = append(errs, err)
+	}
+	if c.JWTJWKSURL != "" {
+		if u, err := url.Parse(c.JWTJWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("jwt_jwks_url", "must be an http or https URL, got %q", c.JWTJWKSURL)
+		}
+	}
+	if _, err := jwtauth.New(c.JWT()); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Apps != nil && c.AppsFile != "" {
+		fail("apps", "cannot be combined with apps_file")
+	} else if _, err := c.LoadApps(); err != nil {
+		fail("apps", "%v", err)
+	}
+	if c.Routes != nil && c.RoutesFile != "" {
+		fail("routes", "cannot be combined with routes_file")
+	} else if table, err := c.LoadRoutes(func(string) *dify.Client { return &dify.Client{} }); err != nil {
+		fail("routes", "%v", err)
+	} else if table.HasShadows() && c.ShadowLog == "" {
+		fail("shadow_log", "is required when routes have a shadow")
+	}
+	return errors.Join(errs...)
+}
 
-	flag.BoolVar(&cfg.A2AEnabled, "a2a", getEnvBool("A2A_ENABLED", false), "Enable A2A server alongside the proxy")
-	flag.IntVar(&cfg.A2APort, "a2a-port", getEnvInt("A2A_PORT", 8000), "A2A server listen port")
-	flag.StringVar(&cfg.AgentName, "agent-name", getEnv("AGENT_NAME", "dify-agent"), "A2A AgentCard name")
-	flag.StringVar(&cfg.AgentDesc, "agent-desc", getEnv("AGENT_DESC", "Dify-backed agent exposed via A2A protocol"), "A2A AgentCard description")
+// LoadApps returns the apps registry held inline or in the apps file.
+func (c *Config) LoadApps() (*apps.Registry, error) {
+	if c.Apps != nil {
+		return apps.New(*c.Apps)
+	}
+	return apps.Load(c.AppsFile)
+}
 
-	flag.Parse()
-	return cfg
+// LoadRoutes returns the routing table held inline or in the routes file.
+// newClient is passed to routes.New.
+func (c *Config) LoadRoutes(newClient func(baseURL string) *dify.Client) (*routes.Table, error) {
+	if c.Routes != nil {
+		return routes.New(*c.Routes, newClient)
+	}
+	return routes.Load(c.RoutesFile, newClient)
 }
 
-func getEnv(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// Identity returns the identity.Config described by the user flags.
+func (c *Config) Identity() identity.Config {
+	var sources []string
+	for _, s := range strings.Split(c.UserSources, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			sources = append(sources, s)
+		}
+	}
+	return identity.Config{
+		Sources:      sources,
+		Default:      c.DefaultUser,
+		TokenClaim:   c.UserTokenClaim,
+		Hash:         c.UserHash,
+		HashSalt:     c.UserHashSalt,
+		Prefix:       c.UserPrefix,
+		TenantHeader: c.TenantHeader,
 	}
-	return fallback
 }
 
-func getEnvBool(key string, fallback bool) bool {
-	v := os.Getenv(key)
-	switch v {
-	case "true", "1", "yes":
-		return true
-	case "false", "0", "no":
-		return false
+// DifyTLS returns the TLS settings of connections to Dify.
+func (c *Config) DifyTLS() tlsutil.ClientConfig {
+	return tlsutil.ClientConfig{
+		CAFile:     c.DifyCAFile,
+		CertFile:   c.DifyClientCert,
+		KeyFile:    c.DifyClientKey,
+		MinVersion: c.DifyTLSMinVersion,
 	}
-	return fallback
 }
 
-func getEnvInt(key string, fallback int) int {
-	v := os.Getenv(key)
-	if v == "" {
-		return fallback
+// ServerTLS returns the TLS settings of the proxy and A2A listeners.
+func (c *Config) ServerTLS() tlsutil.ServerConfig {
+	return tlsutil.ServerConfig{
+		CertFile:     c.TLSCertFile,
+		KeyFile:      c.TLSKeyFile,
+		ClientCAFile: c.TLSClientCA,
+		ClientAuth:   c.TLSClientAuth,
+		MinVersion:   c.TLSMinVersion,
 	}
-	n, err := strconv.Atoi(v)
-	if err != nil {
-		return fallback
+}
+
+// JWT returns the jwtauth.Config described by the JWT flags.
+func (c *Config) JWT() jwtauth.Config {
+	var audience []string
+	for _, a := range strings.Split(c.JWTAudience, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			audience = append(audience, a)
+		}
 	}
-	return n
+	return jwtauth.Config{
+		JWKSFile:      c.JWTJWKSFile,
+		JWKSURL:       c.JWTJWKSURL,
+		CacheTTL:      c.JWTJWKSCache,
+		Issuer:        c.JWTIssuer,
+		Audience:      audience,
+		UserClaim:     c.JWTUserClaim,
+		RoutesClaim:   c.JWTRoutesClaim,
+		TierClaim:     c.JWTTierClaim,
+		AllowDifyKeys: c.JWTAllowDifyKeys,
+	}
+}
+
+// RateLimits returns the limits of resolved users described by the user
+// rate limit settings and the tiers.
+func (c *Config) RateLimits() ratelimit.Users {
+	return ratelimit.Users{
+		Default: ratelimit.Limits{RPM: c.UserRPM, TPM: c.UserTPM, Streams: c.UserStreams},
+		ByUser:  c.UserLimits,
+		Tiers:   c.RateTiers,
+	}
+}
+
+// Usage returns the price table, held inline or in the prices file, and the
+// budgets.
+func (c *Config) Usage() (accounting.Config, error) {
+	prices := c.Prices
+	if prices == nil {
+		var err error
+		if prices, err = accounting.LoadPrices(c.PricesFile); err != nil {
+			return accounting.Config{}, err
+		}
+	} else if err := prices.Validate(); err != nil {
+		return accounting.Config{}, err
+	}
+	return accounting.Config{Prices: prices, Budgets: c.Budgets, Webhook: c.BudgetWebhook}, nil
+}
+
+// Fanout returns the fanout.Limits described by the candidate flags.
+func (c *Config) Fanout() fanout.Limits {
+	return fanout.Limits{MaxCandidates: c.MaxCandidates, Concurrency: c.FanoutConcurrency}
 }
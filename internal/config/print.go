@@ -0,0 +1,66 @@
+package config
+
+import (
+	"io"
+	"net/url"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets in Redacted.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of c with its secrets replaced: the Dify key, the
+// user hash salt, the admin token, the proxy password, the keys of inline
+// apps and routes and the budget webhooks, whose URLs often embed tokens.
+func (c *Config) Redacted() *Config {
+	out := *c
+	hide := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	hide(&out.DifyAPIKey)
+	hide(&out.UserHashSalt)
+	hide(&out.AdminToken)
+	hide(&out.BudgetWebhook)
+	out.Budgets = slices.Clone(c.Budgets)
+	for i := range out.Budgets {
+		hide(&out.Budgets[i].Webhook)
+	}
+	if u, err := url.Parse(out.DifyProxyURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			out.DifyProxyURL = u.String()
+		}
+	}
+	if c.Apps != nil {
+		f := *c.Apps
+		f.Apps = slices.Clone(f.Apps)
+		for i := range f.Apps {
+			hide(&f.Apps[i].APIKey)
+		}
+		out.Apps = &f
+	}
+	if c.Routes != nil {
+		f := *c.Routes
+		f.Routes = slices.Clone(f.Routes)
+		for i := range f.Routes {
+			hide(&f.Routes[i].APIKey)
+		}
+		out.Routes = &f
+	}
+	return &out
+}
+
+// Print writes the effective configuration to w as YAML, with secrets
+// redacted. The output is a valid config file.
+func (c *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Watch re-reads the configuration from args on SIGHUP and, when path is not
+// empty, whenever the file at path changes, checked every interval. Each
+// valid configuration is passed to apply; invalid ones are logged and
+// ignored, leaving the running configuration in place. Watch returns when
+// ctx is done.
+func Watch(ctx context.Context, args []string, path string, interval time.Duration, apply func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var ticks <-chan time.Time
+	last := stat(path)
+	if path != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	reload := func(reason string) {
+		cfg, err := Parse(args)
+		if err != nil {
+			slog.Error("config reload failed; keeping the running configuration", "reason", reason, "error", err)
+			return
+		}
+		slog.Info("config reloaded", "reason", reason)
+		apply(cfg)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last = stat(path)
+			reload("SIGHUP")
+		case <-ticks:
+			if cur := stat(path); cur != last {
+				last = cur
+				reload("file changed")
+			}
+		}
+	}
+}
+
+// fileState identifies a version of a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func stat(path string) fileState {
+	if path == "" {
+		return fileState{}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{fi.ModTime(), fi.Size()}
+}
@@ -4,10 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"strings"
 	"time"
@@ -23,17 +27,37 @@ type Client struct {
 	httpClient *http.Client
 	// streamTransport is used by streaming requests (no timeout, but same proxy).
 	streamTransport http.RoundTripper
+	// mode is the app mode messages are sent for; see WithMode.
+	mode string
+}
+
+// App modes a Client can send messages for.
+const (
+	// ModeChat covers chat and chatflow apps, served by /v1/chat-messages.
+	ModeChat = "chat"
+	// ModeAgent covers agent apps. They are served by /v1/chat-messages but
+	// only in streaming mode, so blocking calls are collected from a stream.
+	ModeAgent = "agent"
+	// ModeCompletion covers text generation apps, served by
+	// /v1/completion-messages. The query is sent as the query input.
+	ModeCompletion = "completion"
+)
+
+// ValidMode reports whether mode is one of the supported app modes.
+func ValidMode(mode string) bool {
+	return mode == ModeChat || mode == ModeAgent || mode == ModeCompletion
 }
 
 // NewClient constructs a Client with the given base URL (or full endpoint URL), timeout,
 // and optional proxy URL. proxyURL may be empty to use the default environment proxy.
-func NewClient(baseURL string, timeout time.Duration, proxyURL string) *Client {
+// tlsConfig configures HTTPS connections; nil uses the defaults.
+func NewClient(baseURL string, timeout time.Duration, proxyURL string, tlsConfig *tls.Config) *Client {
 	chatURL := strings.TrimRight(baseURL, "/")
 	if !strings.HasSuffix(chatURL, "/v1/chat-messages") {
 		chatURL += "/v1/chat-messages"
 	}
 
-	transport := &http.Transport{}
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
 	if proxyURL != "" {
 		parsed, err := url.Parse(proxyURL)
 		if err == nil {
@@ -50,18 +74,64 @@ func NewClient(baseURL string, timeout time.Duration, proxyURL string) *Client {
 			Transport: transport,
 		},
 		streamTransport: transport,
+		mode:            ModeChat,
+	}
+}
+
+// WithMode returns a Client sharing c's connections that sends messages for
+// apps of the given mode. An empty mode means ModeChat.
+func (c *Client) WithMode(mode string) *Client {
+	if mode == "" {
+		mode = ModeChat
+	}
+	out := *c
+	out.mode = mode
+	return &out
+}
+
+// Mode returns the app mode messages are sent for.
+func (c *Client) Mode() string {
+	return c.mode
+}
+
+// messagesURL returns the endpoint messages are sent to.
+func (c *Client) messagesURL() string {
+	if c.mode == ModeCompletion {
+		return c.APIURL("/completion-messages")
 	}
+	return c.chatURL
+}
+
+// marshalMessage encodes req for the endpoint of c's mode.
+func (c *Client) marshalMessage(req *ChatRequest) ([]byte, error) {
+	if c.mode != ModeCompletion {
+		return json.Marshal(req)
+	}
+	inputs := make(map[string]any, len(req.Inputs)+1)
+	for k, v := range req.Inputs {
+		inputs[k] = v
+	}
+	inputs["query"] = req.Query
+	return json.Marshal(CompletionRequest{Inputs: inputs, ResponseMode: req.ResponseMode, User: req.User, Files: req.Files})
 }
 
 // SendBlocking sends a blocking chat-messages request and returns the parsed response.
+// Agent apps are run in streaming mode and their answer collected.
 func (c *Client) SendBlocking(ctx context.Context, apiKey string, req *ChatRequest) (*BlockingResponse, error) {
+	if c.mode == ModeAgent {
+		stream, err := c.SendStreaming(ctx, apiKey, req)
+		if err != nil {
+			return nil, err
+		}
+		return Collect(stream)
+	}
 	req.ResponseMode = "blocking"
-	body, err := json.Marshal(req)
+	body, err := c.marshalMessage(req)
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.chatURL, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.messagesURL(), bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("build request: %w", err)
 	}
@@ -79,7 +149,7 @@ func (c *Client) SendBlocking(ctx context.Context, apiKey string, req *ChatReque
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		raw, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("dify %d: %s", resp.StatusCode, string(raw))
+		return nil, newAPIError(resp.StatusCode, raw)
 	}
 
 	var result BlockingResponse
@@ -93,12 +163,12 @@ func (c *Client) SendBlocking(ctx context.Context, apiKey string, req *ChatReque
 // The HTTP response body is closed when the channel is drained.
 func (c *Client) SendStreaming(ctx context.Context, apiKey string, req *ChatRequest) (<-chan StreamEvent, error) {
 	req.ResponseMode = "streaming"
-	body, err := json.Marshal(req)
+	body, err := c.marshalMessage(req)
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.chatURL, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.messagesURL(), bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("build request: %w", err)
 	}
@@ -120,7 +190,7 @@ func (c *Client) SendStreaming(ctx context.Context, apiKey string, req *ChatRequ
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		raw, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		return nil, fmt.Errorf("dify %d: %s", resp.StatusCode, string(raw))
+		return nil, newAPIError(resp.StatusCode, raw)
 	}
 
 	scanner := bufio.NewScanner(resp.Body)
@@ -135,3 +205,145 @@ func (c *Client) SendStreaming(ctx context.Context, apiKey string, req *ChatRequ
 	}()
 	return ch, nil
 }
+
+// StopTask asks Dify to stop generating for a streaming task. Only the user
+// that started the task may stop it.
+func (c *Client) StopTask(ctx context.Context, apiKey, taskID, user string) error {
+	body, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.messagesURL()+"/"+url.PathEscape(taskID)+"/stop", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+	if user != "" {
+		httpReq.Header.Set("AIGC-USER", user)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("dify request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, raw)
+	}
+	return nil
+}
+
+// GetParameters fetches the app's GET /v1/parameters, which describes the
+// input variables the app accepts.
+func (c *Client) GetParameters(ctx context.Context, apiKey, user string) (*Parameters, error) {
+	u := c.APIURL("/parameters")
+	if user != "" {
+		u += "?user=" + url.QueryEscape(user)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("dify request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(resp.Body)
+		return nil, newAPIError(resp.StatusCode, raw)
+	}
+
+	var result Parameters
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &result, nil
+}
+
+// UploadFile uploads a file through POST /v1/files/upload so that it can be
+// attached to a chat request as a local_file input. It returns the upload ID.
+func (c *Client) UploadFile(ctx context.Context, apiKey, user, filename, contentType string, data []byte) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return "", fmt.Errorf("build upload: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", fmt.Errorf("build upload: %w", err)
+	}
+	if err := mw.WriteField("user", user); err != nil {
+		return "", fmt.Errorf("build upload: %w", err)
+	}
+	if err := mw.Close(); err != nil {
+		return "", fmt.Errorf("build upload: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.APIURL("/files/upload"), &body)
+	if err != nil {
+		return "", fmt.Errorf("build request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", mw.FormDataContentType())
+	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("dify request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(resp.Body)
+		return "", newAPIError(resp.StatusCode, raw)
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decode response: %w", err)
+	}
+	return result.ID, nil
+}
+
+// UploadImages uploads images and returns them as image file inputs. Each
+// image's content type is sniffed from its bytes.
+func (c *Client) UploadImages(ctx context.Context, apiKey, user string, images [][]byte) ([]FileInput, error) {
+	files := make([]FileInput, len(images))
+	for i, data := range images {
+		ct := http.DetectContentType(data)
+		name := fmt.Sprintf("image-%d", i+1)
+		if exts, _ := mime.ExtensionsByType(ct); len(exts) > 0 {
+			name += exts[0]
+		}
+		id, err := c.UploadFile(ctx, apiKey, user, name, ct, data)
+		if err != nil {
+			return nil, fmt.Errorf("upload image: %w", err)
+		}
+		files[i] = FileInput{Type: "image", TransferMethod: "local_file", UploadFileID: id}
+	}
+	return files, nil
+}
+
+// APIURL returns the URL of an endpoint of the Dify app API, which lives
+// next to chat-messages under /v1; path is relative to /v1, e.g. "/parameters".
+func (c *Client) APIURL(path string) string {
+	return strings.TrimSuffix(c.chatURL, "/chat-messages") + path
+}
+
+// Transport returns the transport used for Dify requests. It has no timeout,
+// so callers relaying streams must bound them with a context.
+func (c *Client) Transport() http.RoundTripper {
+	return c.streamTransport
+}
@@ -0,0 +1,45 @@
+package dify
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// APIError is an error reported by Dify, either as a non-2xx response or as
+// an error event in a stream.
+type APIError struct {
+	// Status is the HTTP status Dify reported.
+	Status int
+	// Code is Dify's error code, e.g. app_unavailable or
+	// provider_quota_exceeded; empty when the body carried none.
+	Code    string
+	Message string
+
+	body   string
+	stream bool
+}
+
+// newAPIError returns the error for a non-2xx response with the given body.
+func newAPIError(status int, body []byte) *APIError {
+	e := &APIError{Status: status, body: string(body)}
+	var parsed struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		e.Code, e.Message = parsed.Code, parsed.Message
+	}
+	return e
+}
+
+// EventError returns the error an error event of a stream reports.
+func EventError(ev StreamEvent) *APIError {
+	return &APIError{Status: ev.Status, Code: ev.Code, Message: ev.Message, stream: true}
+}
+
+func (e *APIError) Error() string {
+	if e.stream {
+		return fmt.Sprintf("dify stream error %d %s: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("dify %d: %s", e.Status, e.body)
+}
@@ -39,3 +39,38 @@ func ReadStream(scanner *bufio.Scanner) <-chan StreamEvent {
 	}()
 	return ch
 }
+
+// Collect drains a stream into the BlockingResponse a blocking request would
+// have returned. Unlike a blocking response, it records whether output
+// moderation replaced the answer, in Moderated and Blocked.
+func Collect(stream <-chan StreamEvent) (*BlockingResponse, error) {
+	var (
+		out    BlockingResponse
+		answer strings.Builder
+	)
+	for ev := range stream {
+		if ev.Err != nil {
+			return nil, ev.Err
+		}
+		if out.MessageID == "" {
+			out.MessageID, out.ConversationID, out.CreatedAt = ev.MessageID, ev.ConversationID, ev.CreatedAt
+		}
+		switch ev.Event {
+		case "message", "agent_message":
+			answer.WriteString(ev.Answer)
+		case "message_replace":
+			if !out.Moderated {
+				out.Blocked = answer.Len() == 0
+			}
+			answer.Reset()
+			answer.WriteString(ev.Answer)
+			out.Moderated = true
+		case "message_end":
+			out.Metadata = ev.Metadata
+		case "error":
+			return nil, EventError(ev)
+		}
+	}
+	out.Answer = answer.String()
+	return &out, nil
+}
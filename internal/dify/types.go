@@ -18,14 +18,28 @@ type ChatRequest struct {
 	Files          []FileInput    `json:"files,omitempty"`
 }
 
+// CompletionRequest is sent to POST /v1/completion-messages. It has no
+// conversation; the query travels in Inputs.
+type CompletionRequest struct {
+	Inputs       map[string]any `json:"inputs"`
+	ResponseMode string         `json:"response_mode"`
+	User         string         `json:"user"`
+	Files        []FileInput    `json:"files,omitempty"`
+}
+
 // BlockingResponse is the full Dify response for response_mode=blocking.
 type BlockingResponse struct {
-	MessageID          string         `json:"message_id"`
-	ConversationID     string         `json:"conversation_id"`
-	Mode               string         `json:"mode"`
-	Answer             string         `json:"answer"`
-	Metadata           map[string]any `json:"metadata"`
-	CreatedAt          int64          `json:"created_at"`
+	MessageID      string         `json:"message_id"`
+	ConversationID string         `json:"conversation_id"`
+	Mode           string         `json:"mode"`
+	Answer         string         `json:"answer"`
+	Metadata       map[string]any `json:"metadata"`
+	CreatedAt      int64          `json:"created_at"`
+	// Moderated is set by Collect when output moderation replaced the answer,
+	// and Blocked when it did so before any answer text arrived; Dify's
+	// blocking responses report neither.
+	Moderated bool `json:"-"`
+	Blocked   bool `json:"-"`
 }
 
 // StreamEvent is one SSE event from Dify for response_mode=streaming.
@@ -36,10 +50,79 @@ type StreamEvent struct {
 	ConversationID string `json:"conversation_id,omitempty"`
 	Answer         string `json:"answer,omitempty"`
 	CreatedAt      int64  `json:"created_at,omitempty"`
+	// Metadata is set on message_end and carries usage and retriever resources.
+	Metadata map[string]any `json:"metadata,omitempty"`
 	// Error fields
 	Status  int    `json:"status,omitempty"`
 	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	// Err is set when the Go stream reader itself encounters an error.
 	Err error `json:"-"`
+	// Index is the candidate the event belongs to when one request is fanned
+	// out into several Dify requests.
+	Index int `json:"-"`
+}
+
+// Usage is the token accounting Dify reports under metadata.usage.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ParseUsage extracts metadata.usage from a blocking response or message_end
+// event. ok is false when usage is absent or reports no tokens at all.
+func ParseUsage(metadata map[string]any) (u Usage, ok bool) {
+	raw, _ := metadata["usage"].(map[string]any)
+	if raw == nil {
+		return Usage{}, false
+	}
+	num := func(key string) int {
+		if f, ok := raw[key].(float64); ok {
+			return int(f)
+		}
+		return 0
+	}
+	u = Usage{
+		PromptTokens:     num("prompt_tokens"),
+		CompletionTokens: num("completion_tokens"),
+		TotalTokens:      num("total_tokens"),
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	return u, u.TotalTokens > 0
+}
+
+// Parameters is the response of GET /v1/parameters. Only the input form is
+// decoded.
+type Parameters struct {
+	// UserInputForm lists the app's input variables. Each entry is an object
+	// with a single key naming the control type, e.g. "text-input",
+	// "paragraph", "select" or "number".
+	UserInputForm []map[string]InputField `json:"user_input_form"`
+}
+
+// InputField describes one input variable of an app.
+type InputField struct {
+	// Type is the control type taken from the enclosing form entry.
+	Type      string   `json:"-"`
+	Label     string   `json:"label"`
+	Variable  string   `json:"variable"`
+	Required  bool     `json:"required"`
+	MaxLength int      `json:"max_length,omitempty"`
+	Default   any      `json:"default,omitempty"`
+	Options   []string `json:"options,omitempty"`
+}
+
+// Fields flattens UserInputForm, filling in each field's Type.
+func (p *Parameters) Fields() []InputField {
+	var out []InputField
+	for _, entry := range p.UserInputForm {
+		for typ, f := range entry {
+			f.Type = typ
+			out = append(out, f)
+		}
+	}
+	return out
 }
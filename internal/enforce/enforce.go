@@ -0,0 +1,287 @@
+// Package enforce applies caller-supplied stop sequences and output token
+// limits to Dify answers. Dify apps do not accept these per request, so the
+// proxy cuts the answer itself and stops the upstream task once a limit is
+// reached.
+package enforce
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// stopTimeout bounds the background call that stops an upstream task.
+const stopTimeout = 5 * time.Second
+
+// window is how many bytes at the end of the emitted output are encoded again
+// with each chunk, so that tokens merging across chunk boundaries are counted
+// once without encoding the whole output again.
+const window = 64
+
+// Reason says why output ended early.
+type Reason int
+
+const (
+	// ReasonNone means no limit was hit; the answer ended naturally.
+	ReasonNone Reason = iota
+	// ReasonStopSequence means a stop sequence was found.
+	ReasonStopSequence
+	// ReasonMaxTokens means the output token budget was exhausted.
+	ReasonMaxTokens
+)
+
+// Limiter cuts a streamed answer at the first stop sequence or once
+// MaxTokens output tokens have been produced. A nil *Limiter imposes no
+// limits, so callers can use it unconditionally.
+type Limiter struct {
+	stops     []string
+	maxTokens int
+	tok       tokenizer.Tokenizer
+
+	pending  string
+	done     bool
+	reason   Reason
+	matched  string
+	holdBack int
+
+	// used is the token count of the output emitted so far; tail is its
+	// last window bytes and tailTokens their count.
+	used       int
+	tail       string
+	tailTokens int
+}
+
+// New returns a Limiter for the given stop sequences and token budget, or nil
+// when neither is set. maxTokens <= 0 means no budget.
+func New(stops []string, maxTokens int, tok tokenizer.Tokenizer) *Limiter {
+	var nonEmpty []string
+	hold := 0
+	for _, s := range stops {
+		if s == "" {
+			continue
+		}
+		nonEmpty = append(nonEmpty, s)
+		hold = max(hold, len(s)-1)
+	}
+	if len(nonEmpty) == 0 && maxTokens <= 0 {
+		return nil
+	}
+	return &Limiter{stops: nonEmpty, maxTokens: maxTokens, tok: tok, holdBack: hold}
+}
+
+// Reason reports why the output ended. It is ReasonNone until a limit is hit.
+func (l *Limiter) Reason() Reason {
+	if l == nil {
+		return ReasonNone
+	}
+	return l.reason
+}
+
+// StopSequence returns the stop sequence that ended the output, if any.
+func (l *Limiter) StopSequence() string {
+	if l == nil {
+		return ""
+	}
+	return l.matched
+}
+
+// Push feeds the next chunk of the answer and returns the text that may be
+// sent to the client now. Text that could be the start of a stop sequence
+// spanning into the next chunk is held back until it can be decided. Once a
+// limit is reached done is true and further input is ignored.
+func (l *Limiter) Push(chunk string) (out string, done bool) {
+	if l == nil {
+		return chunk, false
+	}
+	if l.done {
+		return "", true
+	}
+
+	buf := l.pending + chunk
+	l.pending = ""
+
+	if idx, seq := l.firstStop(buf); idx >= 0 {
+		out = l.budget(buf[:idx])
+		if !l.done {
+			l.done, l.reason, l.matched = true, ReasonStopSequence, seq
+		}
+		return out, true
+	}
+
+	keep := l.partialStopSuffix(buf)
+	l.pending = buf[len(buf)-keep:]
+	out = l.budget(buf[:len(buf)-keep])
+	return out, l.done
+}
+
+// Flush returns any held-back text at the end of the stream.
+func (l *Limiter) Flush() string {
+	if l == nil || l.done {
+		return ""
+	}
+	out := l.budget(l.pending)
+	l.pending = ""
+	return out
+}
+
+// Apply runs text through a fresh Limiter in one step. It is used for
+// blocking responses.
+func Apply(text string, stops []string, maxTokens int, tok tokenizer.Tokenizer) (string, *Limiter) {
+	l := New(stops, maxTokens, tok)
+	if l == nil {
+		return text, nil
+	}
+	out, done := l.Push(text)
+	if !done {
+		out += l.Flush()
+	}
+	return out, l
+}
+
+// budget returns the longest prefix of text that keeps the emitted output
+// within maxTokens, marking the limiter done when text had to be cut. Only
+// the tail of the output emitted before is encoded with text.
+func (l *Limiter) budget(text string) string {
+	if text == "" || l.maxTokens <= 0 {
+		return text
+	}
+	if n := l.count(text); l.used+n <= l.maxTokens {
+		l.emit(text, n)
+		return text
+	}
+
+	// Binary search over rune boundaries for the longest fitting prefix.
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if l.used+l.count(string(runes[:mid])) <= l.maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	out := string(runes[:lo])
+	l.emit(out, l.count(out))
+	l.done, l.reason = true, ReasonMaxTokens
+	return out
+}
+
+// count returns how many tokens text adds to the output emitted so far.
+func (l *Limiter) count(text string) int {
+	return l.tok.Count(l.tail+text) - l.tailTokens
+}
+
+// emit records text, adding n tokens, as emitted.
+func (l *Limiter) emit(text string, n int) {
+	l.used += n
+	l.tail += text
+	if len(l.tail) > window {
+		cut := len(l.tail) - window
+		for cut < len(l.tail) && !utf8.RuneStart(l.tail[cut]) {
+			cut++
+		}
+		l.tail = l.tail[cut:]
+	}
+	l.tailTokens = l.tok.Count(l.tail)
+}
+
+// firstStop returns the earliest index of any stop sequence in s.
+func (l *Limiter) firstStop(s string) (int, string) {
+	best, seq := -1, ""
+	for _, stop := range l.stops {
+		if i := strings.Index(s, stop); i >= 0 && (best < 0 || i < best) {
+			best, seq = i, stop
+		}
+	}
+	return best, seq
+}
+
+// partialStopSuffix returns the length of the longest suffix of s that is a
+// proper prefix of some stop sequence.
+func (l *Limiter) partialStopSuffix(s string) int {
+	for n := min(l.holdBack, len(s)); n > 0; n-- {
+		suffix := s[len(s)-n:]
+		for _, stop := range l.stops {
+			if strings.HasPrefix(stop, suffix) {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// Stream applies l to the message events of in. When a limit is reached the
+// remaining text is dropped, stop is called once with the Dify task ID, and
+// the rest of in is drained so the upstream reader can exit. Held-back text is
+// emitted as a final message event when in closes.
+func (l *Limiter) Stream(in <-chan dify.StreamEvent, stop func(taskID string)) <-chan dify.StreamEvent {
+	if l == nil {
+		return in
+	}
+	out := make(chan dify.StreamEvent, 16)
+	go func() {
+		defer close(out)
+		var last dify.StreamEvent
+		stopped := false
+		for ev := range in {
+			if stopped {
+				continue
+			}
+			if ev.Event != "message" && ev.Event != "agent_message" {
+				if ev.Event == "message_end" || ev.Err != nil {
+					if rest := l.Flush(); rest != "" {
+						last.Answer = rest
+						out <- last
+					}
+				}
+				out <- ev
+				continue
+			}
+			last = ev
+			text, done := l.Push(ev.Answer)
+			if text != "" {
+				ev.Answer = text
+				out <- ev
+			}
+			if done {
+				stopped = true
+				if stop != nil {
+					stop(ev.TaskID)
+				}
+			}
+		}
+		if !stopped {
+			if rest := l.Flush(); rest != "" {
+				last.Answer = rest
+				out <- last
+			}
+		}
+	}()
+	return out
+}
+
+// UpstreamStopper returns a stop callback for Limiter.Stream. It asks Dify to
+// stop the task in the background, since the client no longer needs the rest
+// of the answer, and cancels the upstream request context unless cancel is nil.
+func UpstreamStopper(client *dify.Client, apiKey, user string, cancel context.CancelFunc) func(taskID string) {
+	return func(taskID string) {
+		if taskID != "" {
+			go func() {
+				ctx, done := context.WithTimeout(context.Background(), stopTimeout)
+				defer done()
+				if err := client.StopTask(ctx, apiKey, taskID, user); err != nil {
+					slog.Warn("stop dify task", "task_id", taskID, "error", err)
+				}
+			}()
+		}
+		if cancel != nil {
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package eventstream implements the AWS event stream binary framing
+// (application/vnd.amazon.eventstream) used by Bedrock streaming APIs.
+//
+// A message is laid out as
+//
+//	total length (4) | headers length (4) | prelude CRC (4) | headers | payload | message CRC (4)
+//
+// with big-endian integers and CRC32 (IEEE) checksums: the prelude CRC covers
+// the first 8 bytes, the message CRC everything before it. Only string header
+// values are supported, which is all the Bedrock event headers use.
+package eventstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ContentType is the media type of an event stream response.
+const ContentType = "application/vnd.amazon.eventstream"
+
+const (
+	preludeLen   = 12
+	crcLen       = 4
+	stringType   = 7
+	maxHeaderLen = 128 * 1024
+	maxTotalLen  = 16 * 1024 * 1024
+)
+
+// Header is one message header.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Message is one event stream message.
+type Message struct {
+	Headers []Header
+	Payload []byte
+}
+
+// Get returns the value of the named header, or "".
+func (m Message) Get(name string) string {
+	for _, h := range m.Headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// Event returns a message of :message-type event with the given :event-type
+// and a JSON payload.
+func Event(eventType string, payload []byte) Message {
+	return Message{
+		Headers: []Header{
+			{":event-type", eventType},
+			{":content-type", "application/json"},
+			{":message-type", "event"},
+		},
+		Payload: payload,
+	}
+}
+
+// Exception returns a message of :message-type exception with the given
+// :exception-type and a JSON payload.
+func Exception(exceptionType string, payload []byte) Message {
+	return Message{
+		Headers: []Header{
+			{":exception-type", exceptionType},
+			{":content-type", "application/json"},
+			{":message-type", "exception"},
+		},
+		Payload: payload,
+	}
+}
+
+// Encode returns the wire form of m.
+func Encode(m Message) ([]byte, error) {
+	var headers bytes.Buffer
+	for _, h := range m.Headers {
+		if len(h.Name) == 0 || len(h.Name) > 255 {
+			return nil, fmt.Errorf("eventstream: invalid header name %q", h.Name)
+		}
+		if len(h.Value) > 0xffff {
+			return nil, fmt.Errorf("eventstream: header %s value too long", h.Name)
+		}
+		headers.WriteByte(byte(len(h.Name)))
+		headers.WriteString(h.Name)
+		headers.WriteByte(stringType)
+		_ = binary.Write(&headers, binary.BigEndian, uint16(len(h.Value)))
+		headers.WriteString(h.Value)
+	}
+	if headers.Len() > maxHeaderLen {
+		return nil, errors.New("eventstream: headers too long")
+	}
+	total := preludeLen + headers.Len() + len(m.Payload) + crcLen
+	if total > maxTotalLen {
+		return nil, errors.New("eventstream: message too long")
+	}
+
+	out := make([]byte, 0, total)
+	out = binary.BigEndian.AppendUint32(out, uint32(total))
+	out = binary.BigEndian.AppendUint32(out, uint32(headers.Len()))
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[:8]))
+	out = append(out, headers.Bytes()...)
+	out = append(out, m.Payload...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+	return out, nil
+}
+
+// WriteMessage encodes m to w.
+func WriteMessage(w io.Writer, m Message) error {
+	raw, err := Encode(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// ReadMessage reads and verifies one message from r. It returns io.EOF when
+// r is exhausted at a message boundary.
+func ReadMessage(r io.Reader) (Message, error) {
+	prelude := make([]byte, preludeLen)
+	if _, err := io.ReadFull(r, prelude); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Message{}, fmt.Errorf("eventstream: truncated prelude")
+		}
+		return Message{}, err
+	}
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	hlen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return Message{}, errors.New("eventstream: prelude checksum mismatch")
+	}
+	if total > maxTotalLen || hlen > maxHeaderLen || int(total) < preludeLen+int(hlen)+crcLen {
+		return Message{}, fmt.Errorf("eventstream: invalid lengths %d/%d", total, hlen)
+	}
+
+	rest := make([]byte, int(total)-preludeLen)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return Message{}, fmt.Errorf("eventstream: truncated message: %w", err)
+	}
+	body, sum := rest[:len(rest)-crcLen], rest[len(rest)-crcLen:]
+	crc := crc32.NewIEEE()
+	crc.Write(prelude)
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(sum) {
+		return Message{}, errors.New("eventstream: message checksum mismatch")
+	}
+
+	headers, err := decodeHeaders(body[:hlen])
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Headers: headers, Payload: body[hlen:]}, nil
+}
+
+func decodeHeaders(b []byte) ([]Header, error) {
+	var out []Header
+	for len(b) > 0 {
+		n := int(b[0])
+		if len(b) < 1+n+1 {
+			return nil, errors.New("eventstream: truncated header")
+		}
+		name := string(b[1 : 1+n])
+		typ := b[1+n]
+		b = b[2+n:]
+		if typ != stringType {
+			return nil, fmt.Errorf("eventstream: header %s has unsupported type %d", name, typ)
+		}
+		if len(b) < 2 {
+			return nil, errors.New("eventstream: truncated header")
+		}
+		vlen := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+vlen {
+			return nil, errors.New("eventstream: truncated header")
+		}
+		out = append(out, Header{Name: name, Value: string(b[2 : 2+vlen])})
+		b = b[2+vlen:]
+	}
+	return out, nil
+}
@@ -0,0 +1,182 @@
+// Package fanout issues several Dify requests for one protocol request, as
+// needed for OpenAI n and Gemini candidateCount, and merges the results.
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/zhengjr9/dify-agent/internal/dify"
+)
+
+// Limits bounds fan-out. MaxCandidates caps the number of candidates a
+// request may ask for; Concurrency caps how many of one request's Dify calls
+// run at once.
+type Limits struct {
+	MaxCandidates int
+	Concurrency   int
+}
+
+// Count validates a requested candidate count, treating 0 as 1.
+func (l Limits) Count(n int) (int, error) {
+	if n == 0 {
+		n = 1
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("candidate count must be positive")
+	}
+	if l.MaxCandidates > 0 && n > l.MaxCandidates {
+		return 0, fmt.Errorf("candidate count %d exceeds the maximum of %d", n, l.MaxCandidates)
+	}
+	return n, nil
+}
+
+func (l Limits) slots(n int) chan struct{} {
+	c := l.Concurrency
+	if c < 1 || c > n {
+		c = n
+	}
+	return make(chan struct{}, c)
+}
+
+// Blocking runs fn for candidates 0..n-1 and returns the results in order.
+// The first error cancels the remaining calls.
+func Blocking[T any](ctx context.Context, l Limits, n int, fn func(ctx context.Context, i int) (T, error)) ([]T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := make([]T, n)
+	slots := l.slots(n)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := range n {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			v, err := fn(ctx, i)
+			if err != nil {
+				once.Do(func() { firstErr = err; cancel() })
+				return
+			}
+			out[i] = v
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	return out, firstErr
+}
+
+// Stream opens streams for candidates 0..n-1 and merges their events into
+// one channel, setting StreamEvent.Index. At most l.Concurrency streams are
+// open at once; the next one opens when an earlier one ends.
+//
+// The first wave is opened before Stream returns so that an upstream failure
+// can still be reported as an HTTP error; later open errors are delivered as
+// events with Err set.
+//
+// When ctx is cancelled — the client went away, the request timed out or the
+// caller gave up after an error — stop is called with the task ID of every
+// stream that has not finished, so the upstream tasks stop together.
+func Stream(ctx context.Context, l Limits, n int, open func(ctx context.Context, i int) (<-chan dify.StreamEvent, error), stop func(taskID string)) (<-chan dify.StreamEvent, error) {
+	slots := l.slots(n)
+	first := make([]<-chan dify.StreamEvent, cap(slots))
+	errs := make([]error, len(first))
+	var wg sync.WaitGroup
+	for i := range first {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first[i], errs[i] = open(ctx, i)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			for _, in := range first {
+				if in != nil {
+					go drain(in)
+				}
+			}
+			return nil, err
+		}
+	}
+
+	out := make(chan dify.StreamEvent, 16*n)
+	send := func(ev dify.StreamEvent) bool {
+		select {
+		case out <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	forward := func(i int, in <-chan dify.StreamEvent) {
+		defer wg.Done()
+		defer func() { <-slots }()
+		taskID, ended := "", false
+		for ev := range in {
+			if ev.TaskID != "" {
+				taskID = ev.TaskID
+			}
+			// An error caused by the cancellation itself does not mean the
+			// upstream task has ended.
+			if ev.Event == "message_end" || (ev.Err != nil && ctx.Err() == nil) {
+				ended = true
+			}
+			ev.Index = i
+			if !send(ev) {
+				break
+			}
+		}
+		if !ended && ctx.Err() != nil && taskID != "" && stop != nil {
+			stop(taskID)
+		}
+		drain(in)
+	}
+
+	for i, in := range first {
+		slots <- struct{}{}
+		wg.Add(1)
+		go forward(i, in)
+	}
+	go func() {
+		defer close(out)
+		defer wg.Wait()
+		for i := len(first); i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			in, err := open(ctx, i)
+			if err != nil {
+				<-slots
+				send(dify.StreamEvent{Index: i, Err: err})
+				continue
+			}
+			wg.Add(1)
+			go forward(i, in)
+		}
+	}()
+	return out, nil
+}
+
+// drain discards the rest of in so the upstream reader can exit.
+func drain(in <-chan dify.StreamEvent) {
+	for range in {
+	}
+}
@@ -1,8 +1,14 @@
 package httputil
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"slices"
 	"strings"
+
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
 )
 
 // SetSSEHeaders sets the standard headers for a Server-Sent Events response.
@@ -13,20 +19,67 @@ func SetSSEHeaders(w http.ResponseWriter) {
 	w.Header().Set("X-Accel-Buffering", "no")
 }
 
-// Credentials holds the Dify API key and user extracted from a request.
+// Credentials holds the Dify API key extracted from a request. The Dify user
+// is resolved separately by the identity package, which prefers User.
 type Credentials struct {
 	APIKey string
-	User   string
+	// KeyID is set when the caller presented a gateway-issued virtual key;
+	// APIKey is then the Dify key it stands for, possibly empty.
+	KeyID string
+	// Owner is the owner of the virtual key.
+	Owner string
+	// Models restricts a virtual key or access token to the named models
+	// and apps. Empty allows any.
+	Models []string
+	// Limits are the rate limits of a virtual key.
+	Limits ratelimit.Limits
+	// User is the end-user named by a verified access token or client
+	// certificate.
+	User string
+	// Tier is the rate limit tier named by a verified access token.
+	Tier string
+}
+
+// Allows reports whether the credentials may use the model or app name.
+func (c Credentials) Allows(name string) bool {
+	return len(c.Models) == 0 || slices.Contains(c.Models, name)
 }
 
-// ExtractCredentials reads Dify credentials from the request using the following priority:
+// Authenticated reports whether the gateway itself vouches for the caller:
+// by a virtual key, a verified access token or a client certificate. A plain
+// Dify key only authenticates against Dify.
+func (c Credentials) Authenticated() bool {
+	return c.KeyID != "" || c.User != ""
+}
+
+type credentialsKey struct{}
+
+// WithCredentials returns a shallow copy of r whose ExtractCredentials result
+// is c. Middleware resolving virtual keys uses it.
+func WithCredentials(r *http.Request, c Credentials) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), credentialsKey{}, c))
+}
+
+// ExtractCredentials returns the credentials set by WithCredentials, or else
+// those presented by the request; see PresentedKey.
+func ExtractCredentials(r *http.Request) Credentials {
+	if c, ok := r.Context().Value(credentialsKey{}).(Credentials); ok {
+		return c
+	}
+	return Credentials{APIKey: PresentedKey(r)}
+}
+
+// PresentedKey reads the key presented by the caller using the following priority:
 //
 //  1. X-Dify-Api-Key header  → apiKey
 //  2. Authorization: Bearer  → apiKey (fallback)
-//  3. X-Dify-User header     → user   (overrides defaultUser when present)
+//  3. X-Api-Key header       → apiKey (Anthropic SDK style)
+//  4. api-key header         → apiKey (Azure OpenAI style)
+//  5. X-Goog-Api-Key header  → apiKey (Google SDK style)
+//  6. key query parameter    → apiKey (Google SDK style)
 //
-// Returns an empty APIKey when no key is found; callers must validate.
-func ExtractCredentials(r *http.Request, defaultUser string) Credentials {
+// Returns an empty string when no key is found; callers must validate.
+func PresentedKey(r *http.Request) string {
 	apiKey := strings.TrimSpace(r.Header.Get("X-Dify-Api-Key"))
 	if apiKey == "" {
 		auth := r.Header.Get("Authorization")
@@ -34,11 +87,46 @@ func ExtractCredentials(r *http.Request, defaultUser string) Credentials {
 			apiKey = strings.TrimSpace(rest)
 		}
 	}
+	if apiKey == "" {
+		apiKey = strings.TrimSpace(r.Header.Get("X-Api-Key"))
+	}
+	if apiKey == "" {
+		apiKey = strings.TrimSpace(r.Header.Get("Api-Key"))
+	}
+	if apiKey == "" {
+		apiKey = strings.TrimSpace(r.Header.Get("X-Goog-Api-Key"))
+	}
+	if apiKey == "" {
+		apiKey = strings.TrimSpace(r.URL.Query().Get("key"))
+	}
 
-	user := strings.TrimSpace(r.Header.Get("X-Dify-User"))
-	if user == "" {
-		user = defaultUser
+	return apiKey
+}
+
+// BaseURL returns the scheme and host the client used to reach the server,
+// honouring X-Forwarded-Proto and X-Forwarded-Host from a fronting proxy.
+func BaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
 	}
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return scheme + "://" + host
+}
 
-	return Credentials{APIKey: apiKey, User: user}
+// DecodeJSON decodes the request body into v and reads the body to EOF. Only
+// once the body is consumed does net/http watch the connection, so draining it
+// lets the request context be cancelled as soon as the client goes away.
+func DecodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, r.Body)
+	return nil
 }
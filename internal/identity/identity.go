@@ -0,0 +1,202 @@
+// Package identity resolves the Dify end-user for a request.
+//
+// Dify scopes conversations and logs by the `user` field, so callers that
+// share one value also share one conversation namespace. A Resolver walks a
+// configurable chain of sources — the X-Dify-User header, the protocol's own
+// user field, a claim from a JWT bearer token — and falls back to a default.
+// A user named by a token verified by the jwtauth package, or by a verified
+// client certificate, takes precedence over every source.
+// Caller-supplied identities can be hashed and prefixed so raw e-mail
+// addresses never reach Dify, and every identity can be namespaced by tenant.
+package identity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+)
+
+// Identity sources, in the names accepted by Config.Sources.
+const (
+	SourceHeader  = "header"
+	SourceBody    = "body"
+	SourceToken   = "token"
+	SourceDefault = "default"
+)
+
+// UserHeader is the header read by SourceHeader.
+const UserHeader = "X-Dify-User"
+
+// DefaultSources is the resolution order used when Config.Sources is empty.
+var DefaultSources = []string{SourceHeader, SourceBody, SourceDefault}
+
+// Config configures a Resolver.
+type Config struct {
+	// Sources lists where to look for the user, in priority order. The
+	// default user is always the last resort, whether listed or not.
+	Sources []string
+	// Default is the user when no source yields one.
+	Default string
+	// TokenClaim is the JWT claim read by SourceToken (default "sub").
+	TokenClaim string
+	// Hash replaces caller-supplied identities with an HMAC-SHA256 digest
+	// keyed by HashSalt.
+	Hash     bool
+	HashSalt string
+	// Prefix is prepended to caller-supplied identities.
+	Prefix string
+	// TenantHeader names the header carrying the tenant. When set and
+	// present, the user becomes "<tenant>:<user>". Empty disables tenancy.
+	TenantHeader string
+}
+
+// Candidates are the raw identity values found on a request.
+type Candidates struct {
+	// Verified is the user named by a verified access token or client
+	// certificate.
+	Verified string
+	Header   string
+	Body     string
+	Token    string
+	Tenant   string
+}
+
+// Resolver maps Candidates onto a Dify user. A nil *Resolver returns the
+// body user as-is, which keeps adapters usable without configuration.
+type Resolver struct {
+	cfg Config
+}
+
+// New validates cfg and returns a Resolver.
+func New(cfg Config) (*Resolver, error) {
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = DefaultSources
+	}
+	for _, s := range cfg.Sources {
+		switch s {
+		case SourceHeader, SourceBody, SourceToken, SourceDefault:
+		default:
+			return nil, fmt.Errorf("identity: unknown user source %q", s)
+		}
+	}
+	if cfg.TokenClaim == "" {
+		cfg.TokenClaim = "sub"
+	}
+	if cfg.Hash && cfg.HashSalt == "" {
+		return nil, fmt.Errorf("identity: hashing requires a salt")
+	}
+	return &Resolver{cfg: cfg}, nil
+}
+
+// FromRequest collects Candidates from r. bodyUser is the protocol's own user
+// field, e.g. OpenAI "user" or Anthropic "metadata.user_id".
+func (res *Resolver) FromRequest(r *http.Request, bodyUser string) Candidates {
+	c := Candidates{
+		Verified: httputil.ExtractCredentials(r).User,
+		Header:   strings.TrimSpace(r.Header.Get(UserHeader)),
+		Body:     strings.TrimSpace(bodyUser),
+	}
+	if res == nil {
+		return c
+	}
+	if res.usesToken() {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			c.Token = tokenClaim(strings.TrimSpace(token), res.cfg.TokenClaim)
+		}
+	}
+	if res.cfg.TenantHeader != "" {
+		c.Tenant = strings.TrimSpace(r.Header.Get(res.cfg.TenantHeader))
+	}
+	return c
+}
+
+// Resolve returns the Dify user for the request.
+func (res *Resolver) Resolve(r *http.Request, bodyUser string) string {
+	return res.ResolveCandidates(res.FromRequest(r, bodyUser))
+}
+
+// ResolveCandidates applies the verified user or else the source chain, then
+// hashing, prefix and tenant namespace, to c.
+func (res *Resolver) ResolveCandidates(c Candidates) string {
+	if res == nil {
+		if c.Verified != "" {
+			return c.Verified
+		}
+		if c.Header != "" {
+			return c.Header
+		}
+		return c.Body
+	}
+
+	user := c.Verified
+	for _, s := range res.cfg.Sources {
+		if user != "" {
+			break
+		}
+		switch s {
+		case SourceHeader:
+			user = c.Header
+		case SourceBody:
+			user = c.Body
+		case SourceToken:
+			user = c.Token
+		}
+		if s == SourceDefault {
+			break
+		}
+	}
+
+	if user == "" {
+		user = res.cfg.Default
+	} else {
+		if res.cfg.Hash {
+			user = res.hash(user)
+		}
+		user = res.cfg.Prefix + user
+	}
+	if c.Tenant != "" {
+		user = c.Tenant + ":" + user
+	}
+	return user
+}
+
+func (res *Resolver) usesToken() bool {
+	for _, s := range res.cfg.Sources {
+		if s == SourceToken {
+			return true
+		}
+	}
+	return false
+}
+
+func (res *Resolver) hash(user string) string {
+	mac := hmac.New(sha256.New, []byte(res.cfg.HashSalt))
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// tokenClaim returns a string claim from an unverified JWT, or "" when token
+// is not a JWT. The token is not trusted here; it only names the end-user.
+func tokenClaim(token, claim string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	v, _ := claims[claim].(string)
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,269 @@
+// Package inputs builds the Dify `inputs` object for a request.
+//
+// Dify apps expose variables such as `language` or `persona` through their
+// input form. Two sources fill them: protocol parameters (temperature,
+// metadata, ...) routed through the per-app mapping of the apps registry, and
+// the X-Dify-Inputs header, a JSON object of variables set directly. The
+// result is validated against the app's /v1/parameters user_input_form:
+// required fields must be present, select values must be one of the options
+// and values are coerced to the field's type.
+package inputs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+)
+
+// Header carries caller-supplied inputs as a JSON object.
+const Header = "X-Dify-Inputs"
+
+const (
+	// formTTL is how long a fetched input form is reused.
+	formTTL = 5 * time.Minute
+	// failedFormTTL is how long a failed fetch is remembered before retrying.
+	failedFormTTL = 30 * time.Second
+)
+
+// Params are the protocol parameters of a request under neutral names:
+// temperature, top_p, top_k, max_tokens, presence_penalty,
+// frequency_penalty, seed and metadata.<key>. Adapters fill in what their
+// protocol carries; the apps mapping decides which reach Dify.
+type Params map[string]any
+
+// Set stores *v under name when v is non-nil.
+func Set[T any](p Params, name string, v *T) {
+	if v != nil {
+		p[name] = *v
+	}
+}
+
+// App identifies the Dify app inputs are built for.
+type App struct {
+	APIKey string
+	// Client fetches the app's input form; nil means the builder's client.
+	Client *dify.Client
+	// Defaults are input values that mapped and explicit inputs override,
+	// such as the default inputs of a model route.
+	Defaults map[string]any
+}
+
+// Builder builds and validates inputs. A nil *Builder returns only the
+// header inputs, unvalidated.
+type Builder struct {
+	client *dify.Client
+	apps   *apps.Registry
+
+	mu    sync.Mutex
+	forms map[string]form
+}
+
+type form struct {
+	fields  []dify.InputField
+	ok      bool
+	expires time.Time
+}
+
+// NewBuilder returns a Builder that reads mappings from reg and input forms
+// through client.
+func NewBuilder(client *dify.Client, reg *apps.Registry) *Builder {
+	return &Builder{client: client, apps: reg, forms: map[string]form{}}
+}
+
+// Build returns the inputs for a request to app. Errors describe invalid
+// caller input and map to 400. If the app's input form cannot be fetched the
+// inputs are sent unvalidated.
+func (b *Builder) Build(ctx context.Context, r *http.Request, app App, user string, params Params) (map[string]any, error) {
+	explicit, err := FromHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return merge(app.Defaults, explicit), nil
+	}
+
+	mapped := merge(app.Defaults, nil)
+	for name, variable := range b.apps.InputMapping(app.APIKey) {
+		if v, ok := params[name]; ok {
+			mapped[variable] = v
+		}
+	}
+
+	client := app.Client
+	if client == nil {
+		client = b.client
+	}
+	fields, ok := b.form(ctx, client, app.APIKey, user)
+	if !ok {
+		return merge(mapped, explicit), nil
+	}
+	return Validate(fields, mapped, explicit)
+}
+
+// FromHeader decodes the X-Dify-Inputs header. It returns nil when the
+// header is absent.
+func FromHeader(r *http.Request) (map[string]any, error) {
+	raw := strings.TrimSpace(r.Header.Get(Header))
+	if raw == "" {
+		return nil, nil
+	}
+	var out map[string]any
+	if err := json.Unmarshal([]byte(raw), &out); err != nil {
+		return nil, fmt.Errorf("%s must be a JSON object: %v", Header, err)
+	}
+	return out, nil
+}
+
+// Validate checks inputs against an app's input form. Mapped inputs that the
+// form does not declare are dropped, since one mapping serves many apps;
+// explicit inputs must be declared. Values are coerced to the field type.
+func Validate(fields []dify.InputField, mapped, explicit map[string]any) (map[string]any, error) {
+	declared := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		declared[f.Variable] = true
+	}
+	values := map[string]any{}
+	for k, v := range mapped {
+		if declared[k] {
+			values[k] = v
+		}
+	}
+	for k, v := range explicit {
+		if !declared[k] {
+			return nil, fmt.Errorf("input %q is not defined by the app", k)
+		}
+		values[k] = v
+	}
+
+	for _, f := range fields {
+		v, ok := values[f.Variable]
+		if !ok || v == nil || v == "" {
+			delete(values, f.Variable)
+			if f.Required {
+				return nil, fmt.Errorf("input %q is required", f.Variable)
+			}
+			continue
+		}
+		cv, err := coerce(f, v)
+		if err != nil {
+			return nil, err
+		}
+		values[f.Variable] = cv
+	}
+	return values, nil
+}
+
+func coerce(f dify.InputField, v any) (any, error) {
+	switch f.Type {
+	case "text-input", "paragraph", "select":
+		s, ok := v.(string)
+		if !ok {
+			s = format(v)
+		}
+		if f.MaxLength > 0 && utf8.RuneCountInString(s) > f.MaxLength {
+			return nil, fmt.Errorf("input %q must be at most %d characters", f.Variable, f.MaxLength)
+		}
+		if f.Type == "select" && !slices.Contains(f.Options, s) {
+			return nil, fmt.Errorf("input %q must be one of %s", f.Variable, strings.Join(f.Options, ", "))
+		}
+		return s, nil
+	case "number":
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		case string:
+			if x, err := strconv.ParseFloat(strings.TrimSpace(n), 64); err == nil {
+				return x, nil
+			}
+		}
+		return nil, fmt.Errorf("input %q must be a number", f.Variable)
+	case "checkbox":
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if p, err := strconv.ParseBool(b); err == nil {
+				return p, nil
+			}
+		}
+		return nil, fmt.Errorf("input %q must be a boolean", f.Variable)
+	}
+	return v, nil
+}
+
+// format renders a non-string value for a text field.
+func format(v any) string {
+	switch x := v.(type) {
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(x)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// Form returns the input form of the app identified by apiKey, from the same
+// cache Build uses. ok is false when the form is unavailable or b is nil.
+func (b *Builder) Form(ctx context.Context, apiKey, user string) (fields []dify.InputField, ok bool) {
+	if b == nil {
+		return nil, false
+	}
+	return b.form(ctx, b.client, apiKey, user)
+}
+
+// form returns the cached input form of the app, fetching it when stale.
+// ok is false when the form is unavailable.
+func (b *Builder) form(ctx context.Context, client *dify.Client, apiKey, user string) (fields []dify.InputField, ok bool) {
+	b.mu.Lock()
+	cached, found := b.forms[apiKey]
+	b.mu.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.fields, cached.ok
+	}
+
+	params, err := client.GetParameters(ctx, apiKey, user)
+	if err != nil && ctx.Err() != nil {
+		return nil, false
+	}
+	entry := form{ok: err == nil, expires: time.Now().Add(formTTL)}
+	if err != nil {
+		slog.Warn("fetch dify input form; sending inputs unvalidated", "error", err)
+		entry.expires = time.Now().Add(failedFormTTL)
+	} else {
+		entry.fields = params.Fields()
+	}
+	b.mu.Lock()
+	b.forms[apiKey] = entry
+	b.mu.Unlock()
+	return entry.fields, entry.ok
+}
+
+func merge(mapped, explicit map[string]any) map[string]any {
+	out := make(map[string]any, len(mapped)+len(explicit))
+	for k, v := range mapped {
+		out[k] = v
+	}
+	for k, v := range explicit {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,227 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// refetchInterval bounds how often a JWKS URL is fetched, so that forged key
+// IDs or an unreachable issuer do not turn every request into a fetch.
+const refetchInterval = time.Minute
+
+// jwk is a JSON Web Key as found in a key set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key is a parsed verification key.
+type key struct {
+	id  string
+	alg string
+	pub crypto.PublicKey
+}
+
+// parseKeySet parses a JWKS document. Keys of unsupported types and
+// encryption keys are skipped.
+func parseKeySet(raw []byte) ([]key, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("parse JWKS: %w", err)
+	}
+	var out []key
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("parse JWKS key %q: %w", k.Kid, err)
+		}
+		if pub != nil {
+			out = append(out, key{id: k.Kid, alg: k.Alg, pub: pub})
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("JWKS holds no signature keys")
+	}
+	return out, nil
+}
+
+// publicKey returns the key k describes, or nil for unsupported key types
+// and curves.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := b64(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+// keySet holds the keys of a JWKS file, or those fetched from a JWKS URL
+// and cached for ttl.
+type keySet struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    []key
+	fetched time.Time // last successful fetch
+	tried   time.Time // last fetch attempt
+	err     error     // error of the last fetch attempt
+}
+
+// newFileKeySet reads the JWKS file at path.
+func newFileKeySet(path string) (*keySet, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read JWKS file: %w", err)
+	}
+	keys, err := parseKeySet(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &keySet{keys: keys}, nil
+}
+
+// lookup returns the keys that may have signed a token with the given key ID
+// and algorithm. A key set backed by a URL is fetched when its cache has
+// expired or no key matches, at most once per refetchInterval; until a fetch
+// succeeds the cached keys are kept.
+func (s *keySet) lookup(ctx context.Context, kid, alg string) ([]key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.url != "" && time.Since(s.fetched) > s.ttl {
+		s.fetch(ctx)
+	}
+	match := s.match(kid, alg)
+	if len(match) == 0 && s.url != "" {
+		s.fetch(ctx)
+		match = s.match(kid, alg)
+	}
+	if len(match) == 0 && s.err != nil {
+		return nil, s.err
+	}
+	return match, nil
+}
+
+func (s *keySet) match(kid, alg string) []key {
+	var out []key
+	for _, k := range s.keys {
+		if (kid == "" || k.id == kid) && (k.alg == "" || k.alg == alg) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// fetch replaces the keys with those served at s.url unless it was tried
+// within refetchInterval, recording the outcome in s.err. s.mu must be held.
+func (s *keySet) fetch(ctx context.Context) {
+	if time.Since(s.tried) < refetchInterval {
+		return
+	}
+	s.tried = time.Now()
+	keys, err := s.get(ctx)
+	if err != nil {
+		s.err = fmt.Errorf("fetch JWKS: %w", err)
+		return
+	}
+	s.keys, s.fetched, s.err = keys, s.tried, nil
+}
+
+func (s *keySet) get(ctx context.Context) ([]key, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", s.url, resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseKeySet(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.url, err)
+	}
+	return keys, nil
+}
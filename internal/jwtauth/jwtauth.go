@@ -0,0 +1,314 @@
+// Package jwtauth authenticates callers presenting JWT access tokens, such
+// as those issued by an OIDC provider.
+//
+// Tokens are verified against a JSON Web Key Set read from a file or fetched
+// from a URL and cached, and their issuer, audience and expiry are checked.
+// Configurable claims then name the Dify user, the models and apps the
+// caller may use and the rate limit tier it belongs to; Middleware places
+// them in the request's httputil.Credentials.
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+)
+
+// leeway absorbs clock skew between the issuer and the gateway when checking
+// exp and nbf.
+const leeway = time.Minute
+
+// Config configures an Authenticator.
+type Config struct {
+	// JWKSFile is a JSON Web Key Set file; JWKSURL serves one instead.
+	JWKSFile string
+	JWKSURL  string
+	// CacheTTL is how long keys fetched from JWKSURL are used before they
+	// are fetched again (default 10m).
+	CacheTTL time.Duration
+	// Issuer, when set, must equal the iss claim.
+	Issuer string
+	// Audience, when set, must include one of the aud claim's values.
+	Audience []string
+	// UserClaim names the Dify user (default "sub").
+	UserClaim string
+	// RoutesClaim, when set, lists the models and apps the caller may use,
+	// as an array or a space-separated string. Tokens without it are
+	// refused.
+	RoutesClaim string
+	// TierClaim, when set, names the caller's rate limit tier.
+	TierClaim string
+	// AllowDifyKeys lets callers presenting a Dify key or no key through
+	// unauthenticated, as without JWT authentication.
+	AllowDifyKeys bool
+}
+
+// Enabled reports whether cfg configures JWT authentication.
+func (cfg Config) Enabled() bool {
+	return cfg.JWKSFile != "" || cfg.JWKSURL != ""
+}
+
+// Authenticator verifies JWTs. A nil *Authenticator authenticates nobody and
+// its Middleware passes every request through.
+type Authenticator struct {
+	cfg  Config
+	keys *keySet
+}
+
+// New validates cfg and returns an Authenticator, or nil when cfg does not
+// enable JWT authentication. A JWKS file is read immediately; a JWKS URL is
+// first fetched when a token is verified.
+func New(cfg Config) (*Authenticator, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	if cfg.JWKSFile != "" && cfg.JWKSURL != "" {
+		return nil, errors.New("jwtauth: a JWKS file and a JWKS URL cannot be combined")
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 10 * time.Minute
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+	a := &Authenticator{cfg: cfg}
+	if cfg.JWKSFile != "" {
+		var err error
+		if a.keys, err = newFileKeySet(cfg.JWKSFile); err != nil {
+			return nil, fmt.Errorf("jwtauth: %w", err)
+		}
+	} else {
+		a.keys = &keySet{url: cfg.JWKSURL, ttl: cfg.CacheTTL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return a, nil
+}
+
+// Claims are the claims of a verified token.
+type Claims map[string]any
+
+// String returns the string claim name, or "".
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return strings.TrimSpace(s)
+}
+
+// Strings returns the claim name as a list: an array of strings or a
+// space-separated string. ok is false when the claim is absent.
+func (c Claims) Strings(name string) (list []string, ok bool) {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v), true
+	case []any:
+		for _, e := range v {
+			if s, isString := e.(string); isString && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// algorithms maps the supported JWS algorithms to their hash; EdDSA signs
+// the message itself.
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// LooksLikeJWT reports whether token has the shape of a JWS compact
+// serialization, telling tokens apart from Dify keys.
+func LooksLikeJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	return json.Unmarshal(raw, &header) == nil && header.Alg != ""
+}
+
+// Verify checks the signature, expiry, issuer and audience of token and
+// returns its claims.
+func (a *Authenticator) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	keys, err := a.keys.lookup(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !slices.ContainsFunc(keys, func(k key) bool { return verifySignature(k.pub, header.Alg, hash, signed, sig) }) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not yet valid")
+	}
+	if a.cfg.Issuer != "" && claims.String("iss") != a.cfg.Issuer {
+		return nil, fmt.Errorf("token issuer %q is not trusted", claims.String("iss"))
+	}
+	if len(a.cfg.Audience) > 0 {
+		aud, _ := claims.Strings("aud")
+		if !slices.ContainsFunc(aud, func(s string) bool { return slices.Contains(a.cfg.Audience, s) }) {
+			return nil, errors.New("token is not intended for this audience")
+		}
+	}
+	return claims, nil
+}
+
+// Credentials maps verified claims onto the caller's credentials. It fails
+// when the user claim is missing, or the routes claim is configured and
+// grants nothing.
+func (a *Authenticator) Credentials(claims Claims) (httputil.Credentials, error) {
+	c := httputil.Credentials{User: claims.String(a.cfg.UserClaim)}
+	if c.User == "" {
+		return c, fmt.Errorf("token has no %q claim", a.cfg.UserClaim)
+	}
+	if a.cfg.RoutesClaim != "" {
+		c.Models, _ = claims.Strings(a.cfg.RoutesClaim)
+		if len(c.Models) == 0 {
+			return c, fmt.Errorf("token grants no routes in its %q claim", a.cfg.RoutesClaim)
+		}
+	}
+	if a.cfg.TierClaim != "" {
+		c.Tier = claims.String(a.cfg.TierClaim)
+	}
+	return c, nil
+}
+
+// Middleware authenticates the requests to next whose path does not start
+// with one of exempt. A presented JWT is verified and replaced by the
+// credentials its claims describe; invalid tokens are rejected with 401 and
+// tokens granting no routes with 403. Requests carrying a virtual key
+// resolved by an earlier middleware pass through, as do the others only when
+// Config.AllowDifyKeys is set.
+func (a *Authenticator) Middleware(exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.ContainsFunc(exempt, func(p string) bool { return strings.HasPrefix(r.URL.Path, p) }) ||
+				httputil.ExtractCredentials(r).KeyID != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token := httputil.PresentedKey(r)
+			if !LooksLikeJWT(token) {
+				if a.cfg.AllowDifyKeys {
+					next.ServeHTTP(w, r)
+					return
+				}
+				apierrors.WriteJSONError(w, http.StatusUnauthorized, "a valid bearer token is required")
+				return
+			}
+			claims, err := a.Verify(r.Context(), token)
+			if err != nil {
+				apierrors.WriteJSONError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			creds, err := a.Credentials(claims)
+			if err != nil {
+				status := http.StatusUnauthorized
+				if creds.User != "" {
+					status = http.StatusForbidden
+				}
+				apierrors.WriteJSONError(w, status, err.Error())
+				return
+			}
+			next.ServeHTTP(w, httputil.WithCredentials(r, creds))
+		})
+	}
+}
+
+func decodeSegment(seg string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// verifySignature reports whether sig is a valid alg signature of signed
+// by pub.
+func verifySignature(pub crypto.PublicKey, alg string, hash crypto.Hash, signed, sig []byte) bool {
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size || pub.Curve.Params().BitSize != map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[alg] {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+// Package keys issues and resolves virtual API keys: gateway-issued keys
+// that stand for a Dify app key, so that teams never hold Dify keys.
+//
+// Only the SHA-256 digest of a key is stored. Each key carries an owner,
+// labels, the models or apps it may use, rate limits, an optional expiry and
+// an enabled flag. Its upstream Dify key is set directly or named through the apps
+// registry; a key without one can only use routed models. Middleware resolves
+// a presented virtual key into the request's httputil.Credentials.
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/store"
+)
+
+// Prefix starts every virtual key, telling them apart from Dify keys.
+const Prefix = "sk-dify-"
+
+const (
+	keyBucket  = "keys"
+	hashBucket = "key_hashes"
+)
+
+// Errors returned by Resolve and the Manager.
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrInvalid  = errors.New("invalid API key")
+	ErrDisabled = errors.New("API key is disabled")
+	ErrExpired  = errors.New("API key has expired")
+	// ErrInvalidSpec wraps errors in the fields of a Spec.
+	ErrInvalidSpec = errors.New("invalid key")
+)
+
+// Key is a stored virtual key.
+type Key struct {
+	ID     string            `json:"id"`
+	Owner  string            `json:"owner,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Models lists the models and apps the key may use; empty allows any.
+	Models []string `json:"models,omitempty"`
+	// App names the app of the apps registry whose key is used upstream.
+	App string `json:"app,omitempty"`
+	// DifyKey is the upstream Dify key; it takes precedence over App.
+	DifyKey string `json:"dify_key,omitempty"`
+	// Limits are the key's rate limits; zero fields are unlimited.
+	Limits    ratelimit.Limits `json:"limits,omitzero"`
+	Enabled   bool             `json:"enabled"`
+	ExpiresAt *time.Time       `json:"expires_at,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	RotatedAt *time.Time       `json:"rotated_at,omitempty"`
+	// Hash is the hex SHA-256 digest of the key; Hint shows its ends.
+	Hash string `json:"hash"`
+	Hint string `json:"hint"`
+}
+
+// Spec holds the settable fields of a key. Nil fields are left unchanged by
+// Update and take their defaults in Create.
+type Spec struct {
+	Owner     *string            `json:"owner,omitempty"`
+	Labels    *map[string]string `json:"labels,omitempty"`
+	Models    *[]string          `json:"models,omitempty"`
+	App       *string            `json:"app,omitempty"`
+	DifyKey   *string            `json:"dify_key,omitempty"`
+	Limits    *ratelimit.Limits  `json:"limits,omitempty"`
+	Enabled   *bool              `json:"enabled,omitempty"`
+	ExpiresAt *time.Time         `json:"expires_at,omitempty"`
+}
+
+// Manager stores and resolves virtual keys. It is safe for concurrent use.
+type Manager struct {
+	apps *apps.Registry
+	*keyring
+}
+
+// keyring is the state shared by a Manager and those WithApps derives.
+type keyring struct {
+	store store.Store
+	now   func() time.Time
+
+	mu sync.Mutex
+}
+
+// NewManager returns a Manager keeping keys in st. apps resolves the App of
+// a key to its Dify key.
+func NewManager(st store.Store, apps *apps.Registry) *Manager {
+	return &Manager{apps: apps, keyring: &keyring{store: st, now: time.Now}}
+}
+
+// WithApps returns a Manager sharing m's keys that resolves their App
+// through apps, e.g. for the configuration a reload builds.
+func (m *Manager) WithApps(apps *apps.Registry) *Manager {
+	return &Manager{apps: apps, keyring: m.keyring}
+}
+
+// Create issues a key. It returns the stored key and the secret, which is not
+// retrievable afterwards.
+func (m *Manager) Create(spec Spec) (*Key, string, error) {
+	k := &Key{ID: "key_" + randomHex(12), Enabled: true, CreatedAt: m.now().UTC()}
+	if err := m.apply(k, spec); err != nil {
+		return nil, "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secret, err := m.issue(k)
+	if err != nil {
+		return nil, "", err
+	}
+	return k, secret, nil
+}
+
+// Get returns the key with the given ID.
+func (m *Manager) Get(id string) (*Key, error) {
+	var k Key
+	found, err := m.store.Get(keyBucket, id, &k)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return &k, nil
+}
+
+// List returns every key, ordered by ID.
+func (m *Manager) List() ([]*Key, error) {
+	out := []*Key{}
+	err := m.store.List(keyBucket, "", func(_ string, raw []byte) error {
+		var k Key
+		if err := json.Unmarshal(raw, &k); err != nil {
+			return err
+		}
+		out = append(out, &k)
+		return nil
+	})
+	return out, err
+}
+
+// Update changes the fields set in spec.
+func (m *Manager) Update(id string, spec Spec) (*Key, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.apply(k, spec); err != nil {
+		return nil, err
+	}
+	if err := m.store.Put(keyBucket, k.ID, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate replaces the secret of a key, invalidating the old one at once.
+func (m *Manager) Rotate(id string) (*Key, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, err := m.Get(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := m.store.Delete(hashBucket, k.Hash); err != nil {
+		return nil, "", err
+	}
+	now := m.now().UTC()
+	k.RotatedAt = &now
+	secret, err := m.issue(k)
+	if err != nil {
+		return nil, "", err
+	}
+	return k, secret, nil
+}
+
+// Revoke deletes a key.
+func (m *Manager) Revoke(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Delete(hashBucket, k.Hash); err != nil {
+		return err
+	}
+	return m.store.Delete(keyBucket, id)
+}
+
+// Resolve returns the credentials a virtual key stands for.
+func (m *Manager) Resolve(secret string) (httputil.Credentials, error) {
+	var id string
+	found, err := m.store.Get(hashBucket, hash(secret), &id)
+	if err != nil {
+		return httputil.Credentials{}, err
+	}
+	if !found {
+		return httputil.Credentials{}, ErrInvalid
+	}
+	return m.ResolveID(id)
+}
+
+// ResolveID returns the credentials of the key with the given ID, failing
+// like Resolve once it is revoked, disabled or expired. Work queued under a
+// key, such as a batch, re-checks it this way when it runs.
+func (m *Manager) ResolveID(id string) (httputil.Credentials, error) {
+	k, err := m.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return httputil.Credentials{}, ErrInvalid
+	}
+	if err != nil {
+		return httputil.Credentials{}, err
+	}
+	if !k.Enabled {
+		return httputil.Credentials{}, ErrDisabled
+	}
+	if k.ExpiresAt != nil && !m.now().Before(*k.ExpiresAt) {
+		return httputil.Credentials{}, ErrExpired
+	}
+	apiKey := k.DifyKey
+	if apiKey == "" && k.App != "" {
+		if app, ok := m.apps.ByName(k.App); ok {
+			apiKey = app.APIKey
+		}
+	}
+	return httputil.Credentials{APIKey: apiKey, KeyID: k.ID, Owner: k.Owner, Models: k.Models, Limits: k.Limits}, nil
+}
+
+// Middleware resolves virtual keys presented to next, so that
+// httputil.ExtractCredentials returns the Dify key they stand for. Other keys
+// pass through unchanged; invalid, disabled or expired virtual keys are
+// rejected with 401. A nil *Manager passes every request through.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := httputil.PresentedKey(r)
+		if !strings.HasPrefix(presented, Prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		creds, err := m.Resolve(presented)
+		if err != nil {
+			apierrors.WriteJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		next.ServeHTTP(w, httputil.WithCredentials(r, creds))
+	})
+}
+
+// apply copies the fields set in spec onto k.
+func (m *Manager) apply(k *Key, spec Spec) error {
+	if spec.App != nil && *spec.App != "" {
+		if _, ok := m.apps.ByName(*spec.App); !ok {
+			return fmt.Errorf("%w: app %q is not in the apps registry", ErrInvalidSpec, *spec.App)
+		}
+	}
+	if spec.Limits != nil {
+		if err := spec.Limits.Validate(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+		}
+	}
+	if spec.Owner != nil {
+		k.Owner = *spec.Owner
+	}
+	if spec.Labels != nil {
+		k.Labels = *spec.Labels
+	}
+	if spec.Models != nil {
+		k.Models = *spec.Models
+	}
+	if spec.App != nil {
+		k.App = *spec.App
+	}
+	if spec.DifyKey != nil {
+		k.DifyKey = *spec.DifyKey
+	}
+	if spec.Limits != nil {
+		k.Limits = *spec.Limits
+	}
+	if spec.Enabled != nil {
+		k.Enabled = *spec.Enabled
+	}
+	if spec.ExpiresAt != nil {
+		k.ExpiresAt = spec.ExpiresAt
+		if k.ExpiresAt.IsZero() {
+			k.ExpiresAt = nil
+		}
+	}
+	return nil
+}
+
+// issue gives k a new secret and stores it. m.mu must be held.
+func (m *Manager) issue(k *Key) (string, error) {
+	buf := make([]byte, 24)
+	_, _ = rand.Read(buf)
+	secret := Prefix + base64.RawURLEncoding.EncodeToString(buf)
+	k.Hash = hash(secret)
+	k.Hint = secret[:len(Prefix)+4] + "..." + secret[len(secret)-4:]
+	if err := m.store.Put(keyBucket, k.ID, k); err != nil {
+		return "", err
+	}
+	if err := m.store.Put(hashBucket, k.Hash, k.ID); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
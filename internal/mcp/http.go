@@ -0,0 +1,83 @@
+package mcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+)
+
+// ServeHTTP implements the streamable HTTP transport on a single endpoint.
+// Each POST carries one JSON-RPC message. Notifications and responses are
+// acknowledged with 202. A tools/call from a client that accepts
+// text/event-stream is answered with an SSE stream carrying its progress
+// notifications and then the response; every other request gets a JSON
+// response. The server is stateless: it issues no session IDs and offers no
+// GET stream. Callers must present a virtual key or access token; they see
+// and call only the tools of the apps their credentials allow. Calls run as
+// the Dify user resolved from the request headers and are admitted with the
+// caller's credentials.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	creds := httputil.ExtractCredentials(r)
+	if !creds.Authenticated() {
+		writeJSON(w, http.StatusUnauthorized, errorResponse(nil, codeForbidden, "a virtual key or access token is required"))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse(nil, codeParseError, "read body: "+err.Error()))
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		writeJSON(w, http.StatusBadRequest, errorResponse(nil, codeInvalidRequest, "batch requests are not supported"))
+		return
+	}
+	var msg message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse(nil, codeParseError, "parse error: "+err.Error()))
+		return
+	}
+	if !msg.isRequest() {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	c := caller{user: s.users.Resolve(r, ""), creds: creds}
+	if msg.Method == "tools/call" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		httputil.SetSSEHeaders(w)
+		send := func(v any) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		resp := s.handle(r.Context(), &msg, c, func(method string, params any) {
+			send(notification{JSONRPC: "2.0", Method: method, Params: params})
+		})
+		send(resp)
+		return
+	}
+
+	resp := s.handle(r.Context(), &msg, c, func(string, any) {})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
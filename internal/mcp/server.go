@@ -0,0 +1,299 @@
+// Package mcp serves Dify apps as Model Context Protocol tools.
+//
+// Every app of the apps registry becomes a tool whose input schema is built
+// from the app's /v1/parameters user_input_form, plus a required query
+// argument carrying the message. A call runs the app in streaming mode and
+// reports each chunk as a progress notification when the caller asked for
+// progress. The server speaks JSON-RPC over stdio (ServeStdio) and over the
+// streamable HTTP transport (ServeHTTP).
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/admission"
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// ProtocolVersion is the latest protocol revision the server implements.
+const ProtocolVersion = "2025-06-18"
+
+// supportedVersions lists the revisions accepted in initialize, newest first.
+var supportedVersions = []string{ProtocolVersion, "2025-03-26", "2024-11-05"}
+
+// queryArg is the tool argument carrying the message sent to the app.
+const queryArg = "query"
+
+// invalidToolChars matches characters not allowed in tool names.
+var invalidToolChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// Server dispatches MCP requests. It is safe for concurrent use.
+type Server struct {
+	client  *dify.Client
+	users   *identity.Resolver
+	inputs  *inputs.Builder
+	apps    []apps.App
+	timeout time.Duration
+	tokens  *tokenizer.Set
+	control *admission.Controller
+}
+
+// NewServer returns a Server exposing the apps of reg. When reg is empty and
+// defaultKey is set, a single "dify" tool runs the app of that key. Tool
+// calls count against the budgets and rate limits enforced by control, if
+// any, with their usage counted by tokens when Dify reports none.
+func NewServer(client *dify.Client, users *identity.Resolver, in *inputs.Builder, reg *apps.Registry, defaultKey string, timeout time.Duration, tokens *tokenizer.Set, control *admission.Controller) *Server {
+	list := reg.Apps()
+	if len(list) == 0 && defaultKey != "" {
+		list = []apps.App{{Name: "dify", APIKey: defaultKey}}
+	}
+	return &Server{client: client, users: users, inputs: in, apps: list, timeout: timeout, tokens: tokens, control: control}
+}
+
+// notifyFunc sends a notification to the client of the current request.
+type notifyFunc func(method string, params any)
+
+// caller is who a request runs for: the Dify user of the session and the
+// credentials its tool calls are admitted with, which also select the tools
+// it may see and call.
+type caller struct {
+	user  string
+	creds httputil.Credentials
+}
+
+// handle processes one request and returns its response. notify carries
+// progress notifications.
+func (s *Server) handle(ctx context.Context, msg *message, c caller, notify notifyFunc) *response {
+	result, err := s.dispatch(ctx, msg, c, notify)
+	if err != nil {
+		if rerr, ok := err.(*rpcError); ok {
+			return &response{JSONRPC: "2.0", ID: msg.ID, Error: rerr}
+		}
+		return errorResponse(msg.ID, codeInternalError, err.Error())
+	}
+	return &response{JSONRPC: "2.0", ID: msg.ID, Result: result}
+}
+
+func (s *Server) dispatch(ctx context.Context, msg *message, c caller, notify notifyFunc) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		var p initializeParams
+		if err := decodeParams(msg.Params, &p); err != nil {
+			return nil, err
+		}
+		version := ProtocolVersion
+		if slices.Contains(supportedVersions, p.ProtocolVersion) {
+			version = p.ProtocolVersion
+		}
+		return initializeResult{
+			ProtocolVersion: version,
+			Capabilities:    map[string]any{"tools": map[string]any{"listChanged": false}},
+			ServerInfo:      serverInfo{Name: "dify-agent", Version: buildVersion()},
+		}, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		return listToolsResult{Tools: s.tools(ctx, c)}, nil
+	case "tools/call":
+		var p callToolParams
+		if err := decodeParams(msg.Params, &p); err != nil {
+			return nil, err
+		}
+		return s.call(ctx, &p, c, notify)
+	}
+	return nil, &rpcError{Code: codeMethodNotFound, Message: "method not found: " + msg.Method}
+}
+
+// tools describes every app the caller may use as a tool.
+func (s *Server) tools(ctx context.Context, c caller) []Tool {
+	out := make([]Tool, 0, len(s.apps))
+	for _, app := range s.apps {
+		if !c.creds.Allows(app.Name) {
+			continue
+		}
+		fields, _ := s.inputs.Form(ctx, app.APIKey, c.user)
+		desc := app.Description
+		if desc == "" {
+			desc = "Send a message to the Dify app " + app.Name + " and return its answer."
+		}
+		out = append(out, Tool{
+			Name:        toolName(app.Name),
+			Title:       app.Name,
+			Description: desc,
+			InputSchema: inputSchema(fields),
+		})
+	}
+	return out
+}
+
+// call runs the app behind a tool. A call to an app the caller's
+// credentials do not allow is refused with codeForbidden, and one over a rate
+// limit or budget with codeRejected.
+func (s *Server) call(ctx context.Context, p *callToolParams, c caller, notify notifyFunc) (*CallToolResult, error) {
+	app, ok := s.app(p.Name)
+	if !ok {
+		return nil, &rpcError{Code: codeInvalidParams, Message: "unknown tool: " + p.Name}
+	}
+	if !c.creds.Allows(app.Name) {
+		return nil, &rpcError{Code: codeForbidden, Message: "tool " + p.Name + " is not allowed for these credentials"}
+	}
+	query, _ := p.Arguments[queryArg].(string)
+	if strings.TrimSpace(query) == "" {
+		return nil, &rpcError{Code: codeInvalidParams, Message: "argument " + queryArg + " is required"}
+	}
+	user := c.user
+	ticket, _, err := s.control.Admit(admission.Request{
+		Creds:  c.creds,
+		User:   user,
+		Model:  app.Name,
+		Prompt: func() int { return s.tokens.For(app.Name).Count(query) },
+		Stream: true,
+	})
+	if err != nil {
+		return nil, &rpcError{Code: codeRejected, Message: err.Error()}
+	}
+	defer ticket.Settle()
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	explicit := make(map[string]any, len(p.Arguments))
+	for k, v := range p.Arguments {
+		if k != queryArg {
+			explicit[k] = v
+		}
+	}
+	values := explicit
+	if fields, ok := s.inputs.Form(ctx, app.APIKey, user); ok {
+		var err error
+		if values, err = inputs.Validate(fields, nil, explicit); err != nil {
+			return errorResult(err.Error()), nil
+		}
+	}
+
+	stream, err := s.client.SendStreaming(ctx, app.APIKey, &dify.ChatRequest{Inputs: values, Query: query, User: user})
+	if err != nil {
+		return errorResult("upstream error: " + err.Error()), nil
+	}
+	var (
+		answer   strings.Builder
+		chunks   int
+		metadata map[string]any
+	)
+	for ev := range stream {
+		if ev.Err != nil {
+			return errorResult("upstream error: " + ev.Err.Error()), nil
+		}
+		switch ev.Event {
+		case "message", "agent_message":
+			if ev.Answer == "" {
+				continue
+			}
+			answer.WriteString(ev.Answer)
+			chunks++
+			if len(p.Meta.ProgressToken) > 0 {
+				notify("notifications/progress", progressParams{ProgressToken: p.Meta.ProgressToken, Progress: chunks, Message: ev.Answer})
+			}
+		case "message_replace":
+			answer.Reset()
+			answer.WriteString(ev.Answer)
+		case "message_end":
+			metadata = ev.Metadata
+		case "error":
+			return errorResult(fmt.Sprintf("upstream error: %s", ev.Message)), nil
+		}
+	}
+	ticket.Use(s.tokens.Resolve(app.Name, metadata, query, answer.String()))
+	return &CallToolResult{Content: []Content{{Type: "text", Text: answer.String()}}}, nil
+}
+
+func (s *Server) app(tool string) (*apps.App, bool) {
+	for i := range s.apps {
+		if toolName(s.apps[i].Name) == tool {
+			return &s.apps[i], true
+		}
+	}
+	return nil, false
+}
+
+// inputSchema builds a JSON schema from an app's input form. Without a form
+// only the query argument is described.
+func inputSchema(fields []dify.InputField) map[string]any {
+	props := map[string]any{
+		queryArg: map[string]any{"type": "string", "description": "The message sent to the app."},
+	}
+	required := []string{queryArg}
+	for _, f := range fields {
+		if f.Variable == queryArg {
+			continue
+		}
+		prop := map[string]any{"type": "string"}
+		if f.Label != "" {
+			prop["title"] = f.Label
+		}
+		switch f.Type {
+		case "number":
+			prop["type"] = "number"
+		case "checkbox":
+			prop["type"] = "boolean"
+		case "select":
+			if len(f.Options) > 0 {
+				prop["enum"] = f.Options
+			}
+		}
+		if f.MaxLength > 0 && prop["type"] == "string" {
+			prop["maxLength"] = f.MaxLength
+		}
+		if f.Default != nil && f.Default != "" {
+			prop["default"] = f.Default
+		}
+		props[f.Variable] = prop
+		if f.Required {
+			required = append(required, f.Variable)
+		}
+	}
+	return map[string]any{"type": "object", "properties": props, "required": required}
+}
+
+// toolName turns an app name into a valid tool name.
+func toolName(app string) string {
+	name := invalidToolChars.ReplaceAllString(app, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func errorResult(msg string) *CallToolResult {
+	return &CallToolResult{Content: []Content{{Type: "text", Text: msg}}, IsError: true}
+}
+
+func decodeParams(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &rpcError{Code: codeInvalidParams, Message: "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+// buildVersion returns the module version of the binary, or "dev".
+func buildVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	return "dev"
+}
@@ -0,0 +1,97 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/zhengjr9/dify-agent/internal/identity"
+)
+
+// maxMessageSize bounds one newline-delimited message on stdio.
+const maxMessageSize = 16 << 20
+
+// ServeStdio serves newline-delimited JSON-RPC messages read from r, writing
+// responses and notifications to w, until r is exhausted or ctx is done.
+// Requests run concurrently, and notifications/cancelled cancels one; a
+// cancelled request gets no response. Calls run as the default Dify user.
+func (s *Server) ServeStdio(ctx context.Context, r io.Reader, w io.Writer) error {
+	ctx, cancelAll := context.WithCancel(ctx)
+	defer cancelAll()
+
+	var (
+		mu       sync.Mutex // guards w and inflight
+		inflight = map[string]context.CancelFunc{}
+		wg       sync.WaitGroup
+	)
+	write := func(v any) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write(append(data, '\n'))
+	}
+	c := caller{user: s.users.ResolveCandidates(identity.Candidates{})}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '[' {
+			write(errorResponse(nil, codeInvalidRequest, "batch requests are not supported"))
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			write(errorResponse(nil, codeParseError, "parse error: "+err.Error()))
+			continue
+		}
+		if msg.Method == "notifications/cancelled" {
+			var p cancelledParams
+			if json.Unmarshal(msg.Params, &p) == nil {
+				mu.Lock()
+				if cancel, ok := inflight[string(p.RequestID)]; ok {
+					cancel()
+				}
+				mu.Unlock()
+			}
+			continue
+		}
+		if !msg.isRequest() {
+			// Other notifications and client responses need no answer.
+			continue
+		}
+
+		id := string(msg.ID)
+		reqCtx, cancel := context.WithCancel(ctx)
+		mu.Lock()
+		inflight[id] = cancel
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			resp := s.handle(reqCtx, &msg, c, func(method string, params any) {
+				write(notification{JSONRPC: "2.0", Method: method, Params: params})
+			})
+			mu.Lock()
+			delete(inflight, id)
+			mu.Unlock()
+			if reqCtx.Err() != nil && ctx.Err() == nil {
+				return
+			}
+			write(resp)
+		}()
+	}
+	err := scanner.Err()
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,117 @@
+// Package metrics keeps the gateway's counters and serves them in the
+// Prometheus text exposition format on GET /metrics.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	registryMu sync.Mutex
+	registry   []*Counter
+)
+
+// Counter is a monotonically increasing count, split by label values. It is
+// safe for concurrent use.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]*series{}}
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+	return c
+}
+
+// Inc adds one to the series with the given label values, which must match
+// the counter's label names in number and order.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series with the given label values.
+func (c *Counter) Add(v float64, values ...string) {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", c.name, len(c.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &series{labels: slices.Clone(values)}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+// Value returns the value of the series with the given label values.
+func (c *Counter) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.values[strings.Join(values, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) write(sb *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := c.values[k]
+		sb.WriteString(c.name)
+		if len(c.labels) > 0 {
+			sb.WriteByte('{')
+			for i, name := range c.labels {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				fmt.Fprintf(sb, "%s=\"%s\"", name, labelEscaper.Replace(s.labels[i]))
+			}
+			sb.WriteByte('}')
+		}
+		fmt.Fprintf(sb, " %g\n", s.value)
+	}
+}
+
+// labelEscaper escapes label values as the exposition format expects.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Handler serves every registered counter.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		counters := slices.Clone(registry)
+		registryMu.Unlock()
+		var sb strings.Builder
+		for _, c := range counters {
+			c.write(&sb)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(sb.String()))
+	})
+}
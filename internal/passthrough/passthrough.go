@@ -0,0 +1,214 @@
+// Package passthrough forwards the native Dify app API under /dify/v1, so
+// services using a Dify SDK can go through the gateway unchanged.
+//
+// Requests are relayed as-is apart from credentials: the caller's key is
+// replaced by the upstream Dify key, and the gateway's own credential headers
+// are stripped. Responses, including SSE streams, are copied through without
+// buffering.
+//
+// Every request counts against the caller's budgets and rate limits. The
+// usage Dify reports in a response is charged and recorded when the
+// response ends.
+package passthrough
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/admission"
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	gwhttputil "github.com/zhengjr9/dify-agent/internal/httputil"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// Prefix is where the Dify app API is mounted.
+const Prefix = "/dify/v1"
+
+// AppHeader names a registered app whose key is used upstream, so that
+// callers need not hold the Dify key itself. Only callers presenting a
+// virtual key or access token that allows the app may name one.
+const AppHeader = "X-Dify-App"
+
+// endpoints are the first path segments of the Dify app API. Anything else,
+// such as the knowledge base API, which uses different keys, is rejected.
+var endpoints = map[string]bool{
+	"chat-messages":       true,
+	"completion-messages": true,
+	"files":               true,
+	"conversations":       true,
+	"messages":            true,
+	"app":                 true,
+	"apps":                true,
+	"parameters":          true,
+	"meta":                true,
+	"info":                true,
+	"site":                true,
+	"workflows":           true,
+	"audio-to-text":       true,
+	"text-to-audio":       true,
+}
+
+// credentialHeaders are the gateway credential headers stripped upstream,
+// as is the key query parameter.
+var credentialHeaders = []string{"X-Dify-Api-Key", "X-Api-Key", "Api-Key", "X-Goog-Api-Key", AppHeader}
+
+// defaultModel names the app admitted and accounted when the caller
+// presents its own Dify key.
+const defaultModel = "dify"
+
+type (
+	keyContext    struct{}
+	ticketContext struct{}
+)
+
+// Handler relays /dify/v1/* to the Dify app API.
+type Handler struct {
+	client  *dify.Client
+	apps    *apps.Registry
+	users   *identity.Resolver
+	tokens  *tokenizer.Set
+	control *admission.Controller
+	timeout time.Duration
+	proxy   *httputil.ReverseProxy
+}
+
+// NewHandler returns a Handler relaying to the Dify instance of client.
+// timeout bounds each relayed request, including streams. Requests are
+// admitted by control as the Dify user resolved by users, with their prompt
+// estimated by tokens.
+func NewHandler(client *dify.Client, apps *apps.Registry, users *identity.Resolver, tokens *tokenizer.Set, control *admission.Controller, timeout time.Duration) *Handler {
+	h := &Handler{client: client, apps: apps, users: users, tokens: tokens, control: control, timeout: timeout}
+	h.proxy = &httputil.ReverseProxy{
+		Rewrite:        h.rewrite,
+		Transport:      client.Transport(),
+		FlushInterval:  -1,
+		ModifyResponse: h.meter,
+		ErrorHandler:   h.proxyError,
+	}
+	return h
+}
+
+// ServeHTTP handles /dify/v1/*.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, Prefix)
+	segment, _, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if !endpoints[segment] {
+		writeError(w, http.StatusNotFound, "not_found", "not a Dify app API endpoint: "+rest)
+		return
+	}
+
+	creds := gwhttputil.ExtractCredentials(r)
+	apiKey, model := creds.APIKey, defaultModel
+	if name := r.Header.Get(AppHeader); name != "" {
+		// The app's key is the gateway's to lend: only to callers it
+		// authenticated itself.
+		if !creds.Authenticated() {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "the "+AppHeader+" header requires a virtual key or access token")
+			return
+		}
+		app, ok := h.apps.ByName(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "app_not_found", "unknown app "+name)
+			return
+		}
+		if !creds.Allows(name) {
+			writeError(w, http.StatusForbidden, "forbidden", "API key may not use app "+name)
+			return
+		}
+		apiKey, model = app.APIKey, name
+	}
+	if apiKey == "" {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "missing API key: provide Authorization: Bearer <key> or the "+AppHeader+" header")
+		return
+	}
+
+	query, bodyUser := peek(r)
+	ticket, _, err := h.control.Admit(admission.Request{
+		Creds:  creds,
+		User:   h.users.Resolve(r, bodyUser),
+		Model:  model,
+		Prompt: func() int { return h.tokens.For(model).Count(query) },
+	})
+	if err != nil {
+		admission.SetRetryAfter(w.Header(), err)
+		writeError(w, http.StatusTooManyRequests, "too_many_requests", err.Error())
+		return
+	}
+	defer ticket.Settle()
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	ctx = context.WithValue(context.WithValue(ctx, keyContext{}, apiKey), ticketContext{}, ticket)
+	h.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// meter charges the request's ticket with the usage reported in the
+// response, once it has been relayed.
+func (h *Handler) meter(resp *http.Response) error {
+	ticket, _ := resp.Request.Context().Value(ticketContext{}).(*admission.Ticket)
+	if ticket == nil {
+		return nil
+	}
+	stream := isMedia(resp.Header, "text/event-stream")
+	if !stream && !isMedia(resp.Header, "application/json") {
+		return nil
+	}
+	resp.Body = &usageReader{ReadCloser: resp.Body, stream: stream, report: func(metadata map[string]any) {
+		if u, ok := dify.ParseUsage(metadata); ok {
+			ticket.Use(tokenizer.Usage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens})
+		}
+	}}
+	return nil
+}
+
+// rewrite points the outbound request at the upstream endpoint and replaces
+// the caller's credentials with the Dify key.
+func (h *Handler) rewrite(pr *httputil.ProxyRequest) {
+	target, err := url.Parse(h.client.APIURL(strings.TrimPrefix(pr.In.URL.Path, Prefix)))
+	if err != nil {
+		// Unreachable for a valid base URL; the transport reports the error.
+		return
+	}
+	query := pr.In.URL.Query()
+	if query.Has("key") {
+		query.Del("key")
+		target.RawQuery = query.Encode()
+	} else {
+		target.RawQuery = pr.In.URL.RawQuery
+	}
+	pr.Out.URL = target
+	pr.Out.Host = ""
+	for _, name := range credentialHeaders {
+		pr.Out.Header.Del(name)
+	}
+	apiKey, _ := pr.In.Context().Value(keyContext{}).(string)
+	pr.Out.Header.Set("Authorization", "Bearer "+apiKey)
+}
+
+func (h *Handler) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	slog.Warn("dify passthrough", "path", r.URL.Path, "error", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, "upstream_timeout", "upstream timeout")
+		return
+	}
+	writeError(w, http.StatusBadGateway, "upstream_error", "upstream error: "+err.Error())
+}
+
+// writeError writes an error in Dify's format, so Dify SDKs parse it.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"code": code, "message": msg, "status": status})
+}
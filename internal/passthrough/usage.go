@@ -0,0 +1,109 @@
+package passthrough
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/zhengjr9/dify-agent/internal/dify"
+)
+
+// maxPeek bounds the request and blocking response bodies read for their
+// query, user and usage.
+const maxPeek = 1 << 20
+
+// peek returns the query and user of a JSON request body, leaving the body
+// to be relayed unchanged.
+func peek(r *http.Request) (query, user string) {
+	if r.Body == nil || !isMedia(r.Header, "application/json") {
+		return "", ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPeek+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) > maxPeek {
+		return "", ""
+	}
+	var v struct {
+		Query string `json:"query"`
+		User  string `json:"user"`
+	}
+	_ = json.Unmarshal(body, &v)
+	return v.Query, v.User
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func isMedia(h http.Header, want string) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt == want
+}
+
+// usageReader relays a response body and reads the usage Dify reports in
+// it: in the metadata of a blocking response or of the message_end event of
+// a stream. report is called with it, if any, when the body is closed.
+type usageReader struct {
+	io.ReadCloser
+	stream   bool
+	body     bytes.Buffer // a blocking response, up to maxPeek
+	pending  []byte       // the unfinished line of a stream
+	metadata map[string]any
+	report   func(metadata map[string]any)
+}
+
+func (u *usageReader) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	if !u.stream {
+		if u.body.Len() <= maxPeek {
+			u.body.Write(p[:n])
+		}
+		return n, err
+	}
+	data := append(u.pending, p[:n]...)
+	for {
+		line, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			break
+		}
+		u.line(line)
+		data = rest
+	}
+	if len(data) > maxPeek {
+		data = nil
+	}
+	u.pending = append(u.pending[:0], data...)
+	return n, err
+}
+
+// line reads the metadata of a message_end event.
+func (u *usageReader) line(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	var ev dify.StreamEvent
+	if json.Unmarshal(bytes.TrimSpace(data), &ev) == nil && ev.Event == "message_end" {
+		u.metadata = ev.Metadata
+	}
+}
+
+func (u *usageReader) Close() error {
+	err := u.ReadCloser.Close()
+	if !u.stream && u.body.Len() <= maxPeek {
+		var resp struct {
+			Metadata map[string]any `json:"metadata"`
+		}
+		if json.Unmarshal(u.body.Bytes(), &resp) == nil {
+			u.metadata = resp.Metadata
+		}
+	}
+	if u.report != nil {
+		u.report(u.metadata)
+		u.report = nil
+	}
+	return err
+}
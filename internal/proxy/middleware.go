@@ -7,21 +7,30 @@ import (
 	"time"
 
 	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+	"github.com/zhengjr9/dify-agent/internal/routes"
 )
 
-// loggingMiddleware logs each request with method, path, status, and duration.
+// loggingMiddleware logs each request with method, path, status, and
+// duration, and the route and split variant that served it, if any.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 		next.ServeHTTP(lrw, r)
-		slog.Info("request",
+		attrs := []any{
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", lrw.statusCode,
 			"duration", time.Since(start).String(),
 			"remote", r.RemoteAddr,
-		)
+		}
+		if route := lrw.Header().Get(routes.Header); route != "" {
+			attrs = append(attrs, "route", route)
+		}
+		if variant := lrw.Header().Get(routes.VariantHeader); variant != "" {
+			attrs = append(attrs, "variant", variant)
+		}
+		slog.Info("request", attrs...)
 	})
 }
 
@@ -48,3 +57,16 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.statusCode = code
 	lrw.ResponseWriter.WriteHeader(code)
 }
+
+// Flush passes through to the underlying writer so streamed responses are not
+// held back until the handler returns.
+func (lrw *loggingResponseWriter) Flush() {
+	if f, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
@@ -2,59 +2,296 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"github.com/zhengjr9/dify-agent/internal/accounting"
+	"github.com/zhengjr9/dify-agent/internal/adapter"
 	"github.com/zhengjr9/dify-agent/internal/adapter/anthropic"
+	"github.com/zhengjr9/dify-agent/internal/adapter/bedrock"
 	"github.com/zhengjr9/dify-agent/internal/adapter/gemini"
+	"github.com/zhengjr9/dify-agent/internal/adapter/ollama"
 	"github.com/zhengjr9/dify-agent/internal/adapter/openai"
+	"github.com/zhengjr9/dify-agent/internal/admin"
+	"github.com/zhengjr9/dify-agent/internal/admission"
+	"github.com/zhengjr9/dify-agent/internal/batch"
 	"github.com/zhengjr9/dify-agent/internal/config"
 	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/jwtauth"
+	"github.com/zhengjr9/dify-agent/internal/keys"
+	"github.com/zhengjr9/dify-agent/internal/mcp"
+	"github.com/zhengjr9/dify-agent/internal/metrics"
+	"github.com/zhengjr9/dify-agent/internal/passthrough"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/internal/shadow"
+	"github.com/zhengjr9/dify-agent/internal/store"
+	"github.com/zhengjr9/dify-agent/internal/tlsutil"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
 )
 
 // Server is the reverse proxy HTTP server.
+//
+// The handlers built from the configuration form a generation, which Reload
+// replaces atomically: requests already in flight, including open streams,
+// finish on the generation they started on. The state store, the virtual
+// keys, the batch worker, the shadow log, the rate limit buckets and the
+// usage ledger live across generations; each generation holds views of the
+// keys, buckets and ledger bound to its own apps, user limits and budgets.
 type Server struct {
 	httpServer *http.Server
+	tls        *tls.Config
+	store      store.Store
+	keys       *keys.Manager
+	batches    *batch.Manager
+	shadows    *shadow.Log
+	limiter    *ratelimit.Limiter
+	ledger     *accounting.Ledger
+	current    atomic.Pointer[generation]
+	// stopWorkers stops background workers started by New.
+	stopWorkers context.CancelFunc
+}
+
+// generation is the part of the server built from one configuration.
+type generation struct {
+	cfg       *config.Config
+	keys      *keys.Manager
+	handler   http.Handler
+	anthropic *anthropic.Handler
 }
 
 // New constructs a Server from the given config.
-func New(cfg *config.Config) *Server {
-	client := dify.NewClient(cfg.DifyBaseURL, cfg.RequestTimeout, cfg.DifyProxyURL)
+func New(cfg *config.Config) (*Server, error) {
+	tlsConfig, err := tlsutil.NewServer(cfg.ServerTLS())
+	if err != nil {
+		return nil, err
+	}
+	st, err := store.Open(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		tls:     tlsConfig,
+		store:   st,
+		keys:    keys.NewManager(st, nil),
+		limiter: ratelimit.New(cfg.RateLimits()),
+		ledger:  accounting.NewLedger(st, accounting.Config{}),
+	}
+	if cfg.ShadowLog != "" {
+		if s.shadows, err = shadow.OpenLog(cfg.ShadowLog); err != nil {
+			st.Close()
+			return nil, err
+		}
+	}
+	s.batches = batch.NewManager(st, func(ctx context.Context, b *batch.Batch, req batch.Request) batch.Result {
+		return s.current.Load().anthropic.ExecuteBatchRequest(ctx, b, req)
+	}, cfg.BatchConcurrency, anthropic.BatchIDPrefix)
+
+	gen, err := s.build(cfg)
+	if err != nil {
+		s.shadows.Close()
+		st.Close()
+		return nil, err
+	}
+	s.current.Store(gen)
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	if err := s.batches.Start(workerCtx); err != nil {
+		stopWorkers()
+		s.shadows.Close()
+		st.Close()
+		return nil, fmt.Errorf("start batch worker: %w", err)
+	}
+	s.stopWorkers = stopWorkers
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.current.Load().handler.ServeHTTP(w, r)
+	})
+	handler = loggingMiddleware(handler)
+	handler = recoveryMiddleware(handler)
 
-	oaHandler := openai.NewHandler(client, cfg.DefaultUser, cfg.RequestTimeout)
-	anHandler := anthropic.NewHandler(client, cfg.DefaultUser, cfg.RequestTimeout)
-	gmHandler := gemini.NewHandler(client, cfg.DefaultUser, cfg.RequestTimeout)
+	s.httpServer = &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      handler,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: cfg.RequestTimeout + 10*time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	return s, nil
+}
+
+// Reload builds the handlers for cfg and swaps them in. On error the running
+// configuration is kept. Settings that only take effect at startup, such as
+// the listen address, are reported and otherwise ignored.
+func (s *Server) Reload(cfg *config.Config) error {
+	gen, err := s.build(cfg)
+	if err != nil {
+		return err
+	}
+	old := s.current.Load().cfg
+	for _, c := range []struct {
+		key     string
+		changed bool
+	}{
+		{"listen_addr", cfg.ListenAddr != old.ListenAddr},
+		{"tls", cfg.ServerTLS() != old.ServerTLS()},
+		{"request_timeout", cfg.RequestTimeout != old.RequestTimeout},
+		{"state_file", cfg.StateFile != old.StateFile},
+		{"shadow_log", cfg.ShadowLog != old.ShadowLog},
+		{"batch_concurrency", cfg.BatchConcurrency != old.BatchConcurrency},
+		{"a2a", cfg.A2AEnabled != old.A2AEnabled || cfg.A2APort != old.A2APort ||
+			cfg.AgentName != old.AgentName || cfg.AgentDesc != old.AgentDesc},
+	} {
+		if c.changed {
+			slog.Warn("setting changed; it takes full effect after a restart", "key", c.key)
+		}
+	}
+	s.current.Store(gen)
+	return nil
+}
+
+// build constructs the handlers described by cfg.
+func (s *Server) build(cfg *config.Config) (*generation, error) {
+	difyTLS, err := tlsutil.NewClient(cfg.DifyTLS())
+	if err != nil {
+		return nil, err
+	}
+	client := dify.NewClient(cfg.DifyBaseURL, cfg.RequestTimeout, cfg.DifyProxyURL, difyTLS)
+
+	tokens, err := tokenizer.Load(cfg.TokenizerDir, cfg.TokenizerEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("load tokenizer: %w", err)
+	}
+
+	users, err := identity.New(cfg.Identity())
+	if err != nil {
+		return nil, err
+	}
+	auth, err := jwtauth.New(cfg.JWT())
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := cfg.LoadApps()
+	if err != nil {
+		return nil, err
+	}
+	in := inputs.NewBuilder(client, registry)
+	table, err := cfg.LoadRoutes(func(baseURL string) *dify.Client {
+		if baseURL == "" {
+			return client
+		}
+		return dify.NewClient(baseURL, cfg.RequestTimeout, cfg.DifyProxyURL, difyTLS)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The shadow log is opened at startup only.
+	var mirror *shadow.Mirror
+	if s.shadows != nil {
+		mirror = shadow.NewMirror(s.shadows, in, tokens, cfg.RequestTimeout)
+	} else if table.HasShadows() {
+		return nil, errors.New("routes have a shadow but the server was started without shadow_log; restart to enable shadow traffic")
+	}
+
+	usage, err := cfg.Usage()
+	if err != nil {
+		return nil, err
+	}
+	vkeys := s.keys.WithApps(registry)
+	ledger := s.ledger.WithConfig(usage)
+	control := admission.New(s.limiter.WithUsers(cfg.RateLimits()), ledger)
+
+	pipeline := adapter.NewPipeline(client, users, in, cfg.RequestTimeout, tokens, cfg.Fanout(), table, mirror, control)
+	pipeline.Register(openai.Protocol, openai.NewAdapter())
+	pipeline.Register(openai.AzureProtocol, openai.NewAzureAdapter(registry))
+	pipeline.Register(anthropic.Protocol, anthropic.NewAdapter())
+	pipeline.Register(gemini.Protocol, gemini.NewAdapter())
+	pipeline.Register(ollama.Protocol, ollama.NewAdapter(registry, cfg.DifyAPIKey))
+	pipeline.Register(bedrock.Protocol, bedrock.NewAdapter(registry))
+
+	anHandler := anthropic.NewHandler(client, users, cfg.RequestTimeout, tokens, table, registry, vkeys, control)
+	gmHandler := gemini.NewHandler(pipeline.Handler(gemini.Protocol), users, tokens, table, control)
+	olHandler := ollama.NewHandler(pipeline, registry, table)
+	difyHandler := passthrough.NewHandler(client, registry, users, tokens, control, cfg.RequestTimeout)
+	mcpServer := mcp.NewServer(client, users, in, registry, cfg.DifyAPIKey, cfg.RequestTimeout, tokens, control)
+	batchHandler := anthropic.NewBatchHandler(s.batches, users, in, table, registry, control)
 
 	mux := http.NewServeMux()
 
 	// OpenAI
-	mux.Handle("POST /v1/chat/completions", oaHandler)
+	mux.Handle("POST /v1/chat/completions", pipeline.Handler(openai.Protocol))
+	mux.HandleFunc("GET /v1/models", openai.ModelsHandler(table))
+
+	// Azure OpenAI
+	mux.Handle("POST /openai/deployments/{deployment}/chat/completions", pipeline.Handler(openai.AzureProtocol))
 
 	// Anthropic
-	mux.Handle("POST /v1/messages", anHandler)
+	mux.Handle("POST /v1/messages", pipeline.Handler(anthropic.Protocol))
+	mux.HandleFunc("POST /v1/messages/count_tokens", anHandler.CountTokens)
+	mux.HandleFunc("POST /v1/messages/batches", batchHandler.Create)
+	mux.HandleFunc("GET /v1/messages/batches", batchHandler.List)
+	mux.HandleFunc("GET /v1/messages/batches/{id}", batchHandler.Get)
+	mux.HandleFunc("POST /v1/messages/batches/{id}/cancel", batchHandler.Cancel)
+	mux.HandleFunc("GET /v1/messages/batches/{id}/results", batchHandler.Results)
 
 	// Gemini: ServeMux wildcards cannot be mixed with literal suffixes in the same
 	// segment (e.g. "{model}:generateContent" is invalid). Use a prefix catch-all
 	// and dispatch to blocking vs streaming by path suffix inside the handler.
 	mux.HandleFunc("POST /v1beta/models/", gmHandler.Dispatch)
 
-	var handler http.Handler = mux
-	handler = loggingMiddleware(handler)
-	handler = recoveryMiddleware(handler)
+	// Ollama
+	mux.HandleFunc("POST /api/chat", olHandler.Chat)
+	mux.HandleFunc("POST /api/generate", olHandler.Generate)
+	mux.HandleFunc("GET /api/tags", olHandler.Tags)
+	mux.HandleFunc("POST /api/show", olHandler.Show)
+	mux.HandleFunc("GET /api/version", olHandler.Version)
+	mux.HandleFunc("GET /{$}", olHandler.Root)
+
+	// Bedrock
+	mux.Handle("POST /model/{modelId}/converse", pipeline.Handler(bedrock.Protocol))
+	mux.Handle("POST /model/{modelId}/converse-stream", pipeline.Handler(bedrock.Protocol))
 
-	return &Server{
-		httpServer: &http.Server{
-			Addr:         cfg.ListenAddr,
-			Handler:      handler,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: cfg.RequestTimeout + 10*time.Second,
-			IdleTimeout:  60 * time.Second,
-		},
+	// Dify app API passthrough
+	mux.Handle(passthrough.Prefix+"/", difyHandler)
+
+	// MCP (streamable HTTP)
+	mux.Handle("/mcp", mcpServer)
+
+	// Metrics
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	// Admin API
+	if cfg.AdminToken != "" {
+		adminHandler := admin.NewHandler(cfg.AdminToken, vkeys)
+		if s.shadows != nil {
+			adminHandler.Handle("GET /admin/shadow", shadow.Handler(s.shadows))
+		}
+		adminHandler.Handle("GET /admin/usage", accounting.Handler(ledger))
+		mux.Handle("/admin/", adminHandler)
 	}
+
+	// JWT authentication covers every route but those guarded by the admin
+	// token and the metrics. Client certificates name callers no token did.
+	handler := vkeys.Middleware(auth.Middleware("/admin/", "/metrics")(tlsutil.Middleware(cfg.TLSClientIdentity)(mux)))
+
+	return &generation{cfg: cfg, keys: vkeys, handler: handler, anthropic: anHandler}, nil
 }
 
-// Start begins listening and blocks until the server is stopped.
+// Start begins listening, over TLS when configured, and blocks until the
+// server is stopped.
 func (s *Server) Start() error {
+	if s.tls != nil {
+		return s.httpServer.ListenAndServeTLS("", "")
+	}
 	return s.httpServer.ListenAndServe()
 }
 
@@ -63,7 +300,34 @@ func (s *Server) Handler() http.Handler {
 	return s.httpServer.Handler
 }
 
-// Shutdown gracefully stops the server.
+// TLSConfig returns the listener's TLS configuration, nil for plain HTTP. The
+// A2A server shares it.
+func (s *Server) TLSConfig() *tls.Config {
+	return s.tls
+}
+
+// KeyMiddleware resolves the virtual keys presented to next against the
+// current configuration, as the proxy does; the A2A server uses it.
+func (s *Server) KeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.current.Load().keys.Middleware(next).ServeHTTP(w, r)
+	})
+}
+
+// Shutdown gracefully stops the server, then stops background workers,
+// waits for shadow requests to be recorded and budget webhooks to be sent,
+// and closes the state store.
+// Unfinished batch requests resume on the next start.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	err := s.httpServer.Shutdown(ctx)
+	s.stopWorkers()
+	s.batches.Wait()
+	s.ledger.Wait()
+	if cerr := s.shadows.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := s.store.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
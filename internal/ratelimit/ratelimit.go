@@ -0,0 +1,325 @@
+// Package ratelimit limits the requests, tokens and concurrent streams of
+// callers with token buckets.
+//
+// Limits are set per minute and apply to scopes: a virtual key, a resolved
+// user or a route. Each scope has a request bucket and a token bucket holding
+// up to a minute's allowance, refilled continuously. A request is admitted
+// when every scope it belongs to has a request left, room for its prompt
+// tokens and, for a stream, a free stream slot; the completion tokens are
+// taken once its usage is known, so a scope may go into debt and wait for
+// the refill.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits are the allowances of a scope. Zero fields are unlimited.
+type Limits struct {
+	// RPM is the number of requests per minute.
+	RPM int `json:"rpm,omitempty" yaml:"rpm,omitempty" toml:"rpm,omitempty"`
+	// TPM is the number of prompt and completion tokens per minute.
+	TPM int `json:"tpm,omitempty" yaml:"tpm,omitempty" toml:"tpm,omitempty"`
+	// Streams is the number of streaming requests open at once.
+	Streams int `json:"streams,omitempty" yaml:"streams,omitempty" toml:"streams,omitempty"`
+}
+
+// IsZero reports whether l limits nothing.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Validate reports negative limits.
+func (l Limits) Validate() error {
+	if l.RPM < 0 || l.TPM < 0 || l.Streams < 0 {
+		return fmt.Errorf("rate limits must not be negative, got rpm %d, tpm %d, streams %d", l.RPM, l.TPM, l.Streams)
+	}
+	return nil
+}
+
+// Users holds the limits of resolved users: ByUser for the users it names,
+// Tiers for the users of the tiers it names, Default for the others.
+type Users struct {
+	Default Limits
+	ByUser  map[string]Limits
+	Tiers   map[string]Limits
+}
+
+// For returns the limits of user, who belongs to tier; tier may be empty.
+func (u Users) For(user, tier string) Limits {
+	if l, ok := u.ByUser[user]; ok {
+		return l
+	}
+	if l, ok := u.Tiers[tier]; ok && tier != "" {
+		return l
+	}
+	return u.Default
+}
+
+// Scope kinds.
+const (
+	ScopeKey   = "key"
+	ScopeUser  = "user"
+	ScopeRoute = "route"
+)
+
+// Scope is a set of callers sharing limits, e.g. every request of a user.
+type Scope struct {
+	Kind   string
+	Name   string
+	Limits Limits
+}
+
+func (s Scope) id() string { return s.Kind + "\x00" + s.Name }
+
+// Window describes one limit of the most constrained scope of a request:
+// the limit, what is left of it and when it is fully replenished. A zero
+// Limit means unlimited.
+type Window struct {
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+// Status is the state of a request's limits, for the rate limit headers of
+// the response.
+type Status struct {
+	Requests Window
+	Tokens   Window
+}
+
+// Exceeded is the error returned when a request is over a limit.
+type Exceeded struct {
+	Scope Scope
+	// Limit is the limit that was hit: requests, tokens or streams.
+	Limit string
+	// RetryAfter is how long until the request would be admitted.
+	RetryAfter time.Duration
+	Status     Status
+}
+
+func (e *Exceeded) Error() string {
+	what := map[string]string{"requests": "requests per minute", "tokens": "tokens per minute", "streams": "concurrent streams"}[e.Limit]
+	return fmt.Sprintf("rate limit exceeded: %s of %s %q; retry after %s", what, e.Scope.Kind, e.Scope.Name, e.RetryAfter.Round(time.Second))
+}
+
+// Limiter holds the buckets of every scope. It is safe for concurrent use;
+// the zero value is not, use New. A nil *Limiter admits every request.
+type Limiter struct {
+	users Users
+	*buckets
+}
+
+// buckets is the state shared by a Limiter and those WithUsers derives.
+type buckets struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	states    map[string]*state
+	lastSweep time.Time
+}
+
+// state is the buckets of one scope.
+type state struct {
+	requests bucket
+	tokens   bucket
+	streams  int
+}
+
+// bucket is a token bucket holding up to a minute's allowance.
+type bucket struct {
+	level   float64
+	updated time.Time
+}
+
+// refill brings b up to date for the per-minute limit at now. A new bucket
+// starts full.
+func (b *bucket) refill(limit int, now time.Time) {
+	if b.updated.IsZero() {
+		b.level = float64(limit)
+	} else {
+		b.level += now.Sub(b.updated).Minutes() * float64(limit)
+	}
+	b.level = min(b.level, float64(limit))
+	b.updated = now
+}
+
+// wait returns how long until b holds n.
+func (b *bucket) wait(limit int, n float64) time.Duration {
+	return time.Duration((n - b.level) / float64(limit) * float64(time.Minute))
+}
+
+func (b *bucket) window(limit int) Window {
+	return Window{
+		Limit:     limit,
+		Remaining: max(0, int(math.Floor(b.level))),
+		Reset:     b.wait(limit, float64(limit)),
+	}
+}
+
+// New returns a Limiter applying users to resolved users.
+func New(users Users) *Limiter {
+	return &Limiter{users: users, buckets: &buckets{now: time.Now, states: map[string]*state{}}}
+}
+
+// WithUsers returns a Limiter sharing l's buckets that applies users to
+// resolved users, e.g. for the configuration a reload builds.
+func (l *Limiter) WithUsers(users Users) *Limiter {
+	if l == nil {
+		return nil
+	}
+	return &Limiter{users: users, buckets: l.buckets}
+}
+
+// User returns the scope of a resolved user belonging to tier.
+func (l *Limiter) User(user, tier string) Scope {
+	if l == nil {
+		return Scope{Kind: ScopeUser, Name: user}
+	}
+	return Scope{Kind: ScopeUser, Name: user, Limits: l.users.For(user, tier)}
+}
+
+// Acquire admits a request belonging to scopes, taking a request and tokens,
+// its estimated prompt tokens, from each and a stream slot if stream is set.
+// It returns an *Exceeded error, taking nothing, when a scope is over a
+// limit. The Grant must be released when the request ends. Scopes without
+// limits are ignored; when none has any, Acquire returns a nil Grant.
+func (l *Limiter) Acquire(scopes []Scope, tokens int, stream bool) (*Grant, Status, error) {
+	if l == nil {
+		return nil, Status{}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	g := &Grant{l: l, stream: stream, reserved: tokens}
+	var status Status
+	for _, sc := range scopes {
+		if sc.Limits.IsZero() {
+			continue
+		}
+		st := l.states[sc.id()]
+		if st == nil {
+			st = &state{}
+			l.states[sc.id()] = st
+		}
+		lim := sc.Limits
+		exceeded := func(limit string, wait time.Duration) error {
+			return &Exceeded{Scope: sc, Limit: limit, RetryAfter: max(wait, time.Second), Status: status}
+		}
+		if lim.RPM > 0 {
+			st.requests.refill(lim.RPM, now)
+			if st.requests.level < 1 {
+				status.Requests = st.requests.window(lim.RPM)
+				return nil, status, exceeded("requests", st.requests.wait(lim.RPM, 1))
+			}
+		}
+		if lim.TPM > 0 {
+			st.tokens.refill(lim.TPM, now)
+			// A prompt larger than the whole allowance waits for a full
+			// bucket rather than forever.
+			need := float64(min(tokens, lim.TPM))
+			if st.tokens.level < need || st.tokens.level <= 0 {
+				status.Tokens = st.tokens.window(lim.TPM)
+				return nil, status, exceeded("tokens", st.tokens.wait(lim.TPM, max(need, 1)))
+			}
+		}
+		if stream && lim.Streams > 0 && st.streams >= lim.Streams {
+			return nil, status, exceeded("streams", time.Second)
+		}
+		g.scopes = append(g.scopes, granted{state: st, limits: lim})
+	}
+	if len(g.scopes) == 0 {
+		return nil, status, nil
+	}
+	for _, s := range g.scopes {
+		if s.limits.RPM > 0 {
+			s.state.requests.level--
+			if w := s.state.requests.window(s.limits.RPM); status.Requests.Limit == 0 || w.Remaining < status.Requests.Remaining {
+				status.Requests = w
+			}
+		}
+		if s.limits.TPM > 0 {
+			s.state.tokens.level -= float64(tokens)
+			if w := s.state.tokens.window(s.limits.TPM); status.Tokens.Limit == 0 || w.Remaining < status.Tokens.Remaining {
+				status.Tokens = w
+			}
+		}
+		if stream && s.limits.Streams > 0 {
+			s.state.streams++
+		}
+	}
+	return g, status, nil
+}
+
+// sweep drops, at most once a minute, the scopes whose buckets have been
+// full for a while and that have no open stream. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for id, st := range l.states {
+		idle := func(b bucket) bool { return b.updated.IsZero() || now.Sub(b.updated) > 2*time.Minute }
+		if st.streams == 0 && idle(st.requests) && idle(st.tokens) {
+			delete(l.states, id)
+		}
+	}
+}
+
+// Grant is an admitted request. A nil *Grant is valid and does nothing.
+type Grant struct {
+	l        *Limiter
+	scopes   []granted
+	stream   bool
+	reserved int
+
+	// Usage reported so far, summed over candidates.
+	used       bool
+	prompt     int
+	completion int
+}
+
+type granted struct {
+	state  *state
+	limits Limits
+}
+
+// Use reports the usage of one candidate of the request.
+func (g *Grant) Use(promptTokens, completionTokens int) {
+	if g == nil {
+		return
+	}
+	g.l.mu.Lock()
+	defer g.l.mu.Unlock()
+	g.used = true
+	g.prompt += promptTokens
+	g.completion += completionTokens
+}
+
+// Release ends the request: it frees its stream slot and settles its
+// tokens, replacing the estimate taken by Acquire with the usage reported.
+func (g *Grant) Release() {
+	if g == nil {
+		return
+	}
+	g.l.mu.Lock()
+	defer g.l.mu.Unlock()
+	delta := 0
+	if g.used {
+		delta = g.prompt + g.completion - g.reserved
+	}
+	for _, s := range g.scopes {
+		if s.limits.TPM > 0 {
+			s.state.tokens.level = min(s.state.tokens.level-float64(delta), float64(s.limits.TPM))
+		}
+		if g.stream && s.limits.Streams > 0 {
+			s.state.streams--
+		}
+	}
+	g.scopes = nil
+}
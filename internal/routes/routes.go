@@ -0,0 +1,385 @@
+// Package routes holds the model routing table, loaded from a JSON routes
+// file. A route maps a model name and its aliases, as sent by callers in the
+// model field (or the deployment or model path segment), to a Dify app held
+// by the gateway: its base URL, API key, app mode and default inputs.
+// Requests for a routed model run with the route's key, so callers never see
+// or send Dify keys; they must instead present a virtual key or access token
+// unless the route is public.
+//
+// A route may name fallback routes, tried in order when its app fails in one
+// of the ways its triggers list before any output has been sent. The route
+// that served a request is named in the Header response header.
+//
+// A route may instead split its traffic over other routes by weight, for A/B
+// experiments between app versions. Callers stick to one variant by user or
+// by conversation; the variant is named in the VariantHeader response header.
+// A route may also mirror a sample of its requests to a shadow route, whose
+// answers are recorded but never returned; see the shadow package. Rate
+// limits on a route are shared by all of its callers.
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+)
+
+// Route maps a model name to a Dify app.
+type Route struct {
+	Model   string   `json:"model" yaml:"model" toml:"model"`
+	Aliases []string `json:"aliases,omitempty" yaml:"aliases,omitempty" toml:"aliases,omitempty"`
+	// BaseURL is the Dify instance of the app; empty means --dify-base-url.
+	BaseURL string `json:"base_url,omitempty" yaml:"base_url,omitempty" toml:"base_url,omitempty"`
+	APIKey  string `json:"api_key" yaml:"api_key" toml:"api_key"`
+	// Mode is the app mode: chat (also chatflow), agent or completion.
+	// Empty means chat.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty" toml:"mode,omitempty"`
+	// Inputs are default input values; mapped parameters and the
+	// X-Dify-Inputs header override them.
+	Inputs map[string]any `json:"inputs,omitempty" yaml:"inputs,omitempty" toml:"inputs,omitempty"`
+	// Fallbacks names the routes, by model or alias, tried in order when
+	// the app fails with one of FallbackOn's triggers.
+	Fallbacks []string `json:"fallbacks,omitempty" yaml:"fallbacks,omitempty" toml:"fallbacks,omitempty"`
+	// FallbackOn lists the failures that move a request to the next
+	// fallback; nil means DefaultTriggers.
+	FallbackOn *Triggers `json:"fallback_on,omitempty" yaml:"fallback_on,omitempty" toml:"fallback_on,omitempty"`
+	// Split spreads the route's requests over other routes by weight. A
+	// route with a split has no app of its own.
+	Split []Variant `json:"split,omitempty" yaml:"split,omitempty" toml:"split,omitempty"`
+	// Sticky is what keeps a caller on one variant of the split:
+	// StickyUser (the default) or StickyConversation.
+	Sticky string `json:"sticky,omitempty" yaml:"sticky,omitempty" toml:"sticky,omitempty"`
+	// Shadow mirrors a sample of the route's requests to another route.
+	Shadow *Shadow `json:"shadow,omitempty" yaml:"shadow,omitempty" toml:"shadow,omitempty"`
+	// Limits are rate limits shared by every caller of the route.
+	Limits ratelimit.Limits `json:"limits,omitzero" yaml:"limits,omitempty" toml:"limits,omitempty"`
+	// Public lets callers without a virtual key or access token use the
+	// route; any presented Dify key is still ignored.
+	Public bool `json:"public,omitempty" yaml:"public,omitempty" toml:"public,omitempty"`
+}
+
+// Shadow names the route, by model or alias, that a percentage of a route's
+// requests is mirrored to.
+type Shadow struct {
+	Route   string  `json:"route" yaml:"route" toml:"route"`
+	Percent float64 `json:"percent" yaml:"percent" toml:"percent"`
+}
+
+// Variant is one arm of a split: a route, by model or alias, and its share
+// of the traffic.
+type Variant struct {
+	Route  string `json:"route" yaml:"route" toml:"route"`
+	Weight int    `json:"weight" yaml:"weight" toml:"weight"`
+}
+
+// Ways of sticking callers to a variant.
+const (
+	// StickyUser assigns variants by the resolved Dify user.
+	StickyUser = "user"
+	// StickyConversation assigns variants by conversation: the
+	// ConversationHeader when sent, or else the opening of the conversation.
+	StickyConversation = "conversation"
+)
+
+// Response and request headers.
+const (
+	// Header names the route that served a request.
+	Header = "X-Dify-Route"
+	// VariantHeader names the variant a split route assigned a request to.
+	VariantHeader = "X-Dify-Variant"
+	// ConversationHeader identifies a conversation for StickyConversation.
+	ConversationHeader = "X-Dify-Conversation"
+)
+
+// Triggers are the failures that move a request to the next fallback. They
+// apply until the first output is sent to the caller; later failures are
+// reported as usual.
+type Triggers struct {
+	// Statuses are upstream HTTP statuses, e.g. 429 or 503. 502 also covers
+	// an upstream that cannot be reached.
+	Statuses []int `json:"statuses,omitempty" yaml:"statuses,omitempty" toml:"statuses,omitempty"`
+	// Codes are Dify error codes, e.g. app_unavailable.
+	Codes []string `json:"codes,omitempty" yaml:"codes,omitempty" toml:"codes,omitempty"`
+	// Timeout bounds each attempt until its answer, or for streaming
+	// requests until the stream opens. Zero means the request timeout,
+	// which does not fall back.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// FirstToken bounds the time to the first answer token of a streaming
+	// attempt. Zero means no bound.
+	FirstToken Duration `json:"first_token,omitempty" yaml:"first_token,omitempty" toml:"first_token,omitempty"`
+}
+
+// DefaultTriggers are the triggers of routes that list none: rate limits,
+// server errors and the Dify codes for unavailable apps and providers.
+var DefaultTriggers = Triggers{
+	Statuses: []int{429, 500, 502, 503, 504},
+	Codes: []string{
+		"app_unavailable",
+		"provider_not_initialize",
+		"provider_quota_exceeded",
+		"model_currently_not_support",
+		"completion_request_error",
+	},
+}
+
+// Match reports whether err, returned by an attempt, triggers a fallback,
+// and describes why. Timeouts are not errors of the attempt and are checked
+// by the caller.
+func (t *Triggers) Match(err error) (string, bool) {
+	var apiErr *dify.APIError
+	if !errors.As(err, &apiErr) {
+		return "upstream unreachable", slices.Contains(t.Statuses, 502)
+	}
+	if apiErr.Code != "" && slices.Contains(t.Codes, apiErr.Code) {
+		return "code " + apiErr.Code, true
+	}
+	return fmt.Sprintf("status %d", apiErr.Status), slices.Contains(t.Statuses, apiErr.Status)
+}
+
+// Duration is a time.Duration written as a string such as "30s".
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// File is the routes file format.
+type File struct {
+	// Strict rejects models that match no route with 404. Otherwise such
+	// requests run with the caller's key, as without a routes file.
+	Strict bool    `json:"strict,omitempty" yaml:"strict,omitempty" toml:"strict,omitempty"`
+	Routes []Route `json:"routes" yaml:"routes" toml:"routes"`
+}
+
+// Target is a route with the client that reaches its app.
+type Target struct {
+	*Route
+	Client    *dify.Client
+	fallbacks []*Target
+	variants  []*Target
+	weights   []int
+	shadow    *Target
+}
+
+// ShadowTarget returns the route requests are mirrored to and the
+// percentage mirrored, or nil when the route has no shadow.
+func (t *Target) ShadowTarget() (*Target, float64) {
+	if t.shadow == nil {
+		return nil, 0
+	}
+	return t.shadow, t.Shadow.Percent
+}
+
+// IsSplit reports whether the route splits its traffic over variants.
+func (t *Target) IsSplit() bool {
+	return len(t.variants) > 0
+}
+
+// Pick returns the variant a request with the given sticky key is assigned
+// to; the same key always gets the same variant. A route without a split
+// returns itself.
+func (t *Target) Pick(key string) *Target {
+	if !t.IsSplit() {
+		return t
+	}
+	h := fnv.New64a()
+	h.Write([]byte(t.Model + "\x00" + key))
+	n := int(h.Sum64() % uint64(t.weights[len(t.weights)-1]))
+	for i, w := range t.weights {
+		if n < w {
+			return t.variants[i]
+		}
+	}
+	return t.variants[len(t.variants)-1]
+}
+
+// Chain returns the targets a request for the route tries, in order: the
+// route itself, then its fallbacks.
+func (t *Target) Chain() []*Target {
+	return append([]*Target{t}, t.fallbacks...)
+}
+
+// Triggers returns the failures that move a request to the next fallback.
+func (t *Target) Triggers() *Triggers {
+	if t.FallbackOn != nil {
+		return t.FallbackOn
+	}
+	return &DefaultTriggers
+}
+
+// App returns the app inputs are built for.
+func (t *Target) App() inputs.App {
+	return inputs.App{APIKey: t.APIKey, Client: t.Client, Defaults: t.Inputs}
+}
+
+// Table looks up routes by model name or alias. A nil *Table has no routes.
+type Table struct {
+	file    File
+	byModel map[string]*Target
+}
+
+// Load reads the routes file at path. An empty path returns an empty table.
+// newClient returns the client for a base URL, "" meaning the default one.
+func Load(path string, newClient func(baseURL string) *dify.Client) (*Table, error) {
+	if path == "" {
+		return New(File{}, newClient)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read routes file: %w", err)
+	}
+	var f File
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("parse routes file %s: %w", path, err)
+	}
+	return New(f, newClient)
+}
+
+// New validates f and returns a Table. Routes sharing a base URL share a
+// client.
+func New(f File, newClient func(baseURL string) *dify.Client) (*Table, error) {
+	t := &Table{file: f, byModel: make(map[string]*Target, len(f.Routes))}
+	clients := map[string]*dify.Client{}
+	for i := range f.Routes {
+		route := &f.Routes[i]
+		if route.Model == "" || (route.APIKey == "") == (len(route.Split) == 0) {
+			return nil, fmt.Errorf("routes[%d]: model and either api_key or split are required", i)
+		}
+		if route.Sticky != "" && route.Sticky != StickyUser && route.Sticky != StickyConversation {
+			return nil, fmt.Errorf("routes[%d]: sticky %q is not one of %s, %s", i, route.Sticky, StickyUser, StickyConversation)
+		}
+		if err := route.Limits.Validate(); err != nil {
+			return nil, fmt.Errorf("routes[%d]: %v", i, err)
+		}
+		if route.Mode != "" && !dify.ValidMode(route.Mode) {
+			return nil, fmt.Errorf("routes[%d]: mode %q is not one of %s, %s, %s", i, route.Mode, dify.ModeChat, dify.ModeAgent, dify.ModeCompletion)
+		}
+		client, ok := clients[route.BaseURL]
+		if !ok {
+			client = newClient(route.BaseURL)
+			clients[route.BaseURL] = client
+		}
+		target := &Target{Route: route, Client: client.WithMode(route.Mode)}
+		for _, name := range append([]string{route.Model}, route.Aliases...) {
+			if name == "" {
+				return nil, fmt.Errorf("routes[%d]: empty alias", i)
+			}
+			if prev := t.byModel[name]; prev != nil {
+				return nil, fmt.Errorf("routes[%d]: model %q already routed by %q", i, name, prev.Model)
+			}
+			t.byModel[name] = target
+		}
+	}
+	for i := range f.Routes {
+		target := t.byModel[f.Routes[i].Model]
+		for _, name := range f.Routes[i].Fallbacks {
+			fallback, ok := t.byModel[name]
+			if !ok {
+				return nil, fmt.Errorf("routes[%d]: fallback %q is not routed", i, name)
+			}
+			if fallback == target {
+				return nil, fmt.Errorf("routes[%d]: fallback %q is the route itself", i, name)
+			}
+			if len(fallback.Split) > 0 {
+				return nil, fmt.Errorf("routes[%d]: fallback %q is a split route", i, name)
+			}
+			target.fallbacks = append(target.fallbacks, fallback)
+		}
+		if on := f.Routes[i].FallbackOn; on != nil && (on.Timeout < 0 || on.FirstToken < 0) {
+			return nil, fmt.Errorf("routes[%d]: fallback_on timeouts must not be negative", i)
+		}
+		if len(f.Routes[i].Split) > 0 && len(f.Routes[i].Fallbacks) > 0 {
+			return nil, fmt.Errorf("routes[%d]: a split route cannot have fallbacks; give its variants fallbacks instead", i)
+		}
+		total := 0
+		for _, v := range f.Routes[i].Split {
+			variant, ok := t.byModel[v.Route]
+			if !ok {
+				return nil, fmt.Errorf("routes[%d]: split route %q is not routed", i, v.Route)
+			}
+			if len(variant.Split) > 0 {
+				return nil, fmt.Errorf("routes[%d]: split route %q is itself split", i, v.Route)
+			}
+			if v.Weight < 0 {
+				return nil, fmt.Errorf("routes[%d]: split weight of %q must not be negative", i, v.Route)
+			}
+			total += v.Weight
+			target.variants = append(target.variants, variant)
+			target.weights = append(target.weights, total)
+		}
+		if len(f.Routes[i].Split) > 0 && total == 0 {
+			return nil, fmt.Errorf("routes[%d]: split weights must not all be zero", i)
+		}
+		if sh := f.Routes[i].Shadow; sh != nil {
+			shadow, ok := t.byModel[sh.Route]
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("routes[%d]: shadow route %q is not routed", i, sh.Route)
+			case shadow == target:
+				return nil, fmt.Errorf("routes[%d]: shadow %q is the route itself", i, sh.Route)
+			case len(shadow.Split) > 0:
+				return nil, fmt.Errorf("routes[%d]: shadow %q is a split route", i, sh.Route)
+			case sh.Percent <= 0 || sh.Percent > 100:
+				return nil, fmt.Errorf("routes[%d]: shadow percent must be above 0 and at most 100, got %g", i, sh.Percent)
+			}
+			target.shadow = shadow
+		}
+	}
+	return t, nil
+}
+
+// Lookup returns the route for a model name or alias.
+func (t *Table) Lookup(model string) (*Target, bool) {
+	if t == nil {
+		return nil, false
+	}
+	target, ok := t.byModel[model]
+	return target, ok
+}
+
+// Strict reports whether unrouted models are rejected.
+func (t *Table) Strict() bool {
+	return t != nil && t.file.Strict
+}
+
+// HasShadows reports whether any route mirrors requests to a shadow.
+func (t *Table) HasShadows() bool {
+	return slices.ContainsFunc(t.Routes(), func(r Route) bool { return r.Shadow != nil })
+}
+
+// Routes returns every route in file order.
+func (t *Table) Routes() []Route {
+	if t == nil {
+		return nil
+	}
+	return t.file.Routes
+}
+
+// Models returns every routed model name and alias in file order.
+func (t *Table) Models() []string {
+	var out []string
+	for _, r := range t.Routes() {
+		out = append(out, r.Model)
+		out = append(out, r.Aliases...)
+	}
+	return out
+}
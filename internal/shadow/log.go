@@ -0,0 +1,86 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is one mirrored request: the primary and shadow answers side by
+// side.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Route is the route whose shadow ran; Served is the route that served
+	// the primary, which differs after a split or a fallback.
+	Route  string `json:"route"`
+	Served string `json:"served,omitempty"`
+	Shadow string `json:"shadow"`
+	// Model is the model the caller named.
+	Model string `json:"model"`
+	User  string `json:"user"`
+	Query string `json:"query"`
+
+	PrimaryAnswer    string `json:"primary_answer"`
+	PrimaryLatencyMS int64  `json:"primary_latency_ms"`
+	PrimaryTokens    int    `json:"primary_tokens"`
+	PrimaryError     string `json:"primary_error,omitempty"`
+
+	ShadowAnswer    string `json:"shadow_answer"`
+	ShadowLatencyMS int64  `json:"shadow_latency_ms"`
+	ShadowTokens    int    `json:"shadow_tokens"`
+	ShadowError     string `json:"shadow_error,omitempty"`
+
+	// Similarity of the two answers, from 0 to 1; see Similarity. It is
+	// zero when either side failed.
+	Similarity float64 `json:"similarity"`
+}
+
+// Log appends Records to a JSONL file. It is safe for concurrent use.
+type Log struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+	// wg tracks shadow requests in flight, which Close waits for.
+	wg sync.WaitGroup
+}
+
+// OpenLog opens the JSONL file at path for appending, creating it if needed.
+func OpenLog(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open shadow log: %w", err)
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// Path returns the file the log is written to.
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Append writes rec as one line.
+func (l *Log) Append(rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(append(line, '\n'))
+	return err
+}
+
+// Close waits for the shadow requests in flight to be recorded, then closes
+// the file. A nil *Log has nothing to close.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
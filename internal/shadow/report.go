@@ -0,0 +1,152 @@
+package shadow
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	apierrors "github.com/zhengjr9/dify-agent/internal/errors"
+)
+
+// Summary aggregates the records of one route and shadow pair.
+type Summary struct {
+	Route  string `json:"route"`
+	Shadow string `json:"shadow"`
+	// Requests counts mirrored requests; Compared counts those where both
+	// sides answered, over which the averages and Similarity are taken.
+	Requests      int `json:"requests"`
+	Compared      int `json:"compared"`
+	PrimaryErrors int `json:"primary_errors"`
+	ShadowErrors  int `json:"shadow_errors"`
+
+	PrimaryLatencyMS    Latency `json:"primary_latency_ms"`
+	ShadowLatencyMS     Latency `json:"shadow_latency_ms"`
+	PrimaryTokensAvg    float64 `json:"primary_tokens_avg"`
+	ShadowTokensAvg     float64 `json:"shadow_tokens_avg"`
+	SimilarityAvg       float64 `json:"similarity_avg"`
+	SimilarityBelowHalf int     `json:"similarity_below_half"`
+}
+
+// Latency summarises latencies in milliseconds.
+type Latency struct {
+	Avg float64 `json:"avg"`
+	P50 int64   `json:"p50"`
+	P95 int64   `json:"p95"`
+}
+
+// Summarize reads the JSONL log at path and aggregates it per route and
+// shadow, ordered by route then shadow.
+func Summarize(path string) ([]Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open shadow log: %w", err)
+	}
+	defer f.Close()
+
+	type pair struct{ route, shadow string }
+	type acc struct {
+		Summary
+		primary, shadow  []int64
+		primTok, shadTok int
+		similarity       float64
+	}
+	byPair := map[pair]*acc{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("shadow log line %d: %w", line, err)
+		}
+		k := pair{rec.Route, rec.Shadow}
+		a := byPair[k]
+		if a == nil {
+			a = &acc{Summary: Summary{Route: rec.Route, Shadow: rec.Shadow}}
+			byPair[k] = a
+		}
+		a.Requests++
+		if rec.PrimaryError != "" {
+			a.PrimaryErrors++
+		}
+		if rec.ShadowError != "" {
+			a.ShadowErrors++
+		}
+		if rec.PrimaryError != "" || rec.ShadowError != "" {
+			continue
+		}
+		a.Compared++
+		a.primary = append(a.primary, rec.PrimaryLatencyMS)
+		a.shadow = append(a.shadow, rec.ShadowLatencyMS)
+		a.primTok += rec.PrimaryTokens
+		a.shadTok += rec.ShadowTokens
+		a.similarity += rec.Similarity
+		if rec.Similarity < 0.5 {
+			a.SimilarityBelowHalf++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read shadow log: %w", err)
+	}
+
+	out := make([]Summary, 0, len(byPair))
+	for _, a := range byPair {
+		if a.Compared > 0 {
+			n := float64(a.Compared)
+			a.PrimaryLatencyMS = latency(a.primary)
+			a.ShadowLatencyMS = latency(a.shadow)
+			a.PrimaryTokensAvg = float64(a.primTok) / n
+			a.ShadowTokensAvg = float64(a.shadTok) / n
+			a.SimilarityAvg = a.similarity / n
+		}
+		out = append(out, a.Summary)
+	}
+	slices.SortFunc(out, func(a, b Summary) int {
+		return cmp.Or(cmp.Compare(a.Route, b.Route), cmp.Compare(a.Shadow, b.Shadow))
+	})
+	return out, nil
+}
+
+func latency(ms []int64) Latency {
+	slices.Sort(ms)
+	var sum int64
+	for _, v := range ms {
+		sum += v
+	}
+	at := func(q float64) int64 { return ms[int(q*float64(len(ms)-1))] }
+	return Latency{Avg: float64(sum) / float64(len(ms)), P50: at(0.5), P95: at(0.95)}
+}
+
+// WriteReport writes summaries as a text table.
+func WriteReport(w io.Writer, summaries []Summary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tSHADOW\tREQUESTS\tCOMPARED\tERRORS (P/S)\tLATENCY P50 ms (P/S)\tLATENCY P95 ms (P/S)\tTOKENS AVG (P/S)\tSIMILARITY AVG\tSIMILARITY < 0.5")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d/%d\t%d/%d\t%d/%d\t%.1f/%.1f\t%.3f\t%d\n",
+			s.Route, s.Shadow, s.Requests, s.Compared, s.PrimaryErrors, s.ShadowErrors,
+			s.PrimaryLatencyMS.P50, s.ShadowLatencyMS.P50, s.PrimaryLatencyMS.P95, s.ShadowLatencyMS.P95,
+			s.PrimaryTokensAvg, s.ShadowTokensAvg, s.SimilarityAvg, s.SimilarityBelowHalf)
+	}
+	return tw.Flush()
+}
+
+// Handler serves the summaries of log as JSON, for GET /admin/shadow.
+func Handler(log *Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summaries, err := Summarize(log.Path())
+		if err != nil {
+			apierrors.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": summaries})
+	})
+}
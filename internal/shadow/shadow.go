@@ -0,0 +1,181 @@
+// Package shadow mirrors a sample of routed requests to a candidate Dify app
+// and records both answers side by side, so that a new app version can be
+// judged on real traffic before it is promoted.
+//
+// Shadow requests run in the background once the caller's request has been
+// sent upstream: they never delay the caller and their answers are never
+// returned. Each pair is appended to a JSONL log with latencies, token counts
+// and the similarity of the two answers; Summarize aggregates the log.
+package shadow
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/routes"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+)
+
+// Mirror starts shadow requests and records their outcome. A nil *Mirror
+// mirrors nothing.
+type Mirror struct {
+	log     *Log
+	inputs  *inputs.Builder
+	tokens  *tokenizer.Set
+	timeout time.Duration
+	sample  func() float64
+}
+
+// NewMirror returns a Mirror recording to log. in builds the shadow app's
+// inputs and tokens counts answers whose usage Dify does not report.
+func NewMirror(log *Log, in *inputs.Builder, tokens *tokenizer.Set, timeout time.Duration) *Mirror {
+	return &Mirror{log: log, inputs: in, tokens: tokens, timeout: timeout, sample: rand.Float64}
+}
+
+// Request is what a shadow request is built from.
+type Request struct {
+	// Model is the model the caller named.
+	Model  string
+	Query  string
+	User   string
+	Params inputs.Params
+}
+
+// Start mirrors req to the shadow of route when the request is sampled and
+// returns the Run to report the primary outcome to. It returns nil, which
+// reports nothing, when the request is not mirrored. r is cloned, so the
+// shadow may outlive the caller's request.
+func (m *Mirror) Start(r *http.Request, route *routes.Target, req Request) *Run {
+	if m == nil || route == nil {
+		return nil
+	}
+	shadow, percent := route.ShadowTarget()
+	if shadow == nil || m.sample()*100 >= percent {
+		return nil
+	}
+	run := &Run{
+		rec: Record{
+			Time:   time.Now().UTC(),
+			Route:  route.Model,
+			Shadow: shadow.Model,
+			Model:  req.Model,
+			User:   req.User,
+			Query:  req.Query,
+		},
+		start:   time.Now(),
+		primary: make(chan struct{}),
+	}
+	r = r.Clone(context.Background())
+	m.log.wg.Add(1)
+	go func() {
+		defer m.log.wg.Done()
+		m.run(r, shadow, req, run)
+	}()
+	return run
+}
+
+// run sends the shadow request, waits for the primary outcome and records
+// the pair.
+func (m *Mirror) run(r *http.Request, shadow *routes.Target, req Request, run *Run) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	start := time.Now()
+	app := shadow.App()
+	in, err := m.inputs.Build(ctx, r, app, req.User, req.Params)
+	var resp *dify.BlockingResponse
+	if err == nil {
+		resp, err = shadow.Client.SendBlocking(ctx, app.APIKey, &dify.ChatRequest{Inputs: in, Query: req.Query, User: req.User})
+	}
+	latency := time.Since(start)
+
+	// The primary normally ends first; a primary that never reports is
+	// recorded as unanswered once the request timeout has passed twice.
+	select {
+	case <-run.primary:
+	case <-time.After(2 * m.timeout):
+		run.Finish()
+	}
+
+	run.mu.Lock()
+	rec := run.rec
+	run.mu.Unlock()
+	rec.ShadowLatencyMS = latency.Milliseconds()
+	if err != nil {
+		rec.ShadowError = err.Error()
+	} else {
+		rec.ShadowAnswer = resp.Answer
+		rec.ShadowTokens = m.tokens.Resolve(req.Model, resp.Metadata, req.Query, resp.Answer).CompletionTokens
+	}
+	if rec.PrimaryError == "" && rec.ShadowError == "" {
+		rec.Similarity = Similarity(rec.PrimaryAnswer, rec.ShadowAnswer)
+	}
+	if err := m.log.Append(rec); err != nil {
+		slog.Error("record shadow request", "route", rec.Route, "shadow", rec.Shadow, "error", err)
+	}
+}
+
+// Run is a mirrored request awaiting the outcome of its primary. Its
+// methods may be called on a nil *Run, and after the first report further
+// ones are ignored.
+type Run struct {
+	start   time.Time
+	primary chan struct{}
+	once    sync.Once
+
+	mu  sync.Mutex
+	rec Record
+}
+
+// Answered reports the primary's answer: the route that served it, its
+// text and its completion tokens.
+func (run *Run) Answered(served, answer string, completionTokens int) {
+	if run == nil {
+		return
+	}
+	run.once.Do(func() {
+		run.mu.Lock()
+		run.rec.Served = served
+		run.rec.PrimaryAnswer = answer
+		run.rec.PrimaryTokens = completionTokens
+		run.rec.PrimaryLatencyMS = time.Since(run.start).Milliseconds()
+		run.mu.Unlock()
+		close(run.primary)
+	})
+}
+
+// Failed reports that the primary failed with err.
+func (run *Run) Failed(err error) {
+	if run == nil {
+		return
+	}
+	run.once.Do(func() {
+		run.mu.Lock()
+		run.rec.PrimaryError = err.Error()
+		run.rec.PrimaryLatencyMS = time.Since(run.start).Milliseconds()
+		run.mu.Unlock()
+		close(run.primary)
+	})
+}
+
+// Finish reports a primary that has not reported otherwise, e.g. because
+// the request was invalid or the caller went away, as unanswered. Callers
+// defer it right after Start.
+func (run *Run) Finish() {
+	if run == nil {
+		return
+	}
+	run.once.Do(func() {
+		run.mu.Lock()
+		run.rec.PrimaryError = "no answer"
+		run.rec.PrimaryLatencyMS = time.Since(run.start).Milliseconds()
+		run.mu.Unlock()
+		close(run.primary)
+	})
+}
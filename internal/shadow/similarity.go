@@ -0,0 +1,56 @@
+package shadow
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Similarity returns the cosine similarity of the word counts of a and b,
+// from 0 (no word in common) to 1 (the same words equally often). Case and
+// punctuation are ignored; Chinese, Japanese and Korean characters count as
+// words of their own, as those scripts do not separate words by spaces. Two
+// empty answers are identical.
+func Similarity(a, b string) float64 {
+	ca, cb := words(a), words(b)
+	if len(ca) == 0 && len(cb) == 0 {
+		return 1
+	}
+	var dot, na, nb float64
+	for w, n := range ca {
+		dot += float64(n * cb[w])
+		na += float64(n * n)
+	}
+	for _, n := range cb {
+		nb += float64(n * n)
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// words counts the words of s.
+func words(s string) map[string]int {
+	counts := map[string]int{}
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			counts[word.String()]++
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			counts[string(r)]++
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return counts
+}
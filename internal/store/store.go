@@ -0,0 +1,178 @@
+// Package store provides the small persistent key-value store used for
+// gateway state such as message batches. Values are stored as JSON in named
+// buckets.
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a bucketed JSON key-value store.
+type Store interface {
+	// Put stores v under key in bucket, replacing any previous value.
+	Put(bucket, key string, v any) error
+	// Get decodes the value under key into v. found is false when the key
+	// does not exist.
+	Get(bucket, key string, v any) (found bool, err error)
+	// Delete removes key from bucket. Deleting a missing key is not an error.
+	Delete(bucket, key string) error
+	// List calls fn for every key in bucket with the given prefix, in
+	// ascending key order. Iteration stops at the first error fn returns.
+	List(bucket, prefix string, fn func(key string, raw []byte) error) error
+	// Close releases the underlying resources.
+	Close() error
+}
+
+// Open opens the store at path. An empty path returns an in-memory store
+// whose contents are lost on restart.
+func Open(path string) (Store, error) {
+	if path == "" {
+		return newMemory(), nil
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open store %s: %w", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func (s *boltStore) Put(bucket, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s/%s: %w", bucket, key, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), raw)
+	})
+}
+
+func (s *boltStore) Get(bucket, key string, v any) (bool, error) {
+	var raw []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if data := b.Get([]byte(key)); data != nil {
+			raw = append([]byte(nil), data...)
+		}
+		return nil
+	})
+	if err != nil || raw == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+func (s *boltStore) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) List(bucket, prefix string, fn func(key string, raw []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
+
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemory() *memoryStore {
+	return &memoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) Put(bucket, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s/%s: %w", bucket, key, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[bucket]
+	if b == nil {
+		b = make(map[string][]byte)
+		s.buckets[bucket] = b
+	}
+	b[key] = raw
+	return nil
+}
+
+func (s *memoryStore) Get(bucket, key string, v any) (bool, error) {
+	s.mu.RLock()
+	raw, ok := s.buckets[bucket][key]
+	s.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+func (s *memoryStore) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *memoryStore) List(bucket, prefix string, fn func(key string, raw []byte) error) error {
+	s.mu.RLock()
+	b := s.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		vals[i] = b[k]
+	}
+	s.mu.RUnlock()
+
+	for i, k := range keys {
+		if err := fn(k, vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error { return nil }
@@ -0,0 +1,292 @@
+// Package tlsutil builds the TLS configurations of the gateway: that of its
+// listeners, whose certificate, key and client CA bundle are reloaded when
+// their files change, and that of its connections to Dify. Middleware maps
+// the subject of a verified client certificate onto the caller's identity.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/httputil"
+)
+
+// Client authentication modes of a listener with a client CA bundle.
+const (
+	// ClientAuthRequire rejects connections without a client certificate
+	// signed by the CA bundle.
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies client certificates when presented.
+	ClientAuthOptional = "optional"
+)
+
+// Client certificate fields naming the caller; see Middleware.
+const (
+	IdentityNone  = "none"
+	IdentityCN    = "cn"
+	IdentityDN    = "dn"
+	IdentityEmail = "email"
+	IdentityURI   = "uri"
+)
+
+// ValidVersion reports whether v names a TLS version "1.0" to "1.3", or is
+// empty for the default.
+func ValidVersion(v string) bool {
+	_, err := parseVersion(v)
+	return err == nil
+}
+
+// parseVersion returns the TLS version named "1.0" to "1.3"; empty means
+// 1.2.
+func parseVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q: want 1.0, 1.1, 1.2 or 1.3", v)
+}
+
+// ServerConfig configures the TLS of a listener.
+type ServerConfig struct {
+	// CertFile and KeyFile hold the PEM certificate chain and key served.
+	CertFile, KeyFile string
+	// ClientCAFile, when set, is the PEM bundle client certificates are
+	// verified against, as ClientAuth requires.
+	ClientCAFile string
+	ClientAuth   string
+	// MinVersion is the lowest TLS version accepted, e.g. "1.3" (default
+	// "1.2").
+	MinVersion string
+}
+
+// Enabled reports whether cfg configures TLS.
+func (cfg ServerConfig) Enabled() bool {
+	return cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+// NewServer returns the TLS configuration of a listener, or nil when cfg does
+// not enable TLS. The files are read immediately and again, before a
+// handshake, whenever one of them has changed; files that fail to load are
+// logged and the previous ones stay in use.
+func NewServer(cfg ServerConfig) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		if cfg.ClientCAFile != "" {
+			return nil, errors.New("tls: a client CA requires a certificate and key")
+		}
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls: both a certificate and a key are required")
+	}
+	version, err := parseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	auth := tls.NoClientCert
+	if cfg.ClientCAFile != "" {
+		switch cfg.ClientAuth {
+		case ClientAuthRequire, "":
+			auth = tls.RequireAndVerifyClientCert
+		case ClientAuthOptional:
+			auth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("tls: unknown client auth %q: want %s or %s", cfg.ClientAuth, ClientAuthRequire, ClientAuthOptional)
+		}
+	}
+	r := &reloader{cfg: cfg, base: &tls.Config{MinVersion: version, ClientAuth: auth}}
+	if _, err := r.load(); err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return &tls.Config{
+		MinVersion:         version,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return r.load() },
+	}, nil
+}
+
+// reloader holds the configuration built from the files of a ServerConfig
+// and rebuilds it when they change.
+type reloader struct {
+	cfg  ServerConfig
+	base *tls.Config
+
+	mu      sync.Mutex
+	current *tls.Config
+	state   []fileState
+}
+
+func (r *reloader) load() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	state := make([]fileState, len(files))
+	for i, f := range files {
+		state[i] = stat(f)
+	}
+	if r.current != nil && slices.Equal(state, r.state) {
+		return r.current, nil
+	}
+	c, err := r.build()
+	if err != nil {
+		if r.current == nil {
+			return nil, err
+		}
+		slog.Error("TLS files changed but failed to load; keeping the previous ones", "error", err)
+		r.state = state
+		return r.current, nil
+	}
+	if r.current != nil {
+		slog.Info("TLS certificate reloaded", "cert", r.cfg.CertFile)
+	}
+	r.current, r.state = c, state
+	return c, nil
+}
+
+func (r *reloader) build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := r.base.Clone()
+	c.Certificates = []tls.Certificate{cert}
+	if r.cfg.ClientCAFile != "" {
+		if c.ClientCAs, err = LoadPool(r.cfg.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// LoadPool reads a PEM CA bundle.
+func LoadPool(path string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("%s holds no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// ClientConfig configures the TLS of connections to an upstream.
+type ClientConfig struct {
+	// CAFile, when set, replaces the system roots with a PEM bundle.
+	CAFile string
+	// CertFile and KeyFile hold a client certificate presented upstream.
+	CertFile, KeyFile string
+	// MinVersion is the lowest TLS version used, e.g. "1.3" (default "1.2").
+	MinVersion string
+}
+
+// NewClient returns the TLS configuration of upstream connections.
+func NewClient(cfg ClientConfig) (*tls.Config, error) {
+	version, err := parseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	c := &tls.Config{MinVersion: version}
+	if cfg.CAFile != "" {
+		if c.RootCAs, err = LoadPool(cfg.CAFile); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("tls: a client certificate and key must be set together")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// ValidIdentity reports whether field is one of the client certificate
+// fields Middleware can read; empty is IdentityNone.
+func ValidIdentity(field string) bool {
+	switch field {
+	case "", IdentityNone, IdentityCN, IdentityDN, IdentityEmail, IdentityURI:
+		return true
+	}
+	return false
+}
+
+// Middleware names the caller of next by field of its verified client
+// certificate: the subject common name, the whole subject, or the first
+// e-mail or URI subject alternative name. The name becomes the user of the
+// request's httputil.Credentials unless a verified access token named one.
+// Requests without a verified certificate, and all of them when field is
+// IdentityNone or empty, pass through unchanged.
+func Middleware(field string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if field == IdentityNone || field == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			creds := httputil.ExtractCredentials(r)
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || creds.User != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if creds.User = subject(r.TLS.VerifiedChains[0][0], field); creds.User == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, httputil.WithCredentials(r, creds))
+		})
+	}
+}
+
+func subject(cert *x509.Certificate, field string) string {
+	switch field {
+	case IdentityCN:
+		return cert.Subject.CommonName
+	case IdentityDN:
+		return cert.Subject.String()
+	case IdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case IdentityURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// fileState identifies a version of a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func stat(path string) fileState {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{fi.ModTime(), fi.Size()}
+}
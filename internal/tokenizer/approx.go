@@ -0,0 +1,39 @@
+package tokenizer
+
+import "unicode/utf8"
+
+// approx estimates token counts without a vocabulary. It uses the same
+// pre-tokenizer as the exact encoder and then assumes roughly four bytes per
+// token for ASCII text and a fixed number of tokens per non-ASCII rune, which
+// tracks cl100k/o200k closely enough for usage estimates on mixed
+// English/CJK text.
+type approx struct {
+	name      string
+	split     splitFunc
+	runeCost  float64
+	asciiSize int
+}
+
+func (a *approx) Encoding() string { return a.name }
+func (a *approx) Exact() bool      { return false }
+
+func (a *approx) Count(text string) int {
+	n := 0
+	for _, piece := range a.split([]rune(text)) {
+		ascii, wide := 0, 0
+		for _, r := range piece {
+			if r < utf8.RuneSelf {
+				ascii++
+			} else {
+				wide++
+			}
+		}
+		cost := float64(wide)*a.runeCost + float64((ascii+a.asciiSize-1)/a.asciiSize)
+		if c := int(cost + 0.5); c > 0 {
+			n += c
+		} else {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,102 @@
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bpe is an exact byte-level BPE encoder driven by a tiktoken rank table.
+type bpe struct {
+	name  string
+	ranks map[string]int
+	split splitFunc
+}
+
+// loadRanks reads a tiktoken rank file. Each line holds a base64-encoded
+// token followed by its integer rank, separated by a single space.
+func loadRanks(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranks := make(map[string]int, 200000)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		tok, rank, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected \"<base64> <rank>\"", path, lineNo)
+		}
+		raw, err := base64.StdEncoding.DecodeString(tok)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: decode token: %w", path, lineNo, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: parse rank: %w", path, lineNo, err)
+		}
+		ranks[string(raw)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("%s: no ranks found", path)
+	}
+	return ranks, nil
+}
+
+func (b *bpe) Encoding() string { return b.name }
+func (b *bpe) Exact() bool      { return true }
+
+func (b *bpe) Count(text string) int {
+	n := 0
+	for _, piece := range b.split([]rune(text)) {
+		n += b.countPiece([]byte(string(piece)))
+	}
+	return n
+}
+
+// countPiece returns the number of tokens the byte-pair merge produces for a
+// single pre-tokenized piece.
+func (b *bpe) countPiece(piece []byte) int {
+	if _, ok := b.ranks[string(piece)]; ok {
+		return 1
+	}
+	if len(piece) == 1 {
+		return 1
+	}
+
+	// bounds[i] is the start offset of the i-th part; the final entry is
+	// len(piece). Adjacent parts are merged lowest-rank first until no
+	// adjacent pair forms a known token.
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, at := math.MaxInt, -1
+		for i := 0; i+2 < len(bounds); i++ {
+			if r, ok := b.ranks[string(piece[bounds[i]:bounds[i+2]])]; ok && r < best {
+				best, at = r, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		bounds = append(bounds[:at+1], bounds[at+2:]...)
+	}
+	return len(bounds) - 1
+}
@@ -0,0 +1,216 @@
+package tokenizer
+
+import "unicode"
+
+// splitFunc splits text into the pieces that BPE is applied to independently.
+type splitFunc func(rs []rune) [][]rune
+
+// The split functions below are hand-written equivalents of the tiktoken
+// pre-tokenization regexes. Go's regexp package has no look-ahead, which both
+// patterns need for `\s+(?!\S)`, so each alternative is matched explicitly in
+// the same order the regex would try them.
+//
+// cl100k_base:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// o200k_base:
+//
+//	[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|
+//	[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|
+//	\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+(?!\S)|\s+
+
+func splitCL100K(rs []rune) [][]rune {
+	return splitWith(rs, func(rs []rune, i int) int {
+		if n := matchContraction(rs, i); n > 0 {
+			return n
+		}
+		if n := matchLetters(rs, i); n > 0 {
+			return n
+		}
+		if n := matchDigits(rs, i); n > 0 {
+			return n
+		}
+		if n := matchPunct(rs, i, isNewline); n > 0 {
+			return n
+		}
+		return matchSpace(rs, i)
+	})
+}
+
+func splitO200K(rs []rune) [][]rune {
+	return splitWith(rs, func(rs []rune, i int) int {
+		if n := matchCasedWord(rs, i, false); n > 0 {
+			return n
+		}
+		if n := matchCasedWord(rs, i, true); n > 0 {
+			return n
+		}
+		if n := matchDigits(rs, i); n > 0 {
+			return n
+		}
+		if n := matchPunct(rs, i, func(r rune) bool { return isNewline(r) || r == '/' }); n > 0 {
+			return n
+		}
+		return matchSpace(rs, i)
+	})
+}
+
+// splitWith repeatedly applies match at the current offset. A zero-length
+// match consumes a single rune so that splitting always makes progress.
+func splitWith(rs []rune, match func([]rune, int) int) [][]rune {
+	var pieces [][]rune
+	for i := 0; i < len(rs); {
+		n := match(rs, i)
+		if n <= 0 {
+			n = 1
+		}
+		pieces = append(pieces, rs[i:i+n])
+		i += n
+	}
+	return pieces
+}
+
+func isNewline(r rune) bool { return r == '\r' || r == '\n' }
+func isLetter(r rune) bool  { return unicode.IsLetter(r) }
+func isNumber(r rune) bool  { return unicode.IsNumber(r) }
+func isSpace(r rune) bool   { return unicode.IsSpace(r) }
+
+// isPrefix reports whether r matches [^\r\n\p{L}\p{N}].
+func isPrefix(r rune) bool { return !isNewline(r) && !isLetter(r) && !isNumber(r) }
+
+func isUpperish(r rune) bool {
+	return unicode.In(r, unicode.Lu, unicode.Lt, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+func isLowerish(r rune) bool {
+	return unicode.In(r, unicode.Ll, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+// matchContraction matches (?i:'s|'t|'re|'ve|'m|'ll|'d).
+func matchContraction(rs []rune, i int) int {
+	if i >= len(rs) || rs[i] != '\'' {
+		return 0
+	}
+	if i+2 < len(rs) {
+		two := string(unicode.ToLower(rs[i+1])) + string(unicode.ToLower(rs[i+2]))
+		switch two {
+		case "re", "ve", "ll":
+			return 3
+		}
+	}
+	if i+1 < len(rs) {
+		switch unicode.ToLower(rs[i+1]) {
+		case 's', 't', 'm', 'd':
+			return 2
+		}
+	}
+	return 0
+}
+
+// matchLetters matches [^\r\n\p{L}\p{N}]?\p{L}+.
+func matchLetters(rs []rune, i int) int {
+	start := i
+	if isPrefix(rs[i]) && i+1 < len(rs) && isLetter(rs[i+1]) {
+		i++
+	}
+	j := i
+	for j < len(rs) && isLetter(rs[j]) {
+		j++
+	}
+	if j == i {
+		return 0
+	}
+	return j - start
+}
+
+// matchCasedWord matches the two o200k word alternatives. When upperFirst is
+// false it matches prefix?[UPPER]*[LOWER]+ contraction?, otherwise
+// prefix?[UPPER]+[LOWER]* contraction?.
+func matchCasedWord(rs []rune, i int, upperFirst bool) int {
+	try := func(j int) int {
+		u := j
+		for u < len(rs) && isUpperish(rs[u]) {
+			u++
+		}
+		// Greedy [UPPER]* / [UPPER]+ followed by [LOWER]+ / [LOWER]*: give back
+		// upper-ish runes until the lower-ish part can match.
+		minUpper := j
+		if upperFirst {
+			minUpper = j + 1
+		}
+		for k := u; k >= minUpper; k-- {
+			l := k
+			for l < len(rs) && isLowerish(rs[l]) {
+				l++
+			}
+			if !upperFirst && l == k {
+				continue
+			}
+			return l + matchContraction(rs, l)
+		}
+		return -1
+	}
+	if isPrefix(rs[i]) && i+1 < len(rs) {
+		if end := try(i + 1); end >= 0 {
+			return end - i
+		}
+	}
+	if end := try(i); end >= 0 {
+		return end - i
+	}
+	return 0
+}
+
+// matchDigits matches \p{N}{1,3}.
+func matchDigits(rs []rune, i int) int {
+	j := i
+	for j < len(rs) && j-i < 3 && isNumber(rs[j]) {
+		j++
+	}
+	return j - i
+}
+
+// matchPunct matches ` ?[^\s\p{L}\p{N}]+` followed by runes accepted by tail.
+func matchPunct(rs []rune, i int, tail func(rune) bool) int {
+	start := i
+	if rs[i] == ' ' && i+1 < len(rs) && isSymbol(rs[i+1]) {
+		i++
+	}
+	j := i
+	for j < len(rs) && isSymbol(rs[j]) {
+		j++
+	}
+	if j == i {
+		return 0
+	}
+	for j < len(rs) && tail(rs[j]) {
+		j++
+	}
+	return j - start
+}
+
+func isSymbol(r rune) bool { return !isSpace(r) && !isLetter(r) && !isNumber(r) }
+
+// matchSpace matches \s*[\r\n]+|\s+(?!\S)|\s+.
+func matchSpace(rs []rune, i int) int {
+	j := i
+	lastNL := -1
+	for j < len(rs) && isSpace(rs[j]) {
+		if isNewline(rs[j]) {
+			lastNL = j
+		}
+		j++
+	}
+	if j == i {
+		return 0
+	}
+	if lastNL >= 0 {
+		return lastNL + 1 - i
+	}
+	if j < len(rs) && j-i > 1 {
+		// \s+(?!\S): leave the last space to prefix the following word.
+		return j - 1 - i
+	}
+	return j - i
+}
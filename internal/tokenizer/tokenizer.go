@@ -0,0 +1,149 @@
+// Package tokenizer counts tokens locally so the proxy can answer token
+// counting endpoints and fill in usage when Dify does not report it.
+//
+// Exact counts require a tiktoken rank file (e.g. cl100k_base.tiktoken) in the
+// configured directory. When no file is available the encoding falls back to
+// a vocabulary-free approximation and every count it produces is treated as an
+// estimate.
+package tokenizer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/zhengjr9/dify-agent/internal/dify"
+)
+
+// Encoding names understood by Load.
+const (
+	CL100K = "cl100k_base"
+	O200K  = "o200k_base"
+)
+
+// Tokenizer counts tokens for one encoding.
+type Tokenizer interface {
+	// Encoding returns the encoding name, e.g. "cl100k_base".
+	Encoding() string
+	// Count returns the number of tokens in text.
+	Count(text string) int
+	// Exact reports whether counts come from a real vocabulary.
+	Exact() bool
+}
+
+var splitters = map[string]splitFunc{
+	CL100K: splitCL100K,
+	O200K:  splitO200K,
+}
+
+// Set holds one Tokenizer per supported encoding and picks between them by
+// model name.
+type Set struct {
+	def    string
+	byName map[string]Tokenizer
+}
+
+// Load builds a Set. For each supported encoding, "<dir>/<encoding>.tiktoken"
+// is loaded when it exists; otherwise the approximate counter is used.
+// def selects the encoding used for models ForModel does not recognise.
+func Load(dir, def string) (*Set, error) {
+	if def == "" {
+		def = CL100K
+	}
+	if _, ok := splitters[def]; !ok {
+		return nil, fmt.Errorf("tokenizer: unknown encoding %q", def)
+	}
+
+	s := &Set{def: def, byName: make(map[string]Tokenizer, len(splitters))}
+	for name, split := range splitters {
+		s.byName[name] = newApprox(name, split)
+		if dir == "" {
+			continue
+		}
+		ranks, err := loadRanks(filepath.Join(dir, name+".tiktoken"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tokenizer: %w", err)
+		}
+		s.byName[name] = &bpe{name: name, ranks: ranks, split: split}
+	}
+	return s, nil
+}
+
+func newApprox(name string, split splitFunc) Tokenizer {
+	cost := 1.0
+	if name == O200K {
+		cost = 0.75
+	}
+	return &approx{name: name, split: split, runeCost: cost, asciiSize: 4}
+}
+
+// For returns the tokenizer to use for the given model name.
+func (s *Set) For(model string) Tokenizer {
+	return s.byName[s.ForModel(model)]
+}
+
+// ForModel maps a model name to an encoding. Names from the GPT-4o generation
+// onward use o200k_base; everything else uses the configured default.
+func (s *Set) ForModel(model string) string {
+	m := strings.ToLower(model)
+	for _, p := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4", "chatgpt-4o"} {
+		if strings.HasPrefix(m, p) {
+			return O200K
+		}
+	}
+	if strings.HasPrefix(m, "gpt-4") || strings.HasPrefix(m, "gpt-3.5") {
+		return CL100K
+	}
+	return s.def
+}
+
+// Usage is a prompt/completion token pair. Estimated is true when the counts
+// were produced locally instead of being reported by Dify.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	Estimated        bool
+}
+
+// Total returns the sum of prompt and completion tokens.
+func (u Usage) Total() int { return u.PromptTokens + u.CompletionTokens }
+
+// Add sums the usage of two Dify requests, such as two candidates of one
+// request: each is billed for its prompt.
+func (u Usage) Add(o Usage) Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens + o.PromptTokens,
+		CompletionTokens: u.CompletionTokens + o.CompletionTokens,
+		Estimated:        u.Estimated || o.Estimated,
+	}
+}
+
+// Merge combines the usage of two candidates generated for the same prompt
+// as reported to the client: the prompt is counted once and completions are
+// summed. Limits and budgets are charged with Add.
+func (u Usage) Merge(o Usage) Usage {
+	return Usage{
+		PromptTokens:     max(u.PromptTokens, o.PromptTokens),
+		CompletionTokens: u.CompletionTokens + o.CompletionTokens,
+		Estimated:        u.Estimated || o.Estimated,
+	}
+}
+
+// Resolve returns the usage Dify reported in metadata, or a local estimate
+// computed from prompt and completion when metadata carries no usage.
+func (s *Set) Resolve(model string, metadata map[string]any, prompt, completion string) Usage {
+	if u, ok := dify.ParseUsage(metadata); ok {
+		return Usage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens}
+	}
+	tok := s.For(model)
+	return Usage{
+		PromptTokens:     tok.Count(prompt),
+		CompletionTokens: tok.Count(completion),
+		Estimated:        true,
+	}
+}
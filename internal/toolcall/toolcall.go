@@ -0,0 +1,235 @@
+// Package toolcall emulates function calling on top of Dify apps.
+//
+// Dify chat apps have no notion of caller-defined tools, so the declared
+// functions are described in the query together with a reply convention:
+// the model answers with <tool_call>{"name":…,"arguments":{…}}</tool_call>
+// blocks when it wants a function called. The answer is then parsed back into
+// protocol-native function calls. Earlier calls and their results are
+// rendered into the conversation history with the same markup.
+package toolcall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	openTag  = "<tool_call>"
+	closeTag = "</tool_call>"
+)
+
+// Mode controls whether and how the model may call functions.
+type Mode int
+
+const (
+	// ModeAuto lets the model choose between answering and calling.
+	ModeAuto Mode = iota
+	// ModeAny requires the model to call at least one function.
+	ModeAny
+	// ModeNone disables function calling.
+	ModeNone
+)
+
+// Function is one declared function. Parameters is its JSON Schema.
+type Function struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+}
+
+// Call is a function call parsed from an answer.
+type Call struct {
+	Name string
+	Args map[string]any
+}
+
+// Spec is the set of functions offered for one request. A nil *Spec offers
+// none: Prompt is empty and answers are returned unparsed.
+type Spec struct {
+	funcs []Function
+	mode  Mode
+}
+
+// NewSpec returns the Spec for funcs under mode. When allowed is non-empty
+// only those functions are offered. It returns nil when nothing is offered.
+func NewSpec(funcs []Function, mode Mode, allowed []string) *Spec {
+	if mode == ModeNone {
+		return nil
+	}
+	var offered []Function
+	for _, f := range funcs {
+		if f.Name == "" || (len(allowed) > 0 && !slices.Contains(allowed, f.Name)) {
+			continue
+		}
+		offered = append(offered, f)
+	}
+	if len(offered) == 0 {
+		return nil
+	}
+	return &Spec{funcs: offered, mode: mode}
+}
+
+// Prompt returns the instructions that describe the functions and the reply
+// convention to the model.
+func (s *Spec) Prompt() string {
+	if s == nil {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("system: You can call the following functions. To call one, reply with one or more blocks of the form\n")
+	sb.WriteString(openTag + `{"name": "<function name>", "arguments": {<arguments as JSON>}}` + closeTag + "\n")
+	sb.WriteString("and nothing else. Function results are returned in <tool_result> blocks.\n")
+	sb.WriteString("Functions:\n")
+	for _, f := range s.funcs {
+		fmt.Fprintf(&sb, "- %s", f.Name)
+		if f.Description != "" {
+			fmt.Fprintf(&sb, ": %s", f.Description)
+		}
+		sb.WriteString("\n")
+		if len(f.Parameters) > 0 {
+			fmt.Fprintf(&sb, "  parameters: %s\n", compact(f.Parameters))
+		}
+	}
+	if s.mode == ModeAny {
+		sb.WriteString("You must call at least one of these functions.\n")
+	} else {
+		sb.WriteString("Call a function only when it is needed; otherwise answer normally.\n")
+	}
+	return sb.String()
+}
+
+// Parse splits an answer into plain text and function calls. Blocks that are
+// malformed or name an undeclared function are kept as text.
+func (s *Spec) Parse(answer string) (text string, calls []Call) {
+	if s == nil {
+		return answer, nil
+	}
+	var sb strings.Builder
+	rest := answer
+	for {
+		i := strings.Index(rest, openTag)
+		if i < 0 {
+			sb.WriteString(rest)
+			break
+		}
+		sb.WriteString(rest[:i])
+		body := rest[i+len(openTag):]
+		j := strings.Index(body, closeTag)
+		if j < 0 {
+			// Unterminated: accept a trailing block if it parses.
+			if c, ok := s.parseCall(body); ok {
+				calls = append(calls, c)
+			} else {
+				sb.WriteString(rest[i:])
+			}
+			break
+		}
+		if c, ok := s.parseCall(body[:j]); ok {
+			calls = append(calls, c)
+		} else {
+			sb.WriteString(rest[i : i+len(openTag)+j+len(closeTag)])
+		}
+		rest = body[j+len(closeTag):]
+	}
+	return strings.TrimSpace(sb.String()), calls
+}
+
+func (s *Spec) parseCall(body string) (Call, bool) {
+	body = strings.TrimSpace(body)
+	body = strings.TrimPrefix(body, "```json")
+	body = strings.Trim(body, "`\n ")
+	var raw struct {
+		Name      string         `json:"name"`
+		Arguments map[string]any `json:"arguments"`
+		Args      map[string]any `json:"args"`
+	}
+	if err := json.Unmarshal([]byte(body), &raw); err != nil {
+		return Call{}, false
+	}
+	if !slices.ContainsFunc(s.funcs, func(f Function) bool { return f.Name == raw.Name }) {
+		return Call{}, false
+	}
+	args := raw.Arguments
+	if args == nil {
+		args = raw.Args
+	}
+	if args == nil {
+		args = map[string]any{}
+	}
+	return Call{Name: raw.Name, Args: args}, true
+}
+
+// Scanner parses a streamed answer. Text before the first tool call block is
+// passed through as it arrives; everything from the block onwards is held
+// until Finish.
+type Scanner struct {
+	spec     *Spec
+	pending  string
+	captured strings.Builder
+	inCall   bool
+}
+
+// NewScanner returns a Scanner for s.
+func (s *Spec) NewScanner() *Scanner {
+	return &Scanner{spec: s}
+}
+
+// Push feeds the next chunk and returns the text that may be emitted now.
+func (sc *Scanner) Push(chunk string) string {
+	if sc.spec == nil {
+		return chunk
+	}
+	if sc.inCall {
+		sc.captured.WriteString(chunk)
+		return ""
+	}
+	buf := sc.pending + chunk
+	sc.pending = ""
+	if i := strings.Index(buf, openTag); i >= 0 {
+		sc.inCall = true
+		sc.captured.WriteString(buf[i:])
+		return buf[:i]
+	}
+	// Hold back a suffix that could be the start of the open tag.
+	for n := min(len(openTag)-1, len(buf)); n > 0; n-- {
+		if strings.HasPrefix(openTag, buf[len(buf)-n:]) {
+			sc.pending = buf[len(buf)-n:]
+			return buf[:len(buf)-n]
+		}
+	}
+	return buf
+}
+
+// Finish returns the remaining text and the parsed calls.
+func (sc *Scanner) Finish() (text string, calls []Call) {
+	if sc.spec == nil {
+		return "", nil
+	}
+	if !sc.inCall {
+		return sc.pending, nil
+	}
+	return sc.spec.Parse(sc.captured.String())
+}
+
+// FormatCall renders a previous function call for the conversation history.
+func FormatCall(name string, args any) string {
+	data, _ := json.Marshal(map[string]any{"name": name, "arguments": args})
+	return openTag + string(data) + closeTag
+}
+
+// FormatResult renders a function result for the conversation history.
+func FormatResult(name string, result any) string {
+	data, _ := json.Marshal(result)
+	return fmt.Sprintf("<tool_result name=%q>%s</tool_result>", name, data)
+}
+
+func compact(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
@@ -0,0 +1,238 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/accounting"
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func TestAccounting_BudgetsAndUsageReport(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	mock.Usage = map[string]any{"prompt_tokens": 11, "completion_tokens": 7, "total_tokens": 18}
+
+	var (
+		mu    sync.Mutex
+		hooks []accounting.Notification
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n accounting.Notification
+		_ = json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		hooks = append(hooks, n)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		AdminToken:     testAdminToken,
+		Prices:         accounting.Prices{"gpt-4": {Prompt: 1000, Completion: 2000}},
+		Budgets:        []accounting.Budget{{Name: "team-a", Owner: "team-a", Tokens: 30, Thresholds: []float64{50, 100}}},
+		BudgetWebhook:  webhook.URL,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	var teamA, teamB keyView
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"owner":"team-a","dify_key":"`+testAPIKey+`"}`, &teamA)
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"owner":"team-b","dify_key":"`+testAPIKey+`"}`, &teamB)
+
+	// Each request uses 18 tokens: the first crosses 50% of team-a's 30,
+	// the second exhausts it.
+	for i := range 2 {
+		if status := chatWithKey(t, proxySrv.URL, teamA.Key, "gpt-4"); status != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, status)
+		}
+	}
+	resp, body := postAs(t, proxySrv.URL+"/v1/chat/completions", "alice", teamA.Key, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, `budget \"team-a\" is exhausted`) {
+		t.Fatalf("expected 429 for an exhausted budget, got %d %s", resp.StatusCode, body)
+	}
+	if status := chatWithKey(t, proxySrv.URL, teamB.Key, "gpt-4"); status != http.StatusOK {
+		t.Errorf("expected other teams unaffected, got %d", status)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(hooks)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if len(hooks) != 2 || hooks[0].Threshold != 50 || hooks[0].Exhausted || hooks[1].Threshold != 100 || !hooks[1].Exhausted || hooks[1].Tokens != 36 {
+		t.Errorf("expected webhooks at 50%% and 100%%, got %+v", hooks)
+	}
+	mu.Unlock()
+
+	var report struct {
+		Data    []accounting.Aggregate `json:"data"`
+		Budgets []struct {
+			Name      string  `json:"name"`
+			Spent     int64   `json:"spent_tokens"`
+			Used      float64 `json:"used_percent"`
+			Exhausted bool    `json:"exhausted"`
+		} `json:"budgets"`
+	}
+	if status := adminCall(t, http.MethodGet, proxySrv.URL+"/admin/usage?group_by=owner,model", testAdminToken, "", &report); status != http.StatusOK {
+		t.Fatalf("expected the usage report, got %d", status)
+	}
+	if len(report.Data) != 2 {
+		t.Fatalf("expected one aggregate per team, got %+v", report.Data)
+	}
+	a := report.Data[0]
+	if a.Owner != "team-a" || a.Model != "gpt-4" || a.Key != "" || a.Requests != 2 || a.PromptTokens != 22 || a.CompletionTokens != 14 || a.TotalTokens != 36 {
+		t.Errorf("unexpected team-a aggregate %+v", a)
+	}
+	if want := (22*1000 + 14*2000) / 1e6; a.Cost < want-1e-9 || a.Cost > want+1e-9 {
+		t.Errorf("expected cost %g from the price table, got %g", want, a.Cost)
+	}
+	if len(report.Budgets) != 1 || !report.Budgets[0].Exhausted || report.Budgets[0].Spent != 36 {
+		t.Errorf("expected team-a's budget exhausted, got %+v", report.Budgets)
+	}
+
+	if status := adminCall(t, http.MethodGet, proxySrv.URL+"/admin/usage?group_by=team", testAdminToken, "", nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown dimension, got %d", status)
+	}
+}
+
+func TestAccounting_FailedStreams(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.StreamError = "internal_server_error"
+	defer mock.Close()
+
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		AdminToken:     testAdminToken,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	// Every stream ends with a Dify error after the answer; the tokens
+	// streamed until then are still charged.
+	for _, tc := range []struct{ path, body string }{
+		{"/v1/chat/completions", `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/messages", `{"model":"claude","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`},
+		{"/api/chat", `{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`},
+	} {
+		if resp, body := postAs(t, proxySrv.URL+tc.path, "dora", testAPIKey, tc.body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected the stream to start, got %d %s", tc.path, resp.StatusCode, body)
+		}
+	}
+
+	// A client leaving mid-stream is charged for the chunks streamed.
+	mock.Delay = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatalf("read first chunk: %v", err)
+	}
+	cancel()
+	resp.Body.Close()
+
+	var report struct {
+		Data []accounting.Aggregate `json:"data"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(report.Data) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		adminCall(t, http.MethodGet, proxySrv.URL+"/admin/usage?group_by=model", testAdminToken, "", &report)
+	}
+	if len(report.Data) != 4 {
+		t.Fatalf("expected usage for every stream, got %+v", report.Data)
+	}
+	for _, a := range report.Data {
+		if a.Requests != 1 || a.PromptTokens == 0 || a.CompletionTokens == 0 {
+			t.Errorf("expected the streamed answer charged, got %+v", a)
+		}
+	}
+}
+
+func TestAccounting_EveryEntryPoint(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	mock.Usage = map[string]any{"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}
+
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		DifyAPIKey:     testAPIKey,
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		StateFile:      filepath.Join(t.TempDir(), "state.db"),
+		AdminToken:     testAdminToken,
+		Budgets:        []accounting.Budget{{Name: "carol", User: "carol", Tokens: 40}},
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+	defer srv.Shutdown(context.Background())
+
+	// Each candidate is billed for its prompt: two candidates use 30 tokens,
+	// and a passthrough request 15 more, exhausting the budget.
+	if resp, body := postAs(t, proxySrv.URL+"/v1/chat/completions", "carol", testAPIKey, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"n":2}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+	chat := `{"query":"hi","user":"carol","inputs":{},"response_mode":"blocking"}`
+	if resp, body := postAs(t, proxySrv.URL+"/dify/v1/chat-messages", "carol", testAPIKey, chat); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the passthrough request relayed, got %d %s", resp.StatusCode, body)
+	}
+
+	var report struct {
+		Data []accounting.Aggregate `json:"data"`
+	}
+	adminCall(t, http.MethodGet, proxySrv.URL+"/admin/usage?group_by=user", testAdminToken, "", &report)
+	if len(report.Data) != 1 || report.Data[0].PromptTokens != 30 || report.Data[0].CompletionTokens != 15 {
+		t.Fatalf("expected prompts summed over candidates and the passthrough usage recorded, got %+v", report.Data)
+	}
+
+	for _, tc := range []struct{ path, body string }{
+		{"/v1/chat/completions", `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/messages/count_tokens", `{"model":"claude","messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/messages/batches", `{"requests":[{"custom_id":"a","params":{"model":"claude","max_tokens":8,"messages":[{"role":"user","content":"hi"}]}}]}`},
+		{"/dify/v1/chat-messages", chat},
+	} {
+		resp, body := postAs(t, proxySrv.URL+tc.path, "carol", testAPIKey, tc.body)
+		if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, "exhausted") {
+			t.Errorf("%s: expected 429 for the exhausted budget, got %d %s", tc.path, resp.StatusCode, body)
+		}
+	}
+	_, body := postAs(t, proxySrv.URL+"/mcp", "carol", virtualKey(t, proxySrv.URL), `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"dify","arguments":{"query":"hi"}}}`)
+	if !strings.Contains(body, `"code":-32000`) || !strings.Contains(body, "exhausted") {
+		t.Errorf("expected the tool call refused, got %s", body)
+	}
+}
@@ -0,0 +1,163 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// azureFilter is the subset of Azure content filter results the tests inspect.
+type azureFilter struct {
+	Hate struct {
+		Filtered bool   `json:"filtered"`
+		Severity string `json:"severity"`
+	} `json:"hate"`
+	CustomBlocklists struct {
+		Filtered bool `json:"filtered"`
+	} `json:"custom_blocklists"`
+}
+
+func TestAzure_DeploymentSelectsApp(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var out struct {
+		Model               string `json:"model"`
+		PromptFilterResults []struct {
+			PromptIndex          int         `json:"prompt_index"`
+			ContentFilterResults azureFilter `json:"content_filter_results"`
+		} `json:"prompt_filter_results"`
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason         string      `json:"finish_reason"`
+			ContentFilterResults azureFilter `json:"content_filter_results"`
+		} `json:"choices"`
+	}
+	url := proxySrv.URL + "/openai/deployments/support/chat/completions?api-version=2024-10-21"
+	body := `{"messages":[{"role":"user","content":"hi"}],"metadata":{"language":"en"}}`
+	postJSON(t, url, body, map[string]string{"api-key": "azure-resource-key"}, &out)
+	if mock.LastAPIKey != "azure-resource-key" {
+		t.Errorf("expected the caller's own key without a virtual key, got %q", mock.LastAPIKey)
+	}
+
+	postJSON(t, url, body, map[string]string{"api-key": virtualKey(t, proxySrv.URL, "support")}, &out)
+	if mock.LastAPIKey != testAPIKey {
+		t.Errorf("expected the support app key, got %q", mock.LastAPIKey)
+	}
+	if out.Model != "support" || len(out.Choices) != 1 || out.Choices[0].Message.Content != testAnswer {
+		t.Fatalf("unexpected response %+v", out)
+	}
+	if len(out.PromptFilterResults) != 1 || out.PromptFilterResults[0].ContentFilterResults.Hate.Severity != "safe" {
+		t.Errorf("expected prompt_filter_results, got %+v", out.PromptFilterResults)
+	}
+	c := out.Choices[0]
+	if c.FinishReason != "stop" || c.ContentFilterResults.Hate.Severity != "safe" || c.ContentFilterResults.CustomBlocklists.Filtered {
+		t.Errorf("expected an unfiltered choice, got %+v", c)
+	}
+}
+
+func TestAzure_UnknownDeployment(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	resp, err := http.Post(proxySrv.URL+"/openai/deployments/nope/chat/completions?api-version=2024-10-21", "application/json", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestAzure_ModeratedBlocking(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Replace = "Sorry, I can't help with that."
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var out struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason         string      `json:"finish_reason"`
+			ContentFilterResults azureFilter `json:"content_filter_results"`
+		} `json:"choices"`
+	}
+	url := proxySrv.URL + "/openai/deployments/gpt-4o/chat/completions?api-version=2024-10-21"
+	postJSON(t, url, `{"messages":[{"role":"user","content":"hi"}]}`, map[string]string{"api-key": testAPIKey}, &out)
+
+	if mock.LastAPIKey != testAPIKey {
+		t.Errorf("expected the api-key header as Dify key, got %q", mock.LastAPIKey)
+	}
+	if len(out.Choices) != 1 {
+		t.Fatalf("expected one choice, got %+v", out)
+	}
+	c := out.Choices[0]
+	if c.FinishReason != "content_filter" || !c.ContentFilterResults.CustomBlocklists.Filtered || c.Message.Content != "" {
+		t.Errorf("expected a filtered choice, got %+v", c)
+	}
+}
+
+func TestAzure_ModeratedStreaming(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Replace = "Sorry, I can't help with that."
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/openai/deployments/gpt-4o/chat/completions?api-version=2024-10-21", strings.NewReader(`{"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("api-key", testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	type chunk struct {
+		Choices []struct {
+			FinishReason         *string      `json:"finish_reason"`
+			ContentFilterResults *azureFilter `json:"content_filter_results"`
+		} `json:"choices"`
+		PromptFilterResults []any `json:"prompt_filter_results"`
+	}
+	var chunks []chunk
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var c chunk
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			t.Fatalf("decode chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, c)
+	}
+	if len(chunks) < 3 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	if len(chunks[0].PromptFilterResults) != 1 || len(chunks[0].Choices) != 0 {
+		t.Errorf("expected a leading prompt_filter_results chunk, got %+v", chunks[0])
+	}
+	last := chunks[len(chunks)-1].Choices[0]
+	if last.FinishReason == nil || *last.FinishReason != "content_filter" || last.ContentFilterResults == nil || !last.ContentFilterResults.CustomBlocklists.Filtered {
+		t.Errorf("expected a content_filter finish, got %+v", last)
+	}
+}
@@ -0,0 +1,200 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func TestAnthropic_MessageBatches(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	cfg := &config.Config{
+		DifyBaseURL:      mock.URL(),
+		DefaultUser:      "test-user",
+		RequestTimeout:   10 * time.Second,
+		StateFile:        filepath.Join(t.TempDir(), "state.db"),
+		BatchConcurrency: 2,
+	}
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	headers := map[string]string{"x-api-key": testAPIKey, "anthropic-version": "2023-06-01"}
+	body := `{"requests":[
+		{"custom_id":"ok","params":{"model":"claude-3","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}},
+		{"custom_id":"bad","params":{"model":"claude-3","max_tokens":64,"messages":[{"role":"user","content":"hi"}],"stream":true}}
+	]}`
+	var created map[string]any
+	postJSON(t, proxySrv.URL+"/v1/messages/batches", body, headers, &created)
+	id, _ := created["id"].(string)
+	if !strings.HasPrefix(id, "msgbatch_") || created["type"] != "message_batch" {
+		t.Fatalf("unexpected batch object: %v", created)
+	}
+
+	var batch map[string]any
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		batch = getJSON(t, proxySrv.URL+"/v1/messages/batches/"+id, headers)
+		if batch["processing_status"] == "ended" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batch did not end: %v", batch)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	counts := batch["request_counts"].(map[string]any)
+	if counts["succeeded"] != float64(1) || counts["errored"] != float64(1) || counts["processing"] != float64(0) {
+		t.Errorf("unexpected request_counts: %v", counts)
+	}
+	resultsURL, _ := batch["results_url"].(string)
+	if !strings.HasSuffix(resultsURL, "/v1/messages/batches/"+id+"/results") {
+		t.Fatalf("unexpected results_url %q", resultsURL)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, resultsURL, nil)
+	req.Header.Set("x-api-key", testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("results request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	results := map[string]map[string]any{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line struct {
+			CustomID string         `json:"custom_id"`
+			Result   map[string]any `json:"result"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("decode result line %q: %v", scanner.Text(), err)
+		}
+		results[line.CustomID] = line.Result
+	}
+	if got := results["ok"]; got["type"] != "succeeded" {
+		t.Errorf("expected ok to succeed, got %v", got)
+	} else if msg := got["message"].(map[string]any); msg["type"] != "message" {
+		t.Errorf("expected a message object, got %v", msg)
+	}
+	if got := results["bad"]; got["type"] != "errored" {
+		t.Errorf("expected bad to error, got %v", got)
+	} else if e := got["error"].(map[string]any); e["type"] != "error" {
+		t.Errorf("expected an Anthropic error envelope, got %v", e)
+	}
+
+	list := getJSON(t, proxySrv.URL+"/v1/messages/batches?limit=10", headers)
+	if data, _ := list["data"].([]any); len(data) != 1 || list["first_id"] != id {
+		t.Errorf("unexpected list: %v", list)
+	}
+	other := getJSON(t, proxySrv.URL+"/v1/messages/batches?limit=10", map[string]string{"x-api-key": "someone-else"})
+	if data, _ := other["data"].([]any); len(data) != 0 {
+		t.Errorf("batches must be scoped to the creating key, got %v", other)
+	}
+
+	// Malformed params are refused when the batch is created.
+	resp, body = postAs(t, proxySrv.URL+"/v1/messages/batches", "", testAPIKey, `{"requests":[{"custom_id":"broken","params":{"messages":"hi"}}]}`)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "broken") {
+		t.Errorf("expected 400 naming the custom_id, got %d %s", resp.StatusCode, body)
+	}
+
+	// The Dify key the batch ran with is never written to the state file.
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	raw, err := os.ReadFile(cfg.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte(testAPIKey)) {
+		t.Error("expected the Dify key kept out of the state file")
+	}
+}
+
+func TestAnthropic_MessageBatchesOwnedByVirtualKey(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	cfg := &config.Config{
+		DifyBaseURL:    mock.URL(),
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		StateFile:      filepath.Join(t.TempDir(), "state.db"),
+		AdminToken:     testAdminToken,
+		RoutesFile:     writeConfig(t, "routes.json", `{"routes":[{"model":"support","api_key":"`+routeAPIKey+`"}]}`),
+	}
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+	defer srv.Shutdown(context.Background())
+
+	// Neither key stands for a Dify key: they can only use routed models.
+	var teamA, teamB keyView
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"owner":"team-a"}`, &teamA)
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"owner":"team-b"}`, &teamB)
+
+	batches := proxySrv.URL + "/v1/messages/batches"
+	resp, body := postAs(t, batches, "", teamA.Key, `{"requests":[{"custom_id":"a","params":{"model":"other","max_tokens":8,"messages":[{"role":"user","content":"hi"}]}}]}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unrouted model without a Dify key, got %d %s", resp.StatusCode, body)
+	}
+	resp, body = postAs(t, batches, "", teamA.Key, `{"requests":[{"custom_id":"a","params":{"model":"support","max_tokens":8,"messages":[{"role":"user","content":"hi"}]}}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the routed batch accepted, got %d %s", resp.StatusCode, body)
+	}
+
+	list := func(key string) int {
+		data, _ := getJSON(t, batches, map[string]string{"x-api-key": key})["data"].([]any)
+		return len(data)
+	}
+	if n := list(teamB.Key); n != 0 {
+		t.Errorf("expected team B to see no batches, got %d", n)
+	}
+	var rotated keyView
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys/"+teamA.ID+"/rotate", testAdminToken, "", &rotated)
+	if n := list(rotated.Key); n != 1 {
+		t.Errorf("expected the batch to follow the key across rotation, got %d", n)
+	}
+}
+
+// getJSON performs a GET with the given headers and decodes a 200 JSON body.
+func getJSON(t *testing.T, url string, headers map[string]string) map[string]any {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: expected 200, got %d", url, resp.StatusCode)
+	}
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return out
+}
@@ -0,0 +1,207 @@
+package integration
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zhengjr9/dify-agent/internal/eventstream"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// converseResponse is the subset of a Converse response the tests inspect.
+type converseResponse struct {
+	Output struct {
+		Message struct {
+			Role    string `json:"role"`
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"message"`
+	} `json:"output"`
+	StopReason string `json:"stopReason"`
+	Usage      struct {
+		InputTokens  int `json:"inputTokens"`
+		OutputTokens int `json:"outputTokens"`
+		TotalTokens  int `json:"totalTokens"`
+	} `json:"usage"`
+}
+
+// readEvents decodes an event stream body, failing on any framing or
+// checksum error.
+func readEvents(t *testing.T, body io.Reader) []eventstream.Message {
+	t.Helper()
+	var out []eventstream.Message
+	for {
+		m, err := eventstream.ReadMessage(body)
+		if errors.Is(err, io.EOF) {
+			return out
+		}
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		out = append(out, m)
+	}
+}
+
+func TestBedrock_Converse(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"system":[{"text":"Be brief."}],"messages":[{"role":"user","content":[{"text":"Say hello"}]}],"inferenceConfig":{"maxTokens":1}}`
+	var out converseResponse
+	postJSON(t, proxySrv.URL+"/model/anthropic.claude-3-haiku/converse", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &out)
+	if out.Output.Message.Role != "assistant" || len(out.Output.Message.Content) != 1 || !isTruncated(out.Output.Message.Content[0].Text) {
+		t.Errorf("expected a truncated assistant message, got %+v", out.Output)
+	}
+	if out.StopReason != "max_tokens" {
+		t.Errorf("expected stopReason max_tokens, got %q", out.StopReason)
+	}
+	if out.Usage.TotalTokens != out.Usage.InputTokens+out.Usage.OutputTokens || out.Usage.InputTokens == 0 {
+		t.Errorf("unexpected usage %+v", out.Usage)
+	}
+	if q, _ := mock.LastRequest["query"].(string); q != "system: Be brief.\nSay hello" {
+		t.Errorf("unexpected query %q", q)
+	}
+}
+
+func TestBedrock_ConverseStream(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	body := `{"messages":[{"role":"user","content":[{"text":"What is this?"},{"image":{"format":"png","source":{"bytes":"` + png + `"}}}]}]}`
+	// SigV4 signatures are not verified, so the access key ID is no key.
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/model/dify/converse-stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+testAPIKey+"/20260101/us-east-1/bedrock/aws4_request, SignedHeaders=host;x-amz-date, Signature=abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || mock.Requests() != 0 {
+		t.Fatalf("expected 403 for a SigV4 access key ID, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, proxySrv.URL+"/model/dify/converse-stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != eventstream.ContentType {
+		t.Fatalf("expected event stream content-type, got %d %q", resp.StatusCode, ct)
+	}
+
+	events := readEvents(t, resp.Body)
+	var types []string
+	var text strings.Builder
+	for _, m := range events {
+		if m.Get(":message-type") != "event" || m.Get(":content-type") != "application/json" {
+			t.Errorf("unexpected headers %+v", m.Headers)
+		}
+		typ := m.Get(":event-type")
+		if len(types) == 0 || types[len(types)-1] != typ {
+			types = append(types, typ)
+		}
+		if typ == "contentBlockDelta" {
+			var d struct {
+				Delta struct {
+					Text string `json:"text"`
+				} `json:"delta"`
+			}
+			_ = json.Unmarshal(m.Payload, &d)
+			text.WriteString(d.Delta.Text)
+		}
+	}
+	want := "messageStart,contentBlockDelta,contentBlockStop,messageStop,metadata"
+	if got := strings.Join(types, ","); got != want {
+		t.Fatalf("expected events %s, got %s", want, got)
+	}
+	if text.String() != testAnswer {
+		t.Errorf("expected %q, got %q", testAnswer, text.String())
+	}
+
+	var stop struct {
+		StopReason string `json:"stopReason"`
+	}
+	_ = json.Unmarshal(events[len(events)-2].Payload, &stop)
+	if stop.StopReason != "end_turn" {
+		t.Errorf("expected end_turn, got %q", stop.StopReason)
+	}
+	var meta struct {
+		Usage struct {
+			OutputTokens int `json:"outputTokens"`
+		} `json:"usage"`
+		Metrics struct {
+			LatencyMs *int64 `json:"latencyMs"`
+		} `json:"metrics"`
+	}
+	_ = json.Unmarshal(events[len(events)-1].Payload, &meta)
+	if meta.Usage.OutputTokens == 0 || meta.Metrics.LatencyMs == nil {
+		t.Errorf("expected usage and metrics, got %s", events[len(events)-1].Payload)
+	}
+
+	if uploads := mock.Uploads(); len(uploads) != 1 || uploads[0].ContentType != "image/png" {
+		t.Errorf("expected one PNG upload, got %+v", uploads)
+	}
+}
+
+func TestBedrock_ContentFiltered(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Replace = "Sorry, I can't help with that."
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/model/dify/converse-stream", strings.NewReader(`{"messages":[{"role":"user","content":[{"text":"hi"}]}]}`))
+	req.Header.Set("X-Dify-Api-Key", testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	events := readEvents(t, resp.Body)
+	if len(events) < 2 || events[len(events)-2].Get(":event-type") != "messageStop" {
+		t.Fatalf("expected messageStop before metadata, got %d events", len(events))
+	}
+	if p := string(events[len(events)-2].Payload); !strings.Contains(p, "content_filtered") {
+		t.Errorf("expected content_filtered, got %s", p)
+	}
+}
+
+func TestBedrock_MissingKey(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	resp, err := http.Post(proxySrv.URL+"/model/dify/converse", "application/json", strings.NewReader(`{"messages":[{"role":"user","content":[{"text":"hi"}]}]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Message string `json:"message"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Amzn-ErrorType") != "AccessDeniedException" || e.Message == "" {
+		t.Errorf("expected 403 AccessDeniedException, got %d %q %+v", resp.StatusCode, resp.Header.Get("X-Amzn-ErrorType"), e)
+	}
+}
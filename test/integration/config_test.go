@@ -0,0 +1,177 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// writeConfig writes a config file named name and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfig_FileEnvAndFlags(t *testing.T) {
+	path := writeConfig(t, "gateway.yaml", `
+dify_base_url: https://dify.example.com
+default_user: from-file
+listen_addr: ":9000"
+request_timeout: 45s
+routes:
+  routes:
+    - model: support-bot
+      api_key: app-route
+`)
+	t.Setenv("DEFAULT_USER", "from-env")
+	cfg, err := config.Parse([]string{"--config", path, "--listen-addr", ":9001"})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if cfg.DifyBaseURL != "https://dify.example.com" || cfg.RequestTimeout != 45*time.Second {
+		t.Errorf("expected the file values, got %q %s", cfg.DifyBaseURL, cfg.RequestTimeout)
+	}
+	if cfg.DefaultUser != "from-env" {
+		t.Errorf("expected the environment to override the file, got %q", cfg.DefaultUser)
+	}
+	if cfg.ListenAddr != ":9001" {
+		t.Errorf("expected the flag to override the file, got %q", cfg.ListenAddr)
+	}
+	if cfg.Routes == nil || len(cfg.Routes.Routes) != 1 {
+		t.Errorf("expected the inline routes, got %+v", cfg.Routes)
+	}
+
+	toml := writeConfig(t, "gateway.toml", "dify_base_url = \"https://dify.example.com\"\nmax_candidates = 2\n")
+	cfg, err = config.Parse([]string{"--config", toml})
+	if err != nil {
+		t.Fatalf("Parse TOML: %v", err)
+	}
+	if cfg.MaxCandidates != 2 {
+		t.Errorf("expected max_candidates from the TOML file, got %d", cfg.MaxCandidates)
+	}
+}
+
+func TestConfig_ValidationErrors(t *testing.T) {
+	path := writeConfig(t, "gateway.yaml", "dify_base_ur: https://dify.example.com\n")
+	if _, err := config.Parse([]string{"--config", path}); err == nil || !strings.Contains(err.Error(), "dify_base_ur") {
+		t.Errorf("expected an unknown key error, got %v", err)
+	}
+
+	path = writeConfig(t, "gateway.yaml", "request_timeout: 0s\nmax_candidates: 0\n")
+	_, err := config.Parse([]string{"--config", path})
+	if err == nil || !strings.Contains(err.Error(), "request_timeout") || !strings.Contains(err.Error(), "max_candidates") {
+		t.Errorf("expected every invalid setting reported, got %v", err)
+	}
+}
+
+func TestConfig_PrintRedactsSecrets(t *testing.T) {
+	path := writeConfig(t, "gateway.yaml", `
+dify_api_key: app-secret
+admin_token: admin-secret
+apps:
+  apps:
+    - name: support
+      api_key: app-support
+`)
+	cfg, err := config.Parse([]string{"--config", path})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var out strings.Builder
+	if err := cfg.Print(&out); err != nil {
+		t.Fatalf("Print: %v", err)
+	}
+	for _, secret := range []string{"app-secret", "admin-secret", "app-support"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("expected %q redacted, got:\n%s", secret, out.String())
+		}
+	}
+	if cfg.DifyAPIKey != "app-secret" {
+		t.Errorf("expected the config itself unchanged, got %q", cfg.DifyAPIKey)
+	}
+}
+
+func TestConfig_ReloadSwapsRoutes(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	cfg := &config.Config{
+		DifyBaseURL:    mock.URL(),
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+	}
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	send := func() int {
+		body := `{"model":"support-bot","messages":[{"role":"user","content":"hi"}]}`
+		resp, err := http.Post(proxySrv.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send(); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 before the route exists, got %d", status)
+	}
+
+	path := writeConfig(t, "gateway.yaml", `
+dify_base_url: `+mock.URL()+`
+routes:
+  routes:
+    - model: support-bot
+      api_key: `+routeAPIKey+`
+      public: true
+`)
+	next, err := config.Parse([]string{"--config", path})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := srv.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if status := send(); status != http.StatusOK {
+		t.Fatalf("expected 200 after the reload, got %d", status)
+	}
+	if mock.LastAPIKey != routeAPIKey {
+		t.Errorf("expected the new route's key upstream, got %q", mock.LastAPIKey)
+	}
+
+	// The shadow log is only opened at startup, so shadows cannot be
+	// enabled by a reload.
+	path = writeConfig(t, "shadow.yaml", `
+dify_base_url: `+mock.URL()+`
+shadow_log: `+filepath.Join(t.TempDir(), "shadow.jsonl")+`
+routes:
+  routes:
+    - model: support-bot
+      api_key: `+routeAPIKey+`
+      shadow: {route: support-next, percent: 10}
+    - model: support-next
+      api_key: next-key
+`)
+	if next, err = config.Parse([]string{"--config", path}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := srv.Reload(next); err == nil || !strings.Contains(err.Error(), "shadow") {
+		t.Errorf("expected the reload enabling shadows refused, got %v", err)
+	}
+}
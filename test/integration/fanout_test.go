@@ -0,0 +1,200 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func newFanoutProxy(t *testing.T, difyURL string, maxCandidates, concurrency int) *httptest.Server {
+	t.Helper()
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:       difyURL,
+		DefaultUser:       "test-user",
+		RequestTimeout:    10 * time.Second,
+		MaxCandidates:     maxCandidates,
+		FanoutConcurrency: concurrency,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	return httptest.NewServer(srv.Handler())
+}
+
+func TestFanout_OpenAIBlocking(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newFanoutProxy(t, mock.URL(), 8, 2)
+	defer proxySrv.Close()
+
+	var out struct {
+		Choices []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"n":3}`
+	postJSON(t, proxySrv.URL+"/v1/chat/completions", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &out)
+
+	if len(out.Choices) != 3 {
+		t.Fatalf("expected 3 choices, got %d", len(out.Choices))
+	}
+	for i, c := range out.Choices {
+		if c.Index != i || c.Message.Content != testAnswer {
+			t.Errorf("choice %d: unexpected %+v", i, c)
+		}
+	}
+	if n := mock.Requests(); n != 3 {
+		t.Errorf("expected 3 Dify requests, got %d", n)
+	}
+}
+
+func TestFanout_OpenAIStreaming(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newFanoutProxy(t, mock.URL(), 8, 1)
+	defer proxySrv.Close()
+
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"n":2,"stream":true}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	text := map[int]*strings.Builder{0: {}, 1: {}}
+	finished := map[int]string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Index int `json:"index"`
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode chunk: %v", err)
+		}
+		for _, c := range chunk.Choices {
+			sb, ok := text[c.Index]
+			if !ok {
+				t.Fatalf("unexpected choice index %d", c.Index)
+			}
+			sb.WriteString(c.Delta.Content)
+			if c.FinishReason != nil {
+				finished[c.Index] = *c.FinishReason
+			}
+		}
+	}
+	for i, sb := range text {
+		if sb.String() != testAnswer {
+			t.Errorf("choice %d: expected %q, got %q", i, testAnswer, sb.String())
+		}
+		if finished[i] != "stop" {
+			t.Errorf("choice %d: expected finish_reason stop, got %q", i, finished[i])
+		}
+	}
+}
+
+func TestFanout_GeminiCandidateCount(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newFanoutProxy(t, mock.URL(), 8, 4)
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}],"generationConfig":{"candidateCount":2}}`
+	var out struct {
+		Candidates []struct {
+			Index   int `json:"index"`
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+		} `json:"candidates"`
+	}
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent", body, map[string]string{"x-goog-api-key": testAPIKey}, &out)
+	if len(out.Candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(out.Candidates))
+	}
+	for i, c := range out.Candidates {
+		if c.Index != i || len(c.Content.Parts) != 1 || c.Content.Parts[0].Text != testAnswer {
+			t.Errorf("candidate %d: unexpected %+v", i, c)
+		}
+	}
+}
+
+func TestFanout_TooManyCandidates(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newFanoutProxy(t, mock.URL(), 2, 2)
+	defer proxySrv.Close()
+
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"n":3}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+	if n := mock.Requests(); n != 0 {
+		t.Errorf("expected no Dify requests, got %d", n)
+	}
+}
+
+func TestFanout_ClientDisconnectStopsAllTasks(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Delay = 200 * time.Millisecond
+	defer mock.Close()
+
+	proxySrv := newFanoutProxy(t, mock.URL(), 8, 4)
+	defer proxySrv.Close()
+
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"n":2,"stream":true}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	// Read the first chunk, then go away.
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatalf("read first chunk: %v", err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(mock.StoppedTasks()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both upstream tasks stopped, got %v", mock.StoppedTasks())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
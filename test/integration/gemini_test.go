@@ -0,0 +1,344 @@
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func TestGemini_StreamingJSONArray(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"Say hello"}]}]}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1beta/models/gemini-pro:streamGenerateContent", strings.NewReader(body))
+	req.Header.Set("x-goog-api-key", testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, raw)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("expected JSON content-type, got %q", ct)
+	}
+
+	var chunks []struct {
+		Candidates []struct {
+			Content      struct{ Parts []struct{ Text string } } `json:"content"`
+			FinishReason string                                  `json:"finishReason"`
+		} `json:"candidates"`
+		UsageMetadata *struct {
+			TotalTokenCount int `json:"totalTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&chunks); err != nil {
+		t.Fatalf("expected a JSON array of chunks: %v", err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	var text strings.Builder
+	for _, c := range chunks {
+		for _, p := range c.Candidates[0].Content.Parts {
+			text.WriteString(p.Text)
+		}
+	}
+	if text.String() != testAnswer {
+		t.Errorf("expected %q, got %q", testAnswer, text.String())
+	}
+	last := chunks[len(chunks)-1]
+	if last.Candidates[0].FinishReason != "STOP" || last.UsageMetadata == nil {
+		t.Errorf("expected final chunk with STOP and usage, got %+v", last)
+	}
+}
+
+func TestGemini_StreamingJSONArrayUpstreamError(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.StreamError = "completion_request_error"
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"Say hello"}]}]}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1beta/models/gemini-pro:streamGenerateContent", strings.NewReader(body))
+	req.Header.Set("x-goog-api-key", testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The array is closed with the error as its last element.
+	var chunks []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&chunks); err != nil {
+		t.Fatalf("expected a complete JSON array despite the error: %v", err)
+	}
+	if len(chunks) < 2 || chunks[0]["candidates"] == nil {
+		t.Fatalf("expected the answer streamed before the error, got %v", chunks)
+	}
+	e, _ := chunks[len(chunks)-1]["error"].(map[string]any)
+	if e["code"] != float64(http.StatusInternalServerError) || e["status"] != "INTERNAL" {
+		t.Errorf("expected a final error element, got %v", chunks[len(chunks)-1])
+	}
+}
+
+func TestGemini_CamelCaseSystemInstruction(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"systemInstruction":{"parts":[{"text":"Be terse."}]},"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	var out map[string]any
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent", body, map[string]string{"x-goog-api-key": testAPIKey}, &out)
+	if q, _ := mock.LastRequest["query"].(string); !strings.HasPrefix(q, "system: Be terse.") {
+		t.Errorf("expected system instruction in query, got %q", q)
+	}
+}
+
+func TestGemini_ResponseFidelity(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	var out map[string]any
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-1.5-pro:generateContent", body, map[string]string{"x-goog-api-key": testAPIKey}, &out)
+	if out["modelVersion"] != "gemini-1.5-pro" || out["responseId"] != testMessageID {
+		t.Errorf("expected modelVersion and responseId, got %v / %v", out["modelVersion"], out["responseId"])
+	}
+	usage, _ := out["usageMetadata"].(map[string]any)
+	if n, _ := usage["totalTokenCount"].(float64); n == 0 {
+		t.Errorf("expected non-zero usageMetadata, got %v", usage)
+	}
+}
+
+func TestGemini_EmptyAnswerKeepsText(t *testing.T) {
+	mock := testutil.NewMockDify("", testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	var out struct {
+		Candidates []struct {
+			Content struct {
+				Parts []map[string]any `json:"parts"`
+			} `json:"content"`
+		} `json:"candidates"`
+	}
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent", body, map[string]string{"x-goog-api-key": testAPIKey}, &out)
+	if len(out.Candidates) != 1 || len(out.Candidates[0].Content.Parts) != 1 {
+		t.Fatalf("expected one part, got %+v", out)
+	}
+	if text, ok := out.Candidates[0].Content.Parts[0]["text"]; !ok || text != "" {
+		t.Errorf("expected an empty text part, got %v", out.Candidates[0].Content.Parts[0])
+	}
+}
+
+func TestGemini_VirtualKeyInGoogleCredentials(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	proxySrv := newKeysProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var created keyView
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"dify_key":"`+testAPIKey+`"}`, &created)
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	var out map[string]any
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent?key="+created.Key, body, nil, &out)
+	if mock.LastAPIKey != testAPIKey {
+		t.Errorf("expected ?key= to resolve the virtual key, got %q upstream", mock.LastAPIKey)
+	}
+	mock.LastAPIKey = ""
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent", body, map[string]string{"x-goog-api-key": created.Key}, &out)
+	if mock.LastAPIKey != testAPIKey {
+		t.Errorf("expected x-goog-api-key to resolve the virtual key, got %q upstream", mock.LastAPIKey)
+	}
+}
+
+func TestGemini_ModerationSafety(t *testing.T) {
+	cases := []struct {
+		name   string
+		answer string
+		check  func(t *testing.T, last map[string]any)
+	}{
+		{"output replaced", testAnswer, func(t *testing.T, last map[string]any) {
+			cand := last["candidates"].([]any)[0].(map[string]any)
+			if cand["finishReason"] != "SAFETY" {
+				t.Errorf("expected finishReason SAFETY, got %v", cand["finishReason"])
+			}
+		}},
+		{"prompt blocked", "", func(t *testing.T, last map[string]any) {
+			fb, _ := last["promptFeedback"].(map[string]any)
+			if fb["blockReason"] != "SAFETY" || last["candidates"] != nil {
+				t.Errorf("expected promptFeedback.blockReason SAFETY without candidates, got %v", last)
+			}
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testutil.NewMockDify(tc.answer, testMessageID, testConversationID)
+			mock.Replace = "Sorry, I can't help with that."
+			defer mock.Close()
+
+			proxySrv := newTestProxy(t, mock.URL())
+			defer proxySrv.Close()
+
+			body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+			req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1beta/models/gemini-pro:streamGenerateContent", strings.NewReader(body))
+			req.Header.Set("x-goog-api-key", testAPIKey)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var chunks []map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&chunks); err != nil {
+				t.Fatalf("decode stream: %v", err)
+			}
+			for _, c := range chunks {
+				if c["responseId"] != testMessageID {
+					t.Errorf("expected responseId on every chunk, got %v", c["responseId"])
+				}
+			}
+			tc.check(t, chunks[len(chunks)-1])
+
+			// Blocking calls report moderation the same way, without the
+			// replacement text.
+			var out map[string]any
+			postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent", body, map[string]string{"x-goog-api-key": testAPIKey}, &out)
+			tc.check(t, out)
+			if raw, _ := json.Marshal(out); strings.Contains(string(raw), mock.Replace) {
+				t.Errorf("replacement text must not be returned, got %s", raw)
+			}
+		})
+	}
+}
+
+const weatherCall = `Let me check. <tool_call>{"name":"get_weather","arguments":{"city":"Paris"}}</tool_call>`
+
+const weatherTools = `"tools":[{"functionDeclarations":[{"name":"get_weather","description":"Current weather","parameters":{"type":"OBJECT","properties":{"city":{"type":"STRING"}}}}]}]`
+
+func TestGemini_FunctionCallBlocking(t *testing.T) {
+	mock := testutil.NewMockDify(weatherCall, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[
+		{"role":"user","parts":[{"text":"Weather in Paris?"}]},
+		{"role":"model","parts":[{"functionCall":{"name":"get_weather","args":{"city":"Lyon"}}}]},
+		{"role":"user","parts":[{"functionResponse":{"name":"get_weather","response":{"temp":21}}}]},
+		{"role":"user","parts":[{"text":"And Paris?"}]}
+	],` + weatherTools + `}`
+	var out geminiResponse
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent", body, map[string]string{"x-goog-api-key": testAPIKey}, &out)
+
+	query, _ := mock.LastRequest["query"].(string)
+	for _, want := range []string{"get_weather: Current weather", `"city":"Lyon"`, `<tool_result name="get_weather">{"temp":21}</tool_result>`} {
+		if !strings.Contains(query, want) {
+			t.Errorf("expected query to contain %q, got:\n%s", want, query)
+		}
+	}
+
+	parts := out.Candidates[0].Content.Parts
+	if len(parts) != 2 || parts[0].Text != "Let me check." || parts[1].FunctionCall == nil {
+		t.Fatalf("expected text and functionCall parts, got %+v", parts)
+	}
+	if fc := parts[1].FunctionCall; fc.Name != "get_weather" || fc.Args["city"] != "Paris" {
+		t.Errorf("unexpected functionCall %+v", fc)
+	}
+}
+
+func TestGemini_FunctionCallStreaming(t *testing.T) {
+	mock := testutil.NewMockDify(weatherCall, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"Weather in Paris?"}]}],` + weatherTools + `}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1beta/models/gemini-pro:streamGenerateContent", strings.NewReader(body))
+	req.Header.Set("x-goog-api-key", testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var chunks []geminiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&chunks); err != nil {
+		t.Fatalf("decode stream: %v", err)
+	}
+	var text strings.Builder
+	var calls []string
+	for _, c := range chunks {
+		for _, p := range c.Candidates[0].Content.Parts {
+			text.WriteString(p.Text)
+			if p.FunctionCall != nil {
+				calls = append(calls, p.FunctionCall.Name)
+			}
+		}
+	}
+	if strings.Contains(text.String(), "tool_call") || !strings.HasPrefix(text.String(), "Let me check.") {
+		t.Errorf("expected only the plain text to stream, got %q", text.String())
+	}
+	if len(calls) != 1 || calls[0] != "get_weather" {
+		t.Errorf("expected one get_weather call, got %v", calls)
+	}
+}
+
+func TestGemini_FunctionCallingModeNone(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}],` + weatherTools + `,"toolConfig":{"functionCallingConfig":{"mode":"NONE"}}}`
+	var out geminiResponse
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:generateContent", body, map[string]string{"x-goog-api-key": testAPIKey}, &out)
+	if q, _ := mock.LastRequest["query"].(string); strings.Contains(q, "get_weather") {
+		t.Errorf("mode NONE must not offer functions, got query %q", q)
+	}
+	if parts := out.Candidates[0].Content.Parts; len(parts) != 1 || parts[0].Text != testAnswer {
+		t.Errorf("expected plain text answer, got %+v", parts)
+	}
+}
+
+// geminiResponse is the subset of a Gemini response or stream chunk the tests inspect.
+type geminiResponse struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text         string `json:"text"`
+				FunctionCall *struct {
+					Name string         `json:"name"`
+					Args map[string]any `json:"args"`
+				} `json:"functionCall"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+}
@@ -0,0 +1,115 @@
+package integration
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func TestIdentity_DefaultChain(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	bearer := map[string]string{"Authorization": "Bearer " + testAPIKey}
+	cases := []struct {
+		name    string
+		path    string
+		body    string
+		headers map[string]string
+		want    string
+	}{
+		{"openai body user", "/v1/chat/completions", `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"user":"alice"}`, bearer, "alice"},
+		{"anthropic metadata", "/v1/messages", `{"model":"claude-3","max_tokens":16,"messages":[{"role":"user","content":"hi"}],"metadata":{"user_id":"bob"}}`, bearer, "bob"},
+		{"header wins", "/v1/chat/completions", `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"user":"alice"}`, map[string]string{"Authorization": "Bearer " + testAPIKey, "X-Dify-User": "carol"}, "carol"},
+		{"default", "/v1beta/models/gemini-pro:generateContent", `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`, bearer, "test-user"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out map[string]any
+			postJSON(t, proxySrv.URL+tc.path, tc.body, tc.headers, &out)
+			if got := mock.LastRequest["user"]; got != tc.want {
+				t.Errorf("expected Dify user %q, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestIdentity_TokenHashAndTenant(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	cfg := &config.Config{
+		DifyBaseURL:    mock.URL(),
+		DefaultUser:    "anonymous",
+		RequestTimeout: 10 * time.Second,
+		UserSources:    "token,body",
+		UserTokenClaim: "email",
+		UserHash:       true,
+		UserHashSalt:   "pepper",
+		UserPrefix:     "u-",
+		TenantHeader:   "X-Tenant",
+	}
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"email":"dave@example.com"}`))
+	jwt := "eyJhbGciOiJub25lIn0." + payload + ".sig"
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"user":"ignored"}`
+
+	var out map[string]any
+	postJSON(t, proxySrv.URL+"/v1/chat/completions", body, map[string]string{
+		"Authorization":  "Bearer " + jwt,
+		"X-Dify-Api-Key": testAPIKey,
+		"X-Tenant":       "acme",
+	}, &out)
+	user, _ := mock.LastRequest["user"].(string)
+	if !strings.HasPrefix(user, "acme:u-") || strings.Contains(user, "dave") || len(user) != len("acme:u-")+32 {
+		t.Errorf("expected tenant-namespaced hashed user, got %q", user)
+	}
+	first := user
+
+	// The same identity hashes to the same Dify user; another tenant does not.
+	postJSON(t, proxySrv.URL+"/v1/chat/completions", body, map[string]string{
+		"Authorization":  "Bearer " + jwt,
+		"X-Dify-Api-Key": testAPIKey,
+		"X-Tenant":       "acme",
+	}, &out)
+	if got := mock.LastRequest["user"]; got != first {
+		t.Errorf("expected stable hashed user %q, got %v", first, got)
+	}
+	postJSON(t, proxySrv.URL+"/v1/chat/completions", body, map[string]string{
+		"Authorization":  "Bearer " + jwt,
+		"X-Dify-Api-Key": testAPIKey,
+		"X-Tenant":       "globex",
+	}, &out)
+	if got, _ := mock.LastRequest["user"].(string); !strings.HasPrefix(got, "globex:") {
+		t.Errorf("expected globex namespace, got %q", got)
+	}
+
+	// Without a token the body user is used; the default is not hashed.
+	postJSON(t, proxySrv.URL+"/v1/chat/completions", `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`,
+		map[string]string{"Authorization": "Bearer " + testAPIKey}, &out)
+	if got := mock.LastRequest["user"]; got != "anonymous" {
+		t.Errorf("expected default user, got %v", got)
+	}
+}
+
+func TestIdentity_InvalidSource(t *testing.T) {
+	_, err := proxy.New(&config.Config{DifyBaseURL: "http://localhost", UserSources: "cookie"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown user source")
+	}
+}
@@ -0,0 +1,154 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+const testAppsFile = `{
+	"inputs": {"temperature": "temp"},
+	"apps": [
+		{"name": "support", "api_key": "` + testAPIKey + `", "inputs": {"metadata.language": "language", "top_k": "depth"}}
+	]
+}`
+
+var testInputForm = map[string]any{
+	"user_input_form": []any{
+		map[string]any{"text-input": map[string]any{"variable": "temp", "label": "Temperature"}},
+		map[string]any{"select": map[string]any{"variable": "language", "label": "Language", "required": true, "options": []string{"en", "fr"}}},
+		map[string]any{"paragraph": map[string]any{"variable": "persona", "label": "Persona", "max_length": 20}},
+		map[string]any{"number": map[string]any{"variable": "depth", "label": "Depth"}},
+	},
+}
+
+func newInputsProxy(t *testing.T, difyURL string) *httptest.Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "apps.json")
+	if err := os.WriteFile(path, []byte(testAppsFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    difyURL,
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		AppsFile:       path,
+		AdminToken:     testAdminToken,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	return httptest.NewServer(srv.Handler())
+}
+
+func TestInputs_MappingAndHeader(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Parameters = testInputForm
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	cases := []struct {
+		name string
+		path string
+		body string
+		auth map[string]string
+		want map[string]any
+	}{
+		{
+			"openai", "/v1/chat/completions",
+			`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"temperature":0.2,"top_p":0.9,"metadata":{"language":"fr"}}`,
+			map[string]string{"Authorization": "Bearer " + testAPIKey, "X-Dify-Inputs": `{"persona":"pirate"}`},
+			map[string]any{"temp": "0.2", "language": "fr", "persona": "pirate"},
+		},
+		{
+			"anthropic", "/v1/messages",
+			`{"model":"claude-3","max_tokens":16,"temperature":1,"top_k":5,"messages":[{"role":"user","content":"hi"}]}`,
+			map[string]string{"x-api-key": testAPIKey, "X-Dify-Inputs": `{"language":"en"}`},
+			map[string]any{"temp": "1", "language": "en", "depth": float64(5)},
+		},
+		{
+			"gemini", "/v1beta/models/gemini-pro:generateContent",
+			`{"contents":[{"role":"user","parts":[{"text":"hi"}]}],"generationConfig":{"temperature":0.7,"topK":3}}`,
+			map[string]string{"x-goog-api-key": testAPIKey, "X-Dify-Inputs": `{"language":"fr","depth":"4"}`},
+			map[string]any{"temp": "0.7", "language": "fr", "depth": float64(4)},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out map[string]any
+			postJSON(t, proxySrv.URL+tc.path, tc.body, tc.auth, &out)
+			if got := mock.LastRequest["inputs"]; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected inputs %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestInputs_Validation(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Parameters = testInputForm
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	cases := []struct {
+		name   string
+		inputs string
+		want   string
+	}{
+		{"missing required", ``, "is required"},
+		{"bad option", `{"language":"de"}`, "must be one of en, fr"},
+		{"too long", `{"language":"en","persona":"a very long persona description"}`, "at most 20 characters"},
+		{"not a number", `{"language":"en","depth":"deep"}`, "must be a number"},
+		{"undeclared", `{"language":"en","mood":"happy"}`, "is not defined by the app"},
+		{"malformed header", `{"language":`, "must be a JSON object"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+			req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+			if tc.inputs != "" {
+				req.Header.Set("X-Dify-Inputs", tc.inputs)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			raw, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(raw), tc.want) {
+				t.Errorf("expected 400 mentioning %q, got %d: %s", tc.want, resp.StatusCode, raw)
+			}
+		})
+	}
+}
+
+func TestInputs_UnvalidatedWithoutForm(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var out map[string]any
+	postJSON(t, proxySrv.URL+"/v1/chat/completions", `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"temperature":0.5}`,
+		map[string]string{"Authorization": "Bearer " + testAPIKey, "X-Dify-Inputs": `{"mood":"happy"}`}, &out)
+	want := map[string]any{"mood": "happy"}
+	if got := mock.LastRequest["inputs"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected inputs %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,199 @@
+package integration
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// signJWT returns an RS256 token carrying claims, signed by key under kid.
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := enc(map[string]any{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWT_ClaimsSelectUserRoutesAndTier(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		RoutesFile:     writeConfig(t, "routes.json", `{"routes":[{"model":"support","api_key":"`+routeAPIKey+`"},{"model":"sales","api_key":"`+routeAPIKey+`"}]}`),
+		JWTJWKSURL:     jwks.URL,
+		JWTJWKSCache:   time.Hour,
+		JWTIssuer:      "https://idp.example.com",
+		JWTAudience:    "dify-gateway",
+		JWTUserClaim:   "email",
+		JWTRoutesClaim: "routes",
+		JWTTierClaim:   "tier",
+		RateTiers:      map[string]ratelimit.Limits{"bronze": {RPM: 1}},
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	claims := func(email string, extra map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"other", "dify-gateway"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"email":  email,
+			"routes": "support",
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	openAI := proxySrv.URL + "/v1/chat/completions"
+	support := `{"model":"support","messages":[{"role":"user","content":"hi"}]}`
+
+	// The user claim names the Dify user, whatever the headers say.
+	alice := signJWT(t, key, "k1", claims("alice@example.com", nil))
+	resp, body := postAs(t, openAI, "mallory", alice, support)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for a valid token, got %d %s", resp.StatusCode, body)
+	}
+	if got := mock.LastRequest["user"]; got != "alice@example.com" {
+		t.Errorf("expected the token's user to reach Dify, got %v", got)
+	}
+	if mock.LastAPIKey != routeAPIKey {
+		t.Errorf("expected the route's Dify key, got %q", mock.LastAPIKey)
+	}
+	resp, body = postAs(t, openAI, "alice", alice, `{"model":"sales","messages":[{"role":"user","content":"hi"}]}`)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, `may not use model \"sales\"`) {
+		t.Errorf("expected 403 for a route the token does not grant, got %d %s", resp.StatusCode, body)
+	}
+
+	for name, token := range map[string]string{
+		"wrong audience":  signJWT(t, key, "k1", claims("alice@example.com", map[string]any{"aud": "other"})),
+		"wrong issuer":    signJWT(t, key, "k1", claims("alice@example.com", map[string]any{"iss": "https://evil.example.com"})),
+		"expired":         signJWT(t, key, "k1", claims("alice@example.com", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"tampered":        alice[:strings.LastIndex(alice, ".")] + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 256)),
+		"plain Dify key":  testAPIKey,
+		"no user claim":   signJWT(t, key, "k1", claims("", nil)),
+		"no token at all": "",
+	} {
+		if resp, body := postAs(t, openAI, "alice", token, support); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d %s", name, resp.StatusCode, body)
+		}
+	}
+	noRoutes := signJWT(t, key, "k1", claims("carol@example.com", map[string]any{"routes": []string{}}))
+	if resp, body := postAs(t, openAI, "carol", noRoutes, support); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a token granting no routes, got %d %s", resp.StatusCode, body)
+	}
+
+	// The tier claim selects the user's rate limits.
+	bob := signJWT(t, key, "k1", claims("bob@example.com", map[string]any{"tier": "bronze", "routes": []string{"support", "sales"}}))
+	if resp, body := postAs(t, openAI, "", bob, support); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for bob, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := postAs(t, openAI, "", bob, support); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected bob's tier limit to apply, got %d", resp.StatusCode)
+	}
+	if resp, _ := postAs(t, openAI, "", alice, support); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected users outside the tier unaffected, got %d", resp.StatusCode)
+	}
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected the key set fetched once and cached, got %d fetches", n)
+	}
+	if resp, err := http.Get(proxySrv.URL + "/metrics"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the metrics exempt from authentication, got %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestJWT_AllowDifyKeys(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "k1",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:      mock.URL(),
+		ListenAddr:       ":0",
+		DefaultUser:      "test-user",
+		RequestTimeout:   10 * time.Second,
+		JWTJWKSFile:      writeConfig(t, "jwks.json", string(jwks)),
+		JWTUserClaim:     "sub",
+		JWTAllowDifyKeys: true,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	chat := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+	if resp, body := postAs(t, proxySrv.URL+"/v1/chat/completions", "alice", testAPIKey, chat); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected Dify keys accepted, got %d %s", resp.StatusCode, body)
+	}
+	if mock.LastAPIKey != testAPIKey || mock.LastRequest["user"] != "alice" {
+		t.Errorf("expected the caller's key and user, got %q %v", mock.LastAPIKey, mock.LastRequest["user"])
+	}
+	expired := signJWT(t, key, "k1", map[string]any{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()})
+	if resp, _ := postAs(t, proxySrv.URL+"/v1/chat/completions", "alice", expired, chat); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected invalid tokens rejected even with Dify keys allowed, got %d", resp.StatusCode)
+	}
+}
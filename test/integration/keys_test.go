@@ -0,0 +1,158 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+const testAdminToken = "admin-secret"
+
+func newKeysProxy(t *testing.T, difyURL string) *httptest.Server {
+	t.Helper()
+	cfg := &config.Config{
+		DifyBaseURL:    difyURL,
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		AdminToken:     testAdminToken,
+	}
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	return httptest.NewServer(srv.Handler())
+}
+
+type keyView struct {
+	ID         string `json:"id"`
+	Key        string `json:"key"`
+	Hint       string `json:"hint"`
+	HasDifyKey bool   `json:"has_dify_key"`
+	Enabled    bool   `json:"enabled"`
+}
+
+// virtualKey creates a virtual key allowed to use models, or every model when
+// none are given, on the proxy at url.
+func virtualKey(t *testing.T, url string, models ...string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"owner": "test", "models": models})
+	var k keyView
+	if status := adminCall(t, http.MethodPost, url+"/admin/keys", testAdminToken, string(body), &k); status != http.StatusCreated {
+		t.Fatalf("create key: status %d", status)
+	}
+	return k.Key
+}
+
+// adminCall sends an admin API request and decodes the response into out.
+func adminCall(t *testing.T, method, url, token, body string, out any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("admin request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		_ = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+// chatWithKey sends an OpenAI chat completion for model with key.
+func chatWithKey(t *testing.T, base, key, model string) int {
+	t.Helper()
+	body := `{"model":"` + model + `","messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest(http.MethodPost, base+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestKeys_VirtualKeyLifecycle(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	proxySrv := newKeysProxy(t, mock.URL())
+	defer proxySrv.Close()
+	admin := proxySrv.URL + "/admin/keys"
+
+	if status := adminCall(t, http.MethodGet, admin, "wrong", "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin token, got %d", status)
+	}
+
+	var created keyView
+	status := adminCall(t, http.MethodPost, admin, testAdminToken, `{"owner":"team-a","models":["support"],"dify_key":"`+testAPIKey+`"}`, &created)
+	if status != http.StatusCreated || !strings.HasPrefix(created.Key, "sk-dify-") || !created.HasDifyKey {
+		t.Fatalf("expected a new key, got %d %+v", status, created)
+	}
+
+	if status := chatWithKey(t, proxySrv.URL, created.Key, "support"); status != http.StatusOK {
+		t.Fatalf("expected 200 with the virtual key, got %d", status)
+	}
+	if mock.LastAPIKey != testAPIKey {
+		t.Errorf("expected the Dify key upstream, got %q", mock.LastAPIKey)
+	}
+	if status := chatWithKey(t, proxySrv.URL, created.Key, "other"); status != http.StatusForbidden {
+		t.Errorf("expected 403 for a model outside the key's scope, got %d", status)
+	}
+
+	var list struct {
+		Data []keyView `json:"data"`
+	}
+	adminCall(t, http.MethodGet, admin, testAdminToken, "", &list)
+	if len(list.Data) != 1 || list.Data[0].Key != "" || list.Data[0].Hint == "" {
+		t.Errorf("expected the key listed without its secret, got %+v", list.Data)
+	}
+
+	var rotated keyView
+	adminCall(t, http.MethodPost, admin+"/"+created.ID+"/rotate", testAdminToken, "", &rotated)
+	if status := chatWithKey(t, proxySrv.URL, created.Key, "support"); status != http.StatusUnauthorized {
+		t.Errorf("expected the old secret rejected after rotation, got %d", status)
+	}
+	if status := chatWithKey(t, proxySrv.URL, rotated.Key, "support"); status != http.StatusOK {
+		t.Errorf("expected the rotated secret accepted, got %d", status)
+	}
+
+	adminCall(t, http.MethodPatch, admin+"/"+created.ID, testAdminToken, `{"enabled":false}`, nil)
+	if status := chatWithKey(t, proxySrv.URL, rotated.Key, "support"); status != http.StatusUnauthorized {
+		t.Errorf("expected a disabled key rejected, got %d", status)
+	}
+
+	if status := adminCall(t, http.MethodDelete, admin+"/"+created.ID, testAdminToken, "", nil); status != http.StatusOK {
+		t.Fatalf("expected the key revoked, got %d", status)
+	}
+	if status := adminCall(t, http.MethodGet, admin+"/"+created.ID, testAdminToken, "", nil); status != http.StatusNotFound {
+		t.Errorf("expected a revoked key gone, got %d", status)
+	}
+}
+
+func TestKeys_ExpiredKeyRejected(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	proxySrv := newKeysProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var created keyView
+	expired := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"dify_key":"`+testAPIKey+`","expires_at":"`+expired+`"}`, &created)
+	if status := chatWithKey(t, proxySrv.URL, created.Key, "dify"); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an expired key, got %d", status)
+	}
+	if mock.Requests() != 0 {
+		t.Errorf("expected no upstream request, got %d", mock.Requests())
+	}
+}
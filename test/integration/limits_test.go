@@ -0,0 +1,165 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func TestOpenAI_StreamingStopAcrossChunks(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	// The mock streams "Hello", " from", " Dify"; "m D" spans two chunks.
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"Say hello"}],"stream":true,"stop":["m D"]}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	var finish []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta        struct{ Content string } `json:"delta"`
+				FinishReason *string                  `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode chunk: %v", err)
+		}
+		for _, c := range chunk.Choices {
+			content.WriteString(c.Delta.Content)
+			if c.FinishReason != nil {
+				finish = append(finish, *c.FinishReason)
+			}
+		}
+	}
+
+	if got := content.String(); got != "Hello fro" {
+		t.Errorf("expected output cut before stop sequence, got %q", got)
+	}
+	if len(finish) != 1 || finish[0] != "stop" {
+		t.Errorf("expected a single finish_reason \"stop\", got %v", finish)
+	}
+	waitForStoppedTask(t, mock, "task-1")
+}
+
+func TestAnthropic_StopSequenceAndMaxTokens(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	headers := map[string]string{"x-api-key": testAPIKey}
+
+	var stopped map[string]any
+	body := `{"model":"claude-3","max_tokens":1024,"stop_sequences":["Dify"],"messages":[{"role":"user","content":"hi"}]}`
+	postJSON(t, proxySrv.URL+"/v1/messages", body, headers, &stopped)
+	if stopped["stop_reason"] != "stop_sequence" || stopped["stop_sequence"] != "Dify" {
+		t.Errorf("expected stop_sequence \"Dify\", got %v / %v", stopped["stop_reason"], stopped["stop_sequence"])
+	}
+	if text := stopped["content"].([]any)[0].(map[string]any)["text"]; text != "Hello from " {
+		t.Errorf("unexpected text %q", text)
+	}
+
+	var limited map[string]any
+	body = `{"model":"claude-3","max_tokens":1,"messages":[{"role":"user","content":"hi"}]}`
+	postJSON(t, proxySrv.URL+"/v1/messages", body, headers, &limited)
+	if limited["stop_reason"] != "max_tokens" {
+		t.Errorf("expected stop_reason max_tokens, got %v", limited["stop_reason"])
+	}
+	if text, _ := limited["content"].([]any)[0].(map[string]any)["text"].(string); !isTruncated(text) {
+		t.Errorf("expected output cut to one token, got %q", text)
+	}
+}
+
+func TestGemini_StreamingMaxOutputTokens(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"Say hello"}]}],"generationConfig":{"maxOutputTokens":1}}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1beta/models/gemini-pro:streamGenerateContent?alt=sse", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var reasons []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var chunk struct {
+			Candidates []struct {
+				Content      struct{ Parts []struct{ Text string } } `json:"content"`
+				FinishReason string                                  `json:"finishReason"`
+			} `json:"candidates"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode chunk: %v", err)
+		}
+		for _, c := range chunk.Candidates {
+			for _, p := range c.Content.Parts {
+				text.WriteString(p.Text)
+			}
+			if c.FinishReason != "" {
+				reasons = append(reasons, c.FinishReason)
+			}
+		}
+	}
+
+	if !isTruncated(text.String()) {
+		t.Errorf("expected output cut to one token, got %q", text.String())
+	}
+	if len(reasons) == 0 || reasons[len(reasons)-1] != "MAX_TOKENS" {
+		t.Errorf("expected final finishReason MAX_TOKENS, got %v", reasons)
+	}
+	waitForStoppedTask(t, mock, "task-1")
+}
+
+// isTruncated reports whether s is a non-empty proper prefix of the mock
+// answer. The exact cut depends on the configured tokenizer.
+func isTruncated(s string) bool {
+	return s != "" && len(s) < len(testAnswer) && strings.HasPrefix(testAnswer, s)
+}
+
+func waitForStoppedTask(t *testing.T, mock *testutil.MockDify, taskID string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, id := range mock.StoppedTasks() {
+			if id == taskID {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected Dify task %s to be stopped", taskID)
+}
@@ -0,0 +1,286 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/apps"
+	"github.com/zhengjr9/dify-agent/internal/dify"
+	"github.com/zhengjr9/dify-agent/internal/identity"
+	"github.com/zhengjr9/dify-agent/internal/inputs"
+	"github.com/zhengjr9/dify-agent/internal/mcp"
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// rpcReply is a JSON-RPC response or notification as the tests see it.
+type rpcReply struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func mcpPost(t *testing.T, url, key, body, accept string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return resp
+}
+
+func TestMCP_InitializeAndListTools(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Parameters = testInputForm
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+	key := virtualKey(t, proxySrv.URL)
+
+	resp := mcpPost(t, proxySrv.URL+"/mcp", key, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-03-26","capabilities":{},"clientInfo":{"name":"test","version":"1"}}}`, "application/json, text/event-stream")
+	var init rpcReply
+	_ = json.NewDecoder(resp.Body).Decode(&init)
+	resp.Body.Close()
+	if init.Error != nil || !strings.Contains(string(init.Result), `"protocolVersion":"2025-03-26"`) || !strings.Contains(string(init.Result), `"tools"`) {
+		t.Fatalf("unexpected initialize reply %s", init.Result)
+	}
+
+	resp = mcpPost(t, proxySrv.URL+"/mcp", key, `{"jsonrpc":"2.0","method":"notifications/initialized"}`, "application/json")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected 202 for a notification, got %d", resp.StatusCode)
+	}
+
+	resp = mcpPost(t, proxySrv.URL+"/mcp", key, `{"jsonrpc":"2.0","id":2,"method":"tools/list"}`, "application/json")
+	var list rpcReply
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	var tools struct {
+		Tools []struct {
+			Name        string `json:"name"`
+			InputSchema struct {
+				Properties map[string]map[string]any `json:"properties"`
+				Required   []string                  `json:"required"`
+			} `json:"inputSchema"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal(list.Result, &tools); err != nil || len(tools.Tools) != 1 {
+		t.Fatalf("expected one tool, got %s (%v)", list.Result, err)
+	}
+	tool := tools.Tools[0]
+	if tool.Name != "support" {
+		t.Errorf("expected tool support, got %q", tool.Name)
+	}
+	props := tool.InputSchema.Properties
+	if props["query"]["type"] != "string" || props["depth"]["type"] != "number" || props["persona"]["maxLength"] != float64(20) {
+		t.Errorf("unexpected properties %v", props)
+	}
+	if enum, _ := props["language"]["enum"].([]any); len(enum) != 2 {
+		t.Errorf("expected language options as enum, got %v", props["language"])
+	}
+	if strings.Join(tool.InputSchema.Required, ",") != "query,language" {
+		t.Errorf("unexpected required %v", tool.InputSchema.Required)
+	}
+}
+
+func TestMCP_CallToolStreamsProgress(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Parameters = testInputForm
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+	key := virtualKey(t, proxySrv.URL)
+
+	body := `{"jsonrpc":"2.0","id":"call-1","method":"tools/call","params":{"name":"support","arguments":{"query":"Say hello","language":"fr"},"_meta":{"progressToken":"p1"}}}`
+	resp := mcpPost(t, proxySrv.URL+"/mcp", key, body, "application/json, text/event-stream")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an SSE reply, got %q", ct)
+	}
+
+	var msgs []rpcReply
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var m rpcReply
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			t.Fatalf("decode %q: %v", data, err)
+		}
+		msgs = append(msgs, m)
+	}
+	if len(msgs) < 2 {
+		t.Fatalf("expected progress notifications and a result, got %d messages", len(msgs))
+	}
+	var streamed strings.Builder
+	for _, m := range msgs[:len(msgs)-1] {
+		var p struct {
+			ProgressToken string `json:"progressToken"`
+			Message       string `json:"message"`
+		}
+		_ = json.Unmarshal(m.Params, &p)
+		if m.Method != "notifications/progress" || p.ProgressToken != "p1" {
+			t.Errorf("unexpected notification %+v", m)
+		}
+		streamed.WriteString(p.Message)
+	}
+	if streamed.String() != testAnswer {
+		t.Errorf("expected progress to carry the answer, got %q", streamed.String())
+	}
+
+	last := msgs[len(msgs)-1]
+	var result struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	_ = json.Unmarshal(last.Result, &result)
+	if string(last.ID) != `"call-1"` || result.IsError || len(result.Content) != 1 || result.Content[0].Text != testAnswer {
+		t.Errorf("unexpected result %s", last.Result)
+	}
+	in, _ := mock.LastRequest["inputs"].(map[string]any)
+	if in["language"] != "fr" || mock.LastRequest["query"] != "Say hello" {
+		t.Errorf("unexpected Dify request %v", mock.LastRequest)
+	}
+}
+
+func TestMCP_CallToolInvalidInput(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Parameters = testInputForm
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+	key := virtualKey(t, proxySrv.URL)
+
+	body := `{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"support","arguments":{"query":"hi","language":"de"}}}`
+	resp := mcpPost(t, proxySrv.URL+"/mcp", key, body, "application/json")
+	var reply rpcReply
+	_ = json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+	if !strings.Contains(string(reply.Result), `"isError":true`) {
+		t.Errorf("expected a tool error, got %s", reply.Result)
+	}
+	if mock.Requests() != 0 {
+		t.Errorf("expected no Dify request, got %d", mock.Requests())
+	}
+
+	resp = mcpPost(t, proxySrv.URL+"/mcp", key, `{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"nope","arguments":{"query":"hi"}}}`, "application/json")
+	reply = rpcReply{}
+	_ = json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+	if reply.Error == nil || reply.Error.Code != -32602 {
+		t.Errorf("expected invalid params for an unknown tool, got %+v", reply)
+	}
+}
+
+func TestMCP_RequiresCredentials(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	call := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"support","arguments":{"query":"hi"}}}`
+	for _, key := range []string{"", testAPIKey} {
+		resp := mcpPost(t, proxySrv.URL+"/mcp", key, call, "application/json")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("key %q: expected 401, got %d", key, resp.StatusCode)
+		}
+	}
+
+	other := virtualKey(t, proxySrv.URL, "other")
+	resp := mcpPost(t, proxySrv.URL+"/mcp", other, `{"jsonrpc":"2.0","id":2,"method":"tools/list"}`, "application/json")
+	var list rpcReply
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if list.Error != nil || !strings.Contains(string(list.Result), `"tools":[]`) {
+		t.Errorf("expected no tools outside the key's models, got %s", list.Result)
+	}
+	resp = mcpPost(t, proxySrv.URL+"/mcp", other, call, "application/json")
+	var reply rpcReply
+	_ = json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+	if reply.Error == nil || reply.Error.Code != -32001 {
+		t.Errorf("expected a forbidden error, got %+v", reply)
+	}
+	if mock.Requests() != 0 {
+		t.Errorf("expected no Dify request, got %d", mock.Requests())
+	}
+}
+
+func TestMCP_Stdio(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	client := dify.NewClient(mock.URL(), 10*time.Second, "", nil)
+	users, _ := identity.New(identity.Config{Default: "stdio-user"})
+	reg, _ := apps.New(apps.File{})
+	tokens, _ := tokenizer.Load("", tokenizer.CL100K)
+	server := mcp.NewServer(client, users, inputs.NewBuilder(client, reg), reg, testAPIKey, 10*time.Second, tokens, nil)
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeStdio(t.Context(), inR, outW)
+		outW.Close()
+	}()
+
+	replies := bufio.NewScanner(outR)
+	next := func() rpcReply {
+		t.Helper()
+		if !replies.Scan() {
+			t.Fatalf("no reply: %v", replies.Err())
+		}
+		var m rpcReply
+		if err := json.Unmarshal(replies.Bytes(), &m); err != nil {
+			t.Fatalf("decode %q: %v", replies.Text(), err)
+		}
+		return m
+	}
+
+	io.WriteString(inW, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-06-18"}}`+"\n")
+	if m := next(); string(m.ID) != "1" || m.Error != nil {
+		t.Fatalf("unexpected initialize reply %+v", m)
+	}
+	io.WriteString(inW, `{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"dify","arguments":{"query":"hi"}}}`+"\n")
+	m := next()
+	if string(m.ID) != "2" || !strings.Contains(string(m.Result), testAnswer) {
+		t.Errorf("unexpected call reply %+v %s", m, m.Result)
+	}
+	if mock.LastRequest["user"] != "stdio-user" {
+		t.Errorf("expected the default user, got %v", mock.LastRequest["user"])
+	}
+	io.WriteString(inW, `{"jsonrpc":"2.0","id":3,"method":"bogus"}`+"\n")
+	if m := next(); m.Error == nil || m.Error.Code != -32601 {
+		t.Errorf("expected method not found, got %+v", m)
+	}
+
+	inW.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeStdio: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// ollamaResponse is the subset of an Ollama chat or generate object the tests inspect.
+type ollamaResponse struct {
+	Model   string `json:"model"`
+	Message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"message"`
+	Response        string `json:"response"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	TotalDuration   int64  `json:"total_duration"`
+}
+
+func TestOllama_ChatStreaming(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"model":"llama3","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Say hello"}]}`
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/api/chat", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected NDJSON content-type, got %q", ct)
+	}
+
+	var objs []ollamaResponse
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var o ollamaResponse
+		if err := json.Unmarshal(scanner.Bytes(), &o); err != nil {
+			t.Fatalf("decode line %q: %v", scanner.Text(), err)
+		}
+		objs = append(objs, o)
+	}
+	if len(objs) < 2 {
+		t.Fatalf("expected several objects, got %d", len(objs))
+	}
+	var text strings.Builder
+	for _, o := range objs[:len(objs)-1] {
+		if o.Done || o.Model != "llama3" || o.Message.Role != "assistant" {
+			t.Errorf("unexpected chunk %+v", o)
+		}
+		text.WriteString(o.Message.Content)
+	}
+	if text.String() != testAnswer {
+		t.Errorf("expected %q, got %q", testAnswer, text.String())
+	}
+	last := objs[len(objs)-1]
+	if !last.Done || last.DoneReason != "stop" || last.EvalCount == 0 || last.PromptEvalCount == 0 || last.TotalDuration == 0 {
+		t.Errorf("expected final object with done_reason and counts, got %+v", last)
+	}
+	if q, _ := mock.LastRequest["query"].(string); q != "system: Be brief.\nSay hello" {
+		t.Errorf("unexpected query %q", q)
+	}
+}
+
+func TestOllama_ChatBlockingNumPredict(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var out ollamaResponse
+	body := `{"model":"llama3","stream":false,"options":{"num_predict":1},"messages":[{"role":"user","content":"hi"}]}`
+	postJSON(t, proxySrv.URL+"/api/chat", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &out)
+	if !out.Done || out.DoneReason != "length" || !isTruncated(out.Message.Content) {
+		t.Errorf("expected truncated answer with done_reason length, got %+v", out)
+	}
+}
+
+func TestOllama_GenerateWithImages(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	body := `{"model":"llava","stream":false,"system":"Describe images.","prompt":"What is this?","images":["` + png + `"]}`
+	var out ollamaResponse
+	postJSON(t, proxySrv.URL+"/api/generate", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &out)
+	if out.Response != testAnswer || !out.Done {
+		t.Errorf("unexpected response %+v", out)
+	}
+
+	uploads := mock.Uploads()
+	if len(uploads) != 1 || uploads[0].ContentType != "image/png" || uploads[0].User != "test-user" {
+		t.Fatalf("expected one PNG upload, got %+v", uploads)
+	}
+	files, _ := mock.LastRequest["files"].([]any)
+	if len(files) != 1 {
+		t.Fatalf("expected one file input, got %v", mock.LastRequest["files"])
+	}
+	f := files[0].(map[string]any)
+	if f["type"] != "image" || f["transfer_method"] != "local_file" || f["upload_file_id"] != "file-1" {
+		t.Errorf("unexpected file input %v", f)
+	}
+	if q, _ := mock.LastRequest["query"].(string); q != "system: Describe images.\nWhat is this?" {
+		t.Errorf("unexpected query %q", q)
+	}
+}
+
+func TestOllama_ModelsAndDefaultKey(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		DifyAPIKey:     testAPIKey,
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		AdminToken:     testAdminToken,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	resp, err := http.Get(proxySrv.URL + "/api/tags")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&tags)
+	resp.Body.Close()
+	if len(tags.Models) != 1 || tags.Models[0].Name != "dify:latest" {
+		t.Errorf("unexpected tags %+v", tags)
+	}
+
+	resp, err = http.Get(proxySrv.URL + "/api/version")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var version map[string]string
+	_ = json.NewDecoder(resp.Body).Decode(&version)
+	resp.Body.Close()
+	if version["version"] == "" {
+		t.Error("expected a version")
+	}
+
+	var show map[string]any
+	postJSON(t, proxySrv.URL+"/api/show", `{"model":"dify:latest"}`, nil, &show)
+	if show["details"] == nil {
+		t.Errorf("expected model details, got %v", show)
+	}
+
+	// The configured key is lent to a virtual key allowed the model, and
+	// to no anonymous caller.
+	chat := `{"model":"dify","stream":false,"messages":[{"role":"user","content":"hi"}]}`
+	resp, err = http.Post(proxySrv.URL+"/api/chat", "application/json", strings.NewReader(chat))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+	var out ollamaResponse
+	postJSON(t, proxySrv.URL+"/api/chat", chat, map[string]string{"Authorization": "Bearer " + virtualKey(t, proxySrv.URL, "dify")}, &out)
+	if out.Message.Content != testAnswer || mock.LastAPIKey != testAPIKey {
+		t.Errorf("unexpected answer %+v with key %q", out, mock.LastAPIKey)
+	}
+}
+
+func TestOllama_StreamError(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.StreamError = "internal_server_error"
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var o map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &o); err != nil {
+			t.Fatalf("decode line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, o)
+	}
+	if len(lines) < 2 {
+		t.Fatalf("expected chunks and an error, got %v", lines)
+	}
+	last := lines[len(lines)-1]
+	if msg, _ := last["error"].(string); !strings.Contains(msg, "mock stream failure") {
+		t.Errorf("expected a final error object, got %v", last)
+	}
+	for _, o := range lines {
+		if o["done"] == true {
+			t.Errorf("expected no done object, got %v", o)
+		}
+	}
+}
+
+func TestOllama_MissingKey(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	resp, err := http.Post(proxySrv.URL+"/api/chat", "application/json", strings.NewReader(`{"model":"dify","messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	if resp.StatusCode != http.StatusUnauthorized || e.Error == "" {
+		t.Errorf("expected 401 with an Ollama error body, got %d %+v", resp.StatusCode, e)
+	}
+}
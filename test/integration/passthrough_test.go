@@ -0,0 +1,155 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func TestPassthrough_StreamsChatMessages(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newInputsProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var sdk keyView
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"owner":"sdk","models":["support"]}`, &sdk)
+
+	body := `{"query":"hi","inputs":{},"user":"sdk-user","response_mode":"streaming"}`
+	send := func(key, app string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/dify/v1/chat-messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Dify-App", app)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	// Naming an app takes a virtual key or access token that allows it.
+	for _, tc := range []struct {
+		key, app string
+		status   int
+	}{
+		{"", "support", http.StatusUnauthorized},
+		{"app-someone-else", "support", http.StatusUnauthorized},
+		{sdk.Key, "other", http.StatusNotFound},
+	} {
+		resp := send(tc.key, tc.app)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("key %q, app %q: expected %d, got %d", tc.key, tc.app, tc.status, resp.StatusCode)
+		}
+	}
+	if mock.Requests() != 0 {
+		t.Fatalf("expected no upstream requests, got %d", mock.Requests())
+	}
+
+	resp := send(sdk.Key, "support")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("expected an SSE stream, got %d %q", resp.StatusCode, ct)
+	}
+
+	var answer strings.Builder
+	events := map[string]bool{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev struct {
+			Event  string `json:"event"`
+			Answer string `json:"answer"`
+		}
+		_ = json.Unmarshal([]byte(data), &ev)
+		events[ev.Event] = true
+		if ev.Event == "message" {
+			answer.WriteString(ev.Answer)
+		}
+	}
+	if answer.String() != testAnswer || !events["message_end"] {
+		t.Errorf("expected the native Dify stream, got %q %v", answer.String(), events)
+	}
+	if mock.LastAPIKey != testAPIKey {
+		t.Errorf("expected the support app key upstream, got %q", mock.LastAPIKey)
+	}
+	if u, _ := mock.LastRequest["user"].(string); u != "sdk-user" {
+		t.Errorf("expected the body relayed unchanged, got user %q", u)
+	}
+}
+
+func TestPassthrough_BearerKeyAndStatus(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Parameters = map[string]any{"opening_statement": "Hello"}
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	out := getJSON(t, proxySrv.URL+"/dify/v1/parameters", map[string]string{"Authorization": "Bearer " + testAPIKey})
+	if out["opening_statement"] != "Hello" {
+		t.Errorf("unexpected parameters %v", out)
+	}
+
+	// Upstream statuses are relayed as-is.
+	req, _ := http.NewRequest(http.MethodGet, proxySrv.URL+"/dify/v1/conversations?user=u", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the upstream 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestPassthrough_Rejected(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	for _, tc := range []struct {
+		path, key string
+		status    int
+		code      string
+	}{
+		{"/dify/v1/datasets", testAPIKey, http.StatusNotFound, "not_found"},
+		{"/dify/v1/parameters", "", http.StatusUnauthorized, "unauthorized"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, proxySrv.URL+tc.path, nil)
+		if tc.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		var e struct {
+			Code   string `json:"code"`
+			Status int    `json:"status"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || e.Code != tc.code || e.Status != tc.status {
+			t.Errorf("%s: expected %d %s, got %d %+v", tc.path, tc.status, tc.code, resp.StatusCode, e)
+		}
+	}
+	if mock.Requests() != 0 {
+		t.Errorf("expected no upstream requests, got %d", mock.Requests())
+	}
+}
@@ -0,0 +1,49 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// TestPipeline_UpstreamErrorPerProtocol checks that the shared pipeline
+// reports an unreachable Dify in each protocol's own error format.
+func TestPipeline_UpstreamErrorPerProtocol(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	for _, tc := range []struct {
+		path, body string
+		status     int
+		field      string
+	}{
+		{"/v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}]}`, http.StatusBadGateway, "message"},
+		{"/v1/messages", `{"max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, http.StatusBadGateway, "message"},
+		{"/v1beta/models/gemini-pro:generateContent", `{"contents":[{"parts":[{"text":"hi"}]}]}`, http.StatusBadGateway, "message"},
+		{"/api/chat", `{"model":"dify","messages":[{"role":"user","content":"hi"}],"stream":false}`, http.StatusBadGateway, "error"},
+		{"/model/dify/converse", `{"messages":[{"role":"user","content":[{"text":"hi"}]}]}`, http.StatusFailedDependency, "message"},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tc.path, err)
+		}
+		var body map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.status, resp.StatusCode)
+		}
+		if msg, _ := body[tc.field].(string); !strings.HasPrefix(msg, "upstream error") {
+			t.Errorf("%s: expected an upstream error in %q, got %v", tc.path, tc.field, body)
+		}
+	}
+}
@@ -30,7 +30,10 @@ func newTestProxy(t *testing.T, difyURL string) *httptest.Server {
 		DefaultUser:    "test-user",
 		RequestTimeout: 10 * time.Second,
 	}
-	srv := proxy.New(cfg)
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
 	return httptest.NewServer(srv.Handler())
 }
 
@@ -321,7 +324,7 @@ func TestGemini_Streaming(t *testing.T) {
 	defer proxySrv.Close()
 
 	body := `{"contents":[{"role":"user","parts":[{"text":"Say hello"}]}]}`
-	url := proxySrv.URL + "/v1beta/models/gemini-pro:streamGenerateContent?key=" + testAPIKey
+	url := proxySrv.URL + "/v1beta/models/gemini-pro:streamGenerateContent?alt=sse&key=" + testAPIKey
 	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
 
@@ -0,0 +1,241 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/internal/ratelimit"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// postAs sends body to path as user and returns the response with its body
+// read.
+func postAs(t *testing.T, url, user, key, body string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("X-Dify-User", user)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(raw)
+}
+
+func TestRateLimit_UserRequestsPerMinute(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		UserRPM:        2,
+		UserLimits:     map[string]ratelimit.Limits{"batch-job": {RPM: 1}},
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	openAI := proxySrv.URL + "/v1/chat/completions"
+	chat := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+	resp, _ := postAs(t, openAI, "alice", testAPIKey, chat)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("x-ratelimit-limit-requests"); got != "2" {
+		t.Errorf("expected x-ratelimit-limit-requests 2, got %q", got)
+	}
+	if got := resp.Header.Get("x-ratelimit-remaining-requests"); got != "1" {
+		t.Errorf("expected x-ratelimit-remaining-requests 1, got %q", got)
+	}
+	postAs(t, openAI, "alice", testAPIKey, chat)
+	resp, body := postAs(t, openAI, "alice", testAPIKey, chat)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if !strings.Contains(body, "requests per minute") {
+		t.Errorf("expected the limit named in the error, got %s", body)
+	}
+	if got := resp.Header.Get("x-ratelimit-remaining-requests"); got != "0" {
+		t.Errorf("expected x-ratelimit-remaining-requests 0, got %q", got)
+	}
+
+	// Each user has buckets of their own; users named in user_limits have
+	// their own limits.
+	anthropic := proxySrv.URL + "/v1/messages"
+	messages := `{"model":"claude","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`
+	resp, _ = postAs(t, anthropic, "batch-job", testAPIKey, messages)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("anthropic-ratelimit-requests-limit") != "1" {
+		t.Fatalf("expected 200 with anthropic-ratelimit-requests-limit 1, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if _, err := time.Parse(time.RFC3339, resp.Header.Get("anthropic-ratelimit-requests-reset")); err != nil {
+		t.Errorf("expected an RFC 3339 reset time: %v", err)
+	}
+	resp, _ = postAs(t, anthropic, "batch-job", testAPIKey, messages)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, got %d", resp.StatusCode)
+	}
+
+	resp, _ = postAs(t, proxySrv.URL+"/model/dify/converse", "bob", testAPIKey, `{"messages":[{"role":"user","content":[{"text":"hi"}]}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for another user, got %d", resp.StatusCode)
+	}
+	postAs(t, proxySrv.URL+"/model/dify/converse", "bob", testAPIKey, `{"messages":[{"role":"user","content":[{"text":"hi"}]}]}`)
+	resp, _ = postAs(t, proxySrv.URL+"/model/dify/converse", "bob", testAPIKey, `{"messages":[{"role":"user","content":[{"text":"hi"}]}]}`)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("X-Amzn-ErrorType") != "ThrottlingException" {
+		t.Errorf("expected a Bedrock ThrottlingException, got %d %q", resp.StatusCode, resp.Header.Get("X-Amzn-ErrorType"))
+	}
+}
+
+func TestRateLimit_KeyStreamsAndRoute(t *testing.T) {
+	mock := testutil.NewMockDify("one two three", testMessageID, testConversationID)
+	defer mock.Close()
+	proxySrv := newKeysProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	var created keyView
+	status := adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"owner":"script","dify_key":"`+testAPIKey+`","limits":{"streams":1}}`, &created)
+	if status != http.StatusCreated {
+		t.Fatalf("expected a new key, got %d", status)
+	}
+
+	// The first stream holds the key's only stream slot until it ends.
+	mock.Delay = 200 * time.Millisecond
+	stream := `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	done := make(chan int)
+	go func() {
+		resp, _ := postAs(t, proxySrv.URL+"/v1/chat/completions", "alice", created.Key, stream)
+		done <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+	resp, body := postAs(t, proxySrv.URL+"/v1/chat/completions", "bob", created.Key, stream)
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, "concurrent streams") {
+		t.Errorf("expected 429 for a second stream on the key, got %d %s", resp.StatusCode, body)
+	}
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("expected the first stream to succeed, got %d", status)
+	}
+	mock.Delay = 0
+	if resp, _ := postAs(t, proxySrv.URL+"/v1/chat/completions", "bob", created.Key, stream); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the slot freed after the first stream, got %d", resp.StatusCode)
+	}
+	if status := chatWithKey(t, proxySrv.URL, created.Key, "gpt-4"); status != http.StatusOK {
+		t.Errorf("expected blocking requests outside the stream limit, got %d", status)
+	}
+}
+
+func TestRateLimit_RouteSharedByUsers(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	proxySrv := newRoutingProxy(t, mock.URL(), `{"routes":[{"model":"support","public":true,"api_key":"`+routeAPIKey+`","limits":{"rpm":1}}]}`)
+	defer proxySrv.Close()
+
+	chat := `{"model":"support","messages":[{"role":"user","content":"hi"}]}`
+	if resp, _ := postAs(t, proxySrv.URL+"/v1/chat/completions", "alice", "", chat); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp, body := postAs(t, proxySrv.URL+"/v1/chat/completions", "bob", "", chat)
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, `route \"support\"`) {
+		t.Errorf("expected the route's limit to apply to every user, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestRateLimit_EveryEntryPoint(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		DifyAPIKey:     testAPIKey,
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		UserRPM:        1,
+		AdminToken:     testAdminToken,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	for _, tc := range []struct {
+		user, path, body, want string
+	}{
+		{"carol", "/v1/messages/count_tokens", `{"model":"claude","messages":[{"role":"user","content":"hi"}]}`, "requests per minute"},
+		{"dave", "/v1beta/models/gemini-pro:countTokens", `{"contents":[{"parts":[{"text":"hi"}]}]}`, "requests per minute"},
+		{"erin", "/dify/v1/chat-messages", `{"query":"hi","user":"erin","inputs":{},"response_mode":"blocking"}`, `"code":"too_many_requests"`},
+	} {
+		if resp, body := postAs(t, proxySrv.URL+tc.path, tc.user, testAPIKey, tc.body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d %s", tc.path, resp.StatusCode, body)
+		}
+		resp, body := postAs(t, proxySrv.URL+tc.path, tc.user, testAPIKey, tc.body)
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" || !strings.Contains(body, tc.want) {
+			t.Errorf("%s: expected 429 with Retry-After, got %d %s", tc.path, resp.StatusCode, body)
+		}
+	}
+
+	key := virtualKey(t, proxySrv.URL)
+	call := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"dify","arguments":{"query":"hi"}}}`
+	if _, body := postAs(t, proxySrv.URL+"/mcp", "frank", key, call); strings.Contains(body, `"error"`) {
+		t.Fatalf("expected the first tool call to run, got %s", body)
+	}
+	if _, body := postAs(t, proxySrv.URL+"/mcp", "frank", key, call); !strings.Contains(body, `"code":-32000`) || !strings.Contains(body, "requests per minute") {
+		t.Errorf("expected the second tool call refused, got %s", body)
+	}
+}
+
+func TestRateLimit_BatchChargesTokens(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Usage = map[string]any{"prompt_tokens": 100, "completion_tokens": 100, "total_tokens": 200}
+	defer mock.Close()
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    mock.URL(),
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		StateFile:      filepath.Join(t.TempDir(), "state.db"),
+		UserTPM:        100,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+	defer srv.Shutdown(context.Background())
+
+	resp, body := postAs(t, proxySrv.URL+"/v1/messages/batches", "gina", testAPIKey, `{"requests":[{"custom_id":"a","params":{"model":"claude","max_tokens":8,"messages":[{"role":"user","content":"hi"}]}}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the batch accepted, got %d %s", resp.StatusCode, body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal([]byte(body), &created)
+	headers := map[string]string{"x-api-key": testAPIKey}
+	deadline := time.Now().Add(5 * time.Second)
+	for getJSON(t, proxySrv.URL+"/v1/messages/batches/"+created.ID, headers)["processing_status"] != "ended" {
+		if time.Now().After(deadline) {
+			t.Fatal("batch did not end")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The batch request used the user's minute of tokens.
+	resp, body = postAs(t, proxySrv.URL+"/v1/chat/completions", "gina", testAPIKey, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, "tokens per minute") {
+		t.Errorf("expected the batch usage charged to the user, got %d %s", resp.StatusCode, body)
+	}
+}
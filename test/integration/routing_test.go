@@ -0,0 +1,324 @@
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+const routeAPIKey = "route-app-key"
+
+// newRoutingProxy starts a proxy whose default Dify instance is difyURL and
+// whose routes file is routes.
+func newRoutingProxy(t *testing.T, difyURL, routes string) *httptest.Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(routes), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		DifyBaseURL:    difyURL,
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		RoutesFile:     path,
+	}
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	return httptest.NewServer(srv.Handler())
+}
+
+func TestRouting_AliasSelectsAppOnItsInstance(t *testing.T) {
+	def := testutil.NewMockDify("default answer", testMessageID, testConversationID)
+	defer def.Close()
+	routed := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer routed.Close()
+
+	proxySrv := newRoutingProxy(t, def.URL(), `{"routes":[{"model":"support-bot","public":true,"aliases":["gpt-4o"],"base_url":"`+routed.URL()+`","api_key":"`+routeAPIKey+`","inputs":{"persona":"pirate"}}]}`)
+	defer proxySrv.Close()
+
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+	resp, err := http.Post(proxySrv.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 without caller credentials, got %d", resp.StatusCode)
+	}
+	var out struct {
+		Model string `json:"model"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.Model != "gpt-4o" {
+		t.Errorf("expected the requested model echoed, got %q", out.Model)
+	}
+	if def.Requests() != 0 || routed.Requests() != 1 {
+		t.Fatalf("expected the request on the route's instance, got default=%d routed=%d", def.Requests(), routed.Requests())
+	}
+	if routed.LastAPIKey != routeAPIKey {
+		t.Errorf("expected the route key upstream, got %q", routed.LastAPIKey)
+	}
+	if in, _ := routed.LastRequest["inputs"].(map[string]any); in["persona"] != "pirate" {
+		t.Errorf("expected the route's default inputs, got %v", routed.LastRequest["inputs"])
+	}
+}
+
+func TestRouting_RequiresGatewayCredentials(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	cfg := &config.Config{
+		DifyBaseURL:    mock.URL(),
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		AdminToken:     testAdminToken,
+		RoutesFile:     writeConfig(t, "routes.json", `{"routes":[{"model":"support-bot","api_key":"`+routeAPIKey+`"}]}`),
+	}
+	srv, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	if status := chatWithKey(t, proxySrv.URL, testAPIKey, "support-bot"); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a plain Dify key on a private route, got %d", status)
+	}
+	if mock.Requests() != 0 {
+		t.Fatalf("expected no upstream request, got %d", mock.Requests())
+	}
+
+	var created keyView
+	adminCall(t, http.MethodPost, proxySrv.URL+"/admin/keys", testAdminToken, `{"owner":"team-a"}`, &created)
+	if status := chatWithKey(t, proxySrv.URL, created.Key, "support-bot"); status != http.StatusOK {
+		t.Fatalf("expected 200 with a virtual key, got %d", status)
+	}
+	if mock.LastAPIKey != routeAPIKey {
+		t.Errorf("expected the route key upstream, got %q", mock.LastAPIKey)
+	}
+}
+
+func TestRouting_UnroutedModel(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	routes := `{"routes":[{"model":"support-bot","public":true,"api_key":"` + routeAPIKey + `"}]}`
+	send := func(srv *httptest.Server) *http.Response {
+		body := `{"model":"other","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Api-Key", testAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	lenient := newRoutingProxy(t, mock.URL(), routes)
+	defer lenient.Close()
+	resp := send(lenient)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || mock.LastAPIKey != testAPIKey {
+		t.Errorf("expected the caller's key for an unrouted model, got %d %q", resp.StatusCode, mock.LastAPIKey)
+	}
+
+	strict := newRoutingProxy(t, mock.URL(), `{"strict":true,`+routes[1:])
+	defer strict.Close()
+	resp = send(strict)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unrouted model in strict mode, got %d", resp.StatusCode)
+	}
+}
+
+func TestRouting_CompletionApp(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newRoutingProxy(t, mock.URL(), `{"routes":[{"model":"writer","public":true,"api_key":"`+routeAPIKey+`","mode":"completion"}]}`)
+	defer proxySrv.Close()
+
+	body := `{"model":"writer","messages":[{"role":"user","content":"write a haiku"}]}`
+	resp, err := http.Post(proxySrv.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if mock.LastPath != "/v1/completion-messages" {
+		t.Errorf("expected a completion-messages request, got %s", mock.LastPath)
+	}
+	if in, _ := mock.LastRequest["inputs"].(map[string]any); in["query"] != "write a haiku" {
+		t.Errorf("expected the query as an input, got %v", mock.LastRequest["inputs"])
+	}
+}
+
+func TestRouting_ListsModels(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newRoutingProxy(t, mock.URL(), `{"routes":[{"model":"support-bot","public":true,"aliases":["gpt-4o"],"api_key":"`+routeAPIKey+`"}]}`)
+	defer proxySrv.Close()
+
+	resp, err := http.Get(proxySrv.URL + "/v1/models")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if len(out.Data) != 2 || out.Data[0].ID != "support-bot" || out.Data[1].ID != "gpt-4o" {
+		t.Errorf("expected the model and its alias, got %+v", out.Data)
+	}
+}
+
+func TestRouting_FallbackOnUnavailableApp(t *testing.T) {
+	primary := testutil.NewMockDify("primary answer", testMessageID, testConversationID)
+	defer primary.Close()
+	primary.ErrorStatus, primary.ErrorCode = http.StatusBadRequest, "app_unavailable"
+	backup := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer backup.Close()
+
+	proxySrv := newRoutingProxy(t, primary.URL(), `{"routes":[
+		{"model":"support-bot","public":true,"api_key":"`+routeAPIKey+`","fallbacks":["support-backup"]},
+		{"model":"support-backup","public":true,"base_url":"`+backup.URL()+`","api_key":"backup-key"}]}`)
+	defer proxySrv.Close()
+
+	body := `{"model":"support-bot","messages":[{"role":"user","content":"hi"}]}`
+	resp, err := http.Post(proxySrv.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from the fallback, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Dify-Route"); got != "support-backup" {
+		t.Errorf("expected the serving route in X-Dify-Route, got %q", got)
+	}
+	if primary.Requests() != 1 || backup.Requests() != 1 || backup.LastAPIKey != "backup-key" {
+		t.Errorf("expected one try at each app, got primary=%d backup=%d key=%q", primary.Requests(), backup.Requests(), backup.LastAPIKey)
+	}
+
+	// A failure the route does not list is reported without falling back.
+	primary.ErrorCode = "invalid_param"
+	resp2, err := http.Post(proxySrv.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusBadGateway || backup.Requests() != 1 {
+		t.Errorf("expected 502 without a fallback, got %d with backup=%d", resp2.StatusCode, backup.Requests())
+	}
+}
+
+func TestRouting_FallbackOnFirstTokenTimeout(t *testing.T) {
+	slow := testutil.NewMockDify("slow answer", testMessageID, testConversationID)
+	defer slow.Close()
+	slow.Delay = 2 * time.Second
+	backup := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer backup.Close()
+
+	proxySrv := newRoutingProxy(t, slow.URL(), `{"routes":[
+		{"model":"support-bot","public":true,"api_key":"`+routeAPIKey+`","fallbacks":["support-backup"],"fallback_on":{"first_token":"100ms"}},
+		{"model":"support-backup","public":true,"base_url":"`+backup.URL()+`","api_key":"backup-key"}]}`)
+	defer proxySrv.Close()
+
+	body := `{"model":"support-bot","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	begin := time.Now()
+	resp, err := http.Post(proxySrv.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Dify-Route") != "support-backup" {
+		t.Fatalf("expected the stream served by the fallback, got %d %q", resp.StatusCode, resp.Header.Get("X-Dify-Route"))
+	}
+	if !strings.Contains(string(raw), "Hello") || strings.Contains(string(raw), "slow") {
+		t.Errorf("expected only the fallback's answer, got %s", raw)
+	}
+	if time.Since(begin) > time.Second {
+		t.Errorf("expected the slow app abandoned early, took %s", time.Since(begin))
+	}
+}
+
+func TestRouting_StickySplit(t *testing.T) {
+	a := testutil.NewMockDify("answer A", testMessageID, testConversationID)
+	defer a.Close()
+	b := testutil.NewMockDify("answer B", testMessageID, testConversationID)
+	defer b.Close()
+
+	proxySrv := newRoutingProxy(t, a.URL(), `{"routes":[
+		{"model":"support-bot","public":true,"split":[{"route":"support-v1","weight":50},{"route":"support-v2","weight":50}],"sticky":"conversation"},
+		{"model":"support-v1","public":true,"api_key":"v1-key"},
+		{"model":"support-v2","public":true,"base_url":"`+b.URL()+`","api_key":"v2-key"}]}`)
+	defer proxySrv.Close()
+
+	send := func(conversation string) string {
+		body := `{"model":"support-bot","messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Dify-Conversation", conversation)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		variant := resp.Header.Get("X-Dify-Variant")
+		if route := resp.Header.Get("X-Dify-Route"); route != variant {
+			t.Errorf("expected the variant to serve the request, got route %q variant %q", route, variant)
+		}
+		return variant
+	}
+
+	seen := map[string]int{}
+	for i := range 20 {
+		conversation := "conv-" + string(rune('a'+i))
+		first := send(conversation)
+		if again := send(conversation); again != first {
+			t.Errorf("conversation %s moved from %q to %q", conversation, first, again)
+		}
+		seen[first]++
+	}
+	if seen["support-v1"] == 0 || seen["support-v2"] == 0 || seen["support-v1"]+seen["support-v2"] != 20 {
+		t.Errorf("expected traffic on both variants, got %v", seen)
+	}
+	if a.Requests() != 2*seen["support-v1"] || b.Requests() != 2*seen["support-v2"] {
+		t.Errorf("expected each variant's requests on its app, got a=%d b=%d for %v", a.Requests(), b.Requests(), seen)
+	}
+
+	resp, err := http.Get(proxySrv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("metrics request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(raw), `dify_agent_variant_requests_total{route="support-bot",variant="support-v2"}`) {
+		t.Errorf("expected the variant counter in /metrics, got:\n%s", raw)
+	}
+}
@@ -0,0 +1,102 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/internal/shadow"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+func TestShadow_MirrorsAndRecords(t *testing.T) {
+	primary := testutil.NewMockDify("the answer is forty two", testMessageID, testConversationID)
+	defer primary.Close()
+	candidate := testutil.NewMockDify("the answer is 42", testMessageID, testConversationID)
+	defer candidate.Close()
+
+	dir := t.TempDir()
+	routesPath := filepath.Join(dir, "routes.json")
+	routes := `{"routes":[
+		{"model":"support-bot","public":true,"api_key":"` + routeAPIKey + `","shadow":{"route":"support-next","percent":100}},
+		{"model":"support-next","public":true,"base_url":"` + candidate.URL() + `","api_key":"next-key"}]}`
+	if err := os.WriteFile(routesPath, []byte(routes), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "shadow.jsonl")
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:    primary.URL(),
+		ListenAddr:     ":0",
+		DefaultUser:    "test-user",
+		RequestTimeout: 10 * time.Second,
+		RoutesFile:     routesPath,
+		ShadowLog:      logPath,
+		AdminToken:     testAdminToken,
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewServer(srv.Handler())
+	defer proxySrv.Close()
+
+	body := `{"model":"support-bot","messages":[{"role":"user","content":"what is the answer?"}]}`
+	resp, err := http.Post(proxySrv.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var out struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if len(out.Choices) != 1 || out.Choices[0].Message.Content != "the answer is forty two" {
+		t.Fatalf("expected the primary's answer, got %+v", out.Choices)
+	}
+
+	var summaries []shadow.Summary
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if summaries, err = shadow.Summarize(logPath); err == nil && len(summaries) == 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("expected one recorded pair, got %v (%v)", summaries, err)
+	}
+	s := summaries[0]
+	if s.Route != "support-bot" || s.Shadow != "support-next" || s.Requests != 1 || s.Compared != 1 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+	if s.SimilarityAvg <= 0.5 || s.SimilarityAvg >= 1 {
+		t.Errorf("expected partly similar answers, got %v", s.SimilarityAvg)
+	}
+	if candidate.LastAPIKey != "next-key" {
+		t.Errorf("expected the shadow's key upstream, got %q", candidate.LastAPIKey)
+	}
+
+	raw, _ := os.ReadFile(logPath)
+	var rec shadow.Record
+	_ = json.Unmarshal(raw, &rec)
+	if rec.PrimaryAnswer != "the answer is forty two" || rec.ShadowAnswer != "the answer is 42" || rec.Query != "what is the answer?" {
+		t.Errorf("expected both answers side by side, got %+v", rec)
+	}
+
+	var report struct {
+		Data []shadow.Summary `json:"data"`
+	}
+	if status := adminCall(t, http.MethodGet, proxySrv.URL+"/admin/shadow", testAdminToken, "", &report); status != http.StatusOK || len(report.Data) != 1 {
+		t.Errorf("expected the summary from /admin/shadow, got %d %+v", status, report.Data)
+	}
+}
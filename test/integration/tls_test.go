@@ -0,0 +1,280 @@
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhengjr9/dify-agent/internal/config"
+	"github.com/zhengjr9/dify-agent/internal/proxy"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})}
+}
+
+// issue returns a PEM certificate and key for cn, valid for 127.0.0.1 as a
+// server and as a client.
+func (ca *testCA) issue(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		EmailAddresses: []string{cn + "@example.com"},
+		IPAddresses:    []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// writePair issues a certificate for cn, writes it and its key into dir and
+// returns their paths.
+func (ca *testCA) writePair(t *testing.T, dir, name, cn string) (certFile, keyFile string) {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, cn)
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	for path, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// tlsClient returns a client trusting ca and presenting the given
+// certificate, if any. Each request opens a new connection.
+func tlsClient(t *testing.T, ca *testCA, certPEM, keyPEM []byte) *http.Client {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: pool}
+	if certPEM != nil {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+}
+
+func TestTLS_ClientCertificatesAndReload(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.writePair(t, dir, "server", "gateway")
+	caFile := writeConfig(t, "ca.pem", string(ca.pem))
+
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:       mock.URL(),
+		ListenAddr:        ":0",
+		DefaultUser:       "test-user",
+		RequestTimeout:    10 * time.Second,
+		TLSCertFile:       certFile,
+		TLSKeyFile:        keyFile,
+		TLSClientCA:       caFile,
+		TLSClientAuth:     "optional",
+		TLSClientIdentity: "email",
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewUnstartedServer(srv.Handler())
+	proxySrv.TLS = srv.TLSConfig()
+	proxySrv.StartTLS()
+	defer proxySrv.Close()
+
+	chat := func(client *http.Client, user string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, proxySrv.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		req.Header.Set("X-Dify-User", user)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// The verified certificate names the user, whatever the headers say.
+	aliceCert, aliceKey := ca.issue(t, "alice")
+	resp, err := chat(tlsClient(t, ca, aliceCert, aliceKey), "mallory")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 with a client certificate, got %v %v", resp, err)
+	}
+	if got := mock.LastRequest["user"]; got != "alice@example.com" {
+		t.Errorf("expected the certificate's e-mail as the user, got %v", got)
+	}
+	if resp.TLS.PeerCertificates[0].Subject.CommonName != "gateway" {
+		t.Errorf("expected the configured server certificate, got %q", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+
+	// Client certificates are optional; callers without one are named as
+	// usual.
+	if resp, err := chat(tlsClient(t, ca, nil, nil), "bob"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 without a client certificate, got %v %v", resp, err)
+	}
+	if got := mock.LastRequest["user"]; got != "bob" {
+		t.Errorf("expected the header's user, got %v", got)
+	}
+
+	// Certificates from another CA are refused during the handshake.
+	otherCert, otherKey := newTestCA(t).issue(t, "eve")
+	if _, err := chat(tlsClient(t, ca, otherCert, otherKey), "eve"); err == nil {
+		t.Error("expected a certificate from an unknown CA refused")
+	}
+
+	// A renewed certificate is served from the next handshake on.
+	ca.writePair(t, dir, "server", "renewed")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		_ = os.Chtimes(f, later, later)
+	}
+	resp, err = chat(tlsClient(t, ca, nil, nil), "bob")
+	if err != nil {
+		t.Fatalf("request after renewal failed: %v", err)
+	}
+	if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "renewed" {
+		t.Errorf("expected the renewed certificate, got %q", got)
+	}
+}
+
+func TestTLS_RequiredClientCertificate(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.writePair(t, t.TempDir(), "server", "gateway")
+	srv, err := proxy.New(&config.Config{
+		DifyBaseURL:       mock.URL(),
+		ListenAddr:        ":0",
+		DefaultUser:       "test-user",
+		RequestTimeout:    10 * time.Second,
+		TLSCertFile:       certFile,
+		TLSKeyFile:        keyFile,
+		TLSClientCA:       writeConfig(t, "ca.pem", string(ca.pem)),
+		TLSClientIdentity: "cn",
+	})
+	if err != nil {
+		t.Fatalf("proxy.New: %v", err)
+	}
+	proxySrv := httptest.NewUnstartedServer(srv.Handler())
+	proxySrv.TLS = srv.TLSConfig()
+	proxySrv.StartTLS()
+	defer proxySrv.Close()
+
+	if _, err := tlsClient(t, ca, nil, nil).Get(proxySrv.URL + "/metrics"); err == nil {
+		t.Error("expected connections without a client certificate refused")
+	}
+	cert, key := ca.issue(t, "svc-reporting")
+	resp, err := tlsClient(t, ca, cert, key).Post(proxySrv.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	// A client certificate names the caller but stands for no Dify key.
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a Dify key, got %d", resp.StatusCode)
+	}
+}
+
+func TestTLS_UpstreamCAAndClientCertificate(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	upstream := httptest.NewUnstartedServer(mock.Server.Config.Handler)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	upstream.StartTLS()
+	defer upstream.Close()
+	upstreamCA := writeConfig(t, "upstream.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})))
+	clientCert, clientKey := ca.writePair(t, dir, "client", "gateway")
+
+	newProxy := func(cfg config.Config) *httptest.Server {
+		cfg.DifyBaseURL = upstream.URL
+		cfg.ListenAddr = ":0"
+		cfg.DefaultUser = "test-user"
+		cfg.RequestTimeout = 10 * time.Second
+		srv, err := proxy.New(&cfg)
+		if err != nil {
+			t.Fatalf("proxy.New: %v", err)
+		}
+		return httptest.NewServer(srv.Handler())
+	}
+
+	for name, c := range map[string]struct {
+		cfg  config.Config
+		want int
+	}{
+		"system roots":       {config.Config{}, http.StatusBadGateway},
+		"no client cert":     {config.Config{DifyCAFile: upstreamCA}, http.StatusBadGateway},
+		"CA and client cert": {config.Config{DifyCAFile: upstreamCA, DifyClientCert: clientCert, DifyClientKey: clientKey, DifyTLSMinVersion: "1.3"}, http.StatusOK},
+	} {
+		proxySrv := newProxy(c.cfg)
+		if status := chatWithKey(t, proxySrv.URL, testAPIKey, "gpt-4"); status != c.want {
+			t.Errorf("%s: expected %d, got %d", name, c.want, status)
+		}
+		proxySrv.Close()
+	}
+}
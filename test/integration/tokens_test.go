@@ -0,0 +1,151 @@
+package integration
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zhengjr9/dify-agent/internal/tokenizer"
+	"github.com/zhengjr9/dify-agent/test/testutil"
+)
+
+// postJSON sends body to url with the given headers and decodes a 200 JSON
+// response into out.
+func postJSON(t *testing.T, url, body string, headers map[string]string, out any) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, raw)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+}
+
+func TestTokenizer_BPEFromRankFile(t *testing.T) {
+	dir := t.TempDir()
+	var sb strings.Builder
+	for i, tok := range []string{"a", "b", " ", "ab", "abab"} {
+		fmt.Fprintf(&sb, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(tok)), i)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cl100k_base.tiktoken"), []byte(sb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := tokenizer.Load(dir, tokenizer.CL100K)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	tok := set.For("gpt-4")
+	if !tok.Exact() {
+		t.Fatal("expected exact tokenizer when rank file is present")
+	}
+	// "abab" is a known token; "ababab" merges to "abab" + "ab"; " ab" splits
+	// into a single pre-token that merges to " " + "ab".
+	for text, want := range map[string]int{"abab": 1, "ababab": 2, "ab ab": 3} {
+		if got := tok.Count(text); got != want {
+			t.Errorf("Count(%q) = %d, want %d", text, got, want)
+		}
+	}
+	if set.For("gpt-4o").Exact() {
+		t.Error("o200k_base has no rank file and should be approximate")
+	}
+}
+
+func TestAnthropic_CountTokens(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"model":"claude-3","messages":[{"role":"user","content":"Hello there, how are you today?"}]}`
+	var result map[string]any
+	postJSON(t, proxySrv.URL+"/v1/messages/count_tokens", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &result)
+
+	if n, _ := result["input_tokens"].(float64); n <= 0 {
+		t.Errorf("expected positive input_tokens, got %v", result["input_tokens"])
+	}
+	if mock.LastRequest != nil {
+		t.Error("count_tokens must not call Dify")
+	}
+}
+
+func TestGemini_CountTokens(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"contents":[{"role":"user","parts":[{"text":"Hello there, how are you today?"}]}]}`
+	var result map[string]any
+	postJSON(t, proxySrv.URL+"/v1beta/models/gemini-pro:countTokens", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &result)
+
+	if n, _ := result["totalTokens"].(float64); n <= 0 {
+		t.Errorf("expected positive totalTokens, got %v", result["totalTokens"])
+	}
+}
+
+func TestOpenAI_UsageEstimatedWhenDifyOmitsIt(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"Say hello"}]}`
+	var result struct {
+		Usage struct {
+			PromptTokens     int  `json:"prompt_tokens"`
+			CompletionTokens int  `json:"completion_tokens"`
+			Estimated        bool `json:"estimated"`
+		} `json:"usage"`
+	}
+	postJSON(t, proxySrv.URL+"/v1/chat/completions", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &result)
+
+	if !result.Usage.Estimated {
+		t.Error("expected usage to be marked estimated")
+	}
+	if result.Usage.PromptTokens == 0 || result.Usage.CompletionTokens == 0 {
+		t.Errorf("expected non-zero estimated usage, got %+v", result.Usage)
+	}
+}
+
+func TestAnthropic_UsageFromDify(t *testing.T) {
+	mock := testutil.NewMockDify(testAnswer, testMessageID, testConversationID)
+	mock.Usage = map[string]any{"prompt_tokens": 11, "completion_tokens": 7, "total_tokens": 18}
+	defer mock.Close()
+
+	proxySrv := newTestProxy(t, mock.URL())
+	defer proxySrv.Close()
+
+	body := `{"model":"claude-3","max_tokens":1024,"messages":[{"role":"user","content":"Say hello"}]}`
+	var result struct {
+		Usage map[string]any `json:"usage"`
+	}
+	postJSON(t, proxySrv.URL+"/v1/messages", body, map[string]string{"Authorization": "Bearer " + testAPIKey}, &result)
+
+	if result.Usage["input_tokens"] != float64(11) || result.Usage["output_tokens"] != float64(7) {
+		t.Errorf("expected Dify usage 11/7, got %v", result.Usage)
+	}
+	if _, ok := result.Usage["estimated"]; ok {
+		t.Error("reported usage must not be marked estimated")
+	}
+}
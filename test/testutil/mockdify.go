@@ -3,8 +3,11 @@ package testutil
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,9 +19,45 @@ type MockDify struct {
 	Answer         string
 	MessageID      string
 	ConversationID string
+	// Usage, when set, is reported as metadata.usage in blocking responses
+	// and on the message_end event.
+	Usage map[string]any
+	// Replace, when set, is sent as a message_replace event after the
+	// streamed answer, as Dify does when output moderation fires.
+	Replace string
+	// StreamError, when set, ends streams after the answer with an error
+	// event carrying that code instead of message_end.
+	StreamError string
+	// Delay, when set, is slept before each streamed chunk.
+	Delay time.Duration
+	// ErrorStatus, when set, fails message requests with that status and a
+	// Dify error body carrying ErrorCode.
+	ErrorStatus int
+	ErrorCode   string
+	// Parameters, when set, is served from GET /v1/parameters; otherwise
+	// that endpoint returns 404.
+	Parameters map[string]any
 
 	// LastRequest captures the most recent request body parsed.
 	LastRequest map[string]any
+	// LastAPIKey is the bearer token of the most recent chat-messages request.
+	LastAPIKey string
+	// LastPath is the path of the most recent message request, which is
+	// /v1/completion-messages for completion apps.
+	LastPath string
+
+	mu           sync.Mutex
+	stoppedTasks []string
+	requests     int
+	uploads      []Upload
+}
+
+// Upload is a file received on /v1/files/upload.
+type Upload struct {
+	Filename    string
+	ContentType string
+	User        string
+	Size        int
 }
 
 // NewMockDify creates and starts a mock Dify server.
@@ -42,8 +81,46 @@ func (m *MockDify) URL() string {
 	return m.Server.URL
 }
 
+// Requests returns the number of chat-messages requests received.
+func (m *MockDify) Requests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests
+}
+
+// Uploads returns the files received on /v1/files/upload.
+func (m *MockDify) Uploads() []Upload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Upload(nil), m.uploads...)
+}
+
+// StoppedTasks returns the task IDs stopped via /v1/chat-messages/{task_id}/stop.
+func (m *MockDify) StoppedTasks() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.stoppedTasks...)
+}
+
 func (m *MockDify) handle(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/v1/chat-messages" || r.Method != http.MethodPost {
+	if task, ok := strings.CutPrefix(r.URL.Path, "/v1/chat-messages/"); ok && strings.HasSuffix(task, "/stop") {
+		m.mu.Lock()
+		m.stoppedTasks = append(m.stoppedTasks, strings.TrimSuffix(task, "/stop"))
+		m.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"result":"success"}`))
+		return
+	}
+	if r.URL.Path == "/v1/files/upload" && r.Method == http.MethodPost {
+		m.handleUpload(w, r)
+		return
+	}
+	if r.URL.Path == "/v1/parameters" && r.Method == http.MethodGet && m.Parameters != nil {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(m.Parameters)
+		return
+	}
+	if (r.URL.Path != "/v1/chat-messages" && r.URL.Path != "/v1/completion-messages") || r.Method != http.MethodPost {
 		http.NotFound(w, r)
 		return
 	}
@@ -54,38 +131,89 @@ func (m *MockDify) handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
+	m.mu.Lock()
 	m.LastRequest = body
+	m.LastAPIKey = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	m.LastPath = r.URL.Path
+	m.requests++
+	m.mu.Unlock()
+
+	if m.ErrorStatus != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(m.ErrorStatus)
+		_ = json.NewEncoder(w).Encode(map[string]any{"code": m.ErrorCode, "message": "mock failure", "status": m.ErrorStatus})
+		return
+	}
 
 	mode, _ := body["response_mode"].(string)
 
 	if mode == "streaming" {
-		m.writeStreaming(w)
+		m.writeStreaming(w, r)
 		return
 	}
 	m.writeBlocking(w)
 }
 
+func (m *MockDify) handleUpload(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	m.mu.Lock()
+	m.uploads = append(m.uploads, Upload{
+		Filename:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		User:        r.FormValue("user"),
+		Size:        len(data),
+	})
+	id := fmt.Sprintf("file-%d", len(m.uploads))
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "name": header.Filename, "size": len(data)})
+}
+
+func (m *MockDify) metadata() map[string]any {
+	md := map[string]any{}
+	if m.Usage != nil {
+		md["usage"] = m.Usage
+	}
+	return md
+}
+
 func (m *MockDify) writeBlocking(w http.ResponseWriter) {
 	resp := map[string]any{
 		"message_id":      m.MessageID,
 		"conversation_id": m.ConversationID,
 		"mode":            "blocking",
 		"answer":          m.Answer,
-		"metadata":        map[string]any{},
+		"metadata":        m.metadata(),
 		"created_at":      time.Now().Unix(),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
-func (m *MockDify) writeStreaming(w http.ResponseWriter) {
+func (m *MockDify) writeStreaming(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	flusher, hasFlusher := w.(http.Flusher)
 
 	// Split the answer into words for a realistic stream
-	words := splitWords(m.Answer)
+	var words []string
+	if m.Answer != "" {
+		words = splitWords(m.Answer)
+	}
 	for i, word := range words {
+		if m.Delay > 0 {
+			select {
+			case <-time.After(m.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
 		chunk := map[string]any{
 			"event":           "message",
 			"task_id":         "task-1",
@@ -104,12 +232,39 @@ func (m *MockDify) writeStreaming(w http.ResponseWriter) {
 		}
 	}
 
+	if m.Replace != "" {
+		replace := map[string]any{
+			"event":           "message_replace",
+			"task_id":         "task-1",
+			"message_id":      m.MessageID,
+			"conversation_id": m.ConversationID,
+			"answer":          m.Replace,
+		}
+		data, _ := json.Marshal(replace)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+
+	if m.StreamError != "" {
+		errChunk := map[string]any{
+			"event":      "error",
+			"task_id":    "task-1",
+			"message_id": m.MessageID,
+			"status":     500,
+			"code":       m.StreamError,
+			"message":    "mock stream failure",
+		}
+		data, _ := json.Marshal(errChunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		return
+	}
+
 	// Send message_end event
 	endChunk := map[string]any{
 		"event":           "message_end",
 		"task_id":         "task-1",
 		"message_id":      m.MessageID,
 		"conversation_id": m.ConversationID,
+		"metadata":        m.metadata(),
 	}
 	data, _ := json.Marshal(endChunk)
 	fmt.Fprintf(w, "data: %s\n\n", data)